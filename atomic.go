@@ -0,0 +1,125 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// CompareAndSwap atomically compares the 8-byte value at `offset` in the peer's data
+// buffer with `expected` and, if they are equal, replaces it with `swap`.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection over a Reliable Connected queue pair.
+//
+// `offset` must be a multiple of 8 and the 8 bytes at it must lie within the peer's
+// data buffer, which is assumed to have the same size as the local one. The value is
+// interpreted in the byte order of the peer. The operation is one-sided: the peer is
+// not involved and no synchronization takes place, which makes it suitable for
+// building locks shared between the peers.
+//
+// On success, it returns the value found at `offset` before the operation, whether or
+// not the swap happened, and nil error. On failure, it returns 0 and the error
+// encountered; ErrUnsupported is returned if the device has no atomic support.
+//
+// Example:
+//
+//	old, err := h.CompareAndSwap(clientRes, 8, 0, 1)
+//	if err != nil {
+//	    log.Fatalf("RDMA compare and swap failed: %v", err)
+//	}
+//	locked := old == 0
+func (h *RDMAHandler) CompareAndSwap(res *RDMAResources, offset uint64, expected, swap uint64) (uint64, error) {
+	return postAtomic(res, "compare and swap", C.IBV_WR_ATOMIC_CMP_AND_SWP, offset, expected, swap)
+}
+
+// FetchAndAdd atomically adds `delta` to the 8-byte value at `offset` in the peer's
+// data buffer. The requirements on `res` and `offset` are those of CompareAndSwap.
+//
+// On success, it returns the value found at `offset` before the addition and nil
+// error. On failure, it returns 0 and the error encountered.
+//
+// Example:
+//
+//	ticket, err := h.FetchAndAdd(clientRes, 16, 1)
+//	if err != nil {
+//	    log.Fatalf("RDMA fetch and add failed: %v", err)
+//	}
+func (h *RDMAHandler) FetchAndAdd(res *RDMAResources, offset uint64, delta uint64) (uint64, error) {
+	return postAtomic(res, "fetch and add", C.IBV_WR_ATOMIC_FETCH_AND_ADD, offset, delta, 0)
+}
+
+// ReadModifyWrite atomically replaces the 8-byte value at `offset` in the peer's
+// data buffer with `fn` applied to it, which makes remote counters, flags and bit
+// sets possible without a hand-written compare-and-swap loop. The requirements on
+// `res` and `offset` are those of CompareAndSwap.
+//
+// The current value is fetched with a compare-and-swap that leaves it unchanged,
+// then CompareAndSwap installs fn(old) for as long as another writer changes the
+// value in between, calling `fn` again with the value it found. `fn` may thus run
+// several times and must not have side effects. Each attempt is a round trip to
+// the peer, so heavily contended values are better served by FetchAndAdd where
+// it suffices.
+//
+// On success, it returns the value replaced, to which `fn` was applied, and nil
+// error. On failure, it returns 0 and the error encountered.
+//
+// Example:
+//
+//	// set bit 3 of the peer's flag word
+//	old, err := h.ReadModifyWrite(clientRes, 24, func(v uint64) uint64 { return v | 1<<3 })
+//	if err != nil {
+//	    log.Fatalf("RDMA read-modify-write failed: %v", err)
+//	}
+func (h *RDMAHandler) ReadModifyWrite(res *RDMAResources, offset uint64, fn func(old uint64) uint64) (uint64, error) {
+	old, err := postAtomic(res, "read-modify-write", C.IBV_WR_ATOMIC_CMP_AND_SWP, offset, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		cur, err := postAtomic(res, "read-modify-write", C.IBV_WR_ATOMIC_CMP_AND_SWP, offset, old, fn(old))
+		if err != nil {
+			return 0, err
+		}
+		if cur == old {
+			return old, nil
+		}
+		old = cur
+	}
+}
+
+// postAtomic validates the target of an atomic operation, posts it and waits for
+// its completion. It returns the original remote value.
+func postAtomic(res *RDMAResources, op string, opcode C.int, offset, compareAdd, swap uint64) (uint64, error) {
+	if err := res.begin(); err != nil {
+		return 0, err
+	}
+	defer res.end()
+	if err := requireRC(res, op); err != nil {
+		return 0, err
+	}
+	if res.res.device_attr.atomic_cap == C.IBV_ATOMIC_NONE {
+		return 0, fmt.Errorf("%s: %w on this device", op, ErrUnsupported)
+	}
+	if offset%8 != 0 || (uint64(res.res.remote_props.addr)+offset)%8 != 0 {
+		return 0, fmt.Errorf("%s: offset %d is not 8-byte aligned", op, offset)
+	}
+	if size := uint64(res.bufferLimit()); size < 8 || offset > size-8 {
+		return 0, fmt.Errorf("%s: offset %d outside the %d-byte buffer", op, offset, size)
+	}
+
+	acquireInflight()
+	if rc, err := C.post_atomic(&res.res, opcode, C.uint64_t(offset), C.uint64_t(compareAdd), C.uint64_t(swap)); rc != 0 {
+		releaseInflight()
+		return 0, fmt.Errorf("%s: %w", op, res.opError("post_atomic", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return 0, fmt.Errorf("%s: %w", op, res.opError("poll_completion", rc, err))
+	}
+	return uint64(unsafe.Slice(res.res.ctrl, 3)[2]), nil
+}
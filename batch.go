@@ -0,0 +1,180 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// batchHeaderSize is the size of the record count that precedes the records of a
+// batch in the data buffer.
+const batchHeaderSize = 4
+
+// PostWrites sends several payloads to the peer with a single synchronization
+// cycle, keeping all of their RDMA writes in flight at the same time.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// The payloads are laid out back to back in the data buffer as length-prefixed
+// records, after a 4-byte record count, so all of them together must fit in the
+// buffer. One work request is posted per payload, at most Options.SendQueueDepth of
+// them, and only the last one is signaled, so the batch costs one completion instead
+// of one per payload. This raises throughput for many small writes, where Write is
+// dominated by the round trip of each completion and synchronization.
+//
+// PostWrites must be matched by ReadBatch on the peer, which returns the payloads.
+// The work requests carry consecutive IDs starting at res.NextWRID(); if one of
+// them fails, the error names the index of its payload.
+//
+// On success, it returns nil. On failure, it returns an error detailing the issue
+// encountered.
+//
+// Example:
+//
+//	msgs := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+//	if err := h.PostWrites(clientRes, msgs); err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) PostWrites(res *RDMAResources, payloads [][]byte) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if len(payloads) == 0 {
+		return fmt.Errorf("post writes: empty batch")
+	}
+	if depth := int(res.res.max_send_wr); len(payloads) > depth {
+		return fmt.Errorf("post writes: %d payloads exceed the send queue depth of %d", len(payloads), depth)
+	}
+	size := batchHeaderSize
+	total := 0
+	for _, p := range payloads {
+		size += payloadHeaderSize + len(p)
+		total += len(p)
+	}
+	if limit := res.bufferLimit(); size > limit {
+		return fmt.Errorf("post writes: %d bytes do not fit in the %d-byte buffer", size, limit)
+	}
+	if err := syncData(res, syncWrite); err != nil {
+		return err
+	}
+
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(res.res.buf)), size)
+	binary.BigEndian.PutUint32(buf, uint32(len(payloads)))
+	offsets := make([]C.uint32_t, len(payloads))
+	lengths := make([]C.uint32_t, len(payloads))
+	off := batchHeaderSize
+	for i, p := range payloads {
+		binary.BigEndian.PutUint32(buf[off:], uint32(len(p)))
+		copy(buf[off+payloadHeaderSize:], p)
+		offsets[i] = C.uint32_t(off)
+		lengths[i] = C.uint32_t(payloadHeaderSize + len(p))
+		off += payloadHeaderSize + len(p)
+	}
+	// the first write also carries the record count
+	offsets[0] = 0
+	lengths[0] += batchHeaderSize
+	res.syncDeviceMemory(0, size, true)
+
+	first := uint64(res.res.wr_seq) + 1
+	acquireInflight()
+	if rc, err := C.post_write_batch(&res.res, &offsets[0], &lengths[0], C.int(len(payloads))); rc != 0 {
+		releaseInflight()
+		return fmt.Errorf("post writes: %w", res.opError("post_write_batch", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		e := res.opError("poll_completion", rc, err)
+		if e.WRID >= first && e.WRID-first < uint64(len(payloads)) {
+			return fmt.Errorf("post writes: payload %d: %w", e.WRID-first, e)
+		}
+		return fmt.Errorf("post writes: %w", e)
+	}
+	res.writeIndex += uint64(total)
+	res.publishWriteIndex()
+	for _, p := range payloads {
+		res.countWrite(len(p))
+	}
+	return syncData(res, syncDone)
+}
+
+// ReadBatch receives the payloads sent by the peer with PostWrites, in order.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection over a Reliable Connected queue pair.
+//
+// On success, it returns the payloads and nil error. On failure, it returns nil and
+// the error encountered.
+//
+// Example:
+//
+//	msgs, err := h.ReadBatch(serverRes, "server")
+//	if err != nil {
+//	    log.Fatalf("RDMA read failed: %v", err)
+//	}
+func (h *RDMAHandler) ReadBatch(res *RDMAResources, character string) ([][]byte, error) {
+	if err := res.begin(); err != nil {
+		return nil, err
+	}
+	defer res.end()
+	if err := requireRC(res, character); err != nil {
+		return nil, err
+	}
+	if err := syncData(res, syncRead); err != nil {
+		return nil, err
+	}
+	acquireInflight()
+	if rc, err := C.post_send(&res.res, C.IBV_WR_RDMA_READ); rc != 0 {
+		releaseInflight()
+		return nil, fmt.Errorf("%s: %w", character, res.opError("post_send", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return nil, fmt.Errorf("%s: %w", character, res.opError("poll_completion", rc, err))
+	}
+	if err := syncData(res, syncDone); err != nil {
+		return nil, err
+	}
+	payloads, err := res.batchPayloads(character)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range payloads {
+		res.readIndex += uint64(len(p))
+		res.countRead(len(p))
+	}
+	return payloads, nil
+}
+
+// batchPayloads returns copies of the records stored in the data buffer by
+// PostWrites.
+func (res *RDMAResources) batchPayloads(character string) ([][]byte, error) {
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(res.res.buf)), int(res.res.buf_size))
+	count := binary.BigEndian.Uint32(buf)
+	// every record needs at least its header, which bounds a corrupted count
+	if uint64(count)*payloadHeaderSize > uint64(len(buf)-batchHeaderSize) {
+		return nil, fmt.Errorf("%s: batch of %d records exceeds the %d-byte buffer", character, count, len(buf))
+	}
+	payloads := make([][]byte, 0, count)
+	off := batchHeaderSize
+	for i := uint32(0); i < count; i++ {
+		if off+payloadHeaderSize > len(buf) {
+			return nil, fmt.Errorf("%s: batch record %d exceeds the %d-byte buffer", character, i, len(buf))
+		}
+		n := int(binary.BigEndian.Uint32(buf[off:]))
+		off += payloadHeaderSize
+		if n > len(buf)-off {
+			return nil, fmt.Errorf("%s: batch record %d of %d bytes exceeds the %d-byte buffer", character, i, n, len(buf))
+		}
+		payloads = append(payloads, append([]byte(nil), buf[off:off+n]...))
+		off += n
+	}
+	return payloads, nil
+}
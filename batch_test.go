@@ -0,0 +1,38 @@
+package rdmahandler
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// TestPostWritesFullQueue keeps as many writes in flight as the send queue holds.
+func TestPostWritesFullQueue(t *testing.T) {
+	const depth = 16
+	res := newLoopback(t, Options{BufferSize: 4096, SendQueueDepth: depth})
+	var h RDMAHandler
+	payloads := make([][]byte, depth)
+	for i := range payloads {
+		payloads[i] = []byte(fmt.Sprintf("payload %d", i))
+	}
+	for round := 0; round < 3; round++ {
+		if err := h.PostWrites(res, payloads); err != nil {
+			t.Fatalf("round %d: PostWrites: %v", round, err)
+		}
+		got, err := h.ReadBatch(res, "loopback")
+		if err != nil {
+			t.Fatalf("round %d: ReadBatch: %v", round, err)
+		}
+		if len(got) != len(payloads) {
+			t.Fatalf("round %d: ReadBatch returned %d payloads, expected %d", round, len(got), len(payloads))
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], payloads[i]) {
+				t.Errorf("round %d: payload %d is %q, expected %q", round, i, got[i], payloads[i])
+			}
+		}
+	}
+	if err := h.PostWrites(res, make([][]byte, depth+1)); err == nil {
+		t.Errorf("PostWrites of %d payloads with SendQueueDepth %d succeeded", depth+1, depth)
+	}
+}
@@ -0,0 +1,99 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// BenchResult holds the latencies and bandwidth measured by Benchmark.
+type BenchResult struct {
+	Ops     int           // number of operations performed
+	OpSize  int           // bytes moved by each operation
+	Elapsed time.Duration // wall time of the whole run
+
+	// Latencies of single operations, from posting the work request to finding
+	// its completion.
+	Min  time.Duration
+	Max  time.Duration
+	Mean time.Duration
+	P99  time.Duration
+
+	// Bandwidth is the aggregate throughput of the run in bytes per second.
+	Bandwidth float64
+}
+
+func (r BenchResult) String() string {
+	return fmt.Sprintf("%d ops of %d bytes in %v: min %v, mean %v, p99 %v, max %v, %.1f MB/s",
+		r.Ops, r.OpSize, r.Elapsed, r.Min, r.Mean, r.P99, r.Max, r.Bandwidth/1e6)
+}
+
+// Benchmark measures the latency and bandwidth of RDMA writes of `opSize` bytes on
+// the connection, by performing `iterations` of them back to back.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// Each write goes to the start of the peer's data buffer, like WriteAt at offset 0,
+// and is waited for before the next one is posted, so the latency of every operation
+// is measured on its own with the monotonic clock. The peer does not take part, but
+// the beginning of its data buffer is overwritten; no synchronization takes place.
+// `opSize` must not exceed the size of the data buffer.
+//
+// On success, it returns the measurements and nil error. On failure, it returns a zero
+// BenchResult and the error encountered.
+//
+// Example:
+//
+//	r, err := h.Benchmark(clientRes, 4096, 10000)
+//	if err != nil {
+//	    log.Fatalf("Benchmark failed: %v", err)
+//	}
+//	fmt.Println(r)
+func (h *RDMAHandler) Benchmark(res *RDMAResources, opSize int, iterations int) (BenchResult, error) {
+	if err := res.begin(); err != nil {
+		return BenchResult{}, err
+	}
+	defer res.end()
+	if iterations <= 0 {
+		return BenchResult{}, fmt.Errorf("benchmark: invalid iteration count %d", iterations)
+	}
+	if opSize < 0 {
+		return BenchResult{}, fmt.Errorf("benchmark: invalid operation size %d", opSize)
+	}
+	if err := checkRange(res, "benchmark", 0, opSize); err != nil {
+		return BenchResult{}, err
+	}
+
+	latencies := make([]time.Duration, iterations)
+	start := time.Now()
+	for i := range latencies {
+		t := time.Now()
+		if err := transferAt(res, "benchmark", C.IBV_WR_RDMA_WRITE, 0, opSize); err != nil {
+			return BenchResult{}, err
+		}
+		latencies[i] = time.Since(t)
+	}
+	elapsed := time.Since(start)
+
+	var total time.Duration
+	for _, d := range latencies {
+		total += d
+	}
+	slices.Sort(latencies)
+	p99 := (len(latencies)*99 + 99) / 100 // ceil(n * 0.99)
+	return BenchResult{
+		Ops:       iterations,
+		OpSize:    opSize,
+		Elapsed:   elapsed,
+		Min:       latencies[0],
+		Max:       latencies[len(latencies)-1],
+		Mean:      total / time.Duration(iterations),
+		P99:       latencies[p99-1],
+		Bandwidth: float64(opSize) * float64(iterations) / elapsed.Seconds(),
+	}, nil
+}
@@ -0,0 +1,193 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// maxBufferNameLen is the longest buffer name that fits in the descriptor
+// exchanged with the peer by RegisterNamedBuffer.
+const maxBufferNameLen = 48
+
+// bufferDescSize is the size of the descriptor exchanged for an added region:
+// address (8 bytes), rkey (4 bytes), size (4 bytes) and the padded name.
+const bufferDescSize = 8 + 4 + 4 + maxBufferNameLen
+
+// RegisterNamedBuffer allocates and registers an additional memory region of `size`
+// bytes on the connection and makes it addressable under `name`.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// `name` identifies the buffer (e.g., "control", "data" or "metadata"). It must be
+// non-empty, at most 48 bytes long and not already registered on `res`.
+//
+// A named buffer is a region as added by AddRegion, with the default access
+// flags, that is addressed by name: it takes the next RegionID, so WriteRegion and
+// ReadRegion reach it as well, and it uses the same framing.
+//
+// The buffer's name, address, remote key and size are exchanged with the peer over
+// the synchronization socket when it is registered, rather than during the
+// connection handshake, so that buffers can be added to an established connection;
+// both sides must therefore register the same names in the same order. Once
+// registered, WriteNamed and ReadNamed target the peer's buffer with the same name.
+// The buffer is released by Destroy.
+//
+// If the device registers less than `size` bytes, ErrPartialRegistration is returned.
+//
+// On success, it returns nil. On failure, it returns an error and nothing is registered.
+//
+// Example:
+//
+//	if err := h.RegisterNamedBuffer(res, "control", 64); err != nil {
+//	    log.Fatalf("Failed to register buffer: %v", err)
+//	}
+//	err := h.WriteNamed(res, "control", "ready", "client")
+func (h *RDMAHandler) RegisterNamedBuffer(res *RDMAResources, name string, size int) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if name == "" || len(name) > maxBufferNameLen {
+		return fmt.Errorf("invalid buffer name %q", name)
+	}
+	if _, ok := res.regionNames[name]; ok {
+		return fmt.Errorf("buffer %q already registered", name)
+	}
+	id, err := addRegion(res, name, size, defaultAccess)
+	if err != nil {
+		return err
+	}
+	res.extraRegions[id-1].label = fmt.Sprintf("buffer %q", name)
+	if res.regionNames == nil {
+		res.regionNames = make(map[string]RegionID)
+	}
+	res.regionNames[name] = id
+	return nil
+}
+
+// namedRegion returns the region registered under `name` with RegisterNamedBuffer.
+// The caller must hold res.mu.
+func (res *RDMAResources) namedRegion(name string, character string) (*extraRegion, error) {
+	id, ok := res.regionNames[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: buffer %q not registered", character, name)
+	}
+	return res.region(id, character)
+}
+
+// WriteNamed is like Write but targets the named buffer registered with
+// RegisterNamedBuffer instead of the connection's default buffer. It is
+// WriteRegion with the buffer's RegionID.
+//
+// `contents` is sent with a 4-byte length header, as by WriteBytes, so it may hold
+// arbitrary bytes including NULs. Together they must fit in both the local and the
+// remote buffer, otherwise an error is returned and nothing is sent.
+//
+// Example:
+//
+//	err := h.WriteNamed(clientRes, "metadata", "v1", "client")
+//	if err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) WriteNamed(res *RDMAResources, name string, contents string, character string) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	r, err := res.namedRegion(name, character)
+	if err != nil {
+		return err
+	}
+	return writeRegion(res, r, []byte(contents), character)
+}
+
+// ReadNamed is like Read but reads the peer's buffer registered under `name`
+// with RegisterNamedBuffer instead of the connection's default buffer, and returns
+// exactly the contents last written there with WriteNamed. It is ReadRegion with
+// the buffer's RegionID.
+//
+// Example:
+//
+//	data, err := h.ReadNamed(serverRes, "metadata", "server")
+//	if err != nil {
+//	    log.Fatalf("RDMA read failed: %v", err)
+//	}
+func (h *RDMAHandler) ReadNamed(res *RDMAResources, name string, character string) (string, error) {
+	if err := res.begin(); err != nil {
+		return "", err
+	}
+	defer res.end()
+	r, err := res.namedRegion(name, character)
+	if err != nil {
+		return "", err
+	}
+	data, err := readRegion(res, r, character)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// registerBuffer allocates and registers a buffer of `size` bytes with the access
+// flags `access` and exchanges its descriptor with the peer under `name`. On
+// failure nothing stays registered. The caller must hold res.mu.
+func registerBuffer(res *RDMAResources, name string, size int, access AccessFlags) (*extraRegion, error) {
+	mr := C.register_buffer(&res.res, C.size_t(size), C.int(access))
+	if mr == nil {
+		return nil, fmt.Errorf("failed to register buffer %q", name)
+	}
+	if int(mr.length) != size {
+		C.deregister_buffer(mr)
+		return nil, fmt.Errorf("failed to register buffer %q: %w", name, ErrPartialRegistration)
+	}
+	buf := &extraRegion{mr: mr, size: size}
+
+	local := make([]byte, bufferDescSize)
+	remote := make([]byte, bufferDescSize)
+	binary.BigEndian.PutUint64(local[0:8], uint64(uintptr(mr.addr)))
+	binary.BigEndian.PutUint32(local[8:12], uint32(mr.rkey))
+	binary.BigEndian.PutUint32(local[12:16], uint32(size))
+	copy(local[16:], name)
+	if rc, err := C.sock_sync_data(res.res.sock, bufferDescSize, (*C.char)(unsafe.Pointer(&local[0])), (*C.char)(unsafe.Pointer(&remote[0]))); rc != 0 {
+		C.deregister_buffer(mr)
+		return nil, fmt.Errorf("failed to exchange buffer %q with peer: %w", name, newSyncError(rc, err))
+	}
+	if remoteName := string(bytes.TrimRight(remote[16:], "\x00")); remoteName != name {
+		C.deregister_buffer(mr)
+		return nil, fmt.Errorf("peer registered buffer %q, expected %q", remoteName, name)
+	}
+	buf.remoteAddr = binary.BigEndian.Uint64(remote[0:8])
+	buf.remoteKey = binary.BigEndian.Uint32(remote[8:12])
+	buf.remoteSize = int(binary.BigEndian.Uint32(remote[12:16]))
+	return buf, nil
+}
+
+// releaseBuffers deregisters the regions added with AddRegion or
+// RegisterNamedBuffer and the receive buffers of PostRecv. It must run before
+// resources_destroy releases the protection domain.
+func releaseBuffers(res *RDMAResources) error {
+	var failed bool
+	for _, buf := range res.extraRegions {
+		if C.deregister_buffer(buf.mr) != 0 {
+			failed = true
+		}
+	}
+	res.extraRegions, res.regionNames = nil, nil
+	for _, mr := range res.recvSlots {
+		if C.deregister_buffer(mr) != 0 {
+			failed = true
+		}
+	}
+	res.recvSlots, res.recvFree, res.recvPending = nil, nil, nil
+	if failed {
+		return fmt.Errorf("failed to deregister added regions")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// WriteAll sends `data` to the peer like WriteBytes, but without the size limit of
+// the connection's data buffer: `data` is split into buffer-sized chunks, each sent
+// with its own write and synchronization cycle.
+//
+// Before the first chunk, the total length is sent to the peer over the
+// synchronization socket, so the peer's ReadAll knows how much to expect and returns
+// the reassembled data. WriteAll must be matched by ReadAll on the peer.
+//
+// On success, it returns nil. On failure, it returns an error detailing the issue
+// encountered; the peers may then be out of step and the connection should be closed.
+//
+// Example:
+//
+//	payload := make([]byte, 1<<20)
+//	if err := h.WriteAll(clientRes, payload, "client"); err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) WriteAll(res *RDMAResources, data []byte, character string) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	remote, err := syncLength(res, uint64(len(data)))
+	if err != nil {
+		return fmt.Errorf("%s: %w", character, err)
+	}
+	if remote != 0 {
+		return fmt.Errorf("%s: peer is writing too, expected ReadAll on the peer", character)
+	}
+	chunk := res.bufferLimit() - payloadHeaderSize
+	for len(data) > 0 {
+		n := min(len(data), chunk)
+		if _, err := writeBytes(res, data[:n], character); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// ReadAll receives data sent by the peer with WriteAll. It first learns the total
+// length from the peer, then reads chunks with ReadBytes until all of it has arrived.
+//
+// On success, it returns the data and nil error. On failure, it returns nil and the
+// error encountered.
+//
+// Example:
+//
+//	payload, err := h.ReadAll(serverRes, "server")
+//	if err != nil {
+//	    log.Fatalf("RDMA read failed: %v", err)
+//	}
+func (h *RDMAHandler) ReadAll(res *RDMAResources, character string) ([]byte, error) {
+	if err := res.begin(); err != nil {
+		return nil, err
+	}
+	defer res.end()
+	total, err := syncLength(res, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", character, err)
+	}
+	// the length comes from the peer, so do not trust it for a large allocation
+	data := make([]byte, 0, min(total, maxPrealloc))
+	for uint64(len(data)) < total {
+		chunk, _, err := readBytes(res, character)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 || uint64(len(data)+len(chunk)) > total {
+			return nil, fmt.Errorf("%s: chunk of %d bytes does not match the %d bytes left", character, len(chunk), total-uint64(len(data)))
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// maxPrealloc bounds the memory ReadAll reserves up front for the announced length.
+const maxPrealloc = 16 << 20
+
+// syncLength sends `length` to the peer over the synchronization socket and
+// returns the length sent by the peer. The reading side of a WriteAll/ReadAll
+// pair sends 0.
+func syncLength(res *RDMAResources, length uint64) (uint64, error) {
+	res.counters.syncOps.Add(1)
+	local := make([]byte, 8)
+	remote := make([]byte, 8)
+	binary.BigEndian.PutUint64(local, length)
+	if rc, err := C.sock_sync_data(res.res.sock, 8, (*C.char)(unsafe.Pointer(&local[0])), (*C.char)(unsafe.Pointer(&remote[0]))); rc != 0 {
+		res.markErrored()
+		return 0, newSyncError(rc, err)
+	}
+	return binary.BigEndian.Uint64(remote), nil
+}
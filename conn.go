@@ -0,0 +1,120 @@
+package rdmahandler
+
+import (
+	"errors"
+	"io"
+)
+
+// RDMAConn adapts an established connection to io.Reader, io.Writer and io.Closer,
+// so that it can be used with bufio, io.Copy and other code written against the
+// standard interfaces. It is created with NewConn.
+//
+// Each Write sends its argument with WriteAll, and each Read that finds no buffered
+// data receives the next such payload with ReadAll; the peer must therefore issue
+// the matching call, as with the underlying methods. Data from a payload that does
+// not fit in the slice passed to Read is kept and returned by the following Reads.
+//
+// If the connection was created with Options.ConnWindow, Write collects its
+// arguments in a buffer of that size instead and sends them as one payload once
+// the buffer is full, so that the peer reads the data in window-sized pieces and
+// a long io.Copy proceeds at the pace of the peer's Reads. Data still buffered
+// is sent by Flush, by Close and by a Read that has to wait for the peer.
+//
+// An RDMAConn must not be used concurrently by multiple goroutines.
+type RDMAConn struct {
+	h         *RDMAHandler
+	res       *RDMAResources
+	character string
+	pending   []byte
+
+	// window is the capacity of unsent, which holds the data of Writes not yet
+	// sent to the peer.
+	window int
+	unsent []byte
+}
+
+var _ io.ReadWriteCloser = (*RDMAConn)(nil)
+
+// NewConn returns an RDMAConn over the connection `res`. `character` is used in
+// error messages as for Read and Write.
+//
+// Example:
+//
+//	conn := h.NewConn(clientRes, "client")
+//	defer conn.Close()
+//	if _, err := io.Copy(conn, file); err != nil {
+//	    log.Fatalf("Copy failed: %v", err)
+//	}
+func (h *RDMAHandler) NewConn(res *RDMAResources, character string) *RDMAConn {
+	window := res.Config().ConnWindow
+	return &RDMAConn{h: h, res: res, character: character, window: window, unsent: make([]byte, 0, window)}
+}
+
+// Read reads data sent by the peer's Write into p. It returns io.EOF once the peer
+// has closed the connection. Data left over from the last payload is returned
+// first; only when there is none does Read send the data buffered by Write, which
+// the peer may be waiting for, and then wait for the next payload.
+func (c *RDMAConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(c.pending) == 0 {
+		if err := c.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	for len(c.pending) == 0 {
+		data, err := c.h.ReadAll(c.res, c.character)
+		if errors.Is(err, ErrPeerClosed) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.pending = data
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends p to the peer, where it is returned by Read. With a window, p is
+// buffered; Write only blocks, sending the buffered data and waiting for the peer
+// to read it, when p does not fit in the rest of the window. A p larger than the
+// whole window is then sent on its own.
+func (c *RDMAConn) Write(p []byte) (int, error) {
+	if len(c.unsent)+len(p) <= c.window {
+		c.unsent = append(c.unsent, p...)
+		return len(p), nil
+	}
+	if err := c.Flush(); err != nil {
+		return 0, err
+	}
+	if len(p) <= c.window {
+		c.unsent = append(c.unsent, p...)
+		return len(p), nil
+	}
+	if err := c.h.WriteAll(c.res, p, c.character); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush sends the data buffered by Write to the peer and waits until the peer has
+// read it. It does nothing if nothing is buffered, in particular without a window.
+func (c *RDMAConn) Flush() error {
+	if len(c.unsent) == 0 {
+		return nil
+	}
+	if err := c.h.WriteAll(c.res, c.unsent, c.character); err != nil {
+		return err
+	}
+	c.unsent = c.unsent[:0]
+	return nil
+}
+
+// Close sends the data still buffered by Write and releases the connection with
+// Destroy, which happens even if sending fails.
+func (c *RDMAConn) Close() error {
+	return errors.Join(c.Flush(), c.h.Destroy(c.res))
+}
@@ -0,0 +1,209 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"syscall"
+	"time"
+)
+
+// pollCheckInterval is the number of empty completion queue polls between two
+// checks of the deadline and of the context in waitCompletion.
+const pollCheckInterval = 256
+
+// WriteContext is like Write but stops waiting for the completion of the RDMA write
+// when `ctx` is cancelled or its deadline passes, in which case it returns ctx.Err().
+//
+// The context is checked before the operation starts and between iterations of the
+// completion polling loop. The synchronization with the peer before and after the
+// write is not interrupted.
+//
+// A cancelled write may still be executed by the device, and the peer is left waiting
+// at its synchronization point, so the connection cannot be used for further
+// operations. It must be released with Destroy, which is safe to call.
+//
+// Example:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//	defer cancel()
+//	if err := h.WriteContext(ctx, clientRes, "Hello RDMA", "client"); err != nil {
+//	    h.Destroy(clientRes)
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) WriteContext(ctx context.Context, res *RDMAResources, contents string, character string) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := res.checkFits(len(contents), character); err != nil {
+		return err
+	}
+	if err := syncData(res, syncWrite); err != nil {
+		return err
+	}
+	res.putPayload([]byte(contents))
+	length := payloadHeaderSize + len(contents)
+
+	acquireInflight()
+	if rc, err := C.post_send_region(&res.res, C.IBV_WR_RDMA_WRITE, res.res.mr, C.uint32_t(length), res.res.remote_props.addr, res.res.remote_props.rkey); rc != 0 {
+		releaseInflight()
+		return fmt.Errorf("%s: %w", character, res.opError("post_send_region", rc, err))
+	}
+	err := pollContext(ctx, res)
+	releaseInflight()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("%s: poll completion failed: %v", character, err)
+	}
+	res.writeIndex += uint64(len(contents))
+	res.publishWriteIndex()
+	res.countWrite(len(contents))
+	if err := syncData(res, syncDone); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadContext is like Read but stops waiting for the completion of the RDMA read
+// when `ctx` is cancelled or its deadline passes, in which case it returns ctx.Err().
+//
+// Cancellation behaves as described for WriteContext: afterwards the connection must
+// be released with Destroy.
+//
+// Example:
+//
+//	data, err := h.ReadContext(ctx, serverRes, "server")
+//	if errors.Is(err, context.Canceled) {
+//	    h.Destroy(serverRes)
+//	    return
+//	}
+func (h *RDMAHandler) ReadContext(ctx context.Context, res *RDMAResources, character string) (string, error) {
+	if err := res.begin(); err != nil {
+		return "", err
+	}
+	defer res.end()
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := requireRC(res, character); err != nil {
+		return "", err
+	}
+	if err := syncData(res, syncRead); err != nil {
+		return "", err
+	}
+	acquireInflight()
+	if rc, err := C.post_send(&res.res, C.IBV_WR_RDMA_READ); rc != 0 {
+		releaseInflight()
+		return "", fmt.Errorf("%s: %w", character, res.opError("post_send", rc, err))
+	}
+	err := pollContext(ctx, res)
+	releaseInflight()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		return "", fmt.Errorf("%s: poll completion after post_send failed: %v", character, err)
+	}
+	if err := syncData(res, syncDone); err != nil {
+		return "", err
+	}
+	data, err := res.payload(character)
+	if err != nil {
+		return "", err
+	}
+	res.readIndex += uint64(len(data))
+	res.countRead(len(data))
+	return string(data), nil
+}
+
+// exitMessage is the message that ends a conversation, as typed into the
+// receive_message prompt of the C demo.
+const exitMessage = "exit"
+
+// ReceiveWithTimeout is like Read but gives up if the peer does not send a message
+// within `timeout`, so that a server does not block forever when its client went
+// away without closing the connection.
+//
+// `timeout` bounds each wait for the peer on the synchronization socket; zero or a
+// negative value waits forever, like Read.
+//
+// It returns the message and whether the conversation is over: the exit flag is
+// set, with a nil error, if the peer sent "exit" or shut the connection down with
+// Close. If no message arrives in time, it returns an error wrapping
+// ErrReceiveTimeout. The peer may still be about to write, so the two sides are
+// out of step and the connection is marked Errored; it must be released with
+// Destroy.
+//
+// Example:
+//
+//	for {
+//	    msg, exit, err := h.ReceiveWithTimeout(serverRes, "server", 30*time.Second)
+//	    if err != nil {
+//	        log.Printf("receive failed: %v", err)
+//	        break
+//	    }
+//	    if exit {
+//	        break
+//	    }
+//	    fmt.Println("Received data:", msg)
+//	}
+//	h.Destroy(serverRes)
+func (h *RDMAHandler) ReceiveWithTimeout(res *RDMAResources, character string, timeout time.Duration) (string, bool, error) {
+	if err := res.begin(); err != nil {
+		return "", false, err
+	}
+	defer res.end()
+	if timeout > 0 {
+		if rc, err := C.sock_set_timeout(res.res.sock, C.int(min(timeoutMs(timeout), math.MaxInt32))); rc != 0 {
+			return "", false, fmt.Errorf("%s: %w", character, newRDMAError("sock_set_timeout", rc, err))
+		}
+		defer C.sock_set_timeout(res.res.sock, -1)
+	}
+	data, _, err := readBytes(res, character)
+	switch {
+	case errors.Is(err, ErrPeerClosed):
+		return "", true, nil
+	case errors.Is(err, syscall.EAGAIN):
+		// SO_RCVTIMEO expired while waiting for the peer
+		return "", false, fmt.Errorf("%s: %w", character, ErrReceiveTimeout)
+	case err != nil:
+		return "", false, err
+	}
+	msg := string(data)
+	return msg, msg == exitMessage, nil
+}
+
+// pollContext waits for the completion of the send work request last posted on
+// res, like pollCompletion, but checks `ctx` every pollCheckInterval empty polls
+// and returns ctx.Err() once it is done. It gives up with ErrPollTimeout after
+// the same timeout as pollCompletion. The completion queue is busy-polled even on
+// connections created in EventMode, since a blocking wait on the completion
+// channel cannot be interrupted.
+func pollContext(ctx context.Context, res *RDMAResources) (err error) {
+	defer func() {
+		if err != nil {
+			res.markErrored()
+		}
+	}()
+	rc, err := res.waitCompletion(res.sendCompletion(), res.pollTimeout(), ctx.Done())
+	switch {
+	case rc == 0:
+		return nil
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case rc == C.POLL_TIMEOUT:
+		return ErrPollTimeout
+	}
+	return res.opError("poll_completion", rc, err)
+}
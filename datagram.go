@@ -0,0 +1,114 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// SendTo transmits `data` to the peer as one datagram over a UD queue pair.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized with
+// Options.QPType set to QPTypeUD and represent an established connection.
+//
+// Unlike Send, SendTo does not synchronize with the peer: the datagram is delivered
+// only if the peer has a receive posted, which RecvFrom does, and is silently dropped
+// otherwise. The transport gives no acknowledgement and no ordering guarantee beyond
+// that of the fabric. `data` is sent without a length header; it must fit in the data
+// buffer, where it is staged, and in one path MTU, or the send completes with an error.
+//
+// On success, it returns nil. On failure, it returns an error detailing the issue encountered.
+//
+// Example:
+//
+//	if err := h.SendTo(clientRes, []byte("heartbeat")); err != nil {
+//	    log.Printf("UD send failed: %v", err)
+//	}
+func (h *RDMAHandler) SendTo(res *RDMAResources, data []byte) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if err := requireUD(res, "send to"); err != nil {
+		return err
+	}
+	if limit := res.bufferLimit(); len(data) > limit {
+		return fmt.Errorf("send to: %d bytes do not fit in the %d-byte buffer", len(data), limit)
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(res.res.buf)), len(data)), data)
+
+	acquireInflight()
+	if rc, err := C.post_ud_send(&res.res, C.uint32_t(len(data))); rc != 0 {
+		releaseInflight()
+		return fmt.Errorf("send to: %w", res.opError("post_ud_send", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return fmt.Errorf("send to: %w", res.opError("poll_completion", rc, err))
+	}
+	res.countWrite(len(data))
+	return nil
+}
+
+// RecvFrom receives one datagram sent by the peer with SendTo and returns its data.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized with
+// Options.QPType set to QPTypeUD and represent an established connection.
+//
+// RecvFrom posts a receive work request into a dedicated datagram buffer, unless one
+// is already outstanding, and waits for it to complete. Datagrams the peer sends while
+// no receive is posted are lost, so a receiver that must not miss any should call
+// RecvFrom again promptly. Only one receive is posted at a time.
+//
+// On success, it returns the received data and nil error.
+// On failure, it returns nil and the error encountered.
+//
+// Example:
+//
+//	msg, err := h.RecvFrom(serverRes)
+//	if err != nil {
+//	    log.Fatalf("UD receive failed: %v", err)
+//	}
+func (h *RDMAHandler) RecvFrom(res *RDMAResources) ([]byte, error) {
+	if err := res.begin(); err != nil {
+		return nil, err
+	}
+	defer res.end()
+	if err := requireUD(res, "recv from"); err != nil {
+		return nil, err
+	}
+	if !res.recvPosted {
+		if rc, err := C.post_ud_receive(&res.res); rc != 0 {
+			return nil, fmt.Errorf("recv from: %w", res.opError("post_ud_receive", rc, err))
+		}
+		res.recvPosted = true
+	}
+
+	acquireInflight()
+	rc, err := res.pollRecvCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return nil, fmt.Errorf("recv from: %w", res.opError("poll_completion", rc, err))
+	}
+	res.recvPosted = false
+	// every datagram is preceded by the space reserved for its global routing header
+	n := int(res.res.last_byte_len) - C.UD_GRH_SIZE
+	if n < 0 || n > int(res.res.buf_size) {
+		return nil, fmt.Errorf("recv from: invalid datagram length %d", res.res.last_byte_len)
+	}
+	data := C.GoBytes(unsafe.Add(unsafe.Pointer(res.res.ud_buf), C.UD_GRH_SIZE), C.int(n))
+	res.countRead(n)
+	return data, nil
+}
+
+// requireUD returns ErrUnsupported unless res uses an Unreliable Datagram queue pair.
+func requireUD(res *RDMAResources, op string) error {
+	if QPType(res.res.qp.qp_type) != QPTypeUD {
+		return fmt.Errorf("%s: %w on a non-UD queue pair", op, ErrUnsupported)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// ListDevices returns the names of the RDMA devices (HCAs) available on the host,
+// in the order reported by ibv_get_device_list. Any of them can be selected with
+// Options.DeviceName.
+//
+// On success, it returns the device names and nil error; the list is empty if the
+// host has no RDMA device. On failure, it returns nil and the error encountered.
+//
+// Example:
+//
+//	names, err := rdmahandler.ListDevices()
+//	if err != nil {
+//	    log.Fatalf("Failed to list devices: %v", err)
+//	}
+//	fmt.Println("Available devices:", names)
+func ListDevices() ([]string, error) {
+	var num C.int
+	list, err := C.ibv_get_device_list(&num)
+	if list == nil {
+		return nil, newRDMAError("ibv_get_device_list", 0, err)
+	}
+	defer C.ibv_free_device_list(list)
+
+	devices := unsafe.Slice(list, int(num))
+	names := make([]string, 0, len(devices))
+	for _, dev := range devices {
+		names = append(names, C.GoString(C.ibv_get_device_name(dev)))
+	}
+	return names, nil
+}
+
+// checkDevice returns an error listing the available devices if `name` is not
+// one of them.
+func checkDevice(name string) error {
+	names, err := ListDevices()
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("RDMA device %q not found, available devices: [%s]", name, strings.Join(names, ", "))
+}
+
+// Capabilities describes an RDMA device and one of its ports as reported by
+// ProbeDevice.
+type Capabilities struct {
+	// Device is the name of the device, e.g. "mlx5_0", and Port the port queried.
+	Device string
+	Port   int
+
+	// MaxMRSize is the largest memory region the device can register, in bytes.
+	MaxMRSize uint64
+	// Atomics reports whether the device supports atomic operations such as
+	// FetchAdd and CompareSwap.
+	Atomics bool
+	// MaxQPWR is the largest number of work requests per queue, which bounds
+	// Options.SendQueueDepth and Options.RecvQueueDepth.
+	MaxQPWR int
+	// MaxDeviceMemory is the amount of on-chip device memory that can be
+	// allocated, in bytes, and 0 if the device or its provider offers none. It
+	// bounds the BufferSize of connections with Options.UseDeviceMemory.
+	MaxDeviceMemory uint64
+
+	// State is the port state, e.g. "PORT_ACTIVE". Connections can only be
+	// established over an active port.
+	State string
+	// ActiveMTU is the active MTU of the port in bytes.
+	ActiveMTU int
+	// LinkLayer is LinkLayerInfiniBand, LinkLayerEthernet for RoCE, or
+	// LinkLayerAny if the device does not report it.
+	LinkLayer LinkLayer
+}
+
+// ProbeDevice opens the RDMA device selected by `opts`, queries the attributes of
+// the device and of the port, and closes it again, without creating queue pairs or
+// contacting a peer. Only Options.DeviceName and Options.IBPort are used; as for a
+// connection, they default to the first device and port 1.
+//
+// It lets an application check at startup that the host has a usable device with
+// the features it needs and fail fast with a useful message, instead of learning
+// it from a failed connection attempt.
+//
+// On success, it returns the capabilities and nil error. On failure, for example
+// because there is no RDMA device or the port does not exist, it returns an error.
+//
+// Example:
+//
+//	caps, err := rdmahandler.ProbeDevice(rdmahandler.Options{})
+//	if err != nil {
+//	    log.Fatalf("No usable RDMA device: %v", err)
+//	}
+//	if caps.State != "PORT_ACTIVE" {
+//	    log.Fatalf("port %d of %s is %s", caps.Port, caps.Device, caps.State)
+//	}
+func ProbeDevice(opts Options) (Capabilities, error) {
+	if err := opts.validate(); err != nil {
+		return Capabilities{}, err
+	}
+	cfg := defaultConfig()
+	devName := cfg.dev_name
+	if opts.DeviceName != "" {
+		devName = C.CString(opts.DeviceName)
+		defer C.free(unsafe.Pointer(devName))
+	}
+	port := int(cfg.ib_port)
+	if opts.IBPort != 0 {
+		port = opts.IBPort
+	}
+
+	var name [C.IBV_SYSFS_NAME_MAX]C.char
+	var devAttr C.struct_ibv_device_attr
+	var portAttr C.struct_ibv_port_attr
+	var maxDM C.uint64_t
+	if rc, err := C.probe_device(devName, C.int(port), &name[0], C.size_t(len(name)), &devAttr, &portAttr, &maxDM); rc != 0 {
+		e := newRDMAError("probe_device", rc, err)
+		if rc == 1 {
+			return Capabilities{}, fmt.Errorf("failed to open RDMA device: %w", e)
+		}
+		return Capabilities{}, fmt.Errorf("failed to query device %s, port %d: %w", C.GoString(&name[0]), port, e)
+	}
+
+	caps := Capabilities{
+		Device:          C.GoString(&name[0]),
+		Port:            port,
+		MaxMRSize:       uint64(devAttr.max_mr_size),
+		Atomics:         devAttr.atomic_cap != C.IBV_ATOMIC_NONE,
+		MaxQPWR:         int(devAttr.max_qp_wr),
+		MaxDeviceMemory: uint64(maxDM),
+		State:           C.GoString(C.ibv_port_state_str(portAttr.state)),
+		// enum ibv_mtu counts from IBV_MTU_256 = 1 in powers of two
+		ActiveMTU: 128 << portAttr.active_mtu,
+		LinkLayer: LinkLayer(portAttr.link_layer),
+	}
+	return caps, nil
+}
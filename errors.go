@@ -0,0 +1,346 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ErrPartialRegistration is returned when ibv_reg_mr produced a memory region
+// smaller than the requested buffer. Atomics and DMA into such a region would
+// reach past its end, so the connection is not set up.
+var ErrPartialRegistration = errors.New("memory region does not cover the whole buffer")
+
+// ErrQueueTooDeep is returned, wrapped in an RDMAError, when Options.SendQueueDepth
+// or Options.RecvQueueDepth exceeds the number of work requests per queue the device
+// supports (max_qp_wr), or when the completion queue sized to hold their completions
+// exceeds the number of entries per completion queue it supports (max_cqe).
+var ErrQueueTooDeep = errors.New("queue depth exceeds the device limit")
+
+// ErrLinkLayerMismatch is returned, wrapped in an RDMAError, when the port does not
+// have the link layer required by Options.LinkLayer, for example when InfiniBand is
+// requested on an Ethernet (RoCE) port.
+var ErrLinkLayerMismatch = errors.New("port has a different link layer than requested")
+
+// ErrNoGID is returned, wrapped in an RDMAError, when a connection is created on a
+// RoCE port without Options.UseGID and the port has no RoCEv2 GID to choose, which
+// usually means no IP address is configured on the Ethernet interface.
+var ErrNoGID = errors.New("no usable GID on RoCE port")
+
+// ErrOpenDevice is returned, wrapped in an RDMAError, when the RDMA device cannot
+// be opened, for example because no device is present or none is named
+// Options.DeviceName.
+var ErrOpenDevice = errors.New("failed to open RDMA device")
+
+// ErrQueryPort is returned, wrapped in an RDMAError, when the attributes of the
+// port cannot be queried, usually because the device has no port Options.IBPort.
+var ErrQueryPort = errors.New("failed to query port")
+
+// ErrQueryDevice is returned, wrapped in an RDMAError, when the attributes of the
+// opened device cannot be queried.
+var ErrQueryDevice = errors.New("failed to query device attributes")
+
+// ErrAllocPD is returned, wrapped in an RDMAError, when the device cannot allocate
+// a protection domain for the connection.
+var ErrAllocPD = errors.New("failed to allocate protection domain")
+
+// ErrCreateCQ is returned, wrapped in an RDMAError, when the device cannot create
+// the completion queue of the connection, or its completion channel with
+// Options.EventMode.
+var ErrCreateCQ = errors.New("failed to create completion queue")
+
+// ErrAllocBuffer is returned, wrapped in an RDMAError, when the host memory for the
+// data buffer, the control region or the UD receive buffer cannot be allocated.
+var ErrAllocBuffer = errors.New("failed to allocate buffer")
+
+// ErrRegMR is returned, wrapped in an RDMAError, when a buffer of the connection
+// cannot be registered as a memory region. The message includes the size of the
+// attempted registration; a registration larger than the device's max_mr_size or
+// than the locked memory limit (ulimit -l) commonly fails this way.
+var ErrRegMR = errors.New("failed to register memory region")
+
+// ErrCreateQP is returned, wrapped in an RDMAError, when the device cannot create
+// the queue pair, for example because Options.MaxInlineData or the queue depths
+// exceed what it supports for the queue pair type.
+var ErrCreateQP = errors.New("failed to create queue pair")
+
+// ErrResolve is returned when the server host name passed to InitClient cannot
+// be resolved to an IP address.
+var ErrResolve = errors.New("failed to resolve server address")
+
+// ErrInvalidAddress is returned when the server address passed to InitClient looks
+// like an IP literal, because it contains a colon or only digits and dots, but is not
+// a valid IPv4 or IPv6 address.
+var ErrInvalidAddress = errors.New("invalid server address")
+
+// ErrBadHandshake is returned when the queue pair information received from the
+// peer during connection setup has a wrong magic, length or checksum, for example
+// because it was truncated or the peer speaks a different protocol version.
+var ErrBadHandshake = errors.New("malformed connection data received from peer")
+
+// ErrPeerClosed is returned by Read, Write and the other synchronized operations
+// when the peer has shut the connection down cleanly with Close.
+var ErrPeerClosed = errors.New("peer closed the connection")
+
+// ErrProtocolDesync is returned when the peer answers a synchronization with a
+// token that does not match the local one, for example because it is finishing an
+// operation while the local side is starting one. The two sides no longer agree on
+// the state of the connection, so it is marked Errored.
+var ErrProtocolDesync = errors.New("peer is out of step with the synchronization protocol")
+
+// ErrConnectionLost is returned, wrapped in an RDMAError, when the peer's end of the
+// synchronization socket closed in the middle of an exchange, without the close token
+// sent by Close, for example because the peer process exited.
+var ErrConnectionLost = errors.New("synchronization socket closed by the peer")
+
+// ErrIncompatiblePeer is returned by Probe when the peer is reachable but
+// configured in a way that prevents the queue pairs from connecting.
+var ErrIncompatiblePeer = errors.New("peer configuration is incompatible")
+
+// ErrUnsupported is returned when an operation is not available on the
+// connection, such as an RDMA read on an Unreliable Connected queue pair.
+var ErrUnsupported = errors.New("operation not supported")
+
+// ErrDialTimeout is returned when a client could not connect to the server
+// within Options.DialTimeout.
+var ErrDialTimeout = errors.New("connection to the server timed out")
+
+// ErrPortInUse is returned, wrapped in an RDMAError, when a server cannot bind its
+// bootstrap socket because another socket already uses the port. The caller can retry
+// with another port, or set Options.ReuseAddr if the port is only held by connections
+// of a previous listener lingering in TIME_WAIT.
+var ErrPortInUse = errors.New("port is already in use")
+
+// ErrAcceptTimeout is returned by RDMAListener.WaitForClient when no client
+// connected within the timeout.
+var ErrAcceptTimeout = errors.New("no client connected before the timeout")
+
+// ErrReceiveTimeout is returned by ReceiveWithTimeout when the peer did not send a
+// message within the timeout.
+var ErrReceiveTimeout = errors.New("no message arrived before the timeout")
+
+// ErrPollTimeout is returned, possibly wrapped in an RDMAError, when an operation
+// posted a work request but its completion did not arrive within Options.PollTimeout.
+// The work request may still be outstanding, so the connection is marked Errored.
+var ErrPollTimeout = errors.New("completion did not arrive before the timeout")
+
+// ErrPoolExhausted is returned by RDMAPool.Get when all MaxConns connections of the
+// pool are in use.
+var ErrPoolExhausted = errors.New("all pooled connections are in use")
+
+// ErrClosed is returned by operations on an RDMAResources that was already
+// released with Destroy or Close.
+var ErrClosed = errors.New("connection is closed")
+
+// ErrQPError is matched, through an RDMAError, by a failed work completion that
+// left the queue pair in the error state. Every work request posted afterwards
+// fails until the connection is brought back with Recover.
+var ErrQPError = errors.New("queue pair is in the error state")
+
+// RDMAError describes a failed call into the C layer. It is returned, possibly
+// wrapped, by Read, Write, Destroy and the Init functions, and can be inspected with
+// errors.As:
+//
+//	var rerr *rdmahandler.RDMAError
+//	if errors.As(err, &rerr) {
+//	    log.Printf("%s returned %d (errno %v)", rerr.Op, rerr.Code, rerr.Errno)
+//	}
+//
+// errors.Is matches both the wrapped error, such as ErrPartialRegistration or the
+// WCStatus of a failed work completion, and the errno, such as syscall.ENOMEM.
+type RDMAError struct {
+	// Op is the name of the C function that failed, e.g. "post_send".
+	Op string
+	// Code is the value returned by Op, or 0 if Op is not a single C call.
+	Code int
+	// Errno is the value of errno right after Op returned, or 0 if it was not set.
+	Errno syscall.Errno
+
+	// Device and GIDIndex identify the RDMA device and GID table entry used for
+	// the connection. They are only set for connection setup failures; an empty
+	// Device means the first device found was used and a negative GIDIndex means
+	// no GID was used.
+	Device   string
+	GIDIndex int
+
+	// VendorErr is the vendor syndrome of a work completion that failed with a
+	// WCStatus, which is then the underlying error. It is 0 otherwise.
+	VendorErr uint32
+	// WRID is the work request ID of that failed completion, which identifies
+	// the request that failed among several outstanding ones; see
+	// RDMAResources.NextWRID. It is 0 otherwise.
+	WRID uint64
+	// QPError reports that the queue pair was found in the error state after
+	// that failed completion. errors.Is then also matches ErrQPError.
+	QPError bool
+
+	// Err is an underlying error, if any.
+	Err error
+}
+
+func (e *RDMAError) Error() string {
+	msg := e.Op + " failed"
+	if e.Code != 0 {
+		msg += fmt.Sprintf(" with code %d", e.Code)
+	}
+	if e.Errno != 0 {
+		msg += fmt.Sprintf(": %v", e.Errno)
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	if e.VendorErr != 0 {
+		msg += fmt.Sprintf(" (vendor syndrome 0x%x)", e.VendorErr)
+	}
+	if e.WRID != 0 {
+		msg += fmt.Sprintf(" (wr_id %d)", e.WRID)
+	}
+	if e.QPError {
+		msg += " (queue pair in error state)"
+	}
+	if e.Device != "" || e.GIDIndex >= 0 {
+		msg += fmt.Sprintf(" (device %q, gid index %d)", e.Device, e.GIDIndex)
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error, ErrQPError and the errno, when set.
+func (e *RDMAError) Unwrap() []error {
+	var errs []error
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	if e.QPError {
+		errs = append(errs, ErrQPError)
+	}
+	if e.Errno != 0 {
+		errs = append(errs, e.Errno)
+	}
+	return errs
+}
+
+// Temporary reports whether the failure is transient, so that repeating the
+// operation, on a new connection if this one is Errored, may succeed: the peer
+// did not acknowledge or had no receive posted in time (WCRetryExcErr,
+// WCRNRRetryExcErr), a completion or socket wait timed out, the peer went away
+// and may come back (ErrConnectionLost, ECONNRESET, ECONNREFUSED, EPIPE), or a
+// resource was momentarily exhausted (EAGAIN, ENOMEM, EBUSY, EINTR). Protection
+// and access errors, such as WCLocProtErr or a wrong rkey (WCRemAccessErr),
+// repeat on every attempt and are not temporary.
+//
+// Together with Timeout it follows the convention of net.Error:
+//
+//	var rerr *rdmahandler.RDMAError
+//	if errors.As(err, &rerr) && rerr.Temporary() {
+//	    // reconnect and try again
+//	}
+func (e *RDMAError) Temporary() bool {
+	if e.Timeout() {
+		return true
+	}
+	var status WCStatus
+	if errors.As(e.Err, &status) {
+		return status == WCRetryExcErr || status == WCRNRRetryExcErr
+	}
+	if errors.Is(e.Err, ErrConnectionLost) {
+		return true
+	}
+	switch e.Errno {
+	case syscall.EAGAIN, syscall.ENOMEM, syscall.EBUSY, syscall.EINTR,
+		syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE:
+		return true
+	}
+	return false
+}
+
+// Timeout reports whether the failure is a timeout: a completion that did not
+// arrive within Options.PollTimeout, or a socket operation that timed out.
+func (e *RDMAError) Timeout() bool {
+	return errors.Is(e.Err, ErrPollTimeout) || e.Errno == syscall.ETIMEDOUT || e.Errno == syscall.EAGAIN
+}
+
+// isFatal reports whether `err` wraps an RDMAError that is not temporary, so
+// that repeating the operation cannot help.
+func isFatal(err error) bool {
+	var rerr *RDMAError
+	return errors.As(err, &rerr) && !rerr.Temporary()
+}
+
+// WCStatus is the status of a failed work completion (enum ibv_wc_status). When an
+// operation's completion reports an error, the returned RDMAError wraps the status,
+// so that the cause can be tested with errors.Is:
+//
+//	if errors.Is(err, rdmahandler.WCRetryExcErr) {
+//	    log.Println("peer did not acknowledge, is it still running?")
+//	}
+type WCStatus int
+
+// Work completion statuses that commonly indicate why an operation failed.
+const (
+	// WCLocLenErr: the local buffer was too small for the data, e.g. a received
+	// message larger than the posted receive.
+	WCLocLenErr WCStatus = C.IBV_WC_LOC_LEN_ERR
+	// WCLocProtErr: a local buffer is not covered by a registered memory region.
+	WCLocProtErr WCStatus = C.IBV_WC_LOC_PROT_ERR
+	// WCWRFlushErr: the work request was flushed because the queue pair entered
+	// the error state after an earlier failure.
+	WCWRFlushErr WCStatus = C.IBV_WC_WR_FLUSH_ERR
+	// WCRemInvReqErr: the peer rejected the request as invalid, e.g. an RDMA
+	// operation longer than the peer's buffer or an unsupported opcode.
+	WCRemInvReqErr WCStatus = C.IBV_WC_REM_INV_REQ_ERR
+	// WCRemAccessErr: the peer's memory region does not allow the access, or
+	// the remote address or key is wrong.
+	WCRemAccessErr WCStatus = C.IBV_WC_REM_ACCESS_ERR
+	// WCRemOpErr: the peer could not complete the operation.
+	WCRemOpErr WCStatus = C.IBV_WC_REM_OP_ERR
+	// WCRetryExcErr: the peer did not acknowledge within the transport retries
+	// (see Options.QPTimeout and Options.RetryCount), e.g. because it is gone.
+	WCRetryExcErr WCStatus = C.IBV_WC_RETRY_EXC_ERR
+	// WCRNRRetryExcErr: the peer had no receive posted within the RNR retries
+	// (see Options.RNRRetry).
+	WCRNRRetryExcErr WCStatus = C.IBV_WC_RNR_RETRY_EXC_ERR
+	// WCRemAbortErr: the peer aborted the operation.
+	WCRemAbortErr WCStatus = C.IBV_WC_REM_ABORT_ERR
+	// WCGeneralErr: any other transport error.
+	WCGeneralErr WCStatus = C.IBV_WC_GENERAL_ERR
+)
+
+// Error returns the description of the status from ibv_wc_status_str, e.g.
+// "transport retry counter exceeded".
+func (s WCStatus) Error() string {
+	return C.GoString(C.ibv_wc_status_str(C.enum_ibv_wc_status(s)))
+}
+
+// newRDMAError returns an RDMAError for the C function `op` that returned `rc`.
+// `err` is the errno result of the cgo call, as returned by the two-value form
+// `rc, err := C.op(...)`. Device and GIDIndex are left unset.
+func newRDMAError(op string, rc C.int, err error) *RDMAError {
+	e := &RDMAError{Op: op, Code: int(rc), GIDIndex: -1}
+	if errno, ok := err.(syscall.Errno); ok {
+		e.Errno = errno
+	}
+	return e
+}
+
+// newConnError is like newRDMAError but also records the device and GID index
+// selected by `opts`, for failures during connection setup.
+func newConnError(op string, rc C.int, err error, opts Options) *RDMAError {
+	e := newRDMAError(op, rc, err)
+	e.Device = opts.DeviceName
+	e.GIDIndex = opts.gidIndex()
+	return e
+}
+
+// newSyncError returns an RDMAError for a failed sock_sync_data call. If the peer
+// closed the socket, the error wraps ErrConnectionLost.
+func newSyncError(rc C.int, err error) *RDMAError {
+	e := newRDMAError("sock_sync_data", rc, err)
+	if rc == C.SOCK_CLOSED {
+		e.Err = ErrConnectionLost
+	}
+	return e
+}
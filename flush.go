@@ -0,0 +1,59 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import "fmt"
+
+// Flush waits until the RDMA writes previously posted on the connection have been
+// placed in the peer's memory.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection over a Reliable Connected queue pair.
+//
+// Flush posts a zero-length RDMA read and waits for its completion. On an RC queue
+// pair a read is not executed by the peer's adapter before the writes that precede
+// it on the same queue pair, so its completion confirms that all of them, such as a
+// sequence of WriteAt calls or the writes of PostWrites, have reached the peer's
+// memory. It acts as a barrier between those writes and whatever the caller does
+// next, for example telling the peer over another channel that the data is ready.
+//
+// Flush does not notify the peer and does not order anything the peer does: the
+// peer's CPU can observe the data in any order while the writes are in progress,
+// and must not read it until told, by a synchronized operation or otherwise, that
+// Flush has returned. Writes posted on other connections are not covered.
+//
+// On success, it returns nil. On failure, it returns an error detailing the issue
+// encountered.
+//
+// Example:
+//
+//	for i, rec := range records {
+//	    if err := h.WriteAt(clientRes, rec, uint64(i*recordSize)); err != nil {
+//	        log.Fatalf("RDMA write failed: %v", err)
+//	    }
+//	}
+//	if err := h.Flush(clientRes); err != nil {
+//	    log.Fatalf("RDMA flush failed: %v", err)
+//	}
+func (h *RDMAHandler) Flush(res *RDMAResources) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if err := requireRC(res, "flush"); err != nil {
+		return err
+	}
+	acquireInflight()
+	if rc, err := C.post_send_offset(&res.res, C.IBV_WR_RDMA_READ, 0, 0); rc != 0 {
+		releaseInflight()
+		return fmt.Errorf("flush: %w", res.opError("post_send_offset", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return fmt.Errorf("flush: %w", res.opError("poll_completion", rc, err))
+	}
+	return nil
+}
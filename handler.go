@@ -8,7 +8,17 @@ package rdmahandler
 */
 import "C"
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -45,6 +55,8 @@ type RDMAHandler struct{}
 // `port` is the port number on which the RDMA server will listen. It should be a valid
 // port number where the server has permissions to bind.
 //
+// Connections opened by Probe are answered while waiting and do not count as the client.
+//
 // On success, it returns a pointer to the initialized RDMAResources and nil error.
 // On failure, it returns nil and the error encountered.
 //
@@ -57,17 +69,42 @@ type RDMAHandler struct{}
 //	// Use res (RDMAResources) as needed
 //	...
 func (h *RDMAHandler) InitServer(port int) (*RDMAResources, error) {
-	return initRDMAConnection("", port)
+	return initRDMAConnection("", port, Options{})
+}
+
+// InitServerWithOptions is like InitServer but creates the connection with the
+// settings in `opts`, such as the size of the data buffer.
+//
+// If `opts` is invalid, an error is returned before the port is bound. If the port
+// is already in use, the error wraps ErrPortInUse. If opts.BootstrapUnixSocket is
+// set, the server listens on that unix socket instead and `port` is not used.
+//
+// Example:
+//
+//	res, err := h.InitServerWithOptions(8080, rdmahandler.Options{BufferSize: 4096})
+//	if err != nil {
+//	    log.Fatalf("Failed to initialize RDMA server: %v", err)
+//	}
+func (h *RDMAHandler) InitServerWithOptions(port int, opts Options) (*RDMAResources, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return initRDMAConnection("", port, opts)
 }
 
 // InitClient establishes a connection to an RDMA server at the specified IP address and port.
 // It initializes the client-side RDMA resources and returns a pointer to these resources, along with
 // any error encountered during the connection and initialization process.
 //
-// `ip` is the IP address of the RDMA server to connect to. It should be a valid IPv4 or IPv6 address.
+// `ip` is the IP address of the RDMA server to connect to. It should be a valid IPv4 or IPv6 address,
+// or a host name, which is resolved before connecting. Link-local IPv6 addresses need a zone, as in
+// "fe80::1%eth0". A malformed IP address is rejected with ErrInvalidAddress.
 // `port` is the port number on which the RDMA server is listening. It should be a valid port number
 // where the server is expecting connections.
 //
+// The server address and all other connection parameters are passed to the C layer per call, so
+// several goroutines may call InitClient, InitServer and their WithOptions variants concurrently.
+//
 // On success, it returns a pointer to the initialized RDMAResources and nil error. On failure, it
 // returns nil and the error encountered.
 //
@@ -80,7 +117,32 @@ func (h *RDMAHandler) InitServer(port int) (*RDMAResources, error) {
 //	// Use clientRes (RDMAResources) for client-side operations
 //	...
 func (h *RDMAHandler) InitClient(ip string, port int) (*RDMAResources, error) {
-	return initRDMAConnection(ip, port)
+	return initRDMAConnection(ip, port, Options{})
+}
+
+// InitClientWithOptions is like InitClient but creates the connection with the
+// settings in `opts`, such as the size of the data buffer. If the server's
+// BufferSize differs, the smaller of the two limits the payloads; see
+// RDMAResources.MaxMessageSize.
+//
+// If `opts` is invalid, an error is returned before connecting. If
+// opts.BootstrapUnixSocket is set, the client connects to the server's unix
+// socket and `ip` and `port` are not used.
+//
+// Example:
+//
+//	clientRes, err := h.InitClientWithOptions("192.168.1.10", 8080, rdmahandler.Options{BufferSize: 4096})
+//	if err != nil {
+//	    log.Fatalf("Failed to initialize RDMA client: %v", err)
+//	}
+func (h *RDMAHandler) InitClientWithOptions(ip string, port int, opts Options) (*RDMAResources, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.BootstrapUnixSocket != "" {
+		return dialUnix(opts)
+	}
+	return initRDMAConnection(ip, port, opts)
 }
 
 //	Write sends the given contents to a remote RDMA peer using the specified RDMAResources.
@@ -90,7 +152,9 @@ func (h *RDMAHandler) InitClient(ip string, port int) (*RDMAResources, error) {
 // `res` is a pointer to RDMAResources which should be previously initialized and represent
 // an established RDMA connection.
 //
-// `contents` is the string data to be sent to the remote peer.
+// `contents` is the string data to be sent to the remote peer. It must fit in the
+// connection's data buffer as described for WriteBytes, otherwise an error is returned
+// and nothing is sent.
 //
 // `character` is used in error messages to identify the operation or the role of the peer
 // (e.g., "client" or "server").
@@ -107,24 +171,164 @@ func (h *RDMAHandler) InitClient(ip string, port int) (*RDMAResources, error) {
 //	    log.Fatalf("RDMA write failed: %v", err)
 //	}
 func (h *RDMAHandler) Write(res *RDMAResources, contents string, character string) error {
-	if err := syncData(res); err != nil {
+	return h.WriteBytes(res, []byte(contents), character)
+}
+
+// WriteString is Write under a name that pairs with ReadString. The string is
+// framed by a 4-byte big-endian length followed by its bytes, so any content,
+// including NUL bytes and binary data, arrives unchanged, and an empty string is
+// delivered as an empty message rather than mistaken for a failed read.
+//
+// Example:
+//
+//	if err := h.WriteString(clientRes, "a\x00b", "client"); err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) WriteString(res *RDMAResources, s string, character string) error {
+	return h.WriteBytes(res, []byte(s), character)
+}
+
+// WriteBytes is like Write but sends an arbitrary byte slice, which may contain NUL
+// bytes. The length of `data` is transferred along with it, so ReadBytes on the peer
+// returns exactly `data`.
+//
+// `data` plus a 4-byte length header must fit in the connection's data buffer (see
+// Options.BufferSize), otherwise an error is returned and nothing is sent.
+//
+// Example:
+//
+//	err := h.WriteBytes(clientRes, []byte{0x01, 0x00, 0x02}, "client")
+//	if err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) WriteBytes(res *RDMAResources, data []byte, character string) error {
+	if err := res.begin(); err != nil {
 		return err
 	}
-	cContents := C.CString(contents)
-	defer C.free(unsafe.Pointer(cContents))
+	defer res.end()
+	_, err := writeBytes(res, data, character)
+	return err
+}
+
+// WriteN is like WriteBytes but also reports how many bytes the RDMA write moved
+// to the peer: the payload plus its 4-byte length header, as posted to the device.
+// Together with ReadN it allows precise throughput measurements.
+//
+// On success, it returns the number of bytes transferred and nil error. On failure,
+// it returns 0 and the error encountered.
+//
+// Example:
+//
+//	start := time.Now()
+//	n, err := h.WriteN(clientRes, payload, "client")
+//	if err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+//	log.Printf("%.1f MB/s", float64(n)/time.Since(start).Seconds()/1e6)
+func (h *RDMAHandler) WriteN(res *RDMAResources, data []byte, character string) (int, error) {
+	if err := res.begin(); err != nil {
+		return 0, err
+	}
+	defer res.end()
+	return writeBytes(res, data, character)
+}
 
-	C.strcpy(res.res.buf, cContents)
+// writeBytes implements WriteBytes and WriteN. Only the payload and its header are
+// transferred, not the whole data buffer. The caller must hold res.mu.
+func writeBytes(res *RDMAResources, data []byte, character string) (int, error) {
+	if err := res.checkFits(len(data), character); err != nil {
+		return 0, err
+	}
+	if err := syncData(res, syncWrite); err != nil {
+		return 0, err
+	}
+	res.putPayload(data)
+	length := payloadHeaderSize + len(data)
 
-	if C.post_send(&res.res, C.IBV_WR_RDMA_WRITE) != 0 {
-		return fmt.Errorf("%s: failed to post SR", character)
+	acquireInflight()
+	if rc, err := C.post_send_region(&res.res, C.IBV_WR_RDMA_WRITE, res.res.mr, C.uint32_t(length), res.res.remote_props.addr, res.res.remote_props.rkey); rc != 0 {
+		releaseInflight()
+		return 0, fmt.Errorf("%s: %w", character, res.opError("post_send_region", rc, err))
 	}
-	if C.poll_completion(&res.res) != 0 {
-		return fmt.Errorf("%s: poll completion failed", character)
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return 0, fmt.Errorf("%s: %w", character, res.opError("poll_completion", rc, err))
 	}
-	if err := syncData(res); err != nil {
-		return err
+	res.writeIndex += uint64(len(data))
+	res.publishWriteIndex()
+	res.countWrite(len(data))
+	if err := syncData(res, syncDone); err != nil {
+		return 0, err
 	}
-	return nil
+	return length, nil
+}
+
+// WriteAsync starts the same RDMA write as Write but returns as soon as the work
+// request has been accepted by the send queue, leaving the completion to be tracked
+// in the background.
+//
+// `res`, `contents` and `character` have the same meaning as for Write.
+//
+// The two stages of the write are reported separately. A nil error from WriteAsync
+// only means that the write was posted: the data may not have left the local
+// adapter yet and nothing is known about the peer. The returned channel receives
+// exactly one value once the remote side has acknowledged the write, which on a
+// reliable connection is when its work completion is generated, and the trailing
+// synchronization with the peer has finished: nil on success, or the error that
+// occurred. Other operations on `res`, including Destroy, wait until the write has
+// finished.
+//
+// If the write cannot be posted, it returns a nil channel and the error.
+//
+// Example:
+//
+//	done, err := h.WriteAsync(clientRes, "Hello RDMA", "client")
+//	if err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+//	// overlap other work with the transfer
+//	if err := <-done; err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) WriteAsync(res *RDMAResources, contents string, character string) (<-chan error, error) {
+	if err := res.begin(); err != nil {
+		return nil, err
+	}
+	if err := res.checkFits(len(contents), character); err != nil {
+		res.end()
+		return nil, err
+	}
+	if err := syncData(res, syncWrite); err != nil {
+		res.end()
+		return nil, err
+	}
+	res.putPayload([]byte(contents))
+	length := payloadHeaderSize + len(contents)
+
+	acquireInflight()
+	if rc, err := C.post_send_region(&res.res, C.IBV_WR_RDMA_WRITE, res.res.mr, C.uint32_t(length), res.res.remote_props.addr, res.res.remote_props.rkey); rc != 0 {
+		releaseInflight()
+		res.end()
+		return nil, fmt.Errorf("%s: %w", character, res.opError("post_send_region", rc, err))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// the connection stays locked until the write has completed
+		defer res.end()
+		rc, err := res.pollCompletion()
+		releaseInflight()
+		if rc != 0 {
+			done <- fmt.Errorf("%s: %w", character, res.opError("poll_completion", rc, err))
+			return
+		}
+		res.writeIndex += uint64(len(contents))
+		res.publishWriteIndex()
+		res.countWrite(len(contents))
+		done <- syncData(res, syncDone)
+	}()
+	return done, nil
 }
 
 // Read performs an RDMA read operation using the given RDMAResources and retrieves data from a remote RDMA peer.
@@ -149,19 +353,201 @@ func (h *RDMAHandler) Write(res *RDMAResources, contents string, character strin
 //	}
 //	fmt.Println("Received data:", data)
 func (h *RDMAHandler) Read(res *RDMAResources, character string) (string, error) {
-	if err := syncData(res); err != nil {
+	data, err := h.ReadBytes(res, character)
+	if err != nil {
 		return "", err
 	}
-	if C.post_send(&res.res, C.IBV_WR_RDMA_READ) != 0 {
-		return "", fmt.Errorf("%s: failed to post SR", character)
+	return string(data), nil
+}
+
+// ReadString is Read under a name that pairs with WriteString. It reads the 4-byte
+// big-endian length written by the peer and returns exactly that many bytes, so
+// the result equals the string passed to WriteString, NUL bytes included. An
+// empty result with a nil error is an empty message; a failed read always
+// returns a non-nil error.
+//
+// Example:
+//
+//	s, err := h.ReadString(serverRes, "server")
+//	if err != nil {
+//	    log.Fatalf("RDMA read failed: %v", err)
+//	}
+//	fmt.Printf("Received %q\n", s)
+func (h *RDMAHandler) ReadString(res *RDMAResources, character string) (string, error) {
+	return h.Read(res, character)
+}
+
+// ReadBytes is like Read but returns the data as a byte slice. Unlike a string
+// read up to the first NUL byte, the result is exactly the data passed to the
+// peer's last WriteBytes or Write, including any NUL bytes.
+//
+// Example:
+//
+//	data, err := h.ReadBytes(serverRes, "server")
+//	if err != nil {
+//	    log.Fatalf("RDMA read failed: %v", err)
+//	}
+//	fmt.Printf("Received %d bytes\n", len(data))
+func (h *RDMAHandler) ReadBytes(res *RDMAResources, character string) ([]byte, error) {
+	if err := res.begin(); err != nil {
+		return nil, err
+	}
+	defer res.end()
+	data, _, err := readBytes(res, character)
+	return data, err
+}
+
+// ReadN is like ReadBytes but also reports how many bytes the RDMA read moved from
+// the peer, as given by the byte_len of its completion. A read always fetches the
+// peer's whole data buffer, so this is usually larger than the returned payload.
+//
+// On success, it returns the data, the number of bytes transferred and nil error.
+// On failure, it returns nil, 0 and the error encountered.
+//
+// Example:
+//
+//	data, n, err := h.ReadN(serverRes, "server")
+//	if err != nil {
+//	    log.Fatalf("RDMA read failed: %v", err)
+//	}
+func (h *RDMAHandler) ReadN(res *RDMAResources, character string) ([]byte, int, error) {
+	if err := res.begin(); err != nil {
+		return nil, 0, err
+	}
+	defer res.end()
+	return readBytes(res, character)
+}
+
+// ReadInto is like ReadBytes but copies the data into `dst` instead of allocating
+// a new slice, which avoids garbage in a loop that reads many messages. The data
+// is copied straight from the registered buffer.
+//
+// On success, it returns the number of bytes copied to dst and nil error. If the
+// message is longer than dst, it returns the message length, which is the size dst
+// would have needed, and io.ErrShortBuffer; the message has been consumed and is
+// lost, so dst should be as large as the largest message the peer writes. On other
+// failures, it returns 0 and the error encountered.
+//
+// Example:
+//
+//	buf := make([]byte, 64<<10)
+//	for {
+//	    n, err := h.ReadInto(serverRes, buf)
+//	    if err != nil {
+//	        log.Fatalf("RDMA read failed: %v", err)
+//	    }
+//	    process(buf[:n])
+//	}
+func (h *RDMAHandler) ReadInto(res *RDMAResources, dst []byte) (int, error) {
+	if err := res.begin(); err != nil {
+		return 0, err
 	}
-	if C.poll_completion(&res.res) != 0 {
-		return "", fmt.Errorf("%s: poll completion after post_send failed", character)
+	defer res.end()
+	if _, err := readMessage(res, "read into"); err != nil {
+		return 0, err
 	}
-	if err := syncData(res); err != nil {
-		return "", err
+	src, err := res.payloadBytes("read into")
+	if err != nil {
+		return 0, err
+	}
+	res.readIndex += uint64(len(src))
+	res.countRead(len(src))
+	if len(src) > len(dst) {
+		return len(src), io.ErrShortBuffer
 	}
-	return C.GoString(res.res.buf), nil
+	return copy(dst, src), nil
+}
+
+// readBytes implements ReadBytes and ReadN. The caller must hold res.mu.
+func readBytes(res *RDMAResources, character string) ([]byte, int, error) {
+	n, err := readMessage(res, character)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := res.payload(character)
+	if err != nil {
+		return nil, 0, err
+	}
+	res.readIndex += uint64(len(data))
+	res.countRead(len(data))
+	return data, n, nil
+}
+
+// readMessage fetches the peer's data buffer into the local one with an RDMA read
+// and returns the number of bytes transferred. The caller must hold res.mu.
+func readMessage(res *RDMAResources, character string) (int, error) {
+	if err := requireRC(res, character); err != nil {
+		return 0, err
+	}
+	if err := syncData(res, syncRead); err != nil {
+		return 0, err
+	}
+	acquireInflight()
+	if rc, err := C.post_send(&res.res, C.IBV_WR_RDMA_READ); rc != 0 {
+		releaseInflight()
+		return 0, fmt.Errorf("%s: %w", character, res.opError("post_send", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return 0, fmt.Errorf("%s: %w", character, res.opError("poll_completion", rc, err))
+	}
+	n := int(res.res.last_byte_len)
+	if err := syncData(res, syncDone); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Available reports how many bytes the remote peer has written that this side
+// has not yet consumed with Read.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// Every successful Write advances the writer's write index, which lives in a small
+// control region registered next to the data buffer. Available fetches only that
+// 8-byte index from the peer with a one-sided RDMA read and subtracts the local read
+// index advanced by Read. No payload is transferred and no synchronization with the
+// peer takes place, so it can be called at any time to decide whether a Read is worth
+// the round trip.
+//
+// On success, it returns the number of pending bytes and nil error.
+// On failure, it returns 0 and the error encountered.
+//
+// Example:
+//
+//	n, err := h.Available(serverRes)
+//	if err != nil {
+//	    log.Fatalf("RDMA index read failed: %v", err)
+//	}
+//	if n > 0 {
+//	    data, _ := h.Read(serverRes, "server")
+//	    fmt.Println("Received data:", data)
+//	}
+func (h *RDMAHandler) Available(res *RDMAResources) (uint64, error) {
+	if err := res.begin(); err != nil {
+		return 0, err
+	}
+	defer res.end()
+	if err := requireRC(res, "available"); err != nil {
+		return 0, err
+	}
+	acquireInflight()
+	if rc, err := C.post_read_index(&res.res); rc != 0 {
+		releaseInflight()
+		return 0, fmt.Errorf("available: %w", res.opError("post_read_index", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return 0, fmt.Errorf("available: %w", res.opError("poll_completion", rc, err))
+	}
+	remote := binary.BigEndian.Uint64(res.ctrlBytes()[8:16])
+	if remote < res.readIndex {
+		return 0, nil
+	}
+	return remote - res.readIndex, nil
 }
 
 // Destroy releases the resources allocated for an RDMA connection.
@@ -174,6 +560,11 @@ func (h *RDMAHandler) Read(res *RDMAResources, character string) (string, error)
 // If the resources cannot be successfully destroyed, the function returns an error
 // detailing the failure.
 //
+// Afterwards the connection is in the Closed state: further operations on `res` return
+// ErrClosed, and calling Destroy or Close again does nothing and returns nil. Destroy
+// may be called from any goroutine; if an operation on `res` is running, it waits for
+// it to finish first.
+//
 // On success, it returns nil, indicating the resources were successfully released.
 // On failure, it returns an error.
 //
@@ -184,13 +575,113 @@ func (h *RDMAHandler) Read(res *RDMAResources, character string) (string, error)
 //	    log.Fatalf("Failed to destroy RDMA resources: %v", err)
 //	}
 func (h *RDMAHandler) Destroy(res *RDMAResources) error {
-	if C.resources_destroy(&res.res) != 0 {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	return destroy(res)
+}
 
-		return fmt.Errorf("failed to destroy resources")
+// destroy implements Destroy. The caller must hold res.mu.
+func destroy(res *RDMAResources) error {
+	if res.state.Swap(int32(Closed)) == int32(Closed) {
+		return nil
 	}
-	return nil
+	bufErr := errors.Join(releaseBuffers(res), releaseRegions(res))
+	rc, err := C.resources_destroy(&res.res)
+	// the shared receive queue outlives the queue pair that received from it
+	if res.srq != nil {
+		bufErr = errors.Join(bufErr, res.srq.release())
+	}
+	if rc != 0 {
+		e := newRDMAError("resources_destroy", rc, err)
+		e.Err = bufErr
+		return e
+	}
+	return bufErr
 }
 
+// Close shuts the connection down cleanly and releases its resources.
+//
+// `res` is a pointer to RDMAResources representing an established RDMA connection.
+//
+// Before tearing down, Close sends a close token, the single byte 'B', over the
+// synchronization socket and waits up to closeAckTimeout for the peer to acknowledge
+// it with the byte 'A'. The peer picks the token up at its next synchronization
+// point, acknowledges it, and its Read, Write or Recv returns ErrPeerClosed instead
+// of a generic completion or sync error, which lets it tell a graceful shutdown apart
+// from a crash or a fabric fault. If both peers call Close at the same time, each
+// close token acknowledges the other.
+//
+// Once the acknowledgement has arrived, or the wait has timed out, the resources are
+// released as by Destroy, which remains the abrupt variant that does not notify the
+// peer.
+//
+// On success, it returns nil. If the peer did not acknowledge the close token, it
+// returns an error; the resources are released in any case.
+//
+// Example:
+//
+//	if err := h.Close(clientRes); err != nil {
+//	    log.Printf("RDMA close failed: %v", err)
+//	}
+func (h *RDMAHandler) Close(res *RDMAResources) error {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if ConnectionState(res.state.Load()) == Closed {
+		return nil
+	}
+	// connections set up with CreateResources have no socket to notify the peer on
+	var ackErr error
+	if res.res.sock >= 0 {
+		ackErr = sendClose(res)
+	}
+	if err := destroy(res); err != nil {
+		return err
+	}
+	return ackErr
+}
+
+// closeAckTimeout bounds how long Close waits for the peer to acknowledge the
+// close token.
+const closeAckTimeout = 5 * time.Second
+
+// sendClose sends the close token to the peer and waits for its acknowledgement.
+// Tokens the peer sent for a synchronization that had already started are skipped.
+// The caller must hold res.mu.
+func sendClose(res *RDMAResources) error {
+	if rc, err := C.sock_set_timeout(res.res.sock, C.int(timeoutMs(closeAckTimeout))); rc != 0 {
+		return newRDMAError("sock_set_timeout", rc, err)
+	}
+	token := []byte{closeToken}
+	if n, err := C.write(res.res.sock, unsafe.Pointer(&token[0]), 1); n != 1 {
+		return fmt.Errorf("failed to send close token: %w", newRDMAError("write", C.int(n), err))
+	}
+	for {
+		n, err := C.read(res.res.sock, unsafe.Pointer(&token[0]), 1)
+		if n != 1 {
+			return fmt.Errorf("peer did not acknowledge close: %w", newRDMAError("read", C.int(n), err))
+		}
+		if token[0] == closeAck || token[0] == closeToken {
+			return nil
+		}
+	}
+}
+
+// Tokens exchanged by syncData. syncWrite and syncRead are sent before a write or
+// a read starts, syncDone after it has finished. closeToken is sent by Close in
+// their place to announce a clean shutdown, and answered with closeAck. Each token
+// is a single byte.
+// recoverToken and rotateToken start the messages exchanged by Recover and
+// RotateKey with exchangeValue.
+const (
+	syncWrite    = 'W'
+	syncRead     = 'R'
+	syncDone     = 'D'
+	closeToken   = 'B'
+	closeAck     = 'A'
+	recoverToken = 'E'
+	rotateToken  = 'K'
+)
+
 // RDMAResources encapsulates the resources required for establishing and managing
 // an RDMA (Remote Direct Memory Access) connection. It serves as a wrapper around
 // the C-level struct_resources, providing a Go-friendly interface for RDMA operations.
@@ -210,16 +701,240 @@ func (h *RDMAHandler) Destroy(res *RDMAResources) error {
 //	...
 type RDMAResources struct {
 	res C.struct_resources
+
+	// writeIndex is the total number of bytes written by this side and is
+	// published to the control region so the peer can query it.
+	writeIndex uint64
+	// readIndex is the total number of bytes consumed by this side with Read.
+	readIndex uint64
+
+	// regions holds the memory registered with RegisterMemory.
+	regions map[*MemoryRegion]struct{}
+	// extraRegions holds the regions added with AddRegion or
+	// RegisterNamedBuffer; RegionID n is extraRegions[n-1].
+	extraRegions []*extraRegion
+	// regionNames maps the names of RegisterNamedBuffer to their RegionIDs.
+	regionNames map[string]RegionID
+
+	// counters holds the operation counters reported by Stats.
+	counters connCounters
+
+	// mu serializes operations on the connection with each other and with
+	// Destroy, so that the C resources are never released under a running
+	// operation.
+	mu sync.Mutex
+	// state holds the ConnectionState reported by State. It is written with mu
+	// held but may be read at any time.
+	state atomic.Int32
+
+	// recvPosted reports whether a receive work request is outstanding: into the
+	// data buffer from the handshake on the client side or from Recv, or into the
+	// datagram buffer from RecvFrom on a UD queue pair.
+	recvPosted bool
+	// recvSlots are the buffers of the receives posted with PostRecv; a receive
+	// into recvSlots[i] has wr_id RecvWRID|(i+1). recvFree holds the indices of
+	// the idle slots and recvPending those of the posted ones, in posting order,
+	// which is the order their receives complete in.
+	recvSlots   []*C.struct_ibv_mr
+	recvFree    []int
+	recvPending []int
+
+	// wcs receives the completions of a poll_cq_batch call, and unclaimed holds
+	// those no waiting operation has claimed yet, in the order they were taken;
+	// see waitCompletion.
+	wcs       [C.MAX_POLL_BATCH]C.struct_ibv_wc
+	unclaimed []completion
+
+	// srq is the shared receive queue the connection receives from, if it was
+	// accepted by a listener with Options.UseSRQ.
+	srq *sharedRecvQueue
+
+	// loopback reports that the queue pair is connected to itself by
+	// InitLoopback, which leaves syncData nothing to synchronize with.
+	loopback bool
+
+	// manualSync reports that the connection was created with
+	// Options.ManualSync, which leaves syncData to the application's Sync calls.
+	manualSync bool
+
+	// yield reports that the connection was created in YieldMode, so that
+	// pollCompletion lets other goroutines run between bounded runs of polling.
+	yield bool
+
+	// role is the side the connection played in its setup, reported by Role.
+	role Role
+
+	// config holds the effective settings reported by Config.
+	config Options
+}
+
+// LocalKey returns the local key (lkey) of the memory region backing the
+// connection's data buffer. It is needed to reference the buffer in scatter/gather
+// entries of work requests posted by code outside this package.
+func (res *RDMAResources) LocalKey() uint32 {
+	return uint32(res.res.mr.lkey)
+}
+
+// RemoteKeyForLocalBuffer returns the remote key (rkey) of the memory region backing
+// the connection's data buffer, i.e. the key a peer must present to access this
+// side's buffer with RDMA reads and writes.
+func (res *RDMAResources) RemoteKeyForLocalBuffer() uint32 {
+	return uint32(res.res.mr.rkey)
+}
+
+// SyncFD returns the descriptor of the TCP socket the connection synchronizes
+// over, so that an event loop can watch it with epoll or kqueue alongside other
+// descriptors, for example to learn that the peer has sent a synchronization
+// message or closed the connection. It returns -1 if the connection is not open.
+//
+// The descriptor remains owned by `res`: the caller must not close it, change
+// its flags or read from and write to it directly. Readiness only tells that
+// data is pending; it must still be consumed through the library's operations,
+// such as Read, Recv or Close, which keep both peers' synchronization in step.
+// The descriptor is closed by Destroy and must be unregistered before that.
+//
+// Example:
+//
+//	ev := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(res.SyncFD())}
+//	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, res.SyncFD(), &ev); err != nil {
+//	    log.Fatalf("epoll_ctl: %v", err)
+//	}
+func (res *RDMAResources) SyncFD() int {
+	if res.checkOpen() != nil {
+		return -1
+	}
+	return int(res.res.sock)
+}
+
+// ctrlBytes returns the C control region as a byte slice. The first 8 bytes hold
+// the local write index and the next 8 bytes receive the remote one, both stored
+// in network byte order. The last 8 bytes receive the result of atomic operations.
+func (res *RDMAResources) ctrlBytes() []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(res.res.ctrl)), C.CTRL_SIZE)
+}
+
+// payloadHeaderSize is the size of the length header that precedes the payload
+// in the data buffer.
+const payloadHeaderSize = 4
+
+// bufferLimit returns the number of bytes of the data buffer that operations may
+// use: the smaller of the local buffer and the peer's, whose size was exchanged
+// during the handshake. A peer of unknown buffer size does not limit it.
+func (res *RDMAResources) bufferLimit() int {
+	size := int(res.res.buf_size)
+	if remote := int(res.res.remote_props.buf_size); remote > 0 {
+		size = min(size, remote)
+	}
+	return size
+}
+
+// MaxMessageSize returns the largest payload, in bytes, that Write, Send and the
+// other framed operations can transfer in one piece. The peers exchange the sizes
+// of their data buffers during the handshake, and the smaller one, less the 4-byte
+// length header, bounds both directions, so that a side with a larger buffer
+// cannot overrun the peer's. Larger payloads are rejected before anything is
+// posted, instead of failing with a remote access error on the peer's memory
+// region; WriteAt, ReadAt and the atomics are confined to the smaller buffer in
+// the same way. WriteAll and RDMAConn split their data into pieces of this size.
+//
+// It returns 0 if the connection was never established or has been released.
+//
+// Example:
+//
+//	if len(msg) > res.MaxMessageSize() {
+//	    return h.WriteAll(res, msg, "client")
+//	}
+//	return h.WriteBytes(res, msg, "client")
+func (res *RDMAResources) MaxMessageSize() int {
+	if res.checkOpen() != nil {
+		return 0
+	}
+	return res.bufferLimit() - payloadHeaderSize
+}
+
+// checkFits reports an error if a payload of `n` bytes and its length header do
+// not fit in the data buffers of both sides.
+func (res *RDMAResources) checkFits(n int, character string) error {
+	if size := res.bufferLimit(); n+payloadHeaderSize > size {
+		if size < int(res.res.buf_size) {
+			return fmt.Errorf("%s: %d bytes do not fit in the peer's %d-byte buffer", character, n, size)
+		}
+		return fmt.Errorf("%s: %d bytes do not fit in the %d-byte buffer", character, n, size)
+	}
+	return nil
+}
+
+// putPayload stores `data` in the data buffer, preceded by its length in network
+// byte order. The caller must have checked that it fits with checkFits.
+func (res *RDMAResources) putPayload(data []byte) {
+	binary.BigEndian.PutUint32(unsafe.Slice((*byte)(unsafe.Pointer(res.res.buf)), payloadHeaderSize), uint32(len(data)))
+	if len(data) > 0 {
+		dst := unsafe.Add(unsafe.Pointer(res.res.buf), payloadHeaderSize)
+		C.memcpy(dst, unsafe.Pointer(&data[0]), C.size_t(len(data)))
+	}
+	res.syncDeviceMemory(0, payloadHeaderSize+len(data), true)
+}
+
+// syncDeviceMemory copies `n` bytes at `offset` of the data buffer to the device
+// memory the peer accesses if `toDevice` is set, or back from it otherwise, when
+// the connection uses Options.UseDeviceMemory. Data staged locally thus stays
+// readable by the peer, and data the peer wrote can be decoded locally. The
+// copies do not fail for a range inside the buffer.
+func (res *RDMAResources) syncDeviceMemory(offset, n int, toDevice bool) {
+	var dir C.int
+	if toDevice {
+		dir = 1
+	}
+	C.dm_copy(&res.res, C.uint64_t(offset), C.size_t(n), dir)
+}
+
+// payload returns a copy of the payload stored in the data buffer by putPayload.
+func (res *RDMAResources) payload(character string) ([]byte, error) {
+	return decodePayload(unsafe.Pointer(res.res.buf), res.res.buf_size, character)
+}
+
+// payloadBytes is like payload but returns the payload in place, as a slice of
+// the C data buffer that is only valid until the buffer is reused.
+func (res *RDMAResources) payloadBytes(character string) ([]byte, error) {
+	return payloadSlice(unsafe.Pointer(res.res.buf), res.res.buf_size, character)
+}
+
+// decodePayload returns a copy of the payload stored by putPayload in the
+// `size`-byte buffer at `buf`.
+func decodePayload(buf unsafe.Pointer, size C.size_t, character string) ([]byte, error) {
+	b, err := payloadSlice(buf, size, character)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(b), nil
+}
+
+// payloadSlice returns the payload stored by putPayload in the `size`-byte buffer
+// at `buf`, without copying it.
+func payloadSlice(buf unsafe.Pointer, size C.size_t, character string) ([]byte, error) {
+	n := binary.BigEndian.Uint32(unsafe.Slice((*byte)(buf), payloadHeaderSize))
+	if uint64(n)+payloadHeaderSize > uint64(size) {
+		return nil, fmt.Errorf("%s: payload length %d exceeds the %d-byte buffer", character, n, size)
+	}
+	return unsafe.Slice((*byte)(unsafe.Add(buf, payloadHeaderSize)), n), nil
+}
+
+// publishWriteIndex stores the current write index in the control region.
+func (res *RDMAResources) publishWriteIndex() {
+	binary.BigEndian.PutUint64(res.ctrlBytes()[0:8], res.writeIndex)
 }
 
 // initRDMAConnection initializes the RDMA resources and establishes a connection
 // either as a client or a server based on the provided IP address.
 //
-// `ip` is the IP address of the RDMA server to connect to. If `ip` is an empty string,
-// the function sets up as a server, otherwise it sets up as a client.
+// `ip` is the IP address or host name of the RDMA server to connect to. If `ip` is an
+// empty string, the function sets up as a server, otherwise it sets up as a client.
+// Host names are resolved in Go with resolveHost before the address reaches the C layer.
 //
 // `port` is the port number used for the RDMA connection.
 //
+// `opts` holds the connection settings; it must already have been validated.
+//
 // This function configures the RDMA connection parameters, creates the necessary
 // resources, and connects the queue pairs (QPs). If any step in this process fails,
 // it cleans up any partially created resources and returns an error.
@@ -229,59 +944,324 @@ type RDMAResources struct {
 //
 // Example:
 //
-//	res, err := initRDMAConnection("192.168.1.10", 8080)
+//	res, err := initRDMAConnection("192.168.1.10", 8080, Options{})
 //	if err != nil {
 //	    log.Fatalf("RDMA connection initialization failed: %v", err)
 //	}
-func initRDMAConnection(ip string, port int) (*RDMAResources, error) {
-	var resources RDMAResources
+func initRDMAConnection(ip string, port int, opts Options) (*RDMAResources, error) {
+	if ip == "" {
+		if opts.BootstrapUnixSocket != "" {
+			opts.logger().Info("server now setting up", "path", opts.BootstrapUnixSocket)
+		} else {
+			opts.logger().Info("server now setting up", "port", port)
+		}
+		l, err := listen(port, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		return l.WaitForClient(opts.AcceptTimeout)
+	}
 
-	serverAddr := C.CString(ip)
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addr, err := resolveHost(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.logger().Info("client now setting up", "server", addr, "port", port)
+	serverAddr := C.CString(addr)
 	defer C.free(unsafe.Pointer(serverAddr))
+	sock, err := C.sock_connect(serverAddr, C.int(port), C.int(timeoutMs(opts.DialTimeout)))
+	if sock == C.SOCK_TIMEOUT {
+		return nil, fmt.Errorf("server %s, port %d: %w", ip, port, ErrDialTimeout)
+	}
+	if sock < 0 {
+		return nil, fmt.Errorf("failed to establish TCP connection to server %s, port %d: %w", ip, port, newConnError("sock_connect", sock, err, opts))
+	}
+	return setupConnection(sock, true, opts, nil)
+}
 
-	if ip != "" {
-		fmt.Println("client now setting up")
-		C.config.server_name = serverAddr
-	} else {
-		fmt.Println("server now setting up")
-		C.config.server_name = nil
+// dialUnix connects a client to the server listening on the unix socket
+// opts.BootstrapUnixSocket and sets up the connection over it.
+func dialUnix(opts Options) (*RDMAResources, error) {
+	opts.logger().Info("client now setting up", "path", opts.BootstrapUnixSocket)
+	path := C.CString(opts.BootstrapUnixSocket)
+	defer C.free(unsafe.Pointer(path))
+	sock, err := C.sock_connect_unix(path, C.int(timeoutMs(opts.DialTimeout)))
+	if sock == C.SOCK_TIMEOUT {
+		return nil, fmt.Errorf("unix socket %s: %w", opts.BootstrapUnixSocket, ErrDialTimeout)
 	}
-	C.config.tcp_port = C.uint32_t(port)
+	if sock < 0 {
+		return nil, fmt.Errorf("failed to connect to server on unix socket %s: %w", opts.BootstrapUnixSocket, newConnError("sock_connect_unix", sock, err, opts))
+	}
+	return setupConnection(sock, true, opts, nil)
+}
 
-	if C.resources_create(&resources.res) != 0 {
-		return nil, fmt.Errorf("failed to create resources")
+// setupConnection creates the RDMA resources on an established bootstrap socket
+// and connects the queue pairs with the peer on the other end of it.
+//
+// `sock` is the connected TCP socket; it is owned by the returned resources, or
+// closed on failure. `client` reports whether this is the client side. `opts` is
+// applied to the resources before they are created. If `srq` is not nil, the
+// connection receives from it and holds a reference to it while it exists.
+func setupConnection(sock C.int, client bool, opts Options, srq *sharedRecvQueue) (*RDMAResources, error) {
+	resources, err := createResources(sock, opts, srq)
+	if err != nil {
+		return nil, err
+	}
+	timeout := opts.AcceptTimeout
+	if client {
+		timeout = opts.DialTimeout
 	}
-	if C.connect_qp(&resources.res) != 0 {
+	if err := connectQP(resources, client, timeout, opts.TLSConfig); err != nil {
 		C.resources_destroy(&resources.res)
-		return nil, fmt.Errorf("failed to connect QPs")
+		e := newConnError("connect_qp", 0, nil, opts)
+		e.Err = err
+		return nil, e
+	}
+	if srq != nil {
+		srq.acquire()
+		resources.srq = srq
+	}
+	resources.role = Server
+	if client {
+		resources.role = Client
+	}
+	resources.markConnected(opts)
+	return resources, nil
+}
+
+// createResources creates the RDMA resources of a connection with the settings in
+// `opts`, without connecting the queue pair. `sock` and `srq` are as for
+// setupConnection; `sock` is -1 for a connection without a bootstrap socket.
+func createResources(sock C.int, opts Options, srq *sharedRecvQueue) (*RDMAResources, error) {
+	var resources RDMAResources
+	release := opts.apply(&resources)
+	defer release()
+	if srq != nil {
+		resources.res.srq = srq.srq
+	}
+	if rc, err := C.resources_create_with_sock(&resources.res, sock); rc != 0 {
+		e := newConnError("resources_create", rc, err, opts)
+		switch rc {
+		case C.ERR_PARTIAL_REGISTRATION:
+			e.Err = ErrPartialRegistration
+		case C.ERR_QUEUE_DEPTH:
+			e.Err = ErrQueueTooDeep
+		case C.ERR_LINK_LAYER:
+			e.Err = ErrLinkLayerMismatch
+		case C.ERR_NO_GID:
+			e.Err = ErrNoGID
+		case C.ERR_OPEN_DEVICE:
+			e.Err = ErrOpenDevice
+		case C.ERR_QUERY_PORT:
+			e.Err = fmt.Errorf("%w %d", ErrQueryPort, int(resources.res.cfg.ib_port))
+		case C.ERR_QUERY_DEVICE:
+			e.Err = ErrQueryDevice
+		case C.ERR_ALLOC_PD:
+			e.Err = ErrAllocPD
+		case C.ERR_CREATE_CQ:
+			e.Err = ErrCreateCQ
+		case C.ERR_ALLOC_BUFFER:
+			e.Err = ErrAllocBuffer
+		case C.ERR_REG_MR:
+			e.Err = fmt.Errorf("%w of %d bytes (device max_mr_size %d)", ErrRegMR,
+				uint64(resources.res.reg_size), uint64(resources.res.device_attr.max_mr_size))
+		case C.ERR_CREATE_QP:
+			e.Err = ErrCreateQP
+		}
+		return nil, e
+	}
+	if opts.UseDeviceMemory && resources.res.dm == nil {
+		opts.logger().Warn("device memory is not available, using host memory", "device", C.GoString(resources.res.cfg.dev_name))
 	}
 	return &resources, nil
 }
 
+// markConnected records that the queue pair of `res`, created with `opts`, is
+// connected and the resources are ready for use.
+func (res *RDMAResources) markConnected(opts Options) {
+	res.state.Store(int32(Connected))
+	res.config = opts.effective(res)
+}
+
+// resolveTimeout bounds how long initRDMAConnection waits for a host name lookup.
+const resolveTimeout = 10 * time.Second
+
+// resolveHost resolves `host` to a literal IP address using net.DefaultResolver.
+//
+// IP literals are validated and returned in their normalized form; see parseIPLiteral.
+// For host names both A and AAAA records are looked up and an IPv4 address is
+// preferred; an IPv6 address is returned only if the name has no IPv4 address. The
+// server listens on both families, so either can be used to reach it.
+//
+// The lookup honors the deadline and cancellation of `ctx`. On failure, the returned
+// error wraps ErrResolve, or ErrInvalidAddress for a malformed IP literal.
+//
+// Example:
+//
+//	ip, err := resolveHost(ctx, "myserver.internal")
+//	if err != nil {
+//	    log.Fatalf("Lookup failed: %v", err)
+//	}
+func resolveHost(ctx context.Context, host string) (string, error) {
+	if isIPLiteral(host) {
+		return parseIPLiteral(host)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %v", ErrResolve, host, err)
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("%w %q: no addresses found", ErrResolve, host)
+	}
+	return preferredAddr(addrs), nil
+}
+
+// preferredAddr returns the first IPv4 address of `addrs`, or the first address if
+// there is none. `addrs` must not be empty.
+func preferredAddr(addrs []net.IPAddr) string {
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP.String()
+		}
+	}
+	return addrs[0].String()
+}
+
+// isIPLiteral reports whether `host` is meant as an IP address rather than a host
+// name: it contains a colon, as IPv6 addresses do, or consists of digits and dots only.
+func isIPLiteral(host string) bool {
+	if strings.Contains(host, ":") {
+		return true
+	}
+	return host != "" && strings.Trim(host, "0123456789.") == ""
+}
+
+// parseIPLiteral validates the IP address `host` with net.ParseIP and returns it in
+// the form expected by getaddrinfo in the C layer.
+//
+// IPv6 addresses may be enclosed in brackets and may carry a zone, as in
+// "[fe80::1%eth0]"; the brackets are removed and the zone is kept, since link-local
+// addresses cannot be reached without it. IPv4-mapped IPv6 addresses are returned
+// as plain IPv4 addresses.
+//
+// On failure, the returned error wraps ErrInvalidAddress.
+//
+// Example:
+//
+//	ip, err := parseIPLiteral("fe80::1%eth0")
+//	// ip == "fe80::1%eth0"
+func parseIPLiteral(host string) (string, error) {
+	addr := host
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[1 : len(addr)-1]
+	}
+	addr, zone, hasZone := strings.Cut(addr, "%")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("%w %q: not an IPv4 or IPv6 address", ErrInvalidAddress, host)
+	}
+	if !hasZone {
+		return ip.String(), nil
+	}
+	if zone == "" || ip.To4() != nil {
+		return "", fmt.Errorf("%w %q: zones are only valid for IPv6 addresses", ErrInvalidAddress, host)
+	}
+	return ip.String() + "%" + zone, nil
+}
+
 // syncData synchronizes data over the socket associated with the provided RDMA resources.
 //
 // `res` is a pointer to RDMAResources which should be previously initialized and represent
 // an established RDMA connection.
 //
-// This function attempts to synchronize data across the connection by sending a single
-// character ('R') and expecting to receive a character back. This ensures both sides of
-// the RDMA connection are ready to proceed with further operations.
+// `token` is the single character sent to the peer. It identifies the synchronization
+// point: syncWrite or syncRead before an operation starts, syncDone once it has finished.
+// The peer must be at the same kind of point, so the token received back is checked
+// against `token`: a start token must be answered with a start token, of either kind
+// since a write on one side may be paired with a read or a write on the other, and
+// syncDone with syncDone. This ensures both sides of the RDMA connection are ready to
+// proceed with further operations and catches peers that have fallen out of step.
+//
+// If the peer has shut the connection down with Close, the character received is the
+// close token; it is acknowledged and ErrPeerClosed is returned. If the peer answers with an unexpected
+// token, an error wrapping ErrProtocolDesync is returned. In both cases the connection
+// is marked Errored. If the synchronization fails otherwise, the function returns an
+// error detailing the issue.
 //
-// If the synchronization fails, the function returns an error detailing the issue.
+// On connections created with Options.ManualSync and on loopback connections it
+// does nothing and returns nil; syncPeer synchronizes regardless.
 //
 // On success, it returns nil, indicating successful synchronization.
 // On failure, it returns an error.
 //
 // Example:
 //
-//	err := syncData(serverRes)
+//	err := syncData(serverRes, syncRead)
 //	if err != nil {
 //	    log.Fatalf("Data synchronization failed: %v", err)
 //	}
-func syncData(res *RDMAResources) error {
+func syncData(res *RDMAResources, token byte) error {
+	if res.loopback || res.manualSync {
+		return nil
+	}
+	return syncPeer(res, token)
+}
+
+// syncPeer is like syncData but synchronizes with the peer also on connections
+// created with Options.ManualSync, for the steps of Sync, Recover and the like
+// that cannot be left out.
+func syncPeer(res *RDMAResources, token byte) error {
+	if res.res.sock < 0 {
+		return fmt.Errorf("%w: connection has no synchronization socket", ErrUnsupported)
+	}
+	res.counters.syncOps.Add(1)
+	local := []byte{token}
 	var tempChar C.char
-	if C.sock_sync_data(res.res.sock, 1, C.CString("R"), &tempChar) != 0 {
-		return fmt.Errorf("sync error")
+	if rc, err := C.sock_sync_data(res.res.sock, 1, (*C.char)(unsafe.Pointer(&local[0])), &tempChar); rc != 0 {
+		res.markErrored()
+		return newSyncError(rc, err)
+	}
+	remote := byte(tempChar)
+	if remote == closeToken {
+		// the peer waits for the acknowledgement before it tears down; failing to
+		// send it only delays the peer until its timeout
+		ack := []byte{closeAck}
+		C.write(res.res.sock, unsafe.Pointer(&ack[0]), 1)
+		res.markErrored()
+		return ErrPeerClosed
+	}
+	if (token == syncDone) != (remote == syncDone) || (remote != syncDone && remote != syncWrite && remote != syncRead) {
+		res.markErrored()
+		return fmt.Errorf("%w: sent %q, received %q", ErrProtocolDesync, token, remote)
 	}
 	return nil
 }
+
+// exchangeValueSize is the size of a message of exchangeValue: the token
+// followed by the value in network byte order.
+const exchangeValueSize = 5
+
+// exchangeValue sends `token` and `value` to the peer over the synchronization
+// socket of `res` and returns the value the peer sent back, which must come
+// with the same token. Both sides must call it at the same point of the
+// protocol. On failure the connection is marked Errored.
+func exchangeValue(res *RDMAResources, token byte, value uint32) (uint32, error) {
+	local := make([]byte, exchangeValueSize)
+	local[0] = token
+	binary.BigEndian.PutUint32(local[1:], value)
+	remote := make([]byte, exchangeValueSize)
+	res.counters.syncOps.Add(1)
+	if rc, err := C.sock_sync_data(res.res.sock, exchangeValueSize, (*C.char)(unsafe.Pointer(&local[0])), (*C.char)(unsafe.Pointer(&remote[0]))); rc != 0 {
+		res.markErrored()
+		return 0, newSyncError(rc, err)
+	}
+	if remote[0] != token {
+		res.markErrored()
+		return 0, fmt.Errorf("%w: sent %q, received %q", ErrProtocolDesync, token, remote[0])
+	}
+	return binary.BigEndian.Uint32(remote[1:]), nil
+}
@@ -0,0 +1,302 @@
+package rdmahandler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The handler types must be declared exactly once in the package and
+// RDMAHandler must keep implementing RDMACommunicator; this fails to compile
+// otherwise.
+var _ RDMACommunicator = (*RDMAHandler)(nil)
+var _ = RDMAHandler{}
+
+// TestDestroyConcurrent destroys the same resources from two goroutines. The
+// resources hold no verbs objects and no socket, so resources_destroy has
+// nothing to release and the test runs without a device; under -race it checks
+// that the state and the teardown are not raced on.
+func TestDestroyConcurrent(t *testing.T) {
+	res := &RDMAResources{}
+	res.res.sock = -1
+	var h RDMAHandler
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = h.Destroy(res)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Destroy %d: %v", i, err)
+		}
+	}
+	if s := res.State(); s != Closed {
+		t.Errorf("state after Destroy is %v, expected %v", s, Closed)
+	}
+	if err := res.begin(); !errors.Is(err, ErrClosed) {
+		if err == nil {
+			res.end()
+		}
+		t.Errorf("operation after Destroy returned %v, expected ErrClosed", err)
+	}
+}
+
+func TestIsIPLiteral(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"10.0.0.5", true},
+		{"::1", true},
+		{"[::1]", true},
+		{"fe80::1%eth0", true},
+		{"[fe80::1%eth0]", true},
+		// malformed, but meant as an address and rejected by parseIPLiteral
+		{"10.0.0", true},
+		{"myserver.internal", false},
+		{"localhost", false},
+		{"10.0.0.5.nip.io", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isIPLiteral(tt.host); got != tt.want {
+			t.Errorf("isIPLiteral(%q) = %v, expected %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestParseIPLiteral(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"10.0.0.5", "10.0.0.5"},
+		{"::1", "::1"},
+		{"[::1]", "::1"},
+		{"fe80:0:0:0:0:0:0:1", "fe80::1"},
+		{"fe80::1%eth0", "fe80::1%eth0"},
+		{"[fe80::1%eth0]", "fe80::1%eth0"},
+		{"::ffff:10.0.0.5", "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		got, err := parseIPLiteral(tt.host)
+		if err != nil || got != tt.want {
+			t.Errorf("parseIPLiteral(%q) = %q, %v, expected %q", tt.host, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseIPLiteralRejects(t *testing.T) {
+	for _, host := range []string{
+		"10.0.0",
+		"10.0.0.256",
+		"::1::2",
+		"[::1",
+		"fe80::1%",
+		"10.0.0.5%eth0",
+		"[10.0.0.5%eth0]",
+	} {
+		if got, err := parseIPLiteral(host); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("parseIPLiteral(%q) returned %q, %v, expected ErrInvalidAddress", host, got, err)
+		}
+	}
+}
+
+// TestResolveHostLiteral checks that IP literals are normalized without a lookup,
+// which a canceled context would make fail.
+func TestResolveHostLiteral(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"10.0.0.5", "10.0.0.5"},
+		{"[::1]", "::1"},
+		{"[fe80::1%eth0]", "fe80::1%eth0"},
+	}
+	for _, tt := range tests {
+		got, err := resolveHost(ctx, tt.host)
+		if err != nil || got != tt.want {
+			t.Errorf("resolveHost(%q) = %q, %v, expected %q", tt.host, got, err, tt.want)
+		}
+	}
+	if _, err := resolveHost(ctx, "10.0.0"); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("resolveHost of a malformed address returned %v, expected ErrInvalidAddress", err)
+	}
+}
+
+func TestPreferredAddr(t *testing.T) {
+	v4 := net.IPAddr{IP: net.ParseIP("10.0.0.5")}
+	v4b := net.IPAddr{IP: net.ParseIP("10.0.0.6")}
+	v6 := net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	v6ll := net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}
+	tests := []struct {
+		name  string
+		addrs []net.IPAddr
+		want  string
+	}{
+		{"IPv4 only", []net.IPAddr{v4, v4b}, "10.0.0.5"},
+		{"IPv4 after IPv6", []net.IPAddr{v6, v4, v4b}, "10.0.0.5"},
+		{"IPv6 only", []net.IPAddr{v6, v6ll}, "2001:db8::1"},
+		{"link-local IPv6 keeps its zone", []net.IPAddr{v6ll, v6}, "fe80::1%eth0"},
+	}
+	for _, tt := range tests {
+		if got := preferredAddr(tt.addrs); got != tt.want {
+			t.Errorf("%s: preferredAddr returned %q, expected %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveHostName(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, "localhost")
+	if err != nil || len(addrs) == 0 {
+		t.Skipf("localhost does not resolve here: %v", err)
+	}
+	got, err := resolveHost(ctx, "localhost")
+	if err != nil {
+		t.Fatalf("resolveHost(localhost): %v", err)
+	}
+	if want := preferredAddr(addrs); got != want {
+		t.Errorf("resolveHost(localhost) = %q, expected %q of %v", got, want, addrs)
+	}
+	if ip := net.ParseIP(got); ip == nil || !ip.IsLoopback() {
+		t.Errorf("resolveHost(localhost) = %q, expected a loopback address", got)
+	}
+}
+
+func TestResolveHostFails(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the .invalid top-level domain never resolves, see RFC 2606
+	if got, err := resolveHost(ctx, "rdmahandler.invalid"); !errors.Is(err, ErrResolve) {
+		t.Errorf("resolveHost of an unresolvable name returned %q, %v, expected ErrResolve", got, err)
+	}
+}
+
+// newSyncPair returns connected resources whose synchronization socket is one end
+// of a socket pair, and the other end, on which the test plays the peer. Replies
+// of the peer are written before the call that reads them, since the socket
+// buffers them.
+func newSyncPair(t *testing.T) (*RDMAResources, int) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	t.Cleanup(func() {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+	})
+	res := &RDMAResources{}
+	setC(&res.res.sock, uint64(fds[0]))
+	res.state.Store(int32(Connected))
+	return res, fds[1]
+}
+
+// peerSend writes `b` to the socket of the peer.
+func peerSend(t *testing.T, fd int, b []byte) {
+	t.Helper()
+	if n, err := syscall.Write(fd, b); n != len(b) || err != nil {
+		t.Fatalf("peer write: %d, %v", n, err)
+	}
+}
+
+// peerRecv reads `n` bytes from the socket of the peer.
+func peerRecv(t *testing.T, fd int, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	for done := 0; done < n; {
+		m, err := syscall.Read(fd, b[done:])
+		if m <= 0 || err != nil {
+			t.Fatalf("peer read after %d of %d bytes: %d, %v", done, n, m, err)
+		}
+		done += m
+	}
+	return b
+}
+
+func TestSyncPeer(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  byte
+		remote byte
+		want   error
+	}{
+		{"write paired with write", syncWrite, syncWrite, nil},
+		{"write paired with read", syncWrite, syncRead, nil},
+		{"done paired with done", syncDone, syncDone, nil},
+		{"write answered with done", syncWrite, syncDone, ErrProtocolDesync},
+		{"done answered with read", syncDone, syncRead, ErrProtocolDesync},
+		{"unknown token", syncRead, 'X', ErrProtocolDesync},
+		{"peer closing", syncWrite, closeToken, ErrPeerClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, peer := newSyncPair(t)
+			peerSend(t, peer, []byte{tt.remote})
+			err := syncPeer(res, tt.token)
+			if !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil) {
+				t.Fatalf("syncPeer returned %v, expected %v", err, tt.want)
+			}
+			if got := peerRecv(t, peer, 1); got[0] != tt.token {
+				t.Errorf("peer received %q, expected %q", got[0], tt.token)
+			}
+			if tt.remote == closeToken {
+				if got := peerRecv(t, peer, 1); got[0] != closeAck {
+					t.Errorf("peer received %q after closing, expected the acknowledgement", got[0])
+				}
+			}
+			want := Connected
+			if tt.want != nil {
+				want = Errored
+			}
+			if s := res.State(); s != want {
+				t.Errorf("state is %v, expected %v", s, want)
+			}
+		})
+	}
+}
+
+func TestSyncPeerConnectionLost(t *testing.T) {
+	res, peer := newSyncPair(t)
+	syscall.Shutdown(peer, syscall.SHUT_WR)
+	if err := syncPeer(res, syncWrite); !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("syncPeer returned %v, expected ErrConnectionLost", err)
+	}
+	if s := res.State(); s != Errored {
+		t.Errorf("state is %v, expected %v", s, Errored)
+	}
+}
+
+func TestExchangeValue(t *testing.T) {
+	res, peer := newSyncPair(t)
+	peerSend(t, peer, []byte{recoverToken, 0x01, 0x02, 0x03, 0x04})
+	got, err := exchangeValue(res, recoverToken, 0xa0b0c0d0)
+	if err != nil || got != 0x01020304 {
+		t.Fatalf("exchangeValue returned %#x, %v, expected 0x1020304", got, err)
+	}
+	if sent := peerRecv(t, peer, exchangeValueSize); string(sent) != string([]byte{recoverToken, 0xa0, 0xb0, 0xc0, 0xd0}) {
+		t.Errorf("peer received %x", sent)
+	}
+
+	// a peer at another step of the protocol
+	peerSend(t, peer, []byte{rotateToken, 0, 0, 0, 1})
+	if got, err := exchangeValue(res, recoverToken, 1); !errors.Is(err, ErrProtocolDesync) {
+		t.Errorf("exchangeValue with a wrong token returned %#x, %v, expected ErrProtocolDesync", got, err)
+	}
+	if s := res.State(); s != Errored {
+		t.Errorf("state is %v, expected %v", s, Errored)
+	}
+}
@@ -0,0 +1,252 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"time"
+	"unsafe"
+)
+
+const (
+	// qpMagic identifies a connection data message ("RDMA"), see CM_MAGIC.
+	qpMagic = 0x52444d41
+	// qpParamsSize is the encoded size of QPParams, matching struct cm_con_data_t.
+	qpParamsSize = 8 + 8 + 4 + 4 + 4 + 4 + 4 + 2 + 16
+	// qpMessageSize is the encoded size of a connection data message, matching
+	// struct cm_con_msg_t: magic, length, parameters and checksum.
+	qpMessageSize = 4 + 4 + qpParamsSize + 4
+)
+
+// encode serializes p with the given byte order, using the field layout of
+// struct cm_con_data_t.
+func (p QPParams) encode(order binary.ByteOrder) []byte {
+	b := make([]byte, qpParamsSize)
+	order.PutUint64(b[0:8], p.Addr)
+	order.PutUint64(b[8:16], p.CtrlAddr)
+	order.PutUint32(b[16:20], p.RKey)
+	order.PutUint32(b[20:24], p.QPN)
+	order.PutUint32(b[24:28], p.CtrlRKey)
+	order.PutUint32(b[28:32], p.PSN)
+	order.PutUint32(b[32:36], p.BufSize)
+	order.PutUint16(b[36:38], p.LID)
+	copy(b[38:54], p.GID[:])
+	return b
+}
+
+// decodeQPParams is the inverse of QPParams.encode.
+func decodeQPParams(b []byte, order binary.ByteOrder) (QPParams, error) {
+	var p QPParams
+	if len(b) != qpParamsSize {
+		return p, fmt.Errorf("%w: %d bytes of connection data, expected %d", ErrBadHandshake, len(b), qpParamsSize)
+	}
+	p.Addr = order.Uint64(b[0:8])
+	p.CtrlAddr = order.Uint64(b[8:16])
+	p.RKey = order.Uint32(b[16:20])
+	p.QPN = order.Uint32(b[20:24])
+	p.CtrlRKey = order.Uint32(b[24:28])
+	p.PSN = order.Uint32(b[28:32])
+	p.BufSize = order.Uint32(b[32:36])
+	p.LID = order.Uint16(b[36:38])
+	copy(p.GID[:], b[38:54])
+	return p, nil
+}
+
+// qpChecksum computes the 32-bit FNV-1a checksum of b, the same as cm_checksum.
+func qpChecksum(b []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(b)
+	return h.Sum32()
+}
+
+// encodeQPMessage frames p for the wire in network byte order with the magic,
+// length and checksum expected by connect_qp on the other side.
+func encodeQPMessage(p QPParams) []byte {
+	data := p.encode(binary.BigEndian)
+	msg := make([]byte, 0, qpMessageSize)
+	msg = binary.BigEndian.AppendUint32(msg, qpMagic)
+	msg = binary.BigEndian.AppendUint32(msg, qpParamsSize)
+	msg = append(msg, data...)
+	msg = binary.BigEndian.AppendUint32(msg, qpChecksum(data))
+	return msg
+}
+
+// decodeQPMessage validates a message produced by encodeQPMessage and returns
+// the parameters it carries. Any mismatch is reported as ErrBadHandshake.
+func decodeQPMessage(msg []byte) (QPParams, error) {
+	if len(msg) != qpMessageSize {
+		return QPParams{}, fmt.Errorf("%w: %d byte message, expected %d", ErrBadHandshake, len(msg), qpMessageSize)
+	}
+	magic := binary.BigEndian.Uint32(msg[0:4])
+	length := binary.BigEndian.Uint32(msg[4:8])
+	if magic != qpMagic || length != qpParamsSize {
+		return QPParams{}, fmt.Errorf("%w: magic 0x%x, length %d", ErrBadHandshake, magic, length)
+	}
+	data := msg[8 : 8+qpParamsSize]
+	if sum := binary.BigEndian.Uint32(msg[8+qpParamsSize:]); sum != qpChecksum(data) {
+		return QPParams{}, fmt.Errorf("%w: checksum mismatch", ErrBadHandshake)
+	}
+	return decodeQPParams(data, binary.BigEndian)
+}
+
+// MarshalBinary encodes p as the framed connection data message of the built-in
+// handshake, with magic, length and checksum, so that it can be shipped to the
+// peer over any channel.
+func (p QPParams) MarshalBinary() ([]byte, error) {
+	return encodeQPMessage(p), nil
+}
+
+// UnmarshalBinary decodes a message produced by MarshalBinary. A truncated or
+// corrupted message is reported as ErrBadHandshake.
+func (p *QPParams) UnmarshalBinary(data []byte) error {
+	q, err := decodeQPMessage(data)
+	if err != nil {
+		return err
+	}
+	*p = q
+	return nil
+}
+
+// qpParamsJSON is the JSON form of QPParams.
+type qpParamsJSON struct {
+	Addr     uint64 `json:"addr"`
+	RKey     uint32 `json:"rkey"`
+	QPN      uint32 `json:"qpn"`
+	PSN      uint32 `json:"psn"`
+	BufSize  uint32 `json:"buf_size"`
+	LID      uint16 `json:"lid"`
+	GID      string `json:"gid"`
+	CtrlAddr uint64 `json:"ctrl_addr"`
+	CtrlRKey uint32 `json:"ctrl_rkey"`
+}
+
+// MarshalJSON encodes p as a JSON object with the GID in the canonical text form
+// of net.IP, which writes a GID derived from an IPv4 address as a dotted quad, e.g.
+//
+//	{"addr":139820881518592,"rkey":4660,"qpn":72,"psn":9531477,"buf_size":4096,"lid":0,
+//	 "gid":"10.0.0.5","ctrl_addr":139820881522688,"ctrl_rkey":4661}
+func (p QPParams) MarshalJSON() ([]byte, error) {
+	return json.Marshal(qpParamsJSON{
+		Addr:     p.Addr,
+		RKey:     p.RKey,
+		QPN:      p.QPN,
+		PSN:      p.PSN,
+		BufSize:  p.BufSize,
+		LID:      p.LID,
+		GID:      net.IP(p.GID[:]).String(),
+		CtrlAddr: p.CtrlAddr,
+		CtrlRKey: p.CtrlRKey,
+	})
+}
+
+// UnmarshalJSON decodes an object produced by MarshalJSON. An empty or missing
+// GID decodes as the zero GID. A malformed GID, or a starting packet sequence
+// number that does not fit in the 24 bits of a PSN, is an error.
+func (p *QPParams) UnmarshalJSON(data []byte) error {
+	var j qpParamsJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.PSN > maxPSN {
+		return fmt.Errorf("invalid starting PSN %d: must be at most %d", j.PSN, maxPSN)
+	}
+	var gid [16]byte
+	if j.GID != "" {
+		ip := net.ParseIP(j.GID)
+		if ip == nil {
+			return fmt.Errorf("invalid GID %q", j.GID)
+		}
+		copy(gid[:], ip.To16())
+	}
+	*p = QPParams{
+		Addr:     j.Addr,
+		RKey:     j.RKey,
+		QPN:      j.QPN,
+		PSN:      j.PSN,
+		BufSize:  j.BufSize,
+		LID:      j.LID,
+		GID:      gid,
+		CtrlAddr: j.CtrlAddr,
+		CtrlRKey: j.CtrlRKey,
+	}
+	return nil
+}
+
+// exchangeQPParams sends the local parameters to the peer over the bootstrap
+// socket of res and returns the peer's parameters.
+func exchangeQPParams(res *RDMAResources, local QPParams) (QPParams, error) {
+	msg := encodeQPMessage(local)
+	remote := make([]byte, qpMessageSize)
+	if rc, err := C.sock_sync_data(res.res.sock, qpMessageSize, (*C.char)(unsafe.Pointer(&msg[0])), (*C.char)(unsafe.Pointer(&remote[0]))); rc != 0 {
+		return QPParams{}, fmt.Errorf("failed to exchange connection data between sides: %w", newSyncError(rc, err))
+	}
+	return decodeQPMessage(remote)
+}
+
+// connectQP is the Go counterpart of connect_qp. It exchanges the queue pair
+// parameters with the peer and drives the local queue pair to RTS.
+//
+// `client` reports whether res is the client side, which posts a receive
+// request before moving to RTR.
+//
+// `timeout` bounds each exchange with the peer, as the timeout_ms argument of
+// connect_qp does; zero waits indefinitely.
+//
+// If `tlsConfig` is not nil, the parameters are exchanged inside a TLS session,
+// see exchangeQPParamsTLS. Otherwise the messages on the wire are identical to
+// those of connect_qp, so either side may use the C implementation.
+func connectQP(res *RDMAResources, client bool, timeout time.Duration, tlsConfig *tls.Config) (err error) {
+	if rc, serr := C.sock_set_timeout(res.res.sock, C.int(timeoutMs(timeout))); rc != 0 {
+		return newRDMAError("sock_set_timeout", rc, serr)
+	}
+	// the synchronizations after the handshake wait for the peer's operations
+	defer func() {
+		if rc, serr := C.sock_set_timeout(res.res.sock, -1); rc != 0 && err == nil {
+			err = newRDMAError("sock_set_timeout", rc, serr)
+		}
+	}()
+	var h RDMAHandler
+	local, err := h.LocalQPParams(res)
+	if err != nil {
+		return err
+	}
+	var remote QPParams
+	if tlsConfig != nil {
+		remote, err = exchangeQPParamsTLS(res, local, tlsConfig, client, timeout)
+	} else {
+		remote, err = exchangeQPParams(res, local)
+	}
+	if err != nil {
+		return err
+	}
+	if err := h.ModifyQPToInit(res); err != nil {
+		return err
+	}
+	// a UD queue pair posts its receives in RecvFrom
+	if client && QPType(res.res.qp.qp_type) != QPTypeUD {
+		if C.post_receive(&res.res) != 0 {
+			return fmt.Errorf("failed to post RR")
+		}
+		res.recvPosted = true
+	}
+	if err := h.ModifyQPToRTR(res, remote); err != nil {
+		return err
+	}
+	if err := h.ModifyQPToRTS(res); err != nil {
+		return err
+	}
+	// just send a dummy char back and forth
+	dummy := []byte{'Q'}
+	var tempChar C.char
+	if rc, err := C.sock_sync_data(res.res.sock, 1, (*C.char)(unsafe.Pointer(&dummy[0])), &tempChar); rc != 0 {
+		return fmt.Errorf("sync error after QPs were moved to RTS: %w", newSyncError(rc, err))
+	}
+	return nil
+}
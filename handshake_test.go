@@ -0,0 +1,183 @@
+package rdmahandler
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testQPParams has every field set to a distinct value, so that swapped or
+// misplaced fields show up in a round trip.
+var testQPParams = QPParams{
+	Addr:     0x00007f2a4c000000,
+	RKey:     0x1234,
+	QPN:      0x48,
+	PSN:      0x917155,
+	BufSize:  4096,
+	LID:      0x0102,
+	GID:      [16]byte{0xfe, 0x80, 12: 0x0a, 0x00, 0x00, 0x05},
+	CtrlAddr: 0x00007f2a4c001000,
+	CtrlRKey: 0x1235,
+}
+
+func TestQPParamsEncodeRoundTrip(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		b := testQPParams.encode(order)
+		if len(b) != qpParamsSize {
+			t.Fatalf("%v: encoded %d bytes, expected %d", order, len(b), qpParamsSize)
+		}
+		p, err := decodeQPParams(b, order)
+		if err != nil {
+			t.Fatalf("%v: decodeQPParams: %v", order, err)
+		}
+		if p != testQPParams {
+			t.Errorf("%v: decoded %+v, expected %+v", order, p, testQPParams)
+		}
+	}
+}
+
+func TestQPParamsEncodeByteOrder(t *testing.T) {
+	big := testQPParams.encode(binary.BigEndian)
+	little := testQPParams.encode(binary.LittleEndian)
+	if got := binary.BigEndian.Uint32(big[16:20]); got != testQPParams.RKey {
+		t.Errorf("big endian rkey %#x, expected %#x", got, testQPParams.RKey)
+	}
+	if got := binary.LittleEndian.Uint32(little[16:20]); got != testQPParams.RKey {
+		t.Errorf("little endian rkey %#x, expected %#x", got, testQPParams.RKey)
+	}
+	// the GID is a byte string and is not swapped
+	if string(big[38:54]) != string(little[38:54]) {
+		t.Errorf("GID differs between byte orders")
+	}
+}
+
+func TestDecodeQPParamsBadLength(t *testing.T) {
+	_, err := decodeQPParams(make([]byte, qpParamsSize-1), binary.BigEndian)
+	if !errors.Is(err, ErrBadHandshake) {
+		t.Errorf("decodeQPParams of a short buffer returned %v, expected ErrBadHandshake", err)
+	}
+}
+
+func TestQPMessageRoundTrip(t *testing.T) {
+	msg := encodeQPMessage(testQPParams)
+	if len(msg) != qpMessageSize {
+		t.Fatalf("encoded %d bytes, expected %d", len(msg), qpMessageSize)
+	}
+	p, err := decodeQPMessage(msg)
+	if err != nil {
+		t.Fatalf("decodeQPMessage: %v", err)
+	}
+	if p != testQPParams {
+		t.Errorf("decoded %+v, expected %+v", p, testQPParams)
+	}
+}
+
+func TestDecodeQPMessageRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		mangle func([]byte) []byte
+	}{
+		{"bad magic", func(m []byte) []byte {
+			binary.BigEndian.PutUint32(m[0:4], qpMagic+1)
+			return m
+		}},
+		{"bad length field", func(m []byte) []byte {
+			binary.BigEndian.PutUint32(m[4:8], qpParamsSize-1)
+			return m
+		}},
+		{"truncated", func(m []byte) []byte {
+			return m[:len(m)-1]
+		}},
+		{"extra bytes", func(m []byte) []byte {
+			return append(m, 0)
+		}},
+		{"bad checksum", func(m []byte) []byte {
+			m[len(m)-1] ^= 0xff
+			return m
+		}},
+		{"corrupted data", func(m []byte) []byte {
+			m[8] ^= 0x01
+			return m
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.mangle(encodeQPMessage(testQPParams))
+			if _, err := decodeQPMessage(msg); !errors.Is(err, ErrBadHandshake) {
+				t.Errorf("decodeQPMessage returned %v, expected ErrBadHandshake", err)
+			}
+		})
+	}
+}
+
+func TestQPParamsJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		gid  [16]byte
+		text string // expected text form of the GID
+	}{
+		{"zero GID", [16]byte{}, "::"},
+		{"IPv4-mapped GID", [16]byte{10: 0xff, 0xff, 10, 0, 0, 5}, "10.0.0.5"},
+		{"full IPv6 GID", [16]byte{0xfe, 0x80, 8: 0x02, 0x11, 0x22, 0xff, 0xfe, 0x33, 0x44, 0x55}, "fe80::211:22ff:fe33:4455"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testQPParams
+			p.GID = tt.gid
+			b, err := json.Marshal(p)
+			if err != nil {
+				t.Fatalf("MarshalJSON: %v", err)
+			}
+			var j struct {
+				GID string `json:"gid"`
+			}
+			if err := json.Unmarshal(b, &j); err != nil {
+				t.Fatalf("decoding %s: %v", b, err)
+			}
+			if j.GID != tt.text {
+				t.Errorf("GID encoded as %q, expected %q", j.GID, tt.text)
+			}
+			var q QPParams
+			if err := json.Unmarshal(b, &q); err != nil {
+				t.Fatalf("UnmarshalJSON(%s): %v", b, err)
+			}
+			if q != p {
+				t.Errorf("decoded %+v, expected %+v", q, p)
+			}
+		})
+	}
+}
+
+func TestQPParamsUnmarshalJSONEmptyGID(t *testing.T) {
+	var p QPParams
+	if err := json.Unmarshal([]byte(`{"qpn":72,"gid":""}`), &p); err != nil {
+		t.Fatalf("UnmarshalJSON: %v", err)
+	}
+	if p.GID != [16]byte{} || p.QPN != 72 {
+		t.Errorf("decoded %+v, expected QPN 72 and the zero GID", p)
+	}
+}
+
+func TestQPParamsUnmarshalJSONRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"PSN above maxPSN", fmt.Sprintf(`{"psn":%d}`, maxPSN+1)},
+		{"malformed GID", `{"gid":"fe80::zz"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p QPParams
+			if err := json.Unmarshal([]byte(tt.data), &p); err == nil {
+				t.Errorf("UnmarshalJSON(%s) succeeded with %+v", tt.data, p)
+			}
+		})
+	}
+	var p QPParams
+	if err := json.Unmarshal([]byte(fmt.Sprintf(`{"psn":%d}`, maxPSN)), &p); err != nil || p.PSN != maxPSN {
+		t.Errorf("UnmarshalJSON of PSN %d returned %+v, %v", maxPSN, p, err)
+	}
+}
@@ -0,0 +1,65 @@
+package rdmahandler
+
+import "sync"
+
+// inflight bounds the number of outstanding RDMA operations across all
+// connections of the process. A limit of 0 means unlimited.
+var inflight = struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int
+	count int
+}{}
+
+func init() {
+	inflight.cond = sync.NewCond(&inflight.mu)
+}
+
+// SetMaxInflight bounds the total number of RDMA operations that may be posted
+// and awaiting completion at the same time, across every connection in the process.
+//
+// `n` is the new limit. A value of 0 or less removes the limit, which is the default.
+//
+// Read, Write and the other data path methods acquire a slot before posting a work
+// request and release it once the completion has been polled, blocking while the limit
+// is reached. Lowering the limit does not affect operations that are already in flight.
+//
+// Example:
+//
+//	rdmahandler.SetMaxInflight(64)
+//	// at most 64 work requests are outstanding on the HCA from now on
+func SetMaxInflight(n int) {
+	inflight.mu.Lock()
+	defer inflight.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	inflight.limit = n
+	inflight.cond.Broadcast()
+}
+
+// Inflight returns the number of RDMA operations currently posted and not yet
+// completed across all connections. It is intended for monitoring.
+func Inflight() int {
+	inflight.mu.Lock()
+	defer inflight.mu.Unlock()
+	return inflight.count
+}
+
+// acquireInflight blocks until an in-flight slot is available and takes it.
+func acquireInflight() {
+	inflight.mu.Lock()
+	for inflight.limit > 0 && inflight.count >= inflight.limit {
+		inflight.cond.Wait()
+	}
+	inflight.count++
+	inflight.mu.Unlock()
+}
+
+// releaseInflight returns a slot taken by acquireInflight.
+func releaseInflight() {
+	inflight.mu.Lock()
+	inflight.count--
+	inflight.mu.Unlock()
+	inflight.cond.Signal()
+}
@@ -0,0 +1,247 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// RDMAListener is the bootstrap socket of an RDMA server. It is created by Listen
+// and hands out connected RDMAResources as clients arrive.
+type RDMAListener struct {
+	fd   C.int
+	port int
+	// path is the AF_UNIX socket listened on if opts.BootstrapUnixSocket is set,
+	// in which case port is not used.
+	path string
+	// opts is applied to every connection handed out by WaitForClient.
+	opts   Options
+	closed atomic.Bool
+	// srq is shared by the connections handed out if opts.UseSRQ is set.
+	srq *sharedRecvQueue
+}
+
+// Listen binds the bootstrap TCP socket of an RDMA server to `port` and starts
+// listening, without waiting for a client.
+//
+// Together with RDMAListener.WaitForClient this splits InitServer in two, so that a
+// server can bound how long it waits for a client. The listener must be closed with
+// Close once no more clients are expected.
+//
+// On success, it returns the listener and nil error. On failure, it returns nil and
+// the error encountered; if the port is taken, the error wraps ErrPortInUse.
+//
+// Example:
+//
+//	l, err := h.Listen(8080)
+//	if err != nil {
+//	    log.Fatalf("Failed to listen: %v", err)
+//	}
+//	defer l.Close()
+//	res, err := l.WaitForClient(30 * time.Second)
+func (h *RDMAHandler) Listen(port int) (*RDMAListener, error) {
+	return listen(port, Options{})
+}
+
+// ListenWithOptions is like Listen but binds the socket to opts.BindAddress, if set,
+// and creates every connection handed out by WaitForClient with the settings in `opts`.
+//
+// If `opts` is invalid, an error is returned before the port is bound.
+//
+// Example:
+//
+//	l, err := h.ListenWithOptions(8080, rdmahandler.Options{BindAddress: "10.0.0.5"})
+//	if err != nil {
+//	    log.Fatalf("Failed to listen: %v", err)
+//	}
+//	defer l.Close()
+func (h *RDMAHandler) ListenWithOptions(port int, opts Options) (*RDMAListener, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return listen(port, opts)
+}
+
+// listen creates the listening socket of an RDMAListener whose connections use `opts`.
+func listen(port int, opts Options) (*RDMAListener, error) {
+	if opts.BootstrapUnixSocket != "" {
+		return listenUnix(opts)
+	}
+	var bindAddr *C.char
+	if opts.BindAddress != "" {
+		addr, err := parseIPLiteral(opts.BindAddress)
+		if err != nil {
+			return nil, err
+		}
+		bindAddr = C.CString(addr)
+		defer C.free(unsafe.Pointer(bindAddr))
+	}
+	var reuseAddr C.int
+	if opts.ReuseAddr {
+		reuseAddr = 1
+	}
+	fd, err := C.sock_listen(bindAddr, C.int(port), reuseAddr)
+	if fd < 0 {
+		e := newConnError("sock_listen", fd, err, opts)
+		if fd == C.SOCK_IN_USE {
+			e.Err = ErrPortInUse
+		}
+		if opts.BindAddress != "" {
+			return nil, fmt.Errorf("failed to listen on %s, port %d: %w", opts.BindAddress, port, e)
+		}
+		return nil, fmt.Errorf("failed to listen on port %d: %w", port, e)
+	}
+	return newListener(&RDMAListener{fd: fd, port: port, opts: opts})
+}
+
+// listenUnix creates the listening AF_UNIX socket of an RDMAListener at
+// opts.BootstrapUnixSocket.
+func listenUnix(opts Options) (*RDMAListener, error) {
+	path := C.CString(opts.BootstrapUnixSocket)
+	defer C.free(unsafe.Pointer(path))
+	fd, err := C.sock_listen_unix(path)
+	if fd < 0 {
+		e := newConnError("sock_listen_unix", fd, err, opts)
+		if fd == C.SOCK_IN_USE {
+			e.Err = ErrPortInUse
+		}
+		return nil, fmt.Errorf("failed to listen on unix socket %s: %w", opts.BootstrapUnixSocket, e)
+	}
+	return newListener(&RDMAListener{fd: fd, path: opts.BootstrapUnixSocket, opts: opts})
+}
+
+// newListener completes the listener `l` on its listening socket, creating the
+// shared receive queue if its options ask for one. The socket is closed on failure.
+func newListener(l *RDMAListener) (*RDMAListener, error) {
+	if l.opts.UseSRQ {
+		var err error
+		if l.srq, err = newSharedRecvQueue(l.opts); err != nil {
+			l.closeSocket()
+			return nil, fmt.Errorf("failed to create shared receive queue for %s: %w", l.where(), err)
+		}
+	}
+	return l, nil
+}
+
+// where describes the socket l listens on for messages, e.g. "port 8080" or
+// "unix socket /run/rdma.sock".
+func (l *RDMAListener) where() string {
+	if l.path != "" {
+		return "unix socket " + l.path
+	}
+	return fmt.Sprintf("port %d", l.port)
+}
+
+// closeSocket closes the listening socket and removes the socket file of a unix
+// socket listener.
+func (l *RDMAListener) closeSocket() error {
+	rc := C.close(l.fd)
+	if l.path != "" {
+		os.Remove(l.path)
+	}
+	if rc != 0 {
+		return fmt.Errorf("failed to close listener on %s", l.where())
+	}
+	return nil
+}
+
+// WaitForClient waits for a client to connect to the listener, then creates the
+// RDMA resources and completes the queue pair handshake with it.
+//
+// `timeout` bounds the wait for the client's TCP connection. Zero or a negative value
+// waits forever. If no client arrives in time, ErrAcceptTimeout is returned and the
+// listener can be used for another attempt.
+//
+// On success, it returns the connected RDMAResources and nil error.
+// On failure, it returns nil and the error encountered.
+//
+// Example:
+//
+//	res, err := l.WaitForClient(30 * time.Second)
+//	if errors.Is(err, rdmahandler.ErrAcceptTimeout) {
+//	    log.Println("no client showed up")
+//	}
+func (l *RDMAListener) WaitForClient(timeout time.Duration) (*RDMAResources, error) {
+	if l.path != "" {
+		l.opts.logger().Info("waiting for unix socket connection", "path", l.path)
+	} else {
+		l.opts.logger().Info("waiting for TCP connection", "port", l.port)
+	}
+	sock, err := C.sock_accept(l.fd, C.int(timeoutMs(timeout)), C.int(l.opts.gidIndex()))
+	if sock == C.SOCK_TIMEOUT {
+		return nil, ErrAcceptTimeout
+	}
+	if sock < 0 {
+		if l.closed.Load() {
+			return nil, ErrClosed
+		}
+		return nil, fmt.Errorf("failed to establish connection with client on %s: %w", l.where(), newConnError("sock_accept", sock, err, l.opts))
+	}
+	return setupConnection(sock, false, l.opts, l.srq)
+}
+
+// NewListener is the same as Listen. It is the counterpart of Accept for servers
+// that handle many clients.
+func (h *RDMAHandler) NewListener(port int) (*RDMAListener, error) {
+	return h.Listen(port)
+}
+
+// Accept waits for the next client of `l` and returns a connection to it with its
+// own queue pair, memory regions and synchronization socket, like
+// RDMAListener.WaitForClient with the listener's Options.AcceptTimeout.
+//
+// A server calls Accept in a loop to serve any number of clients over a single
+// listening socket. Connections are independent of each other and of the listener,
+// so each can be served in its own goroutine, and Accept can be called again while
+// earlier connections are in use. Closing the listener makes a pending Accept
+// return ErrClosed.
+//
+// On success, it returns the connected RDMAResources and nil error.
+// On failure, it returns nil and the error encountered.
+//
+// Example:
+//
+//	l, err := h.NewListener(8080)
+//	if err != nil {
+//	    log.Fatalf("Failed to listen: %v", err)
+//	}
+//	defer l.Close()
+//	for {
+//	    res, err := h.Accept(l)
+//	    if errors.Is(err, rdmahandler.ErrClosed) {
+//	        return
+//	    }
+//	    if err != nil {
+//	        log.Printf("accept: %v", err)
+//	        continue
+//	    }
+//	    go serve(res)
+//	}
+func (h *RDMAHandler) Accept(l *RDMAListener) (*RDMAResources, error) {
+	return l.WaitForClient(l.opts.AcceptTimeout)
+}
+
+// Close closes the listening socket and interrupts pending calls to WaitForClient
+// and Accept, which return ErrClosed. Connections already handed out are not
+// affected; with Options.UseSRQ the shared receive queue is released once the
+// last of them is destroyed.
+func (l *RDMAListener) Close() error {
+	if !l.closed.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+	// shutting the socket down wakes up a sock_accept blocked in poll
+	C.shutdown(l.fd, C.SHUT_RDWR)
+	if err := l.closeSocket(); err != nil {
+		return err
+	}
+	if l.srq != nil {
+		return l.srq.release()
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package rdmahandler
+
+import "fmt"
+
+// InitLoopback creates RDMA resources whose queue pair is connected to itself, so
+// that the whole stack, from device and memory registration through the queue pair
+// transitions to work completions, can be exercised in a single process on a
+// machine with an RDMA device but no peer, for example in CI.
+//
+// `opts` holds the connection settings as for CreateResources; Options.DialTimeout,
+// AcceptTimeout, BindAddress, BootstrapUnixSocket and TLSConfig are not used.
+//
+// The peer of the connection is the connection itself: Write places the payload in
+// the data buffer through an RDMA write to the buffer's own address, and a following
+// Read fetches it back with an RDMA read, so the two round-trip locally. There is no
+// synchronization socket; the synchronized operations such as Read, Write and
+// ReadNamed skip the synchronization, since both sides are always in step, while
+// WriteAll, ReadAll, Close's notification and the other operations that exchange
+// data over the socket are not available. Send and Recv need a receive posted
+// before the send, so they are used as PostRecv, PostSend and WaitRecv.
+//
+// On success, it returns the connected RDMAResources and nil error. On failure, it
+// returns nil and the error encountered.
+//
+// Example:
+//
+//	res, err := h.InitLoopback(rdmahandler.Options{BufferSize: 4096})
+//	if err != nil {
+//	    t.Skipf("no RDMA device: %v", err)
+//	}
+//	defer h.Destroy(res)
+//	if err := h.Write(res, "ping", "loopback"); err != nil {
+//	    t.Fatal(err)
+//	}
+//	if got, err := h.Read(res, "loopback"); err != nil || got != "ping" {
+//	    t.Fatalf("Read = %q, %v", got, err)
+//	}
+func (h *RDMAHandler) InitLoopback(opts Options) (*RDMAResources, error) {
+	res, local, err := h.CreateResources(opts)
+	if err != nil {
+		return nil, err
+	}
+	res.loopback = true
+	if err := h.ConnectResources(res, local); err != nil {
+		h.Destroy(res)
+		return nil, fmt.Errorf("failed to connect queue pair to itself: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,181 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// MemoryRegion is caller-owned memory registered on a connection with
+// RegisterMemory. It can be used as the local side of WriteFromMR and ReadToMR
+// without copying through the connection's data buffer.
+type MemoryRegion struct {
+	res  *RDMAResources
+	mr   *C.struct_ibv_mr
+	size int
+}
+
+// RegisterMemory registers `length` bytes of memory starting at `ptr` with the
+// device, so that the device can access it directly. The region gets the access
+// flags of the data buffer of `res`, see Options.AccessFlags.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// The memory remains owned by the caller and must stay valid, and at the same
+// address, until the region is deregistered with Deregister or the connection is
+// destroyed. Since the device accesses the memory outside the Go runtime's knowledge,
+// it should be allocated outside the Go heap, for example with C.malloc or
+// syscall.Mmap. Go memory must at least be pinned with runtime.Pinner for the whole
+// lifetime of the registration and kept reachable.
+//
+// If the device registers less than `length` bytes, ErrPartialRegistration is returned.
+//
+// On success, it returns the registered region and nil error. On failure, it returns
+// nil and the error encountered.
+//
+// Example:
+//
+//	ptr := C.malloc(1 << 20)
+//	mr, err := h.RegisterMemory(res, ptr, 1<<20)
+//	if err != nil {
+//	    log.Fatalf("Failed to register memory: %v", err)
+//	}
+//	defer mr.Deregister()
+func (h *RDMAHandler) RegisterMemory(res *RDMAResources, ptr unsafe.Pointer, length int) (*MemoryRegion, error) {
+	if err := res.begin(); err != nil {
+		return nil, err
+	}
+	defer res.end()
+	if ptr == nil || length <= 0 {
+		return nil, fmt.Errorf("invalid memory %p of %d bytes", ptr, length)
+	}
+	mr, err := C.register_memory(&res.res, ptr, C.size_t(length))
+	if mr == nil {
+		return nil, newRDMAError("register_memory", 0, err)
+	}
+	if int(mr.length) != length {
+		C.deregister_memory(mr)
+		return nil, fmt.Errorf("failed to register memory: %w", ErrPartialRegistration)
+	}
+	m := &MemoryRegion{res: res, mr: mr, size: length}
+	if res.regions == nil {
+		res.regions = make(map[*MemoryRegion]struct{})
+	}
+	res.regions[m] = struct{}{}
+	return m, nil
+}
+
+// Len returns the size of the region in bytes.
+func (m *MemoryRegion) Len() int {
+	return m.size
+}
+
+// Deregister deregisters the region from the device. The memory itself is not
+// freed. Deregistering a region twice, or after its connection was destroyed,
+// does nothing.
+func (m *MemoryRegion) Deregister() error {
+	m.res.mu.Lock()
+	defer m.res.mu.Unlock()
+	return m.release()
+}
+
+// release implements Deregister. The caller must hold m.res.mu.
+func (m *MemoryRegion) release() error {
+	if m.mr == nil {
+		return nil
+	}
+	delete(m.res.regions, m)
+	rc, err := C.deregister_memory(m.mr)
+	m.mr = nil
+	if rc != 0 {
+		return newRDMAError("deregister_memory", rc, err)
+	}
+	return nil
+}
+
+// releaseRegions deregisters all regions of res registered with RegisterMemory.
+// It must run before resources_destroy releases the protection domain.
+func releaseRegions(res *RDMAResources) error {
+	var firstErr error
+	for m := range res.regions {
+		if err := m.release(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// WriteFromMR writes the first `length` bytes of the registered region `mr` into the
+// peer's data buffer with an RDMA write, without staging them in the local data buffer.
+//
+// `mr` must have been registered on `res`, and `length` must fit in both `mr` and the
+// data buffer. The bytes are transferred as they are; unlike WriteBytes no length is
+// sent along, so the peers must agree on it. As with Write, the transfer is
+// synchronized with the peer before and after.
+//
+// Example:
+//
+//	if err := h.WriteFromMR(clientRes, mr, 4096, "client"); err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) WriteFromMR(res *RDMAResources, mr *MemoryRegion, length int, character string) error {
+	return transferMR(res, mr, length, C.IBV_WR_RDMA_WRITE, character)
+}
+
+// ReadToMR reads `length` bytes from the start of the peer's data buffer into the
+// registered region `mr` with an RDMA read. The requirements are those of WriteFromMR.
+//
+// Example:
+//
+//	if err := h.ReadToMR(serverRes, mr, 4096, "server"); err != nil {
+//	    log.Fatalf("RDMA read failed: %v", err)
+//	}
+func (h *RDMAHandler) ReadToMR(res *RDMAResources, mr *MemoryRegion, length int, character string) error {
+	return transferMR(res, mr, length, C.IBV_WR_RDMA_READ, character)
+}
+
+// transferMR implements WriteFromMR and ReadToMR.
+func transferMR(res *RDMAResources, mr *MemoryRegion, length int, opcode C.int, character string) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if opcode == C.IBV_WR_RDMA_READ {
+		if err := requireRC(res, character); err != nil {
+			return err
+		}
+	}
+	if mr.res != res || mr.mr == nil {
+		return fmt.Errorf("%s: memory region not registered on this connection", character)
+	}
+	if limit := res.bufferLimit(); length <= 0 || length > mr.size || length > limit {
+		return fmt.Errorf("%s: invalid length %d for a %d-byte region and a %d-byte buffer", character, length, mr.size, limit)
+	}
+	token := byte(syncWrite)
+	if opcode == C.IBV_WR_RDMA_READ {
+		token = syncRead
+	}
+	if err := syncData(res, token); err != nil {
+		return err
+	}
+	acquireInflight()
+	if rc, err := C.post_send_region(&res.res, opcode, mr.mr, C.uint32_t(length), res.res.remote_props.addr, res.res.remote_props.rkey); rc != 0 {
+		releaseInflight()
+		return fmt.Errorf("%s: %w", character, res.opError("post_send_region", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return fmt.Errorf("%s: %w", character, res.opError("poll_completion", rc, err))
+	}
+	if opcode == C.IBV_WR_RDMA_READ {
+		res.countRead(length)
+	} else {
+		res.countWrite(length)
+	}
+	return syncData(res, syncDone)
+}
@@ -0,0 +1,110 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// WriteAt writes `data` into the peer's data buffer at byte `offset` with a one-sided
+// RDMA write, using the peer's buffer as a remote byte array.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// `offset` plus the length of `data` must lie within the peer's data buffer, which is
+// assumed to have the same size as the local one. The bytes are staged at the same
+// offset of the local data buffer. As with CompareAndSwap, the peer is not involved and
+// no synchronization takes place, so the peers must coordinate access to the region
+// themselves; no length header is written.
+//
+// On success, it returns nil. On failure, it returns an error detailing the issue
+// encountered.
+//
+// Example:
+//
+//	if err := h.WriteAt(clientRes, []byte("record"), 4096); err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) WriteAt(res *RDMAResources, data []byte, offset uint64) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if err := checkRange(res, "write at", offset, len(data)); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Add(unsafe.Pointer(res.res.buf), offset)), len(data)), data)
+	res.syncDeviceMemory(int(offset), len(data), true)
+	if err := transferAt(res, "write at", C.IBV_WR_RDMA_WRITE, offset, len(data)); err != nil {
+		return err
+	}
+	res.countWrite(len(data))
+	return nil
+}
+
+// ReadAt reads len(dst) bytes from the peer's data buffer at byte `offset` into `dst`
+// with a one-sided RDMA read. The requirements are those of WriteAt, and the
+// connection must use a Reliable Connected queue pair.
+//
+// On success, it returns the number of bytes read, len(dst), and nil error. On
+// failure, it returns 0 and the error encountered.
+//
+// Example:
+//
+//	dst := make([]byte, 6)
+//	if _, err := h.ReadAt(serverRes, dst, 4096); err != nil {
+//	    log.Fatalf("RDMA read failed: %v", err)
+//	}
+func (h *RDMAHandler) ReadAt(res *RDMAResources, dst []byte, offset uint64) (int, error) {
+	if err := res.begin(); err != nil {
+		return 0, err
+	}
+	defer res.end()
+	if err := requireRC(res, "read at"); err != nil {
+		return 0, err
+	}
+	if err := checkRange(res, "read at", offset, len(dst)); err != nil {
+		return 0, err
+	}
+	if len(dst) == 0 {
+		return 0, nil
+	}
+	if err := transferAt(res, "read at", C.IBV_WR_RDMA_READ, offset, len(dst)); err != nil {
+		return 0, err
+	}
+	n := copy(dst, unsafe.Slice((*byte)(unsafe.Add(unsafe.Pointer(res.res.buf), offset)), len(dst)))
+	res.countRead(n)
+	return n, nil
+}
+
+// checkRange verifies that `length` bytes at `offset` lie within the data buffers
+// of both sides.
+func checkRange(res *RDMAResources, op string, offset uint64, length int) error {
+	if size := uint64(res.bufferLimit()); offset > size || uint64(length) > size-offset {
+		return fmt.Errorf("%s: %d bytes at offset %d outside the %d-byte buffer", op, length, offset, size)
+	}
+	return nil
+}
+
+// transferAt posts an RDMA read or write of `length` bytes at `offset` and waits for
+// its completion.
+func transferAt(res *RDMAResources, op string, opcode C.int, offset uint64, length int) error {
+	acquireInflight()
+	if rc, err := C.post_send_offset(&res.res, opcode, C.uint64_t(offset), C.uint32_t(length)); rc != 0 {
+		releaseInflight()
+		return fmt.Errorf("%s: %w", op, res.opError("post_send_offset", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return fmt.Errorf("%s: %w", op, res.opError("poll_completion", rc, err))
+	}
+	return nil
+}
@@ -0,0 +1,616 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"time"
+	"unsafe"
+)
+
+// Options holds per-connection settings for InitServerWithOptions and
+// InitClientWithOptions. The zero value selects the defaults used by InitServer
+// and InitClient.
+//
+// Every connection keeps its own copy of the settings, so connections with
+// different Options can be set up concurrently, including a server and a client
+// of the same process talking to each other over the loopback interface.
+type Options struct {
+	// BufferSize is the size in bytes of the registered data buffer. It must be
+	// a power of two of at least 8; zero selects the default size used by the C
+	// layer. The peers may use different sizes: the smaller one, reported by
+	// RDMAResources.MaxMessageSize less the 4-byte length header, bounds the
+	// payloads of Write, WriteBytes and the other operations in both directions.
+	BufferSize int
+
+	// DeviceName selects the RDMA device (HCA) by name, as returned by
+	// ListDevices. An empty name selects the first device found.
+	DeviceName string
+
+	// IBPort is the physical port of the device to use. Zero selects port 1.
+	IBPort int
+
+	// UseGID enables addressing the peer by GID, as required for RoCE and for
+	// traffic across subnets, using the entry GIDIndex of the port's GID table.
+	// GIDIndex is ignored unless UseGID is set. On a RoCE port without UseGID, a
+	// RoCEv2 GID is chosen automatically, preferring one derived from an IPv4
+	// address, then a global IPv6 one, over a link-local one; creating the
+	// connection fails with ErrNoGID if there is none.
+	UseGID   bool
+	GIDIndex int
+
+	// LinkLayer requires the port to have the given link layer, so that a
+	// connection meant for InfiniBand is not silently set up on a RoCE port or
+	// vice versa; on a mismatch creating the connection fails with
+	// ErrLinkLayerMismatch. The zero value, LinkLayerAny, accepts either.
+	LinkLayer LinkLayer
+
+	// SendQueueDepth is the number of work requests the send queue can hold, which
+	// bounds the number of payloads PostWrites can keep in flight. RecvQueueDepth
+	// is the number of receive work requests the queue pair can hold, which bounds
+	// the receives PostRecv can keep outstanding. The completion queue is sized
+	// from both, so that every outstanding work request has room for its
+	// completion. Neither may exceed the device's max_qp_wr, nor the completion
+	// queue its max_cqe, otherwise creating the connection fails with
+	// ErrQueueTooDeep; zero selects the default of 10.
+	SendQueueDepth int
+	RecvQueueDepth int
+
+	// MaxInlineData is the largest payload, in bytes, that sends and RDMA writes
+	// carry inline in the work request instead of having the adapter read it from
+	// the registered buffer, which lowers the latency of small messages. Writes are
+	// inlined automatically when their payload, including the length header, fits.
+	// The device may round the value up; if it cannot support it, creating the
+	// queue pair fails. Zero disables inline data.
+	MaxInlineData int
+
+	// UseNUMANode allocates the connection's data buffer from the memory of
+	// NUMA node NUMANode, which should be the node the adapter is attached to,
+	// as reported by /sys/class/infiniband/<device>/device/numa_node. NUMANode is
+	// ignored unless UseNUMANode is set; without it the buffer is allocated
+	// wherever the allocator places it, usually on the node of the thread that
+	// happens to create the connection.
+	//
+	// On machines with several sockets, an adapter that reaches its buffer
+	// through the inter-socket link loses a noticeable share of its bandwidth,
+	// often tens of percent for large transfers, and every access pays the
+	// extra hop in latency. Binding the buffer to the adapter's node removes
+	// that penalty; on single-socket machines it makes no difference. Creating
+	// the connection fails if the node does not exist. Named buffers, regions
+	// and the shared receive queue are not affected.
+	UseNUMANode bool
+	NUMANode    int
+
+	// UseDeviceMemory places the memory the peer reads and writes in the
+	// adapter's on-chip device memory, allocated with ibv_alloc_dm, instead of
+	// host memory. RDMA operations targeting it then complete without a trip
+	// across PCIe to host memory, which lowers their latency; it pays off for
+	// small, latency-bound transfers and atomics. The local data buffer stays in
+	// host memory for staging and decoding and is copied to and from the device
+	// memory as needed.
+	//
+	// Device memory is scarce, typically a few hundred kilobytes per adapter, so
+	// BufferSize should be small. If the device has none, not enough, or the
+	// provider does not support it, the connection falls back to host memory and
+	// logs a warning; Config reports whether device memory is used, and
+	// Capabilities.MaxDeviceMemory how much the device offers.
+	UseDeviceMemory bool
+
+	// AccessFlags restricts what the peer may do with the connection's data
+	// buffer, e.g. AccessRemoteRead alone for a server whose clients only read.
+	// AccessLocalWrite is always added, since receives and RDMA reads land in the
+	// buffer. Zero allows remote reads and writes, and atomics if the device
+	// supports them.
+	//
+	// An operation the peer's buffer does not permit fails on the initiating
+	// side with an RDMAError wrapping WCRemAccessErr, and the connection becomes
+	// Errored; the peer's data is not touched.
+	AccessFlags AccessFlags
+
+	// PathMTU is the path MTU in bytes requested for the queue pair: 256, 512,
+	// 1024, 2048 or 4096. If it exceeds the active MTU of the port, the active MTU
+	// is used instead; RDMAResources.PathMTU reports the value chosen. Zero
+	// selects 256.
+	PathMTU int
+
+	// QPTimeout, RetryCount and RNRRetry tune how the queue pair recovers from
+	// lost packets and from a peer that has no receive request posted. They are
+	// applied when the queue pair moves to RTS and are ignored for UC queue pairs.
+	//
+	// QPTimeout is the exponent of the local ACK timeout: the queue pair waits
+	// 4.096µs * 2^QPTimeout for an acknowledgement before it retransmits, so 14 is
+	// about 67ms and 18 about 1s. It must be at most 31; zero selects the
+	// default of 18, so the infinite timeout the verbs assign to 0 cannot be chosen.
+	//
+	// RetryCount is the number of retransmissions before an operation fails with a
+	// retry exceeded error. It must be at most 7; zero selects the default of 6.
+	//
+	// RNRRetry is the number of retries after a receiver-not-ready NAK. It must be
+	// at most 7, where 7 retries indefinitely. Zero, the default, does not retry.
+	QPTimeout  uint8
+	RetryCount uint8
+	RNRRetry   uint8
+
+	// InitialPSN is the starting packet sequence number of the queue pair's send
+	// queue. It is sent to the peer in QPParams.PSN during the handshake, and the
+	// peer's queue pair expects its first incoming packet to carry it. A PSN has
+	// 24 bits, so it must be below 1<<24. Zero picks a random PSN for every
+	// connection, which keeps packets of an earlier connection on the same queue
+	// pair numbers from being taken for current ones.
+	//
+	// The built-in handshake always delivers the right value. Parameters
+	// exchanged out of band with CreateResources and ConnectResources must carry
+	// it as well: if the PSN a queue pair expects differs from the one the peer
+	// sends with, its packets are silently dropped as out of sequence or as
+	// duplicates. On an RC queue pair the sender retransmits until RetryCount is
+	// exhausted and the operation fails with WCRetryExcErr; on a UC queue pair the
+	// writes are lost without an error.
+	InitialPSN uint32
+
+	// QPType selects the transport of the queue pair. Zero selects QPTypeRC.
+	QPType QPType
+
+	// CompletionMode selects how operations wait for their completion. The
+	// default is PollMode.
+	CompletionMode CompletionMode
+
+	// SeparateCQs creates one completion queue for the send queue and another
+	// for the receive queue instead of a single one shared by both. Send and
+	// receive completions then no longer contend for the same queue inside the
+	// driver, and waiting for one kind never has to get past the other, which
+	// helps servers that mix Send or PostSend traffic with RDMA reads and writes
+	// at high rates. With EventMode both queues signal the same completion
+	// channel.
+	SeparateCQs bool
+
+	// PollBatchSize is the number of completions retrieved per ibv_poll_cq call
+	// while the connection waits for its operations, between 1 and 64. Larger
+	// batches save polling calls when several completions arrive close
+	// together, as with PostSend, PostRecv or SeparateCQs under load. The
+	// completions of other operations in a batch are kept for the operations
+	// that wait for them. Zero uses the process-wide default, which is 1 unless
+	// changed with SetPollBatch.
+	PollBatchSize int
+
+	// ManualSync turns off the synchronization with the peer that Read, Write
+	// and the other one-sided and two-sided operations perform over the
+	// bootstrap socket before and after every transfer, which costs two TCP
+	// round trips per operation. The application then decides when the sides
+	// synchronize by calling Sync. Both sides must set it. By default the
+	// built-in synchronization is on.
+	//
+	// Without the built-in synchronization nothing keeps the sides in step: a
+	// Write may overwrite data the peer has not read yet, a Read may return the
+	// data of an earlier write or a partially written one, and a Send may reach
+	// the peer before it posted a receive, which then depends on RNRRetry. A
+	// Close by the peer is only noticed by the next Sync. Protocols must
+	// therefore order their transfers themselves, for example with a Sync
+	// after each batch of writes and before the peer reads it.
+	ManualSync bool
+
+	// PollTimeout bounds how long an operation waits for the completion of a
+	// work request it posted. If the completion does not arrive in time, the
+	// operation fails with an error wrapping ErrPollTimeout. Zero uses the
+	// default of two seconds.
+	PollTimeout time.Duration
+
+	// DialTimeout bounds how long a client waits for the TCP connection to the
+	// server and then for each exchange of the queue pair handshake. If the
+	// server does not answer in time, ErrDialTimeout or an RDMAError is returned.
+	// Zero waits indefinitely.
+	DialTimeout time.Duration
+
+	// ConnWindow is the number of bytes an RDMAConn over the connection buffers
+	// before its Write sends them to the peer. Small writes, such as those of
+	// io.Copy or a bufio.Writer, are collected and sent with one WriteAll once
+	// the window is full, by Flush or by Close; Write blocks while the buffered
+	// data is sent and read by the peer, which bounds the data in flight to the
+	// window. Zero sends every Write at once.
+	ConnWindow int
+
+	// Logger receives the informational messages of connection setup, such as
+	// "client now setting up". A nil Logger discards them. The C layer writes
+	// nothing to standard output: it reports failures on standard error, and its
+	// own setup messages only when built with RDMA_VERBOSE defined, for example
+	// with CGO_CFLAGS=-DRDMA_VERBOSE.
+	Logger *slog.Logger
+
+	// BindAddress is the IP address of the local interface a server listens on
+	// for the bootstrap TCP connection, so that on a multi-homed host clients are
+	// only accepted on that network. Empty listens on all interfaces. It is not
+	// used by clients.
+	BindAddress string
+
+	// ReuseAddr sets SO_REUSEADDR on the server's bootstrap socket, so that the
+	// port can be bound again right after a previous listener was closed, while
+	// its connections are still in TIME_WAIT. It is not used by clients.
+	ReuseAddr bool
+
+	// BootstrapUnixSocket, if set, is the path of an AF_UNIX socket over which
+	// the queue pair handshake and the later synchronization run instead of a
+	// TCP connection, for peers on the same host. The server creates the socket
+	// and listens on it, replacing a socket file left behind by a listener that
+	// is gone, and removes it when the listener is closed; the client connects
+	// to it. The port, the server address and BindAddress are then not used.
+	// The path must be shorter than 108 bytes.
+	BootstrapUnixSocket string
+
+	// TLSConfig, if set, protects the exchange of the queue pair parameters at
+	// connection setup with TLS, so that on an untrusted network the peer is
+	// authenticated and the remote keys and buffer addresses can neither be read
+	// nor tampered with. Servers need a certificate in it, and clients the
+	// ServerName or RootCAs to verify it with. Both peers must set it. The TLS
+	// session ends with the handshake: the later synchronization over the
+	// bootstrap socket, the key exchanges of AddRegion, RegisterNamedBuffer and
+	// RotateKey, and the RDMA data path are not protected.
+	TLSConfig *tls.Config
+
+	// UseSRQ makes the connections accepted by a listener share one receive
+	// queue (an ibv_srq) instead of each pre-posting receives on its own queue
+	// pair, which saves memory when serving many clients. The connections then
+	// use the listener's device context and protection domain, and Recv takes
+	// messages from 256 shared receive slots of BufferSize bytes. Since any
+	// connection may fill all of the slots, each connection's completion queue
+	// has room for 256 receive completions instead of RecvQueueDepth. The queue
+	// is released when the listener and all its connections are closed. It
+	// cannot be combined with QPTypeUD and is not used by clients.
+	UseSRQ bool
+
+	// AcceptTimeout bounds how long a server waits for a client to connect and
+	// then for each exchange of the queue pair handshake. If no client arrives
+	// in time, ErrAcceptTimeout is returned. Zero waits indefinitely.
+	AcceptTimeout time.Duration
+}
+
+// CompletionMode selects how a connection waits for work completions.
+type CompletionMode int
+
+const (
+	// PollMode busy-polls the completion queue. It has the lowest latency but
+	// keeps a CPU core busy while waiting.
+	PollMode CompletionMode = iota
+	// EventMode sleeps on a completion channel until the device signals a
+	// completion, which frees the CPU during idle waits at the cost of an
+	// interrupt and a system call per completion.
+	EventMode
+	// YieldMode busy-polls like PollMode but returns from C after every
+	// yieldPollSpins empty polls and calls runtime.Gosched before polling
+	// again, so that a wait does not monopolize its thread and other
+	// goroutines keep running when GOMAXPROCS is small or many connections
+	// wait at once. It adds a little latency to completions that arrive
+	// while other goroutines run.
+	YieldMode
+)
+
+// yieldPollSpins is the number of empty completion queue polls between two
+// yields to the Go scheduler in YieldMode.
+const yieldPollSpins = 64
+
+// Bounds of Options.BufferSize. The smallest buffer must hold the payload length
+// header; the largest keeps the size within a scatter/gather entry and an int on
+// every platform.
+const (
+	minBufferSize = 8
+	maxBufferSize = 1 << 30
+)
+
+// maxQueueDepth bounds Options.SendQueueDepth and Options.RecvQueueDepth. Devices
+// typically support fewer work requests per queue; the actual limit is checked
+// against max_qp_wr when the connection is created.
+const maxQueueDepth = 1 << 16
+
+// maxInlineData bounds Options.MaxInlineData. Devices support at most about a
+// kilobyte; the actual limit is enforced when the queue pair is created.
+const maxInlineData = 1 << 12
+
+// maxPSN is the largest packet sequence number, which has 24 bits.
+const maxPSN = 1<<24 - 1
+
+// validate checks that the options can be used to create a connection.
+func (o Options) validate() error {
+	if o.DeviceName != "" {
+		if err := checkDevice(o.DeviceName); err != nil {
+			return err
+		}
+	}
+	if o.BufferSize != 0 && (o.BufferSize < minBufferSize || o.BufferSize > maxBufferSize || o.BufferSize&(o.BufferSize-1) != 0) {
+		return fmt.Errorf("invalid buffer size %d: must be a power of two between %d and %d", o.BufferSize, minBufferSize, maxBufferSize)
+	}
+	if o.SendQueueDepth < 0 || o.SendQueueDepth > maxQueueDepth {
+		return fmt.Errorf("invalid send queue depth %d: must be between 0 (default) and %d", o.SendQueueDepth, maxQueueDepth)
+	}
+	if o.RecvQueueDepth < 0 || o.RecvQueueDepth > maxQueueDepth {
+		return fmt.Errorf("invalid receive queue depth %d: must be between 0 (default) and %d", o.RecvQueueDepth, maxQueueDepth)
+	}
+	if o.MaxInlineData < 0 || o.MaxInlineData > maxInlineData {
+		return fmt.Errorf("invalid max inline data %d: must be between 0 and %d", o.MaxInlineData, maxInlineData)
+	}
+	if o.AccessFlags&^allAccess != 0 {
+		return fmt.Errorf("invalid access flags %#x", int(o.AccessFlags))
+	}
+	if o.PathMTU != 0 {
+		if _, ok := mtuEnum(o.PathMTU); !ok {
+			return fmt.Errorf("invalid path MTU %d: must be 256, 512, 1024, 2048 or 4096", o.PathMTU)
+		}
+	}
+	if o.QPTimeout > 31 {
+		return fmt.Errorf("invalid QP timeout %d: must be at most 31", o.QPTimeout)
+	}
+	if o.RetryCount > 7 || o.RNRRetry > 7 {
+		return fmt.Errorf("invalid retry count %d or RNR retry %d: must be at most 7", o.RetryCount, o.RNRRetry)
+	}
+	if o.InitialPSN > maxPSN {
+		return fmt.Errorf("invalid initial PSN %d: must be at most %d", o.InitialPSN, maxPSN)
+	}
+	if o.LinkLayer != LinkLayerAny && o.LinkLayer != LinkLayerInfiniBand && o.LinkLayer != LinkLayerEthernet {
+		return fmt.Errorf("invalid link layer %d", o.LinkLayer)
+	}
+	if o.QPType != 0 && !o.QPType.valid() {
+		return fmt.Errorf("unsupported QP type %d", o.QPType)
+	}
+	if o.UseSRQ && o.QPType == QPTypeUD {
+		return fmt.Errorf("shared receive queue cannot be used with UD queue pairs")
+	}
+	if o.CompletionMode != PollMode && o.CompletionMode != EventMode && o.CompletionMode != YieldMode {
+		return fmt.Errorf("invalid completion mode %d", o.CompletionMode)
+	}
+	if o.PollBatchSize != 0 {
+		if err := checkPollBatch(o.PollBatchSize); err != nil {
+			return err
+		}
+	}
+	if o.BindAddress != "" {
+		if _, err := parseIPLiteral(o.BindAddress); err != nil {
+			return fmt.Errorf("invalid bind address: %w", err)
+		}
+	}
+	if o.BootstrapUnixSocket != "" {
+		if o.BindAddress != "" {
+			return fmt.Errorf("bind address cannot be used with a unix bootstrap socket")
+		}
+		if limit := len(C.struct_sockaddr_un{}.sun_path); len(o.BootstrapUnixSocket) >= limit {
+			return fmt.Errorf("invalid unix socket path %q: must be shorter than %d bytes", o.BootstrapUnixSocket, limit)
+		}
+	}
+	if o.ConnWindow < 0 {
+		return fmt.Errorf("invalid connection window %d", o.ConnWindow)
+	}
+	if o.DialTimeout < 0 || o.AcceptTimeout < 0 || o.PollTimeout < 0 {
+		return fmt.Errorf("invalid negative timeout")
+	}
+	if o.IBPort < 0 || o.IBPort > 255 {
+		return fmt.Errorf("invalid IB port %d", o.IBPort)
+	}
+	if o.UseNUMANode && (o.NUMANode < 0 || o.NUMANode >= C.MAX_NUMA_NODES) {
+		return fmt.Errorf("invalid NUMA node %d: must be between 0 and %d", o.NUMANode, C.MAX_NUMA_NODES-1)
+	}
+	if o.UseGID {
+		return o.checkGIDIndex()
+	}
+	return nil
+}
+
+// checkGIDIndex verifies that GIDIndex is within the GID table of the selected
+// device port.
+func (o Options) checkGIDIndex() error {
+	var devName *C.char
+	if o.DeviceName != "" {
+		devName = C.CString(o.DeviceName)
+		defer C.free(unsafe.Pointer(devName))
+	}
+	port := o.port()
+	tblLen, err := C.query_gid_table_len(devName, C.int(port))
+	if tblLen < 0 {
+		e := newRDMAError("query_gid_table_len", tblLen, err)
+		return fmt.Errorf("failed to query GID table of port %d: %w", port, e)
+	}
+	if o.GIDIndex < 0 || o.GIDIndex >= int(tblLen) {
+		return fmt.Errorf("GID index %d out of range: port %d has %d GID table entries", o.GIDIndex, port, tblLen)
+	}
+	return nil
+}
+
+// port returns the IB port selected by the options.
+func (o Options) port() int {
+	if o.IBPort == 0 {
+		return 1
+	}
+	return o.IBPort
+}
+
+// apply copies the options into the C resources before they are created. Settings
+// left at their zero value take the defaults in C.config; the resources keep their
+// own copy, so connections with different options can be set up concurrently. The returned function releases
+// the device name, which is only needed until the resources are created.
+func (o Options) apply(res *RDMAResources) (release func()) {
+	res.res.buf_size = C.size_t(o.BufferSize)
+	res.res.max_send_wr = C.uint32_t(o.SendQueueDepth)
+	res.res.max_recv_wr = C.uint32_t(o.RecvQueueDepth)
+	res.res.max_inline_data = C.uint32_t(o.MaxInlineData)
+	res.res.mr_access = C.int(o.AccessFlags)
+	if o.UseDeviceMemory {
+		res.res.use_dm = 1
+	}
+	res.res.numa_node = -1
+	if o.UseNUMANode {
+		res.res.numa_node = C.int(o.NUMANode)
+	}
+	res.res.psn = C.uint32_t(o.InitialPSN)
+	if o.InitialPSN == 0 {
+		res.res.psn = C.uint32_t(rand.Uint32() & maxPSN)
+	}
+	if o.CompletionMode == EventMode {
+		res.res.event_mode = 1
+	}
+	res.yield = o.CompletionMode == YieldMode
+	res.manualSync = o.ManualSync
+	if o.SeparateCQs {
+		res.res.separate_cqs = 1
+	}
+	res.res.poll_batch = C.int(o.PollBatchSize)
+	if o.PollTimeout > 0 {
+		res.res.poll_timeout_ms = C.int(min(timeoutMs(o.PollTimeout), math.MaxInt32))
+	}
+
+	res.res.cfg = defaultConfig()
+	cfg := &res.res.cfg
+	var devName *C.char
+	if o.DeviceName != "" {
+		devName = C.CString(o.DeviceName)
+		cfg.dev_name = devName
+	}
+	if o.IBPort != 0 {
+		cfg.ib_port = C.int(o.IBPort)
+	}
+	if o.UseGID {
+		cfg.gid_idx = C.int(o.GIDIndex)
+	}
+	cfg.qp_type = C.IBV_QPT_RC
+	if o.QPType != 0 {
+		cfg.qp_type = C.int(o.QPType)
+	}
+	if o.LinkLayer != LinkLayerAny {
+		cfg.link_layer = C.int(o.LinkLayer)
+	}
+	if mtu, ok := mtuEnum(o.PathMTU); ok {
+		cfg.path_mtu = C.int(mtu)
+	}
+	if o.QPTimeout != 0 {
+		cfg.qp_timeout = C.uint8_t(o.QPTimeout)
+	}
+	if o.RetryCount != 0 {
+		cfg.retry_cnt = C.uint8_t(o.RetryCount)
+	}
+	if o.RNRRetry != 0 {
+		cfg.rnr_retry = C.uint8_t(o.RNRRetry)
+	}
+	return func() {
+		if devName != nil {
+			C.free(unsafe.Pointer(devName))
+		}
+	}
+}
+
+// effective returns `o` with the settings chosen by the C layer for the newly
+// created connection `res` filled in, so that they no longer depend on defaults.
+func (o Options) effective(res *RDMAResources) Options {
+	cfg := &res.res.cfg
+	o.DeviceName = C.GoString(cfg.dev_name)
+	o.IBPort = int(cfg.ib_port)
+	o.UseGID = cfg.gid_idx >= 0
+	o.GIDIndex = 0
+	if o.UseGID {
+		o.GIDIndex = int(cfg.gid_idx)
+	}
+	// BufferSize is kept as requested: the default size of the C layer is not a
+	// power of two and would not pass validate
+	o.SendQueueDepth = int(res.res.max_send_wr)
+	o.RecvQueueDepth = int(res.res.max_recv_wr)
+	o.MaxInlineData = min(int(res.res.max_inline_data), maxInlineData)
+	o.AccessFlags = AccessFlags(res.res.mr_access)
+	o.UseDeviceMemory = res.res.dm != nil
+	o.QPType = QPType(cfg.qp_type)
+	o.LinkLayer = LinkLayer(res.res.port_attr.link_layer)
+	o.QPTimeout = uint8(cfg.qp_timeout)
+	o.RetryCount = uint8(cfg.retry_cnt)
+	o.RNRRetry = uint8(cfg.rnr_retry)
+	if mtu, err := res.PathMTU(); err == nil {
+		o.PathMTU = mtu
+	}
+	return o
+}
+
+// Config returns the settings `res` was created with, including the values the
+// defaults resolved to: the device actually opened, the IB port, the GID index,
+// the path MTU chosen for the queue pair and the queue pair parameters. A
+// BufferSize left at zero stays zero, since the default buffer size is not a
+// valid BufferSize; MaxMessageSize reports it. Passing the result to
+// InitClientWithOptions or
+// InitServerWithOptions creates another connection configured the same way
+// without re-specifying every parameter.
+//
+// It can be called at any time, also after the connection has been closed.
+//
+// Example:
+//
+//	opts := first.Config()
+//	for i := 0; i < 8; i++ {
+//	    res, err := h.InitClientWithOptions("192.168.1.10", 8080, opts)
+//	    if err != nil {
+//	        log.Fatalf("Failed to initialize RDMA client: %v", err)
+//	    }
+//	    conns = append(conns, res)
+//	}
+func (res *RDMAResources) Config() Options {
+	return res.config
+}
+
+// gidIndex returns the GID index selected by the options, negative if the peer
+// is not addressed by GID.
+func (o Options) gidIndex() int {
+	if o.UseGID {
+		return o.GIDIndex
+	}
+	return int(defaultConfig().gid_idx)
+}
+
+// defaultConfig returns a copy of the process-wide defaults in C.config, from which
+// the configuration of every new connection starts. The defaults are not changed
+// after start-up; the one that is, the poll batch, lives in defaultPollBatch.
+func defaultConfig() C.struct_config_t {
+	return C.config
+}
+
+// mtuEnum returns the enum ibv_mtu value for an MTU of `bytes` bytes, and false if
+// `bytes` is not a valid MTU.
+func mtuEnum(bytes int) (C.enum_ibv_mtu, bool) {
+	switch bytes {
+	case 256:
+		return C.IBV_MTU_256, true
+	case 512:
+		return C.IBV_MTU_512, true
+	case 1024:
+		return C.IBV_MTU_1024, true
+	case 2048:
+		return C.IBV_MTU_2048, true
+	case 4096:
+		return C.IBV_MTU_4096, true
+	}
+	return 0, false
+}
+
+// logger returns the Logger of the options, or a logger that discards everything
+// if none is set.
+func (o Options) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return discardLogger
+}
+
+// discardLogger is the default Options.Logger.
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler is a slog.Handler that drops all records.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// timeoutMs converts a timeout to the milliseconds expected by the C socket
+// functions, where -1 waits indefinitely.
+func timeoutMs(d time.Duration) int {
+	if d <= 0 {
+		return -1
+	}
+	return int(max(d.Milliseconds(), 1))
+}
@@ -0,0 +1,74 @@
+package rdmahandler
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestOptionsApplyConcurrent configures connections from parallel goroutines,
+// as concurrent InitClient calls do, and checks that each one keeps its own
+// settings and that the process-wide defaults are left alone. Run it with -race.
+func TestOptionsApplyConcurrent(t *testing.T) {
+	const n = 16
+	before := defaultConfig()
+	var wg sync.WaitGroup
+	got := make([]Options, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			o := Options{DeviceName: fmt.Sprintf("mlx5_%d", i), IBPort: i + 1}
+			res := &RDMAResources{}
+			release := o.apply(res)
+			defer release()
+			got[i] = o.effective(res)
+		}(i)
+	}
+	wg.Wait()
+	for i, o := range got {
+		if want := fmt.Sprintf("mlx5_%d", i); o.DeviceName != want {
+			t.Errorf("connection %d uses device %q, expected %q", i, o.DeviceName, want)
+		}
+		if o.IBPort != i+1 {
+			t.Errorf("connection %d uses IB port %d, expected %d", i, o.IBPort, i+1)
+		}
+	}
+	if after := defaultConfig(); after != before {
+		t.Errorf("applying options changed the defaults from %+v to %+v", before, after)
+	}
+}
+
+// TestConfigValidates checks that the settings a default connection reports can
+// be passed back to create another one. resources_create is simulated by filling
+// in the defaults it resolves.
+func TestConfigValidates(t *testing.T) {
+	res := &RDMAResources{}
+	release := Options{}.apply(res)
+	defer release()
+	res.res.buf_size = 85 // MSG_SIZE, the default of resources_create
+	res.res.max_send_wr = 10
+	res.res.max_recv_wr = 10
+	o := Options{}.effective(res)
+	if err := o.validate(); err != nil {
+		t.Fatalf("settings of a default connection do not validate: %v", err)
+	}
+	if o.BufferSize != 0 {
+		t.Errorf("default buffer size reported as %d, expected 0", o.BufferSize)
+	}
+}
+
+// TestConfigRoundTrip creates a connection from the settings of another one.
+func TestConfigRoundTrip(t *testing.T) {
+	for _, opts := range []Options{{}, {BufferSize: 4096, SendQueueDepth: 16}} {
+		first := newLoopback(t, opts)
+		cfg := first.Config()
+		second := newLoopback(t, cfg)
+		if got := second.Config(); got.BufferSize != cfg.BufferSize || got.SendQueueDepth != cfg.SendQueueDepth || got.DeviceName != cfg.DeviceName {
+			t.Errorf("connection created from %+v reports %+v", cfg, got)
+		}
+		if first.MaxMessageSize() != second.MaxMessageSize() {
+			t.Errorf("message size %d of the copy differs from %d", second.MaxMessageSize(), first.MaxMessageSize())
+		}
+	}
+}
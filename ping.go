@@ -0,0 +1,54 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"time"
+)
+
+// Ping checks that the peer is still alive by reading its 8-byte write index with a
+// one-sided RDMA read, like Available, and waiting at most `timeout` for the completion.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection over a Reliable Connected queue pair.
+//
+// The peer's application is not involved, so Ping can be called at any time between
+// other operations, for example from a goroutine that periodically checks the
+// connections of a pool. If the read fails or does not complete within `timeout`, the
+// peer is considered dead: an error is returned and the connection is marked Errored,
+// since a late completion would confuse later operations. It must then be released
+// with Destroy.
+//
+// On success, it returns nil. On failure, it returns an error detailing the issue
+// encountered.
+//
+// Example:
+//
+//	if err := h.Ping(res, time.Second); err != nil {
+//	    log.Printf("peer is gone: %v", err)
+//	    h.Destroy(res)
+//	}
+func (h *RDMAHandler) Ping(res *RDMAResources, timeout time.Duration) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if err := requireRC(res, "ping"); err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("ping: invalid timeout %v", timeout)
+	}
+	acquireInflight()
+	defer releaseInflight()
+	if rc, err := C.post_read_index(&res.res); rc != 0 {
+		return fmt.Errorf("ping: %w", res.opError("post_read_index", rc, err))
+	}
+	if rc, err := res.waitCompletion(res.sendCompletion(), timeout, nil); rc != 0 {
+		return fmt.Errorf("ping: %w", res.opError("poll_completion", rc, err))
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// SetPollBatch sets the default for Options.PollBatchSize, the number of
+// completions retrieved per ibv_poll_cq call when waiting for RDMA operations to
+// complete.
+//
+// `n` is checked like PollBatchSize and must be between 1 (the default) and 64.
+// It applies to every connection whose PollBatchSize is zero, including those
+// already established, and may be changed while they are in use.
+//
+// Example:
+//
+//	if err := rdmahandler.SetPollBatch(16); err != nil {
+//	    log.Fatalf("Invalid poll batch: %v", err)
+//	}
+func SetPollBatch(n int) error {
+	if err := checkPollBatch(n); err != nil {
+		return err
+	}
+	defaultPollBatch.Store(int32(n))
+	return nil
+}
+
+// checkPollBatch returns an error if `n` is not a valid poll batch size, for
+// SetPollBatch and Options.PollBatchSize alike.
+func checkPollBatch(n int) error {
+	if n < 1 || n > C.MAX_POLL_BATCH {
+		return fmt.Errorf("poll batch %d out of range [1, %d]", n, C.MAX_POLL_BATCH)
+	}
+	return nil
+}
+
+// defaultPollBatch is the value of SetPollBatch, zero until it is first called.
+// Connections read it while they poll, so it is kept apart from C.config.
+var defaultPollBatch atomic.Int32
+
+// pollCompletion waits for the completion of the send work request last posted
+// on res, busy-polling or sleeping on the completion channel depending on the
+// CompletionMode the connection was created with. It returns 0, POLL_TIMEOUT,
+// WC_ERROR with the failed completion recorded in res.res, or 1 and the errno if
+// polling failed.
+func (res *RDMAResources) pollCompletion() (C.int, error) {
+	return res.waitCompletion(res.sendCompletion(), res.pollTimeout(), nil)
+}
+
+// pollRecvCompletion is like pollCompletion but waits for the completion of the
+// oldest outstanding receive, on the receive completion queue if the connection
+// was created with Options.SeparateCQs.
+func (res *RDMAResources) pollRecvCompletion() (C.int, error) {
+	res.res.poll_recv = 1
+	defer func() { res.res.poll_recv = 0 }()
+	return res.waitCompletion(completion.isRecv, res.pollTimeout(), nil)
+}
+
+// completion is a work completion taken from a completion queue of a connection.
+type completion struct {
+	wrID      uint64
+	status    C.enum_ibv_wc_status
+	opcode    C.enum_ibv_wc_opcode
+	byteLen   uint32
+	vendorErr uint32
+}
+
+// isRecv reports whether c is the completion of a receive request: by its opcode
+// if it succeeded, by its wr_id otherwise, since the opcode of a failed
+// completion is undefined; see RecvWRID.
+func (c completion) isRecv() bool {
+	if c.status == C.IBV_WC_SUCCESS {
+		return c.opcode&C.IBV_WC_RECV != 0
+	}
+	return c.wrID&RecvWRID != 0
+}
+
+// sendCompletion returns a filter accepting the completion of the send work
+// request last posted on res. It also accepts a failed completion of an earlier
+// send, which can only be an unsignaled request of the same PostWrites batch,
+// so that the error names the request that failed.
+func (res *RDMAResources) sendCompletion() func(completion) bool {
+	last := uint64(res.res.wr_seq)
+	return func(c completion) bool {
+		if c.isRecv() {
+			return false
+		}
+		return c.wrID == last || (c.status != C.IBV_WC_SUCCESS && c.wrID < last)
+	}
+}
+
+// waitCompletion waits until a completion accepted by `want` has been taken from
+// the completion queue of res, or `timeout` has passed, or `cancel` is closed.
+// The completions are taken in batches of pollBatch with poll_cq_batch; the
+// others of a batch belong to operations still waiting, such as receives posted
+// with PostRecv, and are kept in res.unclaimed, where their waiters find them.
+//
+// The claimed completion is recorded in res.res: a successful one in last_wr_id,
+// last_opcode and last_byte_len, a failed one in wc_status, wc_vendor_err and
+// wc_wr_id. It returns 0, WC_ERROR for a failed completion, POLL_TIMEOUT if none
+// arrived in time or the wait was cancelled, or 1 and the errno if polling
+// failed. The completion channel is only slept on when `cancel` is nil, since the
+// sleep cannot be interrupted. The caller must hold res.mu.
+func (res *RDMAResources) waitCompletion(want func(completion) bool, timeout time.Duration, cancel <-chan struct{}) (C.int, error) {
+	if c, ok := res.claim(want); ok {
+		return res.record(c), nil
+	}
+	deadline := time.Now().Add(timeout)
+	event := res.res.event_mode != 0 && cancel == nil
+	spins := pollCheckInterval
+	if res.yield {
+		spins = yieldPollSpins
+	}
+	armed := false
+	for {
+		n, err := C.poll_cq_spin(&res.res, &res.wcs[0], C.int(res.pollBatch()), C.int(spins))
+		if n < 0 {
+			return 1, err
+		}
+		if c, ok := res.take(int(n), want); ok {
+			return res.record(c), nil
+		}
+		if n > 0 {
+			continue
+		}
+		if !event {
+			select {
+			case <-cancel:
+				return C.POLL_TIMEOUT, nil
+			default:
+			}
+			if time.Now().After(deadline) {
+				C.drain_async_events(&res.res)
+				return C.POLL_TIMEOUT, nil
+			}
+			if res.yield {
+				runtime.Gosched()
+			}
+			continue
+		}
+		// poll once more after arming, a completion may have arrived before
+		if !armed {
+			if rc, err := C.arm_cq(&res.res); rc != 0 {
+				return 1, err
+			}
+			armed = true
+			continue
+		}
+		rc, err := C.wait_cq_event(&res.res, C.int(max(timeoutMs(time.Until(deadline)), 0)))
+		if rc == C.POLL_TIMEOUT {
+			C.drain_async_events(&res.res)
+			return C.POLL_TIMEOUT, nil
+		}
+		if rc != 0 {
+			return 1, err
+		}
+		armed = false
+	}
+}
+
+// take goes through the `n` completions poll_cq_batch left in res.wcs and returns
+// the first one `want` accepts. The others are appended to res.unclaimed.
+func (res *RDMAResources) take(n int, want func(completion) bool) (completion, bool) {
+	var claimed completion
+	found := false
+	for i := range res.wcs[:n] {
+		wc := &res.wcs[i]
+		c := completion{
+			wrID:      uint64(wc.wr_id),
+			status:    wc.status,
+			opcode:    wc.opcode,
+			byteLen:   uint32(wc.byte_len),
+			vendorErr: uint32(wc.vendor_err),
+		}
+		// a failed completion usually moves the queue pair to the error state,
+		// after which every work request completes with IBV_WC_WR_FLUSH_ERR
+		if c.status != C.IBV_WC_SUCCESS && res.res.qp_err == 0 && C.query_qp_state(&res.res) == C.IBV_QPS_ERR {
+			res.res.qp_err = 1
+		}
+		if !found && want(c) {
+			claimed, found = c, true
+			continue
+		}
+		res.unclaimed = append(res.unclaimed, c)
+	}
+	return claimed, found
+}
+
+// claim removes and returns the oldest completion in res.unclaimed that `want`
+// accepts.
+func (res *RDMAResources) claim(want func(completion) bool) (completion, bool) {
+	for i, c := range res.unclaimed {
+		if want(c) {
+			res.unclaimed = append(res.unclaimed[:i], res.unclaimed[i+1:]...)
+			return c, true
+		}
+	}
+	return completion{}, false
+}
+
+// record stores the claimed completion `c` in res.res, where opError and the
+// operations read it, and returns 0 or WC_ERROR as waitCompletion does.
+func (res *RDMAResources) record(c completion) C.int {
+	if c.status != C.IBV_WC_SUCCESS {
+		res.res.wc_status = C.int(c.status)
+		res.res.wc_vendor_err = C.uint32_t(c.vendorErr)
+		res.res.wc_wr_id = C.uint64_t(c.wrID)
+		return C.WC_ERROR
+	}
+	res.res.last_wr_id = C.uint64_t(c.wrID)
+	res.res.last_opcode = C.int(c.opcode)
+	res.res.last_byte_len = C.uint32_t(c.byteLen)
+	return 0
+}
+
+// dropUnclaimed discards the completions no operation claimed, after the queue
+// pair of res was reset, counting them as dropped. The caller must hold res.mu.
+func (res *RDMAResources) dropUnclaimed() {
+	atomic.AddUint64((*uint64)(unsafe.Pointer(&res.res.dropped)), uint64(len(res.unclaimed)))
+	res.unclaimed = nil
+}
+
+// pollBatch returns the number of completions retrieved per ibv_poll_cq call on
+// res: Options.PollBatchSize, or the process-wide value of SetPollBatch.
+func (res *RDMAResources) pollBatch() int {
+	if res.res.poll_batch > 0 {
+		return int(res.res.poll_batch)
+	}
+	if n := defaultPollBatch.Load(); n > 0 {
+		return int(n)
+	}
+	return 1
+}
+
+// RecvWRID is set in the work request IDs of receive requests and in no send
+// request ID, so that the two kinds of completions cannot be confused; see
+// NextWRID.
+const RecvWRID uint64 = C.RECV_WR_ID
+
+// NextWRID returns the work request ID (wr_id) the next send work request
+// posted on `res` will carry. Send work requests, including RDMA reads, writes
+// and atomics, are numbered from 1 in the order they are posted, so the requests
+// of a PostWrites call started when NextWRID returned n carry n, n+1 and so on.
+// A failed completion reports its ID in RDMAError.WRID, and LastWRID reports the
+// ID of the last successful one, which lets callers match completions to
+// requests when several are outstanding.
+//
+// Receive requests are numbered separately, in a range of their own marked by
+// RecvWRID: those of PostRecv carry RecvWRID|1, RecvWRID|2 and so on in the order
+// their buffers were first used, and the receive into the data buffer carries
+// RecvWRID itself. An ID without RecvWRID is always that of a send request.
+//
+// Example:
+//
+//	first := res.NextWRID()
+//	if err := h.PostWrites(res, msgs); err != nil {
+//	    var e *rdmahandler.RDMAError
+//	    if errors.As(err, &e) && e.WRID >= first {
+//	        log.Printf("payload %d failed: %v", e.WRID-first, err)
+//	    }
+//	}
+func (res *RDMAResources) NextWRID() uint64 {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	return uint64(res.res.wr_seq) + 1
+}
+
+// LastWRID returns the work request ID of the last successful completion on
+// `res`, a send or a receive request; see NextWRID. It is 0 before the first
+// completion.
+func (res *RDMAResources) LastWRID() uint64 {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	return uint64(res.res.last_wr_id)
+}
+
+// pollTimeout returns how long pollCompletion waits for a completion on res.
+func (res *RDMAResources) pollTimeout() time.Duration {
+	if res.res.poll_timeout_ms > 0 {
+		return time.Duration(res.res.poll_timeout_ms) * time.Millisecond
+	}
+	return C.MAX_POLL_CQ_TIMEOUT * time.Millisecond
+}
@@ -0,0 +1,185 @@
+package rdmahandler
+
+import "testing"
+
+// Values of enum ibv_wc_status and enum ibv_wc_opcode, which cgo does not make
+// available to tests.
+const (
+	wcFlushErr    = 5   // IBV_WC_WR_FLUSH_ERR
+	wcRetryExcErr = 12  // IBV_WC_RETRY_EXC_ERR
+	wcRDMAWrite   = 1   // IBV_WC_RDMA_WRITE
+	wcRecv        = 128 // IBV_WC_RECV
+)
+
+// setC stores `v` in a field of a C struct, whose type tests cannot name.
+func setC[T ~int32 | ~uint32 | ~uint64](p *T, v uint64) {
+	*p = T(v)
+}
+
+// fillWCs places completions in res.wcs as poll_cq_batch does and returns their
+// number.
+func fillWCs(res *RDMAResources, cs ...completion) int {
+	for i, c := range cs {
+		wc := &res.wcs[i]
+		setC(&wc.wr_id, c.wrID)
+		setC(&wc.status, uint64(c.status))
+		setC(&wc.opcode, uint64(c.opcode))
+		setC(&wc.byte_len, uint64(c.byteLen))
+		setC(&wc.vendor_err, uint64(c.vendorErr))
+	}
+	return len(cs)
+}
+
+func TestWCConstants(t *testing.T) {
+	if WCStatus(wcFlushErr) != WCWRFlushErr || WCStatus(wcRetryExcErr) != WCRetryExcErr {
+		t.Fatalf("test status values do not match enum ibv_wc_status")
+	}
+}
+
+func TestCompletionIsRecv(t *testing.T) {
+	tests := []struct {
+		name string
+		c    completion
+		want bool
+	}{
+		{"receive", completion{wrID: RecvWRID | 1, opcode: wcRecv}, true},
+		{"receive into the data buffer", completion{wrID: RecvWRID, opcode: wcRecv}, true},
+		{"write", completion{wrID: 7, opcode: wcRDMAWrite}, false},
+		// the opcode of a failed completion is undefined
+		{"failed receive", completion{wrID: RecvWRID | 2, status: wcFlushErr, opcode: wcRDMAWrite}, true},
+		{"failed write", completion{wrID: 7, status: wcRetryExcErr, opcode: wcRecv}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.c.isRecv(); got != tt.want {
+			t.Errorf("%s: isRecv() = %v, expected %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestTakeKeepsUnclaimed takes a batch holding the awaited send completion
+// between two receive completions, which must be kept in order for WaitRecv.
+func TestTakeKeepsUnclaimed(t *testing.T) {
+	res := &RDMAResources{}
+	res.res.wr_seq = 3
+	recv1 := completion{wrID: RecvWRID | 1, opcode: wcRecv, byteLen: 10}
+	send := completion{wrID: 3, opcode: wcRDMAWrite}
+	recv2 := completion{wrID: RecvWRID | 2, opcode: wcRecv, byteLen: 20}
+	n := fillWCs(res, recv1, send, recv2)
+
+	c, ok := res.take(n, res.sendCompletion())
+	if !ok || c != send {
+		t.Fatalf("take returned %+v, %v, expected %+v", c, ok, send)
+	}
+	if len(res.unclaimed) != 2 || res.unclaimed[0] != recv1 || res.unclaimed[1] != recv2 {
+		t.Fatalf("unclaimed completions are %+v, expected %+v and %+v", res.unclaimed, recv1, recv2)
+	}
+	for _, want := range []completion{recv1, recv2} {
+		c, ok := res.claim(completion.isRecv)
+		if !ok || c != want {
+			t.Fatalf("claim returned %+v, %v, expected %+v", c, ok, want)
+		}
+	}
+	if c, ok := res.claim(completion.isRecv); ok {
+		t.Errorf("claim of an empty queue returned %+v", c)
+	}
+}
+
+// TestTakeNothingWanted keeps every completion of a batch none of which is
+// awaited, so that a later wait finds them without polling.
+func TestTakeNothingWanted(t *testing.T) {
+	res := &RDMAResources{}
+	res.res.wr_seq = 5
+	recv := completion{wrID: RecvWRID | 1, opcode: wcRecv, byteLen: 4}
+	n := fillWCs(res, recv)
+	if c, ok := res.take(n, res.sendCompletion()); ok {
+		t.Fatalf("take returned %+v for a batch without the awaited send", c)
+	}
+	// a zero timeout would expire at once if waitCompletion polled
+	if rc, err := res.waitCompletion(completion.isRecv, 0, nil); rc != 0 || err != nil {
+		t.Fatalf("waitCompletion returned %d, %v", rc, err)
+	}
+	if uint64(res.res.last_wr_id) != recv.wrID || res.res.last_opcode != wcRecv || res.res.last_byte_len != 4 {
+		t.Errorf("recorded wr_id %#x, opcode %d, byte_len %d, expected %#x, %d, 4",
+			uint64(res.res.last_wr_id), res.res.last_opcode, res.res.last_byte_len, recv.wrID, wcRecv)
+	}
+	if len(res.unclaimed) != 0 {
+		t.Errorf("%d completions left unclaimed", len(res.unclaimed))
+	}
+}
+
+// TestSendCompletionFailedEarlier claims the failed completion of an earlier
+// unsignaled write of a batch before the flushed completion of the last one, so
+// that the error names the write that failed.
+func TestSendCompletionFailedEarlier(t *testing.T) {
+	res := &RDMAResources{}
+	// the queue pair is known to be in the error state, take does not query it
+	res.res.qp_err = 1
+	res.res.wr_seq = 4
+	failed := completion{wrID: 2, status: wcRetryExcErr, vendorErr: 0x81}
+	flushed := completion{wrID: 3, status: wcFlushErr}
+	last := completion{wrID: 4, status: wcFlushErr}
+	n := fillWCs(res, failed, flushed, last)
+
+	c, ok := res.take(n, res.sendCompletion())
+	if !ok || c != failed {
+		t.Fatalf("take returned %+v, %v, expected %+v", c, ok, failed)
+	}
+	if rc := res.record(c); rc == 0 {
+		t.Fatalf("record of a failed completion returned 0")
+	}
+	if WCStatus(res.res.wc_status) != WCRetryExcErr || res.res.wc_vendor_err != 0x81 || res.res.wc_wr_id != 2 {
+		t.Errorf("recorded status %d, vendor error %#x, wr_id %d, expected %d, 0x81, 2",
+			res.res.wc_status, res.res.wc_vendor_err, res.res.wc_wr_id, wcRetryExcErr)
+	}
+	if len(res.unclaimed) != 2 || res.unclaimed[0] != flushed || res.unclaimed[1] != last {
+		t.Errorf("unclaimed completions are %+v, expected %+v and %+v", res.unclaimed, flushed, last)
+	}
+	res.dropUnclaimed()
+	if len(res.unclaimed) != 0 || res.res.dropped != 2 {
+		t.Errorf("after dropUnclaimed %d completions are left and %d dropped, expected 0 and 2",
+			len(res.unclaimed), res.res.dropped)
+	}
+}
+
+// TestSetPollBatchConcurrent changes the default poll batch while connections are
+// configured and poll. Run it with -race.
+func TestSetPollBatchConcurrent(t *testing.T) {
+	defer SetPollBatch(1)
+	res := &RDMAResources{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = defaultConfig()
+			if n := res.pollBatch(); n < 1 || n > 64 {
+				t.Errorf("poll batch %d out of range", n)
+				return
+			}
+		}
+	}()
+	for i := 1; i <= 64; i++ {
+		if err := SetPollBatch(i); err != nil {
+			t.Fatalf("SetPollBatch(%d): %v", i, err)
+		}
+	}
+	<-done
+	if n := res.pollBatch(); n != 64 {
+		t.Errorf("poll batch of a connection without PollBatchSize is %d, expected 64", n)
+	}
+}
+
+// TestPollBatchRange checks that SetPollBatch and Options.PollBatchSize accept
+// the same sizes and report the same error.
+func TestPollBatchRange(t *testing.T) {
+	defer SetPollBatch(1)
+	for _, n := range []int{-1, 1, 64, 65} {
+		setErr := SetPollBatch(n)
+		optErr := Options{PollBatchSize: n}.validate()
+		if (setErr == nil) != (optErr == nil) || setErr != nil && setErr.Error() != optErr.Error() {
+			t.Errorf("size %d: SetPollBatch returned %v, validate %v", n, setErr, optErr)
+		}
+	}
+	if err := (Options{}).validate(); err != nil {
+		t.Errorf("validate of the default poll batch returned %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package rdmahandler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultPingTimeout is the PingTimeout of a pool created by NewPool.
+const defaultPingTimeout = time.Second
+
+// RDMAPool keeps a set of established connections for reuse, so that a program
+// talking to many peers, or issuing many independent exchanges, does not pay for
+// creating and connecting the RDMA resources every time.
+//
+// Connections are handed out with Get and given back with Put. A connection is used
+// by one caller at a time between Get and Put. All methods are safe for concurrent use.
+type RDMAPool struct {
+	// MaxConns is the number of connections the pool holds at most, idle or in use.
+	MaxConns int
+
+	// PingTimeout bounds the health check run by Put on every returned connection.
+	PingTimeout time.Duration
+
+	h    RDMAHandler
+	dial func() (*RDMAResources, error)
+
+	mu     sync.Mutex
+	idle   []*RDMAResources
+	open   int // connections created and not yet discarded, idle or in use
+	closed bool
+}
+
+// NewPool creates a pool of up to `maxConns` connections and establishes all of them
+// up front.
+//
+// `dial` creates one connection. For a client it typically wraps InitClientWithOptions;
+// for a server it can wrap RDMAListener.WaitForClient, in which case NewPool waits
+// for `maxConns` clients. It is called again by Get to replace connections that were
+// discarded.
+//
+// If a connection cannot be established, the ones created so far are destroyed and
+// the error is returned.
+//
+// On success, it returns the pool and nil error. On failure, it returns nil and the
+// error encountered.
+//
+// Example:
+//
+//	pool, err := rdmahandler.NewPool(8, func() (*rdmahandler.RDMAResources, error) {
+//	    return h.InitClient("192.168.1.10", 8080)
+//	})
+//	if err != nil {
+//	    log.Fatalf("Failed to create pool: %v", err)
+//	}
+//	defer pool.Close()
+func NewPool(maxConns int, dial func() (*RDMAResources, error)) (*RDMAPool, error) {
+	if maxConns <= 0 {
+		return nil, fmt.Errorf("invalid pool size %d", maxConns)
+	}
+	p := &RDMAPool{MaxConns: maxConns, PingTimeout: defaultPingTimeout, dial: dial}
+	for i := 0; i < maxConns; i++ {
+		res, err := dial()
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("failed to establish pooled connection %d: %w", i, err)
+		}
+		p.idle = append(p.idle, res)
+		p.open++
+	}
+	return p, nil
+}
+
+// Get takes a connection out of the pool.
+//
+// An idle connection is returned if there is one. Otherwise, if fewer than MaxConns
+// connections exist because unhealthy ones were discarded, a new connection is
+// established with the pool's dial function. Get does not wait for connections to be
+// returned: if all of them are in use, it fails with ErrPoolExhausted.
+//
+// On success, it returns the connection and nil error. On failure, it returns nil and
+// the error encountered; after Close it returns ErrClosed.
+//
+// Example:
+//
+//	res, err := pool.Get()
+//	if err != nil {
+//	    return err
+//	}
+//	defer pool.Put(res)
+func (p *RDMAPool) Get() (*RDMAResources, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(p.idle); n > 0 {
+		res := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return res, nil
+	}
+	if p.open >= p.MaxConns {
+		p.mu.Unlock()
+		return nil, ErrPoolExhausted
+	}
+	// reserve the slot, the connection is established without holding the lock
+	p.open++
+	p.mu.Unlock()
+
+	res, err := p.dial()
+	if err != nil {
+		p.mu.Lock()
+		p.open--
+		p.mu.Unlock()
+		return nil, fmt.Errorf("failed to establish pooled connection: %w", err)
+	}
+	return res, nil
+}
+
+// Put returns a connection obtained with Get to the pool.
+//
+// The connection is checked with Ping, bounded by PingTimeout, before it is made
+// available again. Connections that fail the check, that are no longer Connected, or
+// that are returned after Close are destroyed instead, which frees their slot for a
+// new connection.
+//
+// Example:
+//
+//	res, err := pool.Get()
+//	if err != nil {
+//	    return err
+//	}
+//	defer pool.Put(res)
+func (p *RDMAPool) Put(res *RDMAResources) {
+	healthy := res.Connected() && p.h.Ping(res, p.PingTimeout) == nil
+
+	p.mu.Lock()
+	if healthy && !p.closed {
+		p.idle = append(p.idle, res)
+		p.mu.Unlock()
+		return
+	}
+	p.open--
+	p.mu.Unlock()
+	p.h.Destroy(res)
+}
+
+// Close destroys all idle connections and prevents further use of the pool.
+// Connections still in use are destroyed when they are returned with Put.
+//
+// It returns the errors of the Destroy calls, joined, or nil.
+//
+// Example:
+//
+//	if err := pool.Close(); err != nil {
+//	    log.Printf("Failed to close pool: %v", err)
+//	}
+func (p *RDMAPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	p.closed = true
+	p.mu.Unlock()
+
+	var errs []error
+	for _, res := range idle {
+		errs = append(errs, p.h.Destroy(res))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,148 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"net"
+	"unsafe"
+)
+
+// LinkLayer is the link layer of a port: native InfiniBand, or Ethernet for RoCE.
+type LinkLayer int
+
+const (
+	// LinkLayerAny accepts a port of either link layer. It is the zero value of
+	// Options.LinkLayer; as a reported link layer it means the device did not
+	// report one.
+	LinkLayerAny LinkLayer = C.IBV_LINK_LAYER_UNSPECIFIED
+	// LinkLayerInfiniBand is a native InfiniBand port, addressed by LID.
+	LinkLayerInfiniBand LinkLayer = C.IBV_LINK_LAYER_INFINIBAND
+	// LinkLayerEthernet is a RoCE port, which has no LID and is addressed by GID.
+	LinkLayerEthernet LinkLayer = C.IBV_LINK_LAYER_ETHERNET
+)
+
+func (l LinkLayer) String() string {
+	switch l {
+	case LinkLayerAny:
+		return "unspecified"
+	case LinkLayerInfiniBand:
+		return "InfiniBand"
+	case LinkLayerEthernet:
+		return "Ethernet"
+	}
+	return fmt.Sprintf("LinkLayer(%d)", int(l))
+}
+
+// PortInfo describes the local port of an RDMA connection as it was when the
+// connection was created. It is meant for diagnostics, such as checking that both
+// peers of a RoCE connection use GIDs of the same type and subnet.
+type PortInfo struct {
+	Port      int       // port number on the device
+	LID       uint16    // local identifier, zero on RoCE ports
+	GIDIndex  int       // index of the GID in the port's GID table, negative if no GID is used
+	GID       string    // the GID at GIDIndex, formatted as an IPv6 address, empty if no GID is used
+	State     string    // port state, e.g. "PORT_ACTIVE"
+	ActiveMTU int       // active MTU of the port in bytes
+	LinkLayer LinkLayer // InfiniBand, or Ethernet for RoCE
+
+	// Speed is the per-lane speed the link negotiated, e.g. "EDR" or "HDR", and
+	// Width its number of lanes, e.g. 4. RateGbps is the resulting data rate in
+	// Gb/s, as ibstat reports it: 100 for 4x EDR, 200 for 4x HDR. RoCE devices
+	// report the Ethernet speed in these terms, e.g. 100GbE as 4x EDR. Speed is
+	// empty and the rate 0 if the device reports values unknown to this package.
+	Speed    string
+	Width    int
+	RateGbps float64
+}
+
+// portSpeed maps the active_speed of ibv_port_attr to the name of the speed and
+// its data rate per lane in Gb/s.
+func portSpeed(speed C.uint8_t) (string, float64) {
+	switch speed {
+	case 1:
+		return "SDR", 2.5
+	case 2:
+		return "DDR", 5
+	case 4:
+		return "QDR", 10
+	case 8:
+		return "FDR10", 10
+	case 16:
+		return "FDR", 14
+	case 32:
+		return "EDR", 25
+	case 64:
+		return "HDR", 50
+	case 128:
+		return "NDR", 100
+	}
+	return "", 0
+}
+
+// portWidth maps the active_width of ibv_port_attr to the number of lanes.
+func portWidth(width C.uint8_t) int {
+	switch width {
+	case 1:
+		return 1
+	case 2:
+		return 4
+	case 4:
+		return 8
+	case 8:
+		return 12
+	case 16:
+		return 2
+	}
+	return 0
+}
+
+// LocalPortInfo returns the LID, GID, state, active MTU and link speed of the local
+// port used by `res`.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized. The LID,
+// state, MTU, link layer and speed are those queried when the resources were created; the
+// GID is read from the port's GID table at the index selected with Options.GIDIndex,
+// or chosen automatically on a RoCE port.
+//
+// On success, it returns the port information and nil error. On failure, it returns a
+// zero PortInfo and the error encountered.
+//
+// Example:
+//
+//	info, err := h.LocalPortInfo(res)
+//	if err != nil {
+//	    log.Fatalf("Failed to query local port: %v", err)
+//	}
+//	log.Printf("port %d: lid %#x gid[%d] %s", info.Port, info.LID, info.GIDIndex, info.GID)
+//	log.Printf("link %dx %s, %g Gb/s", info.Width, info.Speed, info.RateGbps)
+func (h *RDMAHandler) LocalPortInfo(res *RDMAResources) (PortInfo, error) {
+	if err := res.begin(); err != nil {
+		return PortInfo{}, err
+	}
+	defer res.end()
+	attr := &res.res.port_attr
+	info := PortInfo{
+		Port:     int(res.res.cfg.ib_port),
+		LID:      uint16(attr.lid),
+		GIDIndex: int(res.res.cfg.gid_idx),
+		State:    C.GoString(C.ibv_port_state_str(attr.state)),
+		// enum ibv_mtu counts from IBV_MTU_256 = 1 in powers of two
+		ActiveMTU: 128 << attr.active_mtu,
+		LinkLayer: LinkLayer(attr.link_layer),
+		Width:     portWidth(attr.active_width),
+	}
+	var laneRate float64
+	info.Speed, laneRate = portSpeed(attr.active_speed)
+	info.RateGbps = laneRate * float64(info.Width)
+	if info.GIDIndex >= 0 {
+		var gid C.union_ibv_gid
+		if rc, err := C.ibv_query_gid(res.res.ib_ctx, C.uint8_t(info.Port), C.int(info.GIDIndex), &gid); rc != 0 {
+			return PortInfo{}, fmt.Errorf("port %d, gid index %d: %w", info.Port, info.GIDIndex, newRDMAError("ibv_query_gid", rc, err))
+		}
+		info.GID = net.IP(C.GoBytes(unsafe.Pointer(&gid), 16)).String()
+	}
+	return info, nil
+}
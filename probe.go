@@ -0,0 +1,73 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Probe checks that an RDMA server is reachable at `ip` and `port` and is compatible
+// with this side, without creating any RDMA resources on either side.
+//
+// `ip` is the IP address or host name of the server, `port` its bootstrap port.
+//
+// `timeout` bounds the whole probe: name resolution, the TCP connect and the
+// exchange with the server.
+//
+// Probe performs only the TCP bootstrap connect and a short probe exchange, which the
+// server answers and then goes back to waiting for a real client. The server reports
+// whether it addresses the port by GID; if that differs from the local configuration
+// the two sides could not connect their queue pairs and ErrIncompatiblePeer is returned.
+// A server that does not answer the probe with the expected protocol magic yields
+// ErrBadHandshake.
+//
+// On success, it returns nil. On failure, it returns an error describing why the
+// peer cannot be used.
+//
+// Example:
+//
+//	if err := h.Probe("192.168.1.10", 8080, 2*time.Second); err != nil {
+//	    log.Fatalf("RDMA server not usable: %v", err)
+//	}
+func (h *RDMAHandler) Probe(ip string, port int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addr, err := resolveHost(ctx, ip)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("failed to reach %s:%d: %w", ip, port, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, C.PROBE_MAGIC)); err != nil {
+		return fmt.Errorf("failed to send probe to %s:%d: %w", ip, port, err)
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("%w: no probe reply from %s:%d: %v", ErrBadHandshake, ip, port, err)
+	}
+	if magic := binary.BigEndian.Uint32(reply[0:4]); magic != qpMagic {
+		return fmt.Errorf("%w: probe reply magic 0x%x", ErrBadHandshake, magic)
+	}
+	remoteGID := binary.BigEndian.Uint32(reply[4:8])&C.PROBE_FLAG_GID != 0
+	if localGID := defaultConfig().gid_idx >= 0; localGID != remoteGID {
+		return fmt.Errorf("%w: peer GID usage %t, local GID usage %t", ErrIncompatiblePeer, remoteGID, localGID)
+	}
+	return nil
+}
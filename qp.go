@@ -0,0 +1,331 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// QPType selects the transport service of the queue pair.
+//
+// Reliable Connected (RC) queue pairs acknowledge and retransmit every packet and
+// support all operations. Unreliable Connected (UC) queue pairs skip acknowledgments,
+// trading reliability for lower overhead: RDMA writes work, but lost packets are not
+// retransmitted and RDMA reads (Read, ReadNamed, Available) and atomics are not
+// supported and return ErrUnsupported. Unreliable Datagram (UD) queue pairs carry
+// unacknowledged messages of at most one path MTU and support no RDMA operations:
+// they are used with SendTo and RecvFrom only. Both peers must use the same type.
+type QPType int
+
+const (
+	QPTypeRC QPType = C.IBV_QPT_RC // Reliable Connected, the default
+	QPTypeUC QPType = C.IBV_QPT_UC // Unreliable Connected
+	QPTypeUD QPType = C.IBV_QPT_UD // Unreliable Datagram
+)
+
+// valid reports whether t is one of the supported queue pair types.
+func (t QPType) valid() bool {
+	return t == QPTypeRC || t == QPTypeUC || t == QPTypeUD
+}
+
+// requireRC returns ErrUnsupported unless res uses a Reliable Connected queue
+// pair, which RDMA reads and atomics need.
+func requireRC(res *RDMAResources, op string) error {
+	if QPType(res.res.qp.qp_type) != QPTypeRC {
+		return fmt.Errorf("%s: %w on a non-RC queue pair", op, ErrUnsupported)
+	}
+	return nil
+}
+
+// QPParams holds the values one side of a connection must learn about the other
+// to bring its queue pair up: the peer's data buffer and control region, the
+// peer's QP number, its starting packet sequence number, the size of its data
+// buffer and its port addressing (LID, and GID when a GID index is used).
+//
+// All fields are in host byte order.
+type QPParams struct {
+	Addr     uint64   // address of the data buffer
+	RKey     uint32   // remote key of the data buffer
+	QPN      uint32   // queue pair number
+	PSN      uint32   // starting packet sequence number of the send queue, see Options.InitialPSN
+	BufSize  uint32   // size of the data buffer in bytes, zero if unknown; see RDMAResources.MaxMessageSize
+	LID      uint16   // local identifier of the port
+	GID      [16]byte // global identifier of the port, zero if no GID index is used
+	CtrlAddr uint64   // address of the control region holding the write index
+	CtrlRKey uint32   // remote key of the control region
+}
+
+// RemoteRegion describes the peer's side of a connection as learned during the
+// queue pair handshake. It is returned by RemoteInfo for logging and diagnostics.
+type RemoteRegion struct {
+	Addr uint64 // address of the peer's data buffer
+	RKey uint32 // remote key of the peer's data buffer
+	QPN  uint32 // the peer's queue pair number
+}
+
+// String formats r for log messages, e.g. "addr=0x7f2a4c000000 rkey=0x1234 qpn=0x48".
+func (r RemoteRegion) String() string {
+	return fmt.Sprintf("addr=%#x rkey=%#x qpn=%#x", r.Addr, r.RKey, r.QPN)
+}
+
+// RemoteInfo returns the address and remote key of the peer's data buffer and the
+// peer's queue pair number, as exchanged when the connection was set up.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection. The values are those targeted by Read, Write and the
+// other one-sided operations; they cannot be modified through the result.
+//
+// On success, it returns the peer's region and nil error. On failure (the connection
+// was never established or has been released), it returns a zero region and an error.
+//
+// Example:
+//
+//	remote, err := h.RemoteInfo(res)
+//	if err != nil {
+//	    log.Fatalf("Failed to query remote info: %v", err)
+//	}
+//	log.Printf("connected to %v", remote)
+func (h *RDMAHandler) RemoteInfo(res *RDMAResources) (RemoteRegion, error) {
+	if err := res.begin(); err != nil {
+		return RemoteRegion{}, err
+	}
+	defer res.end()
+	return RemoteRegion{
+		Addr: uint64(res.res.remote_props.addr),
+		RKey: uint32(res.res.remote_props.rkey),
+		QPN:  uint32(res.res.remote_props.qp_num),
+	}, nil
+}
+
+// qpParamsFromC converts a host byte order C connection data struct.
+func qpParamsFromC(data *C.struct_cm_con_data_t) QPParams {
+	p := QPParams{
+		Addr:     uint64(data.addr),
+		RKey:     uint32(data.rkey),
+		QPN:      uint32(data.qp_num),
+		PSN:      uint32(data.psn),
+		BufSize:  uint32(data.buf_size),
+		LID:      uint16(data.lid),
+		CtrlAddr: uint64(data.ctrl_addr),
+		CtrlRKey: uint32(data.ctrl_rkey),
+	}
+	for i := range p.GID {
+		p.GID[i] = byte(data.gid[i])
+	}
+	return p
+}
+
+// toC converts p into a host byte order C connection data struct.
+func (p QPParams) toC() C.struct_cm_con_data_t {
+	var data C.struct_cm_con_data_t
+	data.addr = C.uint64_t(p.Addr)
+	data.rkey = C.uint32_t(p.RKey)
+	data.qp_num = C.uint32_t(p.QPN)
+	data.psn = C.uint32_t(p.PSN)
+	data.buf_size = C.uint32_t(p.BufSize)
+	data.lid = C.uint16_t(p.LID)
+	data.ctrl_addr = C.uint64_t(p.CtrlAddr)
+	data.ctrl_rkey = C.uint32_t(p.CtrlRKey)
+	for i, b := range p.GID {
+		data.gid[i] = C.uint8_t(b)
+	}
+	return data
+}
+
+// LocalQPParams returns the parameters the remote peer needs to connect to `res`.
+//
+// `res` is a pointer to RDMAResources whose device, memory regions and queue pair
+// have been created.
+//
+// Together with ModifyQPToInit, ModifyQPToRTR and ModifyQPToRTS it allows the
+// connection to be brought up step by step, with the parameters exchanged over
+// any channel the caller chooses.
+//
+// On success, it returns the local parameters and nil error.
+// On failure (the GID cannot be queried), it returns zero parameters and an error.
+//
+// Example:
+//
+//	local, err := h.LocalQPParams(res)
+//	if err != nil {
+//	    log.Fatalf("Failed to query local QP parameters: %v", err)
+//	}
+//	// ship local to the peer, receive its parameters as remote
+func (h *RDMAHandler) LocalQPParams(res *RDMAResources) (QPParams, error) {
+	var data C.struct_cm_con_data_t
+	if C.query_local_con_data(&res.res, &data) != 0 {
+		return QPParams{}, fmt.Errorf("failed to query local connection data")
+	}
+	return qpParamsFromC(&data), nil
+}
+
+// ModifyQPToInit transitions the queue pair of `res` from RESET to INIT, setting
+// the port and the local and remote access flags.
+//
+// This is the first step of the manual connection sequence. A side that expects to
+// receive messages should post its receive requests after this call and before the
+// peer starts sending.
+//
+// On success, it returns nil. On failure, it returns an error.
+//
+// Example:
+//
+//	if err := h.ModifyQPToInit(res); err != nil {
+//	    log.Fatalf("QP transition failed: %v", err)
+//	}
+func (h *RDMAHandler) ModifyQPToInit(res *RDMAResources) error {
+	if C.modify_qp_to_init(&res.res) != 0 {
+		return fmt.Errorf("failed to modify QP state to INIT")
+	}
+	return nil
+}
+
+// ModifyQPToRTR transitions the queue pair of `res` from INIT to RTR (ready to
+// receive), pointing it at the remote queue pair described by `remote`.
+//
+// `remote` is the peer's result of LocalQPParams. Its buffer and control region are
+// also recorded on `res` so that later Read, Write and Available calls target them.
+// For a UD queue pair, the address handle used by SendTo is created from it.
+//
+// On success, it returns nil. On failure, it returns an error.
+//
+// Example:
+//
+//	if err := h.ModifyQPToRTR(res, remote); err != nil {
+//	    log.Fatalf("QP transition failed: %v", err)
+//	}
+func (h *RDMAHandler) ModifyQPToRTR(res *RDMAResources, remote QPParams) error {
+	data := remote.toC()
+	res.res.remote_props = data
+	if C.modify_qp_to_rtr(&res.res, data.qp_num, data.lid, (*C.uint8_t)(unsafe.Pointer(&data.gid[0]))) != 0 {
+		return fmt.Errorf("failed to modify QP state to RTR")
+	}
+	// a UD queue pair reaches the peer through an address handle instead
+	if QPType(res.res.qp.qp_type) == QPTypeUD && C.create_ud_ah(&res.res) != 0 {
+		return fmt.Errorf("failed to create address handle for the peer")
+	}
+	return nil
+}
+
+// ModifyQPToRTS transitions the queue pair of `res` from RTR to RTS (ready to send).
+// After both sides have reached RTS, the connection is ready for RDMA operations.
+//
+// On success, it returns nil. On failure, it returns an error.
+//
+// Example:
+//
+//	if err := h.ModifyQPToRTS(res); err != nil {
+//	    log.Fatalf("QP transition failed: %v", err)
+//	}
+func (h *RDMAHandler) ModifyQPToRTS(res *RDMAResources) error {
+	if C.modify_qp_to_rts(&res.res) != 0 {
+		return fmt.Errorf("failed to modify QP state to RTS")
+	}
+	return nil
+}
+
+// CreateResources is the first half of a two-phase connection setup for
+// deployments that exchange the queue pair parameters out of band, for example
+// through a coordination service, instead of over the built-in TCP socket.
+//
+// It creates the device context, memory regions and queue pair with the settings
+// in `opts`, moves the queue pair to INIT and returns the resources together with
+// the parameters the peer needs, which can be serialized with
+// QPParams.MarshalBinary or as JSON. Once the peer's parameters have arrived,
+// ConnectResources completes the connection.
+//
+// A connection set up this way has no synchronization socket, so only operations
+// that do not synchronize with the peer can be used: WriteAt, ReadAt, Flush,
+// CompareAndSwap and FetchAndAdd, and SendTo and RecvFrom on a UD queue pair.
+// Read, Write, Send, Recv and the other synchronized operations return
+// ErrUnsupported. Options.DialTimeout,
+// AcceptTimeout and BindAddress are not used.
+//
+// On success, it returns the resources, the local parameters and nil error. On
+// failure, it returns nil, zero parameters and the error encountered. Resources
+// that are not going to be connected must be released with Destroy.
+//
+// Example:
+//
+//	res, local, err := h.CreateResources(rdmahandler.Options{})
+//	if err != nil {
+//	    log.Fatalf("Failed to create RDMA resources: %v", err)
+//	}
+//	msg, _ := local.MarshalBinary()
+//	registry.Publish("node-a", msg)
+//	var remote rdmahandler.QPParams
+//	if err := remote.UnmarshalBinary(registry.Wait("node-b")); err != nil {
+//	    log.Fatalf("Bad parameters from peer: %v", err)
+//	}
+//	if err := h.ConnectResources(res, remote); err != nil {
+//	    log.Fatalf("Failed to connect: %v", err)
+//	}
+func (h *RDMAHandler) CreateResources(opts Options) (*RDMAResources, QPParams, error) {
+	if err := opts.validate(); err != nil {
+		return nil, QPParams{}, err
+	}
+	res, err := createResources(-1, opts, nil)
+	if err != nil {
+		return nil, QPParams{}, err
+	}
+	local, err := h.LocalQPParams(res)
+	if err == nil {
+		err = h.ModifyQPToInit(res)
+	}
+	if err != nil {
+		C.resources_destroy(&res.res)
+		return nil, QPParams{}, err
+	}
+	res.config = opts
+	return res, local, nil
+}
+
+// ConnectResources is the second half of the two-phase connection setup started
+// with CreateResources. It moves the queue pair of `res` to RTR and RTS against the
+// peer described by `remote`, the parameters returned by the peer's
+// CreateResources. The peer must be connected the same way before either side's
+// operations can complete.
+//
+// On success, the connection is Connected and it returns nil. On failure, it
+// returns an error; the resources must still be released with Destroy.
+func (h *RDMAHandler) ConnectResources(res *RDMAResources, remote QPParams) error {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if res.State() != Uninitialized || res.res.sock >= 0 {
+		return fmt.Errorf("connection was not created with CreateResources or is already connected")
+	}
+	if err := h.ModifyQPToRTR(res, remote); err != nil {
+		return err
+	}
+	if err := h.ModifyQPToRTS(res); err != nil {
+		return err
+	}
+	res.markConnected(res.config)
+	return nil
+}
+
+// PathMTU returns the path MTU in bytes used by the queue pair of `res`. It can be
+// lower than Options.PathMTU if the port does not support the requested value.
+//
+// On success, it returns the MTU and nil error. On failure, it returns 0 and an error.
+//
+// Example:
+//
+//	mtu, err := res.PathMTU()
+//	if err == nil && mtu < 4096 {
+//	    log.Printf("port limited the path MTU to %d", mtu)
+//	}
+func (res *RDMAResources) PathMTU() (int, error) {
+	if err := res.checkOpen(); err != nil {
+		return 0, err
+	}
+	mtu, err := C.query_path_mtu(res.res.qp)
+	if mtu < 0 {
+		return 0, newRDMAError("query_path_mtu", mtu, err)
+	}
+	// enum ibv_mtu counts from IBV_MTU_256 = 1 in powers of two
+	return 128 << mtu, nil
+}
@@ -4,7 +4,13 @@ struct config_t config = {
 	NULL,  /* server_name */
 	19875, /* tcp_port */
 	1,	   /* ib_port */
-	-1 /* gid_idx */};
+	-1,	   /* gid_idx */
+	IBV_QPT_RC, /* qp_type */
+	0,		   /* path_mtu */
+	0x12,	   /* qp_timeout */
+	6,		   /* retry_cnt */
+	0,		   /* rnr_retry */
+	IBV_LINK_LAYER_UNSPECIFIED /* link_layer */};
 /******************************************************************************
 Socket operations
 For simplicity, the example program uses TCP sockets to exchange control
@@ -18,17 +24,19 @@ this example
 输入:
 servername：要连接的服务器的 URL（在服务器模式下为 NULL）。
 port：服务的端口号。
+timeout_ms：连接（客户端）或等待客户端（服务器）的超时毫秒数，小于 0 表示一直等待。
 
 * Output
 * none
 *
 * Returns
-* socket (fd) on success, negative error code on failure
+* socket (fd) on success, SOCK_TIMEOUT if timeout_ms passed, negative error
+* code on other failures
 *
 * Description
 否则，在指定端口上监听传入连接。
 ******************************************************************************/
-int sock_connect(const char *servername, int port)
+int sock_connect(const char *servername, int port, int timeout_ms)
 {
 	// ：struct addrinfo *resolved_addr 和 *iterator: 用于存储 getaddrinfo 函数返回的地址信息和遍历这些地址的迭代器。
 	struct addrinfo *resolved_addr = NULL;
@@ -38,18 +46,36 @@ int sock_connect(const char *servername, int port)
 
 	// int sockfd 和 listenfd: 分别用于存储套接字文件描述符和监听文件描述符。
 	int sockfd = -1;
-	int listenfd = 0;
+	int listenfd;
 	int tmp;
+	int timed_out = 0;
 
 	// ：struct addrinfo hints: 用于指定 getaddrinfo 函数的配置，如套接字类型和协议族。
 	struct addrinfo hints =
 		{
-			// ：.ai_flags = AI_PASSIVE：这个标志表示套接字用于被动监听（例如，用于服务器端口监听），而不是主动连接。
-			.ai_flags = AI_PASSIVE,
-			// .ai_family = AF_INET：指定地址族为 IPv4。这意味着我们只对 IPv4 地址感兴趣。
-			.ai_family = AF_INET,
+			// 客户端模式下地址已在 Go 侧解析为 IP 字面量，可能是 IPv4 也可能是 IPv6
+			.ai_family = AF_UNSPEC,
 			//.ai_socktype = SOCK_STREAM：指定套接字类型为流套接字，通常用于 TCP 连接。
 			.ai_socktype = SOCK_STREAM};
+
+	if (!servername)
+	{
+		/* Server mode. Set up listening socket an accept a connection */
+		listenfd = sock_listen(NULL, port, 0);
+		if (listenfd < 0)
+			return -1;
+		sockfd = sock_accept(listenfd, timeout_ms, config.gid_idx);
+		close(listenfd);
+		if (sockfd == SOCK_TIMEOUT)
+			fprintf(stderr, "no client connected within %d ms\n", timeout_ms);
+		else if (sockfd < 0)
+		{
+			perror("server accept");
+			fprintf(stderr, "accept() failed\n");
+		}
+		return sockfd;
+	}
+
 	if (sprintf(service, "%d", port) < 0)
 		goto sock_connect_exit;
 
@@ -67,47 +93,475 @@ int sock_connect(const char *servername, int port)
 		sockfd = socket(iterator->ai_family, iterator->ai_socktype, iterator->ai_protocol);
 		if (sockfd >= 0)
 		{
-			if (servername)
-			{
-				/* Client mode. Initiate connection to remote */
-				if ((tmp = connect(sockfd, iterator->ai_addr, iterator->ai_addrlen)))
-				{
-					fprintf(stdout, "failed connect \n");
-					close(sockfd);
-					sockfd = -1;
-				}
-			}
-			else
+			/* Client mode. Initiate connection to remote */
+			if ((tmp = connect_timeout(sockfd, iterator->ai_addr, iterator->ai_addrlen, timeout_ms)))
 			{
-				/* Server mode. Set up listening socket an accept a connection */
-				listenfd = sockfd;
+				verbose_print("failed connect \n");
+				timed_out = tmp == SOCK_TIMEOUT;
+				close(sockfd);
 				sockfd = -1;
-				if (bind(listenfd, iterator->ai_addr, iterator->ai_addrlen))
-					goto sock_connect_exit;
-				listen(listenfd, 1);
-				sockfd = accept(listenfd, NULL, 0);
 			}
+			else
+				break;
 		}
 	}
 
 sock_connect_exit:
-	if (listenfd)
-		close(listenfd);
 	if (resolved_addr)
 		freeaddrinfo(resolved_addr);
 	if (sockfd < 0)
 	{
-		if (servername)
-			fprintf(stderr, "Couldn't connect to %s:%d\n", servername, port);
-		else
+		fprintf(stderr, "Couldn't connect to %s:%d\n", servername, port);
+		if (timed_out)
+			sockfd = SOCK_TIMEOUT;
+	}
+	return sockfd;
+}
+/******************************************************************************
+* Function: connect_timeout
+*
+* Input
+* sockfd socket to connect
+* addr, addrlen address to connect to
+* timeout_ms timeout in milliseconds, negative to wait as long as connect does
+*
+* Output
+* none
+*
+* Returns
+* 0 on success, SOCK_TIMEOUT if the timeout passed, -1 on other failures
+*
+* Description
+* connect() with a timeout. The socket is made non-blocking for the duration
+* of the connection attempt and restored afterwards.
+******************************************************************************/
+int connect_timeout(int sockfd, const struct sockaddr *addr, socklen_t addrlen, int timeout_ms)
+{
+	struct pollfd pfd;
+	socklen_t len;
+	int flags;
+	int err;
+	int rc;
+	if (timeout_ms < 0)
+		return connect(sockfd, addr, addrlen) ? -1 : 0;
+	flags = fcntl(sockfd, F_GETFL, 0);
+	if (flags < 0 || fcntl(sockfd, F_SETFL, flags | O_NONBLOCK) < 0)
+		return -1;
+	rc = connect(sockfd, addr, addrlen);
+	if (rc && errno == EINPROGRESS)
+	{
+		// 连接在后台进行，等待套接字变为可写或超时
+		pfd.fd = sockfd;
+		pfd.events = POLLOUT;
+		pfd.revents = 0;
+		do
+			rc = poll(&pfd, 1, timeout_ms);
+		while (rc < 0 && errno == EINTR);
+		if (rc == 0)
 		{
-			perror("server accept");
-			fprintf(stderr, "accept() failed\n");
+			errno = ETIMEDOUT;
+			rc = SOCK_TIMEOUT;
+		}
+		else if (rc > 0)
+		{
+			len = sizeof(err);
+			if (getsockopt(sockfd, SOL_SOCKET, SO_ERROR, &err, &len) < 0)
+				rc = -1;
+			else if (err)
+			{
+				errno = err;
+				rc = -1;
+			}
+			else
+				rc = 0;
+		}
+	}
+	else if (rc)
+		rc = -1;
+	fcntl(sockfd, F_SETFL, flags);
+	return rc;
+}
+/******************************************************************************
+* Function: sock_set_timeout
+*
+* Input
+* sock socket to configure
+* timeout_ms timeout in milliseconds, 0 or negative to block indefinitely
+*
+* Output
+* none
+*
+* Returns
+* 0 on success, -1 on failure
+*
+* Description
+* Set SO_RCVTIMEO and SO_SNDTIMEO on the socket, so that sock_sync_data fails
+* instead of blocking forever when the peer stops responding.
+******************************************************************************/
+int sock_set_timeout(int sock, int timeout_ms)
+{
+	struct timeval tv;
+	memset(&tv, 0, sizeof(tv));
+	if (timeout_ms > 0)
+	{
+		tv.tv_sec = timeout_ms / 1000;
+		tv.tv_usec = (timeout_ms % 1000) * 1000;
+	}
+	if (setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv)) ||
+		setsockopt(sock, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv)))
+	{
+		fprintf(stderr, "failed to set socket timeout\n");
+		return -1;
+	}
+	return 0;
+}
+/******************************************************************************
+* Function: sock_listen
+*
+* Input
+* bind_addr IP address of the local interface to listen on, NULL for all interfaces
+* port port to listen on
+* reuse_addr non-zero to set SO_REUSEADDR before binding
+*
+* Output
+* none
+*
+* Returns
+* listening socket (fd) on success, SOCK_IN_USE if the port is already in use,
+* other negative values on failure
+*
+* Description
+* Bind a TCP socket to port on bind_addr, or on all interfaces, and start
+* listening. On all interfaces an IPv6 socket that also accepts IPv4 clients is
+* preferred; if IPv6 is not available the socket listens on IPv4 only. Connections are taken with sock_accept; the socket stays open until the
+* caller closes it, so several clients can be accepted on it.
+******************************************************************************/
+int sock_listen(const char *bind_addr, int port, int reuse_addr)
+{
+	struct addrinfo *resolved_addr = NULL;
+	struct addrinfo *iterator;
+	char service[6];
+	int listenfd = -1;
+	int rc;
+	int pass;
+	int v6only = 0;
+	int in_use = 0;
+	struct addrinfo hints =
+		{
+			// ：.ai_flags = AI_PASSIVE：这个标志表示套接字用于被动监听（例如，用于服务器端口监听），而不是主动连接。
+			.ai_flags = AI_PASSIVE,
+			// .ai_family = AF_UNSPEC：同时取得 IPv6 和 IPv4 的通配地址，客户端可以使用任意一种地址连接
+			.ai_family = AF_UNSPEC,
+			.ai_socktype = SOCK_STREAM};
+	if (sprintf(service, "%d", port) < 0)
+		return -1;
+	// 指定了本地地址时只绑定该地址，地址已在 Go 侧校验为 IP 字面量
+	if (bind_addr)
+		hints.ai_flags |= AI_NUMERICHOST;
+	rc = getaddrinfo(bind_addr, service, &hints, &resolved_addr);
+	if (rc)
+	{
+		fprintf(stderr, "%s for %s:%d\n", gai_strerror(rc), bind_addr ? bind_addr : "*", port);
+		return -1;
+	}
+	// 第一轮只尝试 IPv6 地址（关闭 IPV6_V6ONLY 以便同时接受 IPv4 客户端），失败后第二轮尝试其余地址
+	for (pass = 0; pass < 2 && listenfd < 0; pass++)
+	{
+		for (iterator = resolved_addr; iterator; iterator = iterator->ai_next)
+		{
+			if ((iterator->ai_family == AF_INET6) != (pass == 0))
+				continue;
+			listenfd = socket(iterator->ai_family, iterator->ai_socktype, iterator->ai_protocol);
+			if (listenfd < 0)
+				continue;
+			if (iterator->ai_family == AF_INET6 &&
+				setsockopt(listenfd, IPPROTO_IPV6, IPV6_V6ONLY, &v6only, sizeof(v6only)))
+			{
+				close(listenfd);
+				listenfd = -1;
+				continue;
+			}
+			// SO_REUSEADDR 允许在上一个监听者的连接仍处于 TIME_WAIT 时立即重新绑定端口
+			if (reuse_addr &&
+				setsockopt(listenfd, SOL_SOCKET, SO_REUSEADDR, &reuse_addr, sizeof(reuse_addr)))
+			{
+				close(listenfd);
+				listenfd = -1;
+				continue;
+			}
+			if (!bind(listenfd, iterator->ai_addr, iterator->ai_addrlen) && !listen(listenfd, SOMAXCONN))
+				break;
+			if (errno == EADDRINUSE)
+				in_use = 1;
+			close(listenfd);
+			listenfd = -1;
+		}
+	}
+	freeaddrinfo(resolved_addr);
+	if (listenfd < 0)
+	{
+		fprintf(stderr, "couldn't listen on %s:%d\n", bind_addr ? bind_addr : "*", port);
+		// 恢复 errno，调用者据此区分端口被占用和其他失败
+		if (in_use)
+		{
+			errno = EADDRINUSE;
+			return SOCK_IN_USE;
+		}
+	}
+	return listenfd;
+}
+/******************************************************************************
+* Function: sock_listen_unix
+*
+* Input
+* path file system path of the AF_UNIX socket to create
+*
+* Output
+* none
+*
+* Returns
+* listening socket (fd) on success, SOCK_IN_USE if another process listens on
+* path, other negative values on failure
+*
+* Description
+* Like sock_listen, but for peers on the same host: bind an AF_UNIX stream
+* socket to path and start listening. A socket file left behind by a listener
+* that exited without removing it is replaced; a path on which a listener
+* still accepts connections is not. Connections are taken with sock_accept.
+******************************************************************************/
+int sock_listen_unix(const char *path)
+{
+	struct sockaddr_un addr;
+	int listenfd;
+	int probefd;
+	int rc;
+	memset(&addr, 0, sizeof(addr));
+	addr.sun_family = AF_UNIX;
+	if (strlen(path) >= sizeof(addr.sun_path))
+	{
+		fprintf(stderr, "unix socket path %s is too long\n", path);
+		errno = ENAMETOOLONG;
+		return -1;
+	}
+	strcpy(addr.sun_path, path);
+	listenfd = socket(AF_UNIX, SOCK_STREAM, 0);
+	if (listenfd < 0)
+		return -1;
+	rc = bind(listenfd, (struct sockaddr *)&addr, sizeof(addr));
+	if (rc && errno == EADDRINUSE)
+	{
+		// 文件已存在：能连上说明仍有监听者，否则是遗留的套接字文件，删除后重新绑定
+		probefd = socket(AF_UNIX, SOCK_STREAM, 0);
+		if (probefd >= 0 && !connect(probefd, (struct sockaddr *)&addr, sizeof(addr)))
+		{
+			close(probefd);
+			close(listenfd);
+			fprintf(stderr, "unix socket %s is already in use\n", path);
+			errno = EADDRINUSE;
+			return SOCK_IN_USE;
 		}
+		if (probefd >= 0)
+			close(probefd);
+		unlink(path);
+		rc = bind(listenfd, (struct sockaddr *)&addr, sizeof(addr));
+	}
+	if (rc || listen(listenfd, SOMAXCONN))
+	{
+		fprintf(stderr, "couldn't listen on unix socket %s\n", path);
+		close(listenfd);
+		return -1;
+	}
+	return listenfd;
+}
+/******************************************************************************
+* Function: sock_connect_unix
+*
+* Input
+* path file system path of the server's AF_UNIX socket
+* timeout_ms connection timeout in milliseconds, negative to wait as long as
+* connect does
+*
+* Output
+* none
+*
+* Returns
+* socket (fd) on success, SOCK_TIMEOUT if timeout_ms passed, negative error
+* code on other failures
+*
+* Description
+* Client counterpart of sock_listen_unix.
+******************************************************************************/
+int sock_connect_unix(const char *path, int timeout_ms)
+{
+	struct sockaddr_un addr;
+	int sockfd;
+	int rc;
+	memset(&addr, 0, sizeof(addr));
+	addr.sun_family = AF_UNIX;
+	if (strlen(path) >= sizeof(addr.sun_path))
+	{
+		fprintf(stderr, "unix socket path %s is too long\n", path);
+		errno = ENAMETOOLONG;
+		return -1;
+	}
+	strcpy(addr.sun_path, path);
+	sockfd = socket(AF_UNIX, SOCK_STREAM, 0);
+	if (sockfd < 0)
+		return -1;
+	rc = connect_timeout(sockfd, (struct sockaddr *)&addr, sizeof(addr), timeout_ms);
+	if (rc)
+	{
+		fprintf(stderr, "Couldn't connect to unix socket %s\n", path);
+		close(sockfd);
+		return rc == SOCK_TIMEOUT ? SOCK_TIMEOUT : -1;
 	}
 	return sockfd;
 }
 /******************************************************************************
+* Function: sock_accept
+*
+* Input
+* listenfd listening socket returned by sock_listen
+* timeout_ms how long to wait for a client, negative to wait forever
+* gid_idx GID index the connections will use, reported to probes
+*
+* Output
+* none
+*
+* Returns
+* socket (fd) of the client on success, SOCK_TIMEOUT if no client connected
+* in time, other negative values on failure
+*
+* Description
+* Wait for a client to connect. Probe connections (see answer_probe) are
+* answered and do not end the wait.
+******************************************************************************/
+int sock_accept(int listenfd, int timeout_ms, int gid_idx)
+{
+	struct pollfd pfd;
+	struct timeval cur_time;
+	unsigned long deadline_msec = 0;
+	unsigned long cur_time_msec;
+	int wait_ms = -1;
+	int sockfd;
+	int rc;
+	if (timeout_ms >= 0)
+	{
+		gettimeofday(&cur_time, NULL);
+		deadline_msec = (cur_time.tv_sec * 1000) + (cur_time.tv_usec / 1000) + timeout_ms;
+	}
+	for (;;)
+	{
+		if (timeout_ms >= 0)
+		{
+			gettimeofday(&cur_time, NULL);
+			cur_time_msec = (cur_time.tv_sec * 1000) + (cur_time.tv_usec / 1000);
+			wait_ms = cur_time_msec >= deadline_msec ? 0 : (int)(deadline_msec - cur_time_msec);
+		}
+		pfd.fd = listenfd;
+		pfd.events = POLLIN;
+		pfd.revents = 0;
+		rc = poll(&pfd, 1, wait_ms);
+		if (rc < 0)
+		{
+			if (errno == EINTR)
+				continue;
+			return -1;
+		}
+		if (rc == 0)
+			return SOCK_TIMEOUT;
+		sockfd = accept(listenfd, NULL, 0);
+		if (sockfd < 0)
+			return -1;
+		// 探测连接的首个数据同样受 accept 的截止时间限制
+		if (timeout_ms >= 0)
+		{
+			gettimeofday(&cur_time, NULL);
+			cur_time_msec = (cur_time.tv_sec * 1000) + (cur_time.tv_usec / 1000);
+			wait_ms = cur_time_msec >= deadline_msec ? 0 : (int)(deadline_msec - cur_time_msec);
+		}
+		// 探测连接（见 answer_probe）应答后继续等待真正的客户端
+		rc = answer_probe(sockfd, gid_idx, wait_ms);
+		if (rc == 0)
+			return sockfd;
+		if (rc == SOCK_TIMEOUT)
+			return SOCK_TIMEOUT;
+	}
+}
+/******************************************************************************
+* Function: answer_probe
+*
+* Input
+* sock freshly accepted socket
+* gid_idx GID index the connection would use, negative if no GID is used
+* timeout_ms how long to wait for the first bytes, negative to wait forever
+*
+* Output
+* none
+*
+* Returns
+* 1 if the connection was a probe (or closed before sending anything) and has
+* been closed, SOCK_TIMEOUT if nothing arrived in time and the connection has
+* been closed, 0 if it is a regular client connection
+*
+* Description
+* Peek at the first bytes sent by the peer. A probe starts with PROBE_MAGIC and
+* is answered with CM_MAGIC and the PROBE_FLAG_* flags of this side, so that the
+* prober can check reachability and compatibility without the server setting
+* up any RDMA resources for it. Regular clients start with a connection data
+* message and are left untouched. The peek is bounded by timeout_ms so that a
+* peer which connects and stays silent cannot hold up the accept past its
+* deadline.
+******************************************************************************/
+int answer_probe(int sock, int gid_idx, int timeout_ms)
+{
+	struct timeval tv = {0, 0};
+	uint32_t magic;
+	uint32_t reply[2];
+	ssize_t n;
+	if (timeout_ms >= 0)
+	{
+		// 超时为 0 表示永久等待，因此至少等待 1 毫秒
+		if (timeout_ms == 0)
+			timeout_ms = 1;
+		tv.tv_sec = timeout_ms / 1000;
+		tv.tv_usec = (timeout_ms % 1000) * 1000;
+		setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
+	}
+	do
+		n = recv(sock, &magic, sizeof(magic), MSG_PEEK | MSG_WAITALL);
+	while (n < 0 && errno == EINTR);
+	if (timeout_ms >= 0)
+	{
+		tv.tv_sec = 0;
+		tv.tv_usec = 0;
+		setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
+	}
+	if (n < 0 && (errno == EAGAIN || errno == EWOULDBLOCK))
+	{
+		// 截止时间内对端未发送任何数据
+		close(sock);
+		return SOCK_TIMEOUT;
+	}
+	if (n <= 0)
+	{
+		// 对端未发送任何数据就断开（例如端口扫描），继续等待
+		close(sock);
+		return 1;
+	}
+	if (n < (ssize_t)sizeof(magic) || ntohl(magic) != PROBE_MAGIC)
+		return 0;
+	if (recv(sock, &magic, sizeof(magic), 0) == sizeof(magic))
+	{
+		reply[0] = htonl(CM_MAGIC);
+		reply[1] = htonl(gid_idx >= 0 ? PROBE_FLAG_GID : 0);
+		if (write(sock, reply, sizeof(reply)) != sizeof(reply))
+			fprintf(stderr, "failed to answer probe\n");
+	}
+	close(sock);
+	return 1;
+}
+/******************************************************************************
 * Function: sock_sync_data
 *
 * Input
@@ -119,7 +573,8 @@ sock_connect_exit:
 * remote_data pointer to buffer to receive remote data
 *
 * Returns
-* 0 on success, negative error code on failure
+* 0 on success, SOCK_CLOSED if the peer closed the socket before all of its
+* data arrived, -1 on other failures with errno set
 *
 * Description
 * Sync data across a socket. The indicated local data will be sent to the
@@ -131,226 +586,1555 @@ sock_sync_data 函数在 RDMA 程序中通常用于同步控制信息，例如
 函数首先将本地数据（local_data）发送到远端，然后等待并接收远端发回的数据到 remote_data 缓冲区。
 返回值为指向字符串的指针
 * Also note this is a blocking function and will wait for the full data to be
-* received from the remote.
+* received from the remote. Short writes and reads, and calls interrupted by
+* a signal, are retried until all xfer_size bytes have been transferred.
 *
 ******************************************************************************/
 int sock_sync_data(int sock, int xfer_size, char *local_data, char *remote_data)
 {
 	int rc;
-	int read_bytes = 0;
-	int total_read_bytes = 0;
-	rc = write(sock, local_data, xfer_size);
-	if (rc < xfer_size)
-		fprintf(stderr, "Failed writing data during sock_sync_data\n");
-	else
-		rc = 0;
-	// ：使用 while 循环从套接字读取数据，直到读取到的总字节数等于预期的 xfer_size
-	while (!rc && total_read_bytes < xfer_size)
+	int saved_errno;
+	int done = 0;
+	// write 和 read 都可能只传输部分数据或被信号中断（EINTR），因此循环直到传输完全部 xfer_size 字节
+	while (done < xfer_size)
 	{
-		read_bytes = read(sock, remote_data, xfer_size);
-		if (read_bytes > 0)
-			total_read_bytes += read_bytes;
-		else
-			rc = read_bytes;
+		// 使用 MSG_NOSIGNAL，对端已关闭时返回 EPIPE 而不是触发 SIGPIPE
+		rc = send(sock, local_data + done, xfer_size - done, MSG_NOSIGNAL);
+		if (rc < 0 && errno == EINTR)
+			continue;
+		if (rc <= 0)
+		{
+			saved_errno = errno;
+			fprintf(stderr, "Failed writing data during sock_sync_data\n");
+			errno = saved_errno;
+			return -1;
+		}
+		done += rc;
 	}
-	return rc;
+	done = 0;
+	while (done < xfer_size)
+	{
+		// 每次读到 remote_data 中尚未填充的位置
+		rc = read(sock, remote_data + done, xfer_size - done);
+		if (rc < 0 && errno == EINTR)
+			continue;
+		if (rc == 0)
+		{
+			fprintf(stderr, "connection closed by peer after %d of %d bytes during sock_sync_data\n", done, xfer_size);
+			return SOCK_CLOSED;
+		}
+		if (rc < 0)
+		{
+			saved_errno = errno;
+			fprintf(stderr, "Failed reading data during sock_sync_data\n");
+			errno = saved_errno;
+			return -1;
+		}
+		done += rc;
+	}
+	return 0;
 }
 /******************************************************************************
 End of socket operations
 ******************************************************************************/
-/* poll_completion */
+/* completion polling */
 /******************************************************************************
-* Function: poll_completion
+* Function: wait_cq
 *
 * Input
 * res pointer to resources structure
 *
 * Output
 * none
-无直接输出参数，但函数通过轮询 CQ 来获取 RDMA 操作的完成状态。
 *
 * Returns
-* 0 on success, 1 on failure
+* the completion queue the poll functions wait on
 *
 * Description
-* Poll the completion queue for a single event. This function will continue to
-* poll the queue until MAX_POLL_CQ_TIMEOUT milliseconds have passed.
+* Return res->recv_cq if the resources were created with separate_cqs and
+* the caller set res->poll_recv to wait for a receive, res->cq otherwise.
 *
 ******************************************************************************/
-int poll_completion(struct resources *res)
+struct ibv_cq *wait_cq(struct resources *res)
+{
+	return res->poll_recv && res->recv_cq ? res->recv_cq : res->cq;
+}
+/******************************************************************************
+* Function: poll_cq_batch
+*
+* Input
+* res pointer to resources structure
+* num_entries the maximum number of completions to retrieve, between 1 and
+* MAX_POLL_BATCH; values out of range are clamped
+*
+* Output
+* wc array of at least num_entries work completions, filled with the
+* completions retrieved
+*
+* Returns
+* the number of completions retrieved, 0 if the CQ is empty, a negative value
+* if polling failed
+*
+* Description
+* Retrieve up to num_entries completions from the CQ selected by wait_cq with
+* a single ibv_poll_cq call. The completions are returned as they are, of any
+* status and for any work request; matching them to the operations waiting
+* for them is left to the caller.
+*
+******************************************************************************/
+int poll_cq_batch(struct resources *res, struct ibv_wc *wc, int num_entries)
 {
-	// 定义并初始化用于轮询的变量，包括 struct ibv_wc wc（用于存储完成事件的详情）和时间相关的变量（用于控制轮询超时）
-	struct ibv_wc wc;
-	unsigned long start_time_msec;
-	unsigned long cur_time_msec;
-	struct timeval cur_time;
 	int poll_result;
-	int rc = 0;
-	/* poll the completion for a while before giving up of doing it .. */
-	gettimeofday(&cur_time, NULL);
-	start_time_msec = (cur_time.tv_sec * 1000) + (cur_time.tv_usec / 1000);
-	do
-	{
-		poll_result = ibv_poll_cq(res->cq, 1, &wc);
-		gettimeofday(&cur_time, NULL);
-		cur_time_msec = (cur_time.tv_sec * 1000) + (cur_time.tv_usec / 1000);
-	} while ((poll_result == 0) && ((cur_time_msec - start_time_msec) < MAX_POLL_CQ_TIMEOUT));
-
-	if (poll_result < 0)
-	{
-		// 表示轮询 CQ 失败，打印错误消息，并设置返回代码为 1。
+	if (num_entries < 1)
+		num_entries = 1;
+	if (num_entries > MAX_POLL_BATCH)
+		num_entries = MAX_POLL_BATCH;
+	poll_result = ibv_poll_cq(wait_cq(res), num_entries, wc);
+	if (poll_result == 0)
+		__atomic_add_fetch(&res->poll_spins, 1, __ATOMIC_RELAXED);
+	else if (poll_result < 0)
 		fprintf(stderr, "poll CQ failed\n");
-		rc = 1;
-	}
-	else if (poll_result == 0)
-	{
-		// 表示轮询超时但未找到完成事件，打印超时错误消息，并设置返回代码为 1。
-		fprintf(stderr, "completion wasn't found in the CQ after timeout\n");
-		rc = 1;
-	}
-	else
-	{
-		/* CQE found */
-		fprintf(stdout, "completion was found in CQ with status 0x%x\n", wc.status);
-		if (wc.status != IBV_WC_SUCCESS)
-		{
-			fprintf(stderr, "got bad completion with status: 0x%x, vendor syndrome: 0x%x\n", wc.status,
-					wc.vendor_err);
-			rc = 1;
-		}
+	return poll_result;
+}
+/******************************************************************************
+* Function: poll_cq_spin
+*
+* Input
+* res pointer to resources structure
+* num_entries the maximum number of completions to retrieve, as for
+* poll_cq_batch
+* spins the maximum number of empty polls
+*
+* Output
+* wc array of at least num_entries work completions, filled with the
+* completions retrieved
+*
+* Returns
+* the same values as poll_cq_batch; 0 if the CQ stayed empty for spins polls
+*
+* Description
+* Call poll_cq_batch until it retrieves completions or spins polls came back
+* empty. The busy wait stays in C for a bounded number of polls, so that the
+* caller can check its deadline or let other goroutines run in between
+* without paying a cgo call per poll.
+*
+******************************************************************************/
+int poll_cq_spin(struct resources *res, struct ibv_wc *wc, int num_entries, int spins)
+{
+	int poll_result = 0;
+	int i;
+	for (i = 0; i < spins && poll_result == 0; i++)
+		poll_result = poll_cq_batch(res, wc, num_entries);
+	return poll_result;
+}
+/******************************************************************************
+* Function: arm_cq
+*
+* Input
+* res pointer to resources structure, created with event_mode set
+*
+* Output
+* none
+*
+* Returns
+* 0 on success, error code of ibv_req_notify_cq on failure
+*
+* Description
+* Request a notification on the completion channel for the next completion
+* on the CQ selected by wait_cq. The caller must poll the CQ once more after
+* arming it before sleeping in wait_cq_event, so that a completion that
+* arrived before the CQ was armed is not missed.
+*
+******************************************************************************/
+int arm_cq(struct resources *res)
+{
+	int rc;
+	if (!res->channel)
+	{
+		fprintf(stderr, "no completion channel, resources were not created in event mode\n");
+		return 1;
+	}
+	rc = ibv_req_notify_cq(wait_cq(res), 0);
+	if (rc)
+		fprintf(stderr, "failed to request CQ notification\n");
+	return rc;
+}
+/******************************************************************************
+* Function: wait_cq_event
+*
+* Input
+* res pointer to resources structure, created with event_mode set
+* timeout_ms how long to sleep at most, in milliseconds
+*
+* Output
+* none
+*
+* Returns
+* 0 if an event arrived or the wait was interrupted by a signal,
+* POLL_TIMEOUT if nothing arrived in time, 1 on failure
+*
+* Description
+* Sleep on the completion channel until a CQ armed with arm_cq signals a
+* completion. The event taken with ibv_get_cq_event is acknowledged right
+* away, so the CQ can always be destroyed. The CQ must be armed again before
+* the next wait.
+*
+******************************************************************************/
+int wait_cq_event(struct resources *res, int timeout_ms)
+{
+	struct ibv_cq *ev_cq;
+	void *ev_ctx;
+	struct pollfd pfd;
+	int poll_result;
+	pfd.fd = res->channel->fd;
+	pfd.events = POLLIN;
+	poll_result = poll(&pfd, 1, timeout_ms);
+	if (poll_result < 0 && errno == EINTR)
+		return 0;
+	if (poll_result == 0)
+	{
+		fprintf(stderr, "completion wasn't found in the CQ after timeout\n");
+		return POLL_TIMEOUT;
+	}
+	if (poll_result < 0)
+	{
+		fprintf(stderr, "failed to wait on the completion channel\n");
+		return 1;
+	}
+	if (ibv_get_cq_event(res->channel, &ev_cq, &ev_ctx))
+	{
+		fprintf(stderr, "failed to get CQ event\n");
+		return 1;
+	}
+	// 每个取得的事件都必须确认，否则 ibv_destroy_cq 会一直阻塞
+	ibv_ack_cq_events(ev_cq, 1);
+	return 0;
+}
+/******************************************************************************
+* Function: drain_async_events
+*
+* Input
+* res pointer to resources structure
+*
+* Output
+* none
+*
+* Returns
+* none
+*
+* Description
+* Consume all pending asynchronous events of the device context without
+* blocking (the async fd is non-blocking, see resources_create). CQ errors on
+* res->cq or res->recv_cq, which signal a completion queue overrun, are counted in
+* res->cq_overruns; every event is acknowledged.
+******************************************************************************/
+void drain_async_events(struct resources *res)
+{
+	struct ibv_async_event event;
+	if (!res->ib_ctx)
+		return;
+	while (!ibv_get_async_event(res->ib_ctx, &event))
+	{
+		if (event.event_type == IBV_EVENT_CQ_ERR && (event.element.cq == res->cq || event.element.cq == res->recv_cq))
+		{
+			fprintf(stderr, "CQ overrun detected\n");
+			__atomic_add_fetch(&res->cq_overruns, 1, __ATOMIC_RELAXED);
+		}
+		ibv_ack_async_event(&event);
+	}
+}
+/******************************************************************************
+* Function: next_wr_id
+*
+* Input
+* res pointer to resources structure
+*
+* Output
+* none
+*
+* Returns
+* the ID for the next send work request of res
+*
+* Description
+* Send work requests are numbered from 1 in the order they are posted, so
+* that a completion, successful or not, can be matched to its request.
+* Receive requests use their own IDs with RECV_WR_ID set, which keeps the two
+* ranges apart; see post_receive_region.
+******************************************************************************/
+uint64_t next_wr_id(struct resources *res)
+{
+	return ++res->wr_seq;
+}
+/******************************************************************************
+* Function: send_flags
+*
+* Input
+* res pointer to resources structure
+* opcode opcode of the work request
+* length total number of bytes the work request carries
+*
+* Output
+* none
+*
+* Returns
+* IBV_SEND_SIGNALED, combined with IBV_SEND_INLINE when the payload is inlined
+*
+* Description
+* Sends and RDMA writes of at most res->max_inline_data bytes are posted
+* inline: the payload is copied into the work request, which saves the
+* adapter a DMA read of the buffer and lowers the latency of small messages.
+* The buffer can be reused as soon as ibv_post_send returns.
+******************************************************************************/
+int send_flags(struct resources *res, int opcode, uint32_t length)
+{
+	// RDMA 读和原子操作没有可内联的负载
+	if ((opcode == IBV_WR_SEND || opcode == IBV_WR_RDMA_WRITE) && res->max_inline_data && length <= res->max_inline_data)
+		return IBV_SEND_SIGNALED | IBV_SEND_INLINE;
+	return IBV_SEND_SIGNALED;
+}
+/******************************************************************************
+* Function: post_send，用于创建并提交一个发送工作请求（Send Work Request）到 RDMA 队列对（Queue Pair）
+
+* Input：该函数接受一个指向资源结构体的指针和一个操作码，用于指定发送工作请求的类型。
+* res pointer to resources structure
+* opcode IBV_WR_SEND, IBV_WR_RDMA_READ or IBV_WR_RDMA_WRITE
+*
+* Output
+* none
+*
+* Returns
+* 0 on success, error code on failure
+*
+* Description
+* This function will create and post a send work request
+******************************************************************************/
+int post_send(struct resources *res, int opcode)
+{
+	// 在 RDMA 操作中，发送工作请求用于指定如何发送数据（例如，普通发送、RDMA 读或写等）。
+	// sr 的字段包括散布/聚集元素的列表、操作类型（opcode）、发送标志等
+	struct ibv_send_wr sr;
+
+	// sge 用于指定 RDMA 操作中要使用的数据缓冲区的地址、长度和本地密钥（lkey）。本地密钥是 RDMA 设备用于访问该内存区域的权限令牌。
+	struct ibv_sge sge;
+
+	// 如果 ibv_post_send 返回错误，bad_wr 将被设置为指向问题所在的发送工作请求。初始时设置为 NULL，表示没有错误。
+	struct ibv_send_wr *bad_wr = NULL;
+	int rc;
+	memset(&sge, 0, sizeof(sge));	// 使用 memset 初始化散布/聚集条目 sge。
+	sge.addr = (uintptr_t)res->buf; // 设置 sge.addr 为要发送或读写的数据的地址
+	sge.length = res->buf_size;		// 设置 sge.length 为要发送或读写的数据的长度。
+	// 对端的缓冲区较小时只传输对端缓冲区大小的数据，避免越界访问对端的内存区域
+	if (res->remote_props.buf_size && res->remote_props.buf_size < sge.length)
+		sge.length = res->remote_props.buf_size;
+	sge.lkey = res->mr->lkey;		// 设置 sge.lkey 为关联内存区域的本地密钥。
+	memset(&sr, 0, sizeof(sr));		// 使用 memset 初始化发送工作请求 sr。
+	sr.next = NULL;
+	sr.wr_id = next_wr_id(res);
+	sr.sg_list = &sge;				   // 设置 sr.sg_list 指向散布/聚集条目
+	sr.num_sge = 1;					   // 设置 sr.num_sge 为 1，表示只有一个散布/聚集条目。
+	sr.opcode = opcode;				   // 设置 sr.opcode 为传入的操作码。
+	sr.send_flags = send_flags(res, opcode, sge.length); // 设置 sr.send_flags 为 IBV_SEND_SIGNALED，以触发完成事件；小负载同时内联。
+
+	if (opcode != IBV_WR_SEND)
+	{
+		sr.wr.rdma.remote_addr = res->remote_props.addr;
+		sr.wr.rdma.rkey = res->remote_props.rkey;
+	}
+	/* there is a Receive Request in the responder side, so we won't get any into RNR flow */
+	// 在 post_send 函数中，rc 用于存储 ibv_post_send 函数的返回值，以指示操作是否成功。成功时，rc 通常为 0；失败时，它包含错误代码。
+	rc = ibv_post_send(res->qp, &sr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post SR\n");
+	return rc;
+}
+/******************************************************************************
+ * Function: post_receive
+ * Input
+ * res pointer to resources structure
+ *  int post_receive(struct resources *res): 该函数接受一个指向包含 RDMA 资源的 resources 结构体的指针 res
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ *
+ ******************************************************************************/
+int post_receive(struct resources *res)
+{
+	struct ibv_recv_wr rr;
+	struct ibv_sge sge;
+	struct ibv_recv_wr *bad_wr;
+	int rc;
+	/* prepare the scatter/gather entry */
+	memset(&sge, 0, sizeof(sge));
+	sge.addr = (uintptr_t)res->buf;
+	sge.length = res->buf_size;
+	sge.lkey = res->mr->lkey;
+
+	memset(&rr, 0, sizeof(rr));
+	rr.next = NULL;
+	rr.wr_id = RECV_WR_ID;
+	rr.sg_list = &sge; // 设置 rr.sg_list 指向散布/聚集条目
+	rr.num_sge = 1;	   // 设置 rr.num_sge 为 1，表示只有一个散布/聚集条目
+
+	rc = ibv_post_recv(res->qp, &rr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post RR\n");
+	return rc;
+}
+/******************************************************************************
+ * Function: post_receive_region
+ *
+ * Input
+ * res pointer to resources structure
+ * mr memory region returned by register_buffer that receives the message
+ * wr_id work request ID reported by the completion of the receive, combined
+ * with RECV_WR_ID
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ * Post a receive request covering the whole memory region mr, so that
+ * several receives can be outstanding at the same time, each in its own
+ * buffer.
+ ******************************************************************************/
+int post_receive_region(struct resources *res, struct ibv_mr *mr, uint64_t wr_id)
+{
+	struct ibv_recv_wr rr;
+	struct ibv_sge sge;
+	struct ibv_recv_wr *bad_wr;
+	int rc;
+	memset(&sge, 0, sizeof(sge));
+	sge.addr = (uintptr_t)mr->addr;
+	sge.length = mr->length;
+	sge.lkey = mr->lkey;
+
+	memset(&rr, 0, sizeof(rr));
+	rr.next = NULL;
+	rr.wr_id = RECV_WR_ID | wr_id;
+	rr.sg_list = &sge;
+	rr.num_sge = 1;
+
+	rc = ibv_post_recv(res->qp, &rr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post RR\n");
+	return rc;
+}
+/******************************************************************************
+ * Function: post_ud_send
+ *
+ * Input
+ * res pointer to resources structure, with a UD QP and res->ah created
+ * length number of bytes at the start of res->buf to send
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ * Send the first length bytes of res->buf as one datagram to the peer's QP
+ * through the address handle created by create_ud_ah.
+ ******************************************************************************/
+int post_ud_send(struct resources *res, uint32_t length)
+{
+	struct ibv_send_wr sr;
+	struct ibv_sge sge;
+	struct ibv_send_wr *bad_wr = NULL;
+	int rc;
+	memset(&sge, 0, sizeof(sge));
+	sge.addr = (uintptr_t)res->buf;
+	sge.length = length;
+	sge.lkey = res->mr->lkey;
+	memset(&sr, 0, sizeof(sr));
+	sr.next = NULL;
+	sr.wr_id = next_wr_id(res);
+	sr.sg_list = &sge;
+	sr.num_sge = 1;
+	sr.opcode = IBV_WR_SEND;
+	sr.send_flags = send_flags(res, IBV_WR_SEND, length);
+	sr.wr.ud.ah = res->ah;
+	sr.wr.ud.remote_qpn = res->remote_props.qp_num;
+	sr.wr.ud.remote_qkey = UD_QKEY;
+	rc = ibv_post_send(res->qp, &sr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post UD SR\n");
+	return rc;
+}
+/******************************************************************************
+ * Function: post_ud_receive
+ *
+ * Input
+ * res pointer to resources structure, with a UD QP
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ * Post a receive request for one datagram into res->ud_buf. The device
+ * writes the 40-byte GRH first, so the data starts at UD_GRH_SIZE.
+ ******************************************************************************/
+int post_ud_receive(struct resources *res)
+{
+	struct ibv_recv_wr rr;
+	struct ibv_sge sge;
+	struct ibv_recv_wr *bad_wr;
+	int rc;
+	memset(&sge, 0, sizeof(sge));
+	sge.addr = (uintptr_t)res->ud_buf;
+	sge.length = UD_GRH_SIZE + res->buf_size;
+	sge.lkey = res->ud_mr->lkey;
+	memset(&rr, 0, sizeof(rr));
+	rr.next = NULL;
+	rr.wr_id = RECV_WR_ID;
+	rr.sg_list = &sge;
+	rr.num_sge = 1;
+	rc = ibv_post_recv(res->qp, &rr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post UD RR\n");
+	return rc;
+}
+/******************************************************************************
+ * Function: create_ud_ah
+ *
+ * Input
+ * res pointer to resources structure, with res->remote_props set
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, 1 on failure
+ *
+ * Description
+ * Create the address handle through which a UD QP reaches the peer's port,
+ * from the LID and, when res->cfg.gid_idx is set, the GID in res->remote_props.
+ * The path attributes are those modify_qp_to_rtr uses for connected QPs.
+ ******************************************************************************/
+int create_ud_ah(struct resources *res)
+{
+	struct ibv_ah_attr ah_attr;
+	memset(&ah_attr, 0, sizeof(ah_attr));
+	ah_attr.is_global = 0;
+	ah_attr.dlid = res->remote_props.lid;
+	ah_attr.sl = 0;
+	ah_attr.src_path_bits = 0;
+	ah_attr.port_num = res->cfg.ib_port;
+	if (res->cfg.gid_idx >= 0)
+	{
+		ah_attr.is_global = 1;
+		memcpy(&ah_attr.grh.dgid, res->remote_props.gid, 16);
+		ah_attr.grh.flow_label = 0;
+		ah_attr.grh.hop_limit = 1;
+		ah_attr.grh.sgid_index = res->cfg.gid_idx;
+		ah_attr.grh.traffic_class = 0;
+	}
+	if (res->ah)
+		ibv_destroy_ah(res->ah);
+	res->ah = ibv_create_ah(res->pd, &ah_attr);
+	if (!res->ah)
+	{
+		fprintf(stderr, "failed to create address handle\n");
+		return 1;
+	}
+	return 0;
+}
+/******************************************************************************
+ * Function: open_ib_device
+ *
+ * Input
+ * dev_name name of the IB device to open, NULL for the first one found
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * the device context on success, NULL on failure
+ *
+ * Description
+ * Find the device in the device list and open it. The asynchronous event
+ * descriptor of the context is made non-blocking for drain_async_events.
+ ******************************************************************************/
+struct ibv_context *open_ib_device(const char *dev_name)
+{
+	struct ibv_device **dev_list;
+	struct ibv_device *ib_dev = NULL;
+	struct ibv_context *ib_ctx = NULL;
+	int num_devices;
+	int i;
+	verbose_print("searching for IB devices in host\n");
+	// 使用 ibv_get_device_list 函数获取系统中所有 IB（InfiniBand）设备的列表
+	dev_list = ibv_get_device_list(&num_devices);
+	if (!dev_list)
+	{
+		fprintf(stderr, "failed to get IB devices list\n");
+		return NULL;
+	}
+	/* if there isn't any IB device in host */
+	if (!num_devices)
+	{
+		fprintf(stderr, "found %d device(s)\n", num_devices);
+		goto open_ib_device_exit;
+	}
+	verbose_print("found %d device(s)\n", num_devices);
+	// 遍历设备列表，找到与指定名称相匹配的设备，未指定名称时使用第一个设备
+	for (i = 0; i < num_devices; i++)
+	{
+		if (!dev_name)
+		{
+			dev_name = ibv_get_device_name(dev_list[i]);
+			verbose_print("device not specified, using first one found: %s\n", dev_name);
+		}
+		if (!strcmp(ibv_get_device_name(dev_list[i]), dev_name))
+		{
+			ib_dev = dev_list[i];
+			break;
+		}
+	}
+	/* if the device wasn't found in host */
+	if (!ib_dev)
+	{
+		fprintf(stderr, "IB device %s wasn't found\n", dev_name);
+		goto open_ib_device_exit;
+	}
+	ib_ctx = ibv_open_device(ib_dev);
+	if (!ib_ctx)
+	{
+		fprintf(stderr, "failed to open device %s\n", dev_name);
+		goto open_ib_device_exit;
+	}
+	// 异步事件描述符设为非阻塞，以便 drain_async_events 在没有事件时立即返回
+	if (fcntl(ib_ctx->async_fd, F_SETFL, fcntl(ib_ctx->async_fd, F_GETFL) | O_NONBLOCK) < 0)
+	{
+		fprintf(stderr, "failed to make async event fd non-blocking\n");
+		ibv_close_device(ib_ctx);
+		ib_ctx = NULL;
+	}
+open_ib_device_exit:
+	ibv_free_device_list(dev_list);
+	return ib_ctx;
+}
+/******************************************************************************
+ * Function: query_max_dm_size
+ *
+ * Input
+ * ib_ctx opened device context
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * the size of the device memory that can be allocated, 0 if the device or
+ * its provider has none
+ *
+ * Description
+ * Query the extended device attributes for the on-chip device memory.
+ ******************************************************************************/
+uint64_t query_max_dm_size(struct ibv_context *ib_ctx)
+{
+	struct ibv_device_attr_ex attr_ex;
+	memset(&attr_ex, 0, sizeof(attr_ex));
+	if (ibv_query_device_ex(ib_ctx, NULL, &attr_ex))
+		return 0;
+	return attr_ex.max_dm_size;
+}
+/******************************************************************************
+ * Function: probe_device
+ *
+ * Input
+ * dev_name name of the IB device, NULL for the first one found
+ * ib_port port of the device to query
+ *
+ * Output
+ * name the name of the opened device, NUL-terminated in name_len bytes
+ * device_attr attributes of the device
+ * port_attr attributes of the port
+ * max_dm_size size of the device memory that can be allocated, 0 if none
+ *
+ * Returns
+ * 0 on success, 1 if the device cannot be opened, 2 if a query fails
+ *
+ * Description
+ * Open the device, query its attributes and those of the port, and close it
+ * again without creating any other resources.
+ ******************************************************************************/
+int probe_device(const char *dev_name, int ib_port, char *name, size_t name_len, struct ibv_device_attr *device_attr, struct ibv_port_attr *port_attr, uint64_t *max_dm_size)
+{
+	struct ibv_context *ib_ctx;
+	int rc = 0;
+	ib_ctx = open_ib_device(dev_name);
+	if (!ib_ctx)
+		return 1;
+	// 关闭上下文后设备名称可能失效，复制到调用者的缓冲区
+	snprintf(name, name_len, "%s", ibv_get_device_name(ib_ctx->device));
+	if (ibv_query_device(ib_ctx, device_attr))
+	{
+		fprintf(stderr, "ibv_query_device failed\n");
+		rc = 2;
+	}
+	else if (ibv_query_port(ib_ctx, ib_port, port_attr))
+	{
+		fprintf(stderr, "ibv_query_port on port %u failed\n", ib_port);
+		rc = 2;
+	}
+	*max_dm_size = query_max_dm_size(ib_ctx);
+	ibv_close_device(ib_ctx);
+	return rc;
+}
+/******************************************************************************
+ * Function: srq_create
+ *
+ * Input
+ * srq pointer to the shared receive queue to be filled in, with buf_size and
+ *     depth set or 0 for the defaults
+ * dev_name name of the IB device, NULL for the first one found
+ *
+ * Output
+ * srq filled in with resources
+ *
+ * Returns
+ * 0 on success, 1 on failure
+ *
+ * Description
+ * Open the device, allocate a protection domain and create a shared receive
+ * queue with depth receive slots of buf_size bytes, all of which are posted.
+ * Connections created with res->srq pointing to it use its device context
+ * and protection domain, so that their QPs can receive from the shared queue.
+ ******************************************************************************/
+int srq_create(struct srq_t *srq, const char *dev_name)
+{
+	struct ibv_srq_init_attr srq_init_attr;
+	uint32_t i;
+	int rc = 0;
+	if (!srq->buf_size)
+		srq->buf_size = MSG_SIZE;
+	if (!srq->depth)
+		srq->depth = DEFAULT_SRQ_WR;
+	srq->ib_ctx = open_ib_device(dev_name);
+	if (!srq->ib_ctx)
+	{
+		rc = 1;
+		goto srq_create_exit;
+	}
+	srq->pd = ibv_alloc_pd(srq->ib_ctx);
+	if (!srq->pd)
+	{
+		fprintf(stderr, "ibv_alloc_pd failed\n");
+		rc = 1;
+		goto srq_create_exit;
+	}
+	memset(&srq_init_attr, 0, sizeof(srq_init_attr));
+	srq_init_attr.attr.max_wr = srq->depth;
+	srq_init_attr.attr.max_sge = 1;
+	srq->srq = ibv_create_srq(srq->pd, &srq_init_attr);
+	if (!srq->srq)
+	{
+		fprintf(stderr, "failed to create SRQ with %u entries\n", srq->depth);
+		rc = 1;
+		goto srq_create_exit;
+	}
+	// 所有接收槽放在同一块缓冲区中，只需注册一个内存区域
+	srq->buf = (char *)calloc(srq->depth, srq->buf_size);
+	if (!srq->buf)
+	{
+		fprintf(stderr, "failed to malloc %u receive slots of %Zu bytes\n", srq->depth, srq->buf_size);
+		rc = 1;
+		goto srq_create_exit;
+	}
+	srq->mr = ibv_reg_mr(srq->pd, srq->buf, (size_t)srq->depth * srq->buf_size, IBV_ACCESS_LOCAL_WRITE);
+	if (!srq->mr)
+	{
+		fprintf(stderr, "ibv_reg_mr failed for SRQ buffer\n");
+		rc = 1;
+		goto srq_create_exit;
+	}
+	for (i = 0; i < srq->depth; i++)
+	{
+		if (post_srq_receive(srq, i))
+		{
+			rc = 1;
+			goto srq_create_exit;
+		}
+	}
+	verbose_print("SRQ was created with %u receive slots of %Zu bytes\n", srq->depth, srq->buf_size);
+srq_create_exit:
+	if (rc)
+		srq_destroy(srq);
+	return rc;
+}
+/******************************************************************************
+ * Function: post_srq_receive
+ *
+ * Input
+ * srq pointer to the shared receive queue
+ * slot index of the receive slot, below srq->depth
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ * Post a receive request into the given slot of the shared receive queue.
+ * The slot number, combined with RECV_WR_ID, is the wr_id of the request, so
+ * that the completion tells which slot holds the message.
+ ******************************************************************************/
+int post_srq_receive(struct srq_t *srq, uint32_t slot)
+{
+	struct ibv_recv_wr rr;
+	struct ibv_sge sge;
+	struct ibv_recv_wr *bad_wr;
+	int rc;
+	memset(&sge, 0, sizeof(sge));
+	sge.addr = (uintptr_t)(srq->buf + (size_t)slot * srq->buf_size);
+	sge.length = srq->buf_size;
+	sge.lkey = srq->mr->lkey;
+	memset(&rr, 0, sizeof(rr));
+	rr.next = NULL;
+	rr.wr_id = RECV_WR_ID | slot;
+	rr.sg_list = &sge;
+	rr.num_sge = 1;
+	rc = ibv_post_srq_recv(srq->srq, &rr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post SRQ RR\n");
+	return rc;
+}
+/******************************************************************************
+ * Function: srq_destroy
+ *
+ * Input
+ * srq pointer to the shared receive queue
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, 1 if a resource could not be released
+ *
+ * Description
+ * Release the resources of a shared receive queue, also after a partial
+ * srq_create. All connections using it must have been destroyed.
+ ******************************************************************************/
+int srq_destroy(struct srq_t *srq)
+{
+	int rc = 0;
+	if (srq->srq)
+	{
+		if (ibv_destroy_srq(srq->srq))
+		{
+			fprintf(stderr, "failed to destroy SRQ\n");
+			rc = 1;
+		}
+		srq->srq = NULL;
+	}
+	if (srq->mr)
+	{
+		if (ibv_dereg_mr(srq->mr))
+		{
+			fprintf(stderr, "failed to deregister SRQ MR\n");
+			rc = 1;
+		}
+		srq->mr = NULL;
+	}
+	free(srq->buf);
+	srq->buf = NULL;
+	if (srq->pd)
+	{
+		if (ibv_dealloc_pd(srq->pd))
+		{
+			fprintf(stderr, "failed to deallocate PD\n");
+			rc = 1;
+		}
+		srq->pd = NULL;
+	}
+	if (srq->ib_ctx)
+	{
+		if (ibv_close_device(srq->ib_ctx))
+		{
+			fprintf(stderr, "failed to close device context\n");
+			rc = 1;
+		}
+		srq->ib_ctx = NULL;
+	}
+	return rc;
+}
+/******************************************************************************
+ * Function: post_read_index
+ *
+ * Input
+ * res pointer to resources structure
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ * Post an RDMA read of the remote write index (ctrl[0] on the remote side)
+ * into the local landing slot ctrl[1]. Only the 8-byte index is transferred,
+ * the payload buffer is left untouched.
+ ******************************************************************************/
+int post_read_index(struct resources *res)
+{
+	struct ibv_send_wr sr;
+	struct ibv_sge sge;
+	struct ibv_send_wr *bad_wr = NULL;
+	int rc;
+	memset(&sge, 0, sizeof(sge));
+	// 读取结果落在本地控制区的第二个槽位，避免覆盖本端自己的写索引
+	sge.addr = (uintptr_t)&res->ctrl[1];
+	sge.length = sizeof(uint64_t);
+	sge.lkey = res->ctrl_mr->lkey;
+	memset(&sr, 0, sizeof(sr));
+	sr.next = NULL;
+	sr.wr_id = next_wr_id(res);
+	sr.sg_list = &sge;
+	sr.num_sge = 1;
+	sr.opcode = IBV_WR_RDMA_READ;
+	sr.send_flags = IBV_SEND_SIGNALED;
+	// 远端写索引位于远端控制区的起始位置
+	sr.wr.rdma.remote_addr = res->remote_props.ctrl_addr;
+	sr.wr.rdma.rkey = res->remote_props.ctrl_rkey;
+	rc = ibv_post_send(res->qp, &sr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post index read\n");
+	return rc;
+}
+/******************************************************************************
+ * Function: post_atomic
+ *
+ * Input
+ * res pointer to resources structure
+ * opcode IBV_WR_ATOMIC_CMP_AND_SWP or IBV_WR_ATOMIC_FETCH_AND_ADD
+ * offset offset of the 8-byte target in the remote data buffer
+ * compare_add value to compare with, or value to add for fetch and add
+ * swap value to store if the comparison succeeds, ignored for fetch and add
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ * Post an atomic operation on the remote data buffer. The original remote
+ * value is returned into the local landing slot ctrl[2]. The target must be
+ * 8-byte aligned; this is checked by the caller.
+ ******************************************************************************/
+int post_atomic(struct resources *res, int opcode, uint64_t offset, uint64_t compare_add, uint64_t swap)
+{
+	struct ibv_send_wr sr;
+	struct ibv_sge sge;
+	struct ibv_send_wr *bad_wr = NULL;
+	int rc;
+	memset(&sge, 0, sizeof(sge));
+	// 原子操作返回的远端原值落在本地控制区的第三个槽位
+	sge.addr = (uintptr_t)&res->ctrl[2];
+	sge.length = sizeof(uint64_t);
+	sge.lkey = res->ctrl_mr->lkey;
+	memset(&sr, 0, sizeof(sr));
+	sr.next = NULL;
+	sr.wr_id = next_wr_id(res);
+	sr.sg_list = &sge;
+	sr.num_sge = 1;
+	sr.opcode = opcode;
+	sr.send_flags = IBV_SEND_SIGNALED;
+	sr.wr.atomic.remote_addr = res->remote_props.addr + offset;
+	sr.wr.atomic.rkey = res->remote_props.rkey;
+	sr.wr.atomic.compare_add = compare_add;
+	sr.wr.atomic.swap = swap;
+	rc = ibv_post_send(res->qp, &sr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post atomic operation\n");
+	return rc;
+}
+/******************************************************************************
+ * Function: post_write_sg
+ *
+ * Input
+ * res pointer to resources structure
+ * addrs local address of each segment
+ * lengths number of bytes of each segment
+ * lkeys local key of the memory region containing each segment
+ * count number of segments, at most MAX_SEND_SGE
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ * Post a single RDMA write that gathers the segments, in order, into the start
+ * of the remote buffer exchanged in connect_qp.
+ ******************************************************************************/
+int post_write_sg(struct resources *res, const uint64_t *addrs, const uint32_t *lengths, const uint32_t *lkeys, int count)
+{
+	struct ibv_send_wr sr;
+	struct ibv_sge sge[MAX_SEND_SGE];
+	struct ibv_send_wr *bad_wr = NULL;
+	uint32_t total = 0;
+	int i;
+	int rc;
+	if (count <= 0 || count > MAX_SEND_SGE)
+		return EINVAL;
+	memset(sge, 0, sizeof(sge));
+	for (i = 0; i < count; i++)
+	{
+		sge[i].addr = addrs[i];
+		sge[i].length = lengths[i];
+		sge[i].lkey = lkeys[i];
+		total += lengths[i];
+	}
+	memset(&sr, 0, sizeof(sr));
+	sr.next = NULL;
+	sr.wr_id = next_wr_id(res);
+	sr.sg_list = sge;
+	sr.num_sge = count;
+	sr.opcode = IBV_WR_RDMA_WRITE;
+	sr.send_flags = send_flags(res, IBV_WR_RDMA_WRITE, total);
+	sr.wr.rdma.remote_addr = res->remote_props.addr;
+	sr.wr.rdma.rkey = res->remote_props.rkey;
+	rc = ibv_post_send(res->qp, &sr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post SR with %d segments\n", count);
+	return rc;
+}
+/******************************************************************************
+ * Function: post_send_region
+ *
+ * Input
+ * res pointer to resources structure
+ * opcode IBV_WR_RDMA_READ or IBV_WR_RDMA_WRITE
+ * mr local memory region used as source (write) or destination (read)
+ * length number of bytes to transfer
+ * remote_addr remote buffer address
+ * rkey remote key of the remote buffer
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ * Same as post_send, but against an arbitrary registered region instead of
+ * res->buf and the remote buffer exchanged in connect_qp.
+ ******************************************************************************/
+int post_send_region(struct resources *res, int opcode, struct ibv_mr *mr, uint32_t length, uint64_t remote_addr, uint32_t rkey)
+{
+	struct ibv_send_wr sr;
+	struct ibv_sge sge;
+	struct ibv_send_wr *bad_wr = NULL;
+	int rc;
+	memset(&sge, 0, sizeof(sge));
+	sge.addr = (uintptr_t)mr->addr;
+	sge.length = length;
+	sge.lkey = mr->lkey;
+	memset(&sr, 0, sizeof(sr));
+	sr.next = NULL;
+	sr.wr_id = next_wr_id(res);
+	sr.sg_list = &sge;
+	sr.num_sge = 1;
+	sr.opcode = opcode;
+	sr.send_flags = send_flags(res, opcode, length);
+	sr.wr.rdma.remote_addr = remote_addr;
+	sr.wr.rdma.rkey = rkey;
+	rc = ibv_post_send(res->qp, &sr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post SR on region\n");
+	return rc;
+}
+/******************************************************************************
+ * Function: post_send_offset
+ *
+ * Input
+ * res pointer to resources structure
+ * opcode IBV_WR_RDMA_READ or IBV_WR_RDMA_WRITE
+ * offset offset into both res->buf and the remote buffer
+ * length number of bytes to transfer
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ * Same as post_send, but transfers length bytes at offset instead of the
+ * whole buffer. The local bytes at the same offset are the source of a write
+ * and the destination of a read. The caller checks the bounds.
+ ******************************************************************************/
+int post_send_offset(struct resources *res, int opcode, uint64_t offset, uint32_t length)
+{
+	struct ibv_send_wr sr;
+	struct ibv_sge sge;
+	struct ibv_send_wr *bad_wr = NULL;
+	int rc;
+	memset(&sge, 0, sizeof(sge));
+	sge.addr = (uintptr_t)res->buf + offset;
+	sge.length = length;
+	sge.lkey = res->mr->lkey;
+	memset(&sr, 0, sizeof(sr));
+	sr.next = NULL;
+	sr.wr_id = next_wr_id(res);
+	sr.sg_list = &sge;
+	sr.num_sge = 1;
+	sr.opcode = opcode;
+	sr.send_flags = send_flags(res, opcode, length);
+	sr.wr.rdma.remote_addr = res->remote_props.addr + offset;
+	sr.wr.rdma.rkey = res->remote_props.rkey;
+	rc = ibv_post_send(res->qp, &sr, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post SR at offset %" PRIu64 "\n", offset);
+	return rc;
+}
+/******************************************************************************
+ * Function: post_write_batch
+ *
+ * Input
+ * res pointer to resources structure
+ * offsets offset of each region in res->buf and in the remote buffer
+ * lengths number of bytes of each region
+ * count number of regions, at most res->max_send_wr
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code on failure
+ *
+ * Description
+ * Post one RDMA write per region of res->buf to the same offset of the remote
+ * buffer, chained in a single ibv_post_send call. Only the last work request
+ * is signaled, so the whole batch produces a single completion, which the
+ * caller waits for. Since the writes on an RC queue pair complete in order,
+ * that completion also covers the earlier ones. If a write fails, it and every
+ * write after it complete with an error even though they are not signaled;
+ * the send CQ has max_send_wr entries, so they all fit.
+ ******************************************************************************/
+int post_write_batch(struct resources *res, const uint32_t *offsets, const uint32_t *lengths, int count)
+{
+	struct ibv_send_wr *wrs;
+	struct ibv_sge *sges;
+	struct ibv_send_wr *bad_wr = NULL;
+	int i;
+	int rc;
+	if (count <= 0)
+		return EINVAL;
+	wrs = (struct ibv_send_wr *)calloc(count, sizeof(*wrs));
+	sges = (struct ibv_sge *)calloc(count, sizeof(*sges));
+	if (!wrs || !sges)
+	{
+		fprintf(stderr, "failed to allocate %d work requests\n", count);
+		free(wrs);
+		free(sges);
+		return ENOMEM;
+	}
+	for (i = 0; i < count; i++)
+	{
+		sges[i].addr = (uintptr_t)res->buf + offsets[i];
+		sges[i].length = lengths[i];
+		sges[i].lkey = res->mr->lkey;
+		wrs[i].wr_id = next_wr_id(res);
+		wrs[i].sg_list = &sges[i];
+		wrs[i].num_sge = 1;
+		wrs[i].opcode = IBV_WR_RDMA_WRITE;
+		wrs[i].wr.rdma.remote_addr = res->remote_props.addr + offsets[i];
+		wrs[i].wr.rdma.rkey = res->remote_props.rkey;
+		wrs[i].send_flags = send_flags(res, IBV_WR_RDMA_WRITE, lengths[i]) & IBV_SEND_INLINE;
+		// 只有最后一个工作请求产生完成事件，其余的随之完成
+		wrs[i].next = i + 1 < count ? &wrs[i + 1] : NULL;
+	}
+	wrs[count - 1].send_flags |= IBV_SEND_SIGNALED;
+	rc = ibv_post_send(res->qp, wrs, &bad_wr);
+	if (rc)
+		fprintf(stderr, "failed to post batch of %d writes\n", count);
+	free(wrs);
+	free(sges);
+	return rc;
+}
+/******************************************************************************
+ * Function: register_buffer
+ *
+ * Input
+ * res pointer to resources structure
+ * size size of the buffer to allocate
+ * mr_flags access flags of the memory region (IBV_ACCESS_*)
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * the registered memory region on success, NULL on failure
+ *
+ * Description
+ * Allocate a zeroed buffer of the given size and register it in the
+ * protection domain of res with the given access flags.
+ * The buffer is reachable through mr->addr and is released by
+ * deregister_buffer.
+ ******************************************************************************/
+struct ibv_mr *register_buffer(struct resources *res, size_t size, int mr_flags)
+{
+	struct ibv_mr *mr;
+	char *buf;
+	buf = (char *)calloc(1, size);
+	if (!buf)
+	{
+		fprintf(stderr, "failed to malloc %Zu bytes to memory buffer\n", size);
+		return NULL;
+	}
+	mr = ibv_reg_mr(res->pd, buf, size, mr_flags);
+	if (!mr)
+	{
+		fprintf(stderr, "ibv_reg_mr failed with mr_flags=0x%x\n", mr_flags);
+		free(buf);
+		return NULL;
+	}
+	return mr;
+}
+/******************************************************************************
+ * Function: deregister_buffer
+ *
+ * Input
+ * mr memory region returned by register_buffer
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, 1 on failure
+ *
+ * Description
+ * Deregister the memory region and free the buffer backing it.
+ ******************************************************************************/
+int deregister_buffer(struct ibv_mr *mr)
+{
+	void *buf = mr->addr;
+	if (ibv_dereg_mr(mr))
+	{
+		fprintf(stderr, "failed to deregister MR\n");
+		return 1;
+	}
+	free(buf);
+	return 0;
+}
+/******************************************************************************
+ * Function: register_memory
+ *
+ * Input
+ * res pointer to resources structure
+ * addr start of caller-owned memory to register
+ * size size of the memory in bytes
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * the registered memory region on success, NULL on failure
+ *
+ * Description
+ * Register memory owned by the caller in the protection domain of res with
+ * the same access flags as res->buf, res->mr_access. Unlike register_buffer nothing is
+ * allocated; the memory must stay valid until deregister_memory.
+ ******************************************************************************/
+struct ibv_mr *register_memory(struct resources *res, void *addr, size_t size)
+{
+	struct ibv_mr *mr;
+	/* 与 resources_create 为 res->buf 选择的标志相同 */
+	int mr_flags = res->mr_access | IBV_ACCESS_LOCAL_WRITE;
+	mr = ibv_reg_mr(res->pd, addr, size, mr_flags);
+	if (!mr)
+		fprintf(stderr, "ibv_reg_mr failed with mr_flags=0x%x\n", mr_flags);
+	return mr;
+}
+/******************************************************************************
+ * Function: deregister_memory
+ *
+ * Input
+ * mr memory region returned by register_memory
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, 1 on failure
+ *
+ * Description
+ * Deregister the memory region. The memory itself belongs to the caller and
+ * is not freed.
+ ******************************************************************************/
+int deregister_memory(struct ibv_mr *mr)
+{
+	if (ibv_dereg_mr(mr))
+	{
+		fprintf(stderr, "failed to deregister MR\n");
+		return 1;
+	}
+	return 0;
+}
+/******************************************************************************
+ * Function: resources_init
+ *
+ * Input
+ * res pointer to resources structure
+ *
+ * Output
+ * res is initialized
+ *
+ * Returns
+ * none
+ *
+ * Description
+ * res is initialized to default values
+ ******************************************************************************/
+void resources_init(struct resources *res)
+{
+	memset(res, 0, sizeof *res);
+	// res->sock = -1;: 将 sock 成员（套接字文件描述符）设置为 -1。这是一个常用的技巧，用于表示该套接字尚未被分配或初始化
+	res->sock = -1;
+	res->numa_node = -1;
+}
+/******************************************************************************
+ * Function: alloc_data_buffer
+ *
+ * Input
+ * size size of the buffer in bytes
+ * node NUMA node the memory must come from, or a negative value for any node
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * the buffer on success, NULL on failure with errno set
+ *
+ * Description
+ * Allocate the data buffer of a connection. Without a node the buffer comes
+ * from malloc. Otherwise it is mapped anonymously and bound to the node with
+ * mbind before any page is touched, so that the pages the device accesses
+ * are local to it. Release the buffer with free_data_buffer.
+ ******************************************************************************/
+char *alloc_data_buffer(size_t size, int node)
+{
+	unsigned long mask[MAX_NUMA_NODES / (8 * sizeof(unsigned long))];
+	void *buf;
+	if (node < 0)
+		return (char *)malloc(size);
+	if (node >= MAX_NUMA_NODES)
+	{
+		errno = EINVAL;
+		return NULL;
+	}
+	buf = mmap(NULL, size, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_ANONYMOUS, -1, 0);
+	if (buf == MAP_FAILED)
+		return NULL;
+	memset(mask, 0, sizeof mask);
+	mask[node / (8 * sizeof(unsigned long))] = 1UL << (node % (8 * sizeof(unsigned long)));
+	// MPOL_BIND（2）：页面只能从指定节点分配；内核的 maxnode 比位数多一
+	if (syscall(SYS_mbind, buf, size, 2, mask, (unsigned long)MAX_NUMA_NODES + 1, 0))
+	{
+		int err = errno;
+		fprintf(stderr, "failed to bind buffer to NUMA node %d\n", node);
+		munmap(buf, size);
+		errno = err;
+		return NULL;
 	}
-	return rc;
+	return (char *)buf;
 }
 /******************************************************************************
-* Function: post_send，用于创建并提交一个发送工作请求（Send Work Request）到 RDMA 队列对（Queue Pair）
-
-* Input：该函数接受一个指向资源结构体的指针和一个操作码，用于指定发送工作请求的类型。
-* res pointer to resources structure
-* opcode IBV_WR_SEND, IBV_WR_RDMA_READ or IBV_WR_RDMA_WRITE
-*
-* Output
-* none
-*
-* Returns
-* 0 on success, error code on failure
-*
-* Description
-* This function will create and post a send work request
-******************************************************************************/
-int post_send(struct resources *res, int opcode)
+ * Function: free_data_buffer
+ *
+ * Input
+ * buf buffer returned by alloc_data_buffer
+ * size size the buffer was allocated with
+ * node node the buffer was allocated with
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * none
+ *
+ * Description
+ * Release a buffer allocated by alloc_data_buffer.
+ ******************************************************************************/
+void free_data_buffer(char *buf, size_t size, int node)
 {
-	// 在 RDMA 操作中，发送工作请求用于指定如何发送数据（例如，普通发送、RDMA 读或写等）。
-	// sr 的字段包括散布/聚集元素的列表、操作类型（opcode）、发送标志等
-	struct ibv_send_wr sr;
-
-	// sge 用于指定 RDMA 操作中要使用的数据缓冲区的地址、长度和本地密钥（lkey）。本地密钥是 RDMA 设备用于访问该内存区域的权限令牌。
-	struct ibv_sge sge;
-
-	// 如果 ibv_post_send 返回错误，bad_wr 将被设置为指向问题所在的发送工作请求。初始时设置为 NULL，表示没有错误。
-	struct ibv_send_wr *bad_wr = NULL;
-	int rc;
-	memset(&sge, 0, sizeof(sge));	// 使用 memset 初始化散布/聚集条目 sge。
-	sge.addr = (uintptr_t)res->buf; // 设置 sge.addr 为要发送或读写的数据的地址
-	sge.length = MSG_SIZE;			// 设置 sge.length 为要发送或读写的数据的长度。
-	sge.lkey = res->mr->lkey;		// 设置 sge.lkey 为关联内存区域的本地密钥。
-	memset(&sr, 0, sizeof(sr));		// 使用 memset 初始化发送工作请求 sr。
-	sr.next = NULL;
-	sr.wr_id = 0;
-	sr.sg_list = &sge;				   // 设置 sr.sg_list 指向散布/聚集条目
-	sr.num_sge = 1;					   // 设置 sr.num_sge 为 1，表示只有一个散布/聚集条目。
-	sr.opcode = opcode;				   // 设置 sr.opcode 为传入的操作码。
-	sr.send_flags = IBV_SEND_SIGNALED; // 设置 sr.send_flags 为 IBV_SEND_SIGNALED，以触发完成事件。
-
-	if (opcode != IBV_WR_SEND)
-	{
-		sr.wr.rdma.remote_addr = res->remote_props.addr;
-		sr.wr.rdma.rkey = res->remote_props.rkey;
-	}
-	/* there is a Receive Request in the responder side, so we won't get any into RNR flow */
-	// 在 post_send 函数中，rc 用于存储 ibv_post_send 函数的返回值，以指示操作是否成功。成功时，rc 通常为 0；失败时，它包含错误代码。
-	rc = ibv_post_send(res->qp, &sr, &bad_wr);
-	if (rc)
-		fprintf(stderr, "failed to post SR\n");
+	if (node < 0)
+		free(buf);
 	else
+		munmap(buf, size);
+}
+/******************************************************************************
+ * Function: alloc_device_memory
+ *
+ * Input
+ * res pointer to resources structure, with the protection domain created
+ * size size of the data buffer
+ * mr_flags access flags of the data buffer
+ *
+ * Output
+ * res->dm and res->dm_mr on success
+ *
+ * Returns
+ * 0 on success, 1 if the device memory cannot be used
+ *
+ * Description
+ * Allocate size bytes of device memory, register them zero-based with the
+ * access flags of the data buffer and clear them. The peer then reaches the
+ * device memory instead of res->buf; see dm_copy. On failure nothing stays
+ * allocated, so the connection can go on with host memory.
+ ******************************************************************************/
+int alloc_device_memory(struct resources *res, size_t size, int mr_flags)
+{
+	struct ibv_alloc_dm_attr dm_attr;
+	if (query_max_dm_size(res->ib_ctx) < size)
+		return 1;
+	memset(&dm_attr, 0, sizeof(dm_attr));
+	dm_attr.length = size;
+	res->dm = ibv_alloc_dm(res->ib_ctx, &dm_attr);
+	if (!res->dm)
+		return 1;
+	// 设备内存的内存区域必须以 0 为起始地址，远端按偏移量访问
+	res->dm_mr = ibv_reg_dm_mr(res->pd, res->dm, 0, size, mr_flags | IBV_ACCESS_ZERO_BASED);
+	if (!res->dm_mr || ibv_memcpy_to_dm(res->dm, 0, res->buf, size))
 	{
-		switch (opcode)
-		{
-		case IBV_WR_SEND:
-			fprintf(stdout, "Send Request was posted\n");
-			break;
-		case IBV_WR_RDMA_READ:
-			fprintf(stdout, "RDMA Read Request was posted\n");
-			break;
-		case IBV_WR_RDMA_WRITE:
-			fprintf(stdout, "RDMA Write Request was posted\n");
-			break;
-		default:
-			fprintf(stdout, "Unknown Request was posted\n");
-			break;
-		}
+		free_device_memory(res);
+		return 1;
 	}
-	return rc;
+	verbose_print("device memory MR was registered with rkey=0x%x\n", res->dm_mr->rkey);
+	return 0;
 }
 /******************************************************************************
- * Function: post_receive
+ * Function: free_device_memory
+ *
  * Input
  * res pointer to resources structure
- *  int post_receive(struct resources *res): 该函数接受一个指向包含 RDMA 资源的 resources 结构体的指针 res
  *
  * Output
  * none
  *
  * Returns
- * 0 on success, error code on failure
+ * none
  *
  * Description
+ * Release the device memory of res and its memory region, if any.
+ ******************************************************************************/
+void free_device_memory(struct resources *res)
+{
+	if (res->dm_mr)
+	{
+		ibv_dereg_mr(res->dm_mr);
+		res->dm_mr = NULL;
+	}
+	if (res->dm)
+	{
+		ibv_free_dm(res->dm);
+		res->dm = NULL;
+	}
+}
+/******************************************************************************
+ * Function: rotate_mr
+ *
+ * Input
+ * res pointer to resources structure with the data buffer registered
+ *
+ * Output
+ * rkey the remote key the peer must use from now on to reach the data buffer
+ *
+ * Returns
+ * 0 on success, 1 if the new memory region cannot be registered, 2 if an old
+ * memory region cannot be deregistered
  *
+ * Description
+ * Register the data buffer, and the device memory if it is used, again with
+ * the same access flags and deregister the old memory regions, so that their
+ * keys become invalid. The old regions are only released once the new ones
+ * are in place; if registering fails, nothing changes and rkey is the current
+ * key. No work request may be outstanding on the old regions.
  ******************************************************************************/
-int post_receive(struct resources *res)
+int rotate_mr(struct resources *res, uint32_t *rkey)
 {
-	struct ibv_recv_wr rr;
-	struct ibv_sge sge;
-	struct ibv_recv_wr *bad_wr;
-	int rc;
-	/* prepare the scatter/gather entry */
-	memset(&sge, 0, sizeof(sge));
-	sge.addr = (uintptr_t)res->buf;
-	sge.length = MSG_SIZE;
-	sge.lkey = res->mr->lkey;
-
-	memset(&rr, 0, sizeof(rr));
-	rr.next = NULL;
-	rr.wr_id = 0;
-	rr.sg_list = &sge; // 设置 rr.sg_list 指向散布/聚集条目
-	rr.num_sge = 1;	   // 设置 rr.num_sge 为 1，表示只有一个散布/聚集条目
-
-	rc = ibv_post_recv(res->qp, &rr, &bad_wr);
-	if (rc)
-		fprintf(stderr, "failed to post RR\n");
-	else
-		fprintf(stdout, "Receive Request was posted\n");
+	struct ibv_mr *mr;
+	struct ibv_mr *dm_mr = NULL;
+	int rc = 0;
+	*rkey = res->dm_mr ? res->dm_mr->rkey : res->mr->rkey;
+	mr = ibv_reg_mr(res->pd, res->buf, res->mr->length, res->mr_access);
+	if (!mr)
+	{
+		fprintf(stderr, "ibv_reg_mr failed with mr_flags=0x%x\n", res->mr_access);
+		return 1;
+	}
+	if (res->dm_mr)
+	{
+		dm_mr = ibv_reg_dm_mr(res->pd, res->dm, 0, res->dm_mr->length, res->mr_access | IBV_ACCESS_ZERO_BASED);
+		if (!dm_mr)
+		{
+			fprintf(stderr, "ibv_reg_dm_mr failed with mr_flags=0x%x\n", res->mr_access);
+			ibv_dereg_mr(mr);
+			return 1;
+		}
+	}
+	// 注销旧的内存区域后它的 rkey 失效，对端只能使用新的 rkey
+	if (ibv_dereg_mr(res->mr))
+	{
+		fprintf(stderr, "failed to deregister old MR\n");
+		rc = 2;
+	}
+	res->mr = mr;
+	if (dm_mr)
+	{
+		if (ibv_dereg_mr(res->dm_mr))
+		{
+			fprintf(stderr, "failed to deregister old device memory MR\n");
+			rc = 2;
+		}
+		res->dm_mr = dm_mr;
+	}
+	*rkey = res->dm_mr ? res->dm_mr->rkey : res->mr->rkey;
+	verbose_print("MR was registered again with lkey=0x%x, rkey=0x%x\n", res->mr->lkey, *rkey);
 	return rc;
 }
 /******************************************************************************
- * Function: resources_init
+ * Function: dm_copy
  *
  * Input
  * res pointer to resources structure
+ * offset offset of the range in the data buffer
+ * length length of the range
+ * to_dm non-zero to copy res->buf to the device memory, zero for the reverse
  *
  * Output
- * res is initialized
+ * none
  *
  * Returns
- * none
+ * 0 on success, error code on failure
  *
  * Description
- * res is initialized to default values
+ * Keep the device memory, which the peer reads and writes, and res->buf,
+ * where the data is staged and decoded, in step. Does nothing without
+ * device memory.
  ******************************************************************************/
-void resources_init(struct resources *res)
+int dm_copy(struct resources *res, uint64_t offset, size_t length, int to_dm)
 {
-	memset(res, 0, sizeof *res);
-	// res->sock = -1;: 将 sock 成员（套接字文件描述符）设置为 -1。这是一个常用的技巧，用于表示该套接字尚未被分配或初始化
-	res->sock = -1;
+	if (!res->dm || !length)
+		return 0;
+	if (to_dm)
+		return ibv_memcpy_to_dm(res->dm, offset, res->buf + offset, length);
+	return ibv_memcpy_from_dm(res->buf + offset, res->dm, offset, length);
 }
 /******************************************************************************
 * Function: resources_create
@@ -361,172 +2145,232 @@ void resources_init(struct resources *res)
 * res filled in with resources
 *
 * Returns
-* 0 on success, 1 on failure
+* 0 on success, -1 if the TCP connection could not be established, otherwise
+* the same values as resources_create_with_sock
+*
+* Description
+*
+* Establish the TCP connection described by config (connect to
+* config.server_name, or wait for a client if it is NULL) and create all
+* resources on it with resources_create_with_sock, using a copy of config as
+* res->cfg.
+*****************************************************************************/
+int resources_create(struct resources *res)
+{
+	int sock;
+	// 本连接使用全局配置的副本
+	res->cfg = config;
+	// 根据配置，函数尝试建立一个 TCP 连接。在客户端模式下，它连接到指定的服务器和端口；在服务器模式下，它监听指定的端口。
+	/* if client side */
+	if (res->cfg.server_name)
+	{
+		sock = sock_connect(res->cfg.server_name, res->cfg.tcp_port, -1);
+		if (sock < 0)
+		{
+			fprintf(stderr, "failed to establish TCP connection to server %s, port %d\n",
+					res->cfg.server_name, res->cfg.tcp_port);
+			return -1;
+		}
+	}
+	else
+	{
+		verbose_print("waiting on port %d for TCP connection\n", res->cfg.tcp_port);
+		sock = sock_connect(NULL, res->cfg.tcp_port, -1);
+		if (sock < 0)
+		{
+			fprintf(stderr, "failed to establish TCP connection with client on port %d\n",
+					res->cfg.tcp_port);
+			return -1;
+		}
+	}
+	return resources_create_with_sock(res, sock);
+}
+/******************************************************************************
+* Function: resources_create_with_sock
+* Input
+* res pointer to resources structure to be filled in, with res->cfg set
+* sock connected TCP socket to the remote side, owned by res afterwards, or -1
+*      if the connection information is exchanged by other means
+*
+* Output
+* res filled in with resources
+*
+* Returns
+* 0 on success, ERR_PARTIAL_REGISTRATION if a memory region does not cover
+* the whole requested size, ERR_QUEUE_DEPTH if res->max_send_wr or
+* res->max_recv_wr exceeds the device's max_qp_wr, ERR_LINK_LAYER if the port
+* does not have the link layer required by res->cfg.link_layer, ERR_NO_GID if
+* a RoCE port has no usable GID, other non-zero values on failure
 *
 * Description
 *
 * This function creates and allocates all necessary system resources. These
-* are stored in res.
+* are stored in res. On failure sock is closed as well. The device, port and
+* QP type are taken from res->cfg, which the caller fills in beforehand, so
+* connections with different settings can be created concurrently. On success
+* res->cfg.dev_name names the opened device.
 通过正确创建和配置这些资源，RDMA 应用程序能够进行高效的网络通信和远程直接内存访问操作。
 *****************************************************************************/
-int resources_create(struct resources *res)
+int resources_create_with_sock(struct resources *res, int sock)
 {
 
-	// dev_list 是一个指向 InfiniBand 设备指针数组的指针。这个数组用于存储系统中检测到的所有 IB 设备
-	// 初始设置为 NULL，这个数组将由 ibv_get_device_list 函数填充。
-	struct ibv_device **dev_list = NULL;
-
 	// qp_init_attr 是一个结构体，用于初始化队列对（Queue Pair, QP）。它包含了创建 QP 所需的所有参数，如 QP 类型、发送/接收完成队列（CQ）的指针、最大发送/接收工作请求等。
 	struct ibv_qp_init_attr qp_init_attr;
 
-	// ib_dev 是一个指向单个 IB 设备的指针。它将用于指向从 dev_list 中选定的设备
-	// 最初设置为 NULL，在设备选择过程中会被赋值。
-	struct ibv_device *ib_dev = NULL;
-
 	// size 用于存储将要分配的内存缓冲区的大小。在这个上下文中，它通常被设置为消息大小。
 	size_t size;
 
-	// i 是一个循环计数器，用于遍历 IB 设备列表
-	int i;
-
 	// mr_flags 用于指定注册内存区域（Memory Region, MR）时的访问权限标志。这些标志包括本地写入、远程读取和远程写入权限。
 	int mr_flags = 0;
 
-	// cq_size 用于指定创建的完成队列（CQ）的大小。在这个示例中，由于每个端只发送一个工作请求，所以一个 CQ 条目足够了。
+	// cq_size 用于指定创建的完成队列（CQ）的大小，由发送和接收队列的深度决定，见下文。
 	int cq_size = 0;
 
-	// num_devices 用于存储系统中检测到的 IB 设备数量。这个值由 ibv_get_device_list 函数设置。
-	int num_devices;
+	// recv_cqe 是可能同时未取回的接收完成事件数，即接收队列（或共享接收队列）的深度。
+	int recv_cqe = 0;
 
 	// rc 是一个返回码变量，用于存储函数的执行结果。成功时为 0，失败时为非零值。
 	int rc = 0;
 
-	// 根据配置，函数尝试建立一个 TCP 连接。在客户端模式下，它连接到指定的服务器和端口；在服务器模式下，它监听指定的端口。
-	/* if client side */
-	if (config.server_name)
-	{
-		res->sock = sock_connect(config.server_name, config.tcp_port);
-		if (res->sock < 0)
-		{
-			fprintf(stderr, "failed to establish TCP connection to server %s, port %d\n",
-					config.server_name, config.tcp_port);
-			rc = -1;
-			goto resources_create_exit;
-		}
-	}
+	res->sock = sock;
+	if (sock >= 0)
+		verbose_print("TCP connection was established\n");
+	// 使用共享接收队列时沿用它的设备上下文，否则打开配置中指定的设备
+	if (res->srq)
+		res->ib_ctx = res->srq->ib_ctx;
 	else
+		res->ib_ctx = open_ib_device(res->cfg.dev_name);
+	if (!res->ib_ctx)
 	{
-		fprintf(stdout, "waiting on port %d for TCP connection\n", config.tcp_port);
-		res->sock = sock_connect(NULL, config.tcp_port);
-		if (res->sock < 0)
-		{
-			fprintf(stderr, "failed to establish TCP connection with client on port %d\n",
-					config.tcp_port);
-			rc = -1;
-			goto resources_create_exit;
-		}
+		rc = ERR_OPEN_DEVICE;
+		goto resources_create_exit;
 	}
-	fprintf(stdout, "TCP connection was established\n");
-	fprintf(stdout, "searching for IB devices in host\n");
+	// 调用者传入的名称只在创建期间有效，改为指向设备上下文中的名称
+	res->cfg.dev_name = ibv_get_device_name(res->ib_ctx->device);
 
-	// 使用 ibv_get_device_list 函数获取系统中所有 IB（InfiniBand）设备的列表
-	dev_list = ibv_get_device_list(&num_devices);
-	if (!dev_list)
+	// 使用 ibv_query_port 查询指定 IB 端口的属性
+	// 这个调用查询指定的 InfiniBand 端口属性，存储在 res->port_attr 中。
+	// res->ib_ctx 是打开的 IB 设备的上下文，res->cfg.ib_port 是要查询的端口号。
+	if (ibv_query_port(res->ib_ctx, res->cfg.ib_port, &res->port_attr))
 	{
-		fprintf(stderr, "failed to get IB devices list\n");
-		rc = 1;
+		fprintf(stderr, "ibv_query_port on port %u failed\n", res->cfg.ib_port);
+		rc = ERR_QUERY_PORT;
 		goto resources_create_exit;
 	}
-	/* if there isn't any IB device in host */
-	if (!num_devices)
+	// 检查端口的链路层是否符合要求，例如要求 InfiniBand 却使用了以太网（RoCE）端口
+	if (res->cfg.link_layer != IBV_LINK_LAYER_UNSPECIFIED && res->port_attr.link_layer != res->cfg.link_layer)
 	{
-		fprintf(stderr, "found %d device(s)\n", num_devices);
-		rc = 1;
+		fprintf(stderr, "port %d has link layer %d, but %d was requested\n",
+				res->cfg.ib_port, res->port_attr.link_layer, res->cfg.link_layer);
+		rc = ERR_LINK_LAYER;
 		goto resources_create_exit;
 	}
-	fprintf(stdout, "found %d device(s)\n", num_devices);
-
-	// 遍历设备列表，找到与配置中指定名称相匹配的设备。
-	for (i = 0; i < num_devices; i++)
+	// RoCE 端口没有 LID，只能通过 GID 寻址；未指定 GID 索引时自动选择一个
+	if (res->port_attr.link_layer == IBV_LINK_LAYER_ETHERNET && res->cfg.gid_idx < 0)
 	{
-		if (!config.dev_name)
-		{
-			// 自动选择设备列表中的第一个设备，并将其名称复制到 config.dev_name。这里使用 strdup 函数来分配新的内存并复制设备名称字符串。
-			config.dev_name = strdup(ibv_get_device_name(dev_list[i]));
-			fprintf(stdout, "device not specified, using first one found: %s\n", config.dev_name);
-		}
-
-		// 如果设备名称可以匹配
-		if (!strcmp(ibv_get_device_name(dev_list[i]), config.dev_name))
+		res->cfg.gid_idx = select_roce_gid(res->ib_ctx, res->cfg.ib_port, res->port_attr.gid_tbl_len);
+		if (res->cfg.gid_idx < 0)
 		{
-			// ib_dev = dev_list[i];：将 ib_dev 指针设置为匹配的设备。
-			ib_dev = dev_list[i];
-			break;
+			fprintf(stderr, "no usable GID on RoCE port %d\n", res->cfg.ib_port);
+			rc = ERR_NO_GID;
+			goto resources_create_exit;
 		}
+		verbose_print("RoCE port %d, using GID index %d\n", res->cfg.ib_port, res->cfg.gid_idx);
 	}
-	/* if the device wasn't found in host */
-	if (!ib_dev)
+	// 查询设备属性，用于判断是否支持原子操作
+	if (ibv_query_device(res->ib_ctx, &res->device_attr))
 	{
-		fprintf(stderr, "IB device %s wasn't found\n", config.dev_name);
-		rc = 1;
+		fprintf(stderr, "ibv_query_device failed\n");
+		rc = ERR_QUERY_DEVICE;
 		goto resources_create_exit;
 	}
-
-	// 使用 ibv_open_device 函数打开找到的设备，并获取设备上下文。
-	res->ib_ctx = ibv_open_device(ib_dev);
-	if (!res->ib_ctx)
+	// 队列深度未指定时使用默认值，超过设备能力时报错而不是悄悄截断
+	if (!res->max_send_wr)
+		res->max_send_wr = DEFAULT_MAX_SEND_WR;
+	if (!res->max_recv_wr)
+		res->max_recv_wr = DEFAULT_MAX_RECV_WR;
+	if (res->max_send_wr > (uint32_t)res->device_attr.max_qp_wr || res->max_recv_wr > (uint32_t)res->device_attr.max_qp_wr)
 	{
-		fprintf(stderr, "failed to open device %s\n", config.dev_name);
-		rc = 1;
+		fprintf(stderr, "queue depth %u/%u exceeds device max_qp_wr %d\n",
+				res->max_send_wr, res->max_recv_wr, res->device_attr.max_qp_wr);
+		rc = ERR_QUEUE_DEPTH;
 		goto resources_create_exit;
 	}
-	// 现在初始化完毕，可以释放原来的设备列表了
-	ibv_free_device_list(dev_list);
-	dev_list = NULL;
-	ib_dev = NULL;
 
-	// 使用 ibv_query_port 查询指定 IB 端口的属性
-	// 这个调用查询指定的 InfiniBand 端口属性，存储在 res->port_attr 中。
-	// res->ib_ctx 是打开的 IB 设备的上下文，config.ib_port 是要查询的端口号。
-	if (ibv_query_port(res->ib_ctx, config.ib_port, &res->port_attr))
+	// 使用 ibv_alloc_pd 分配一个保护域（Protection Domain），使用共享接收队列时必须与它在同一个保护域中。
+	if (res->srq)
+		res->pd = res->srq->pd;
+	else
+		res->pd = ibv_alloc_pd(res->ib_ctx);
+	if (!res->pd)
 	{
-		fprintf(stderr, "ibv_query_port on port %u failed\n", config.ib_port);
-		rc = 1;
+		fprintf(stderr, "ibv_alloc_pd failed\n");
+		rc = ERR_ALLOC_PD;
 		goto resources_create_exit;
 	}
 
-	// 使用 ibv_alloc_pd 分配一个保护域（Protection Domain）。
-	res->pd = ibv_alloc_pd(res->ib_ctx);
-	if (!res->pd)
+	// 事件模式下创建完成通道，完成事件通过它通知而不必忙轮询
+	if (res->event_mode)
 	{
-		fprintf(stderr, "ibv_alloc_pd failed\n");
-		rc = 1;
+		res->channel = ibv_create_comp_channel(res->ib_ctx);
+		if (!res->channel)
+		{
+			fprintf(stderr, "failed to create completion channel\n");
+			rc = ERR_CREATE_CQ;
+			goto resources_create_exit;
+		}
+	}
+
+	// 完成队列必须容纳所有可能同时未取回的完成事件，溢出会使队列对进入错误状态：
+	// 发送队列中的每个工作请求都可能产生完成事件（出错时未发信号的请求也会），
+	// 接收完成事件的数目不超过接收队列的深度，使用共享接收队列时不超过它的接收槽数，
+	// 因为所有槽都可能被这一个连接的消息占用。
+	recv_cqe = res->srq ? (int)res->srq->depth : (int)res->max_recv_wr;
+	cq_size = res->separate_cqs ? (int)res->max_send_wr : (int)res->max_send_wr + recv_cqe;
+	if (cq_size > res->device_attr.max_cqe || recv_cqe > res->device_attr.max_cqe)
+	{
+		fprintf(stderr, "completion queue of %d entries exceeds device max_cqe %d\n",
+				cq_size > recv_cqe ? cq_size : recv_cqe, res->device_attr.max_cqe);
+		rc = ERR_QUEUE_DEPTH;
 		goto resources_create_exit;
 	}
 
 	// 使用 ibv_create_cq 创建一个完成队列（Completion Queue）。
-	cq_size = 1;
-	res->cq = ibv_create_cq(res->ib_ctx, cq_size, NULL, NULL, 0);
+	res->cq = ibv_create_cq(res->ib_ctx, cq_size, NULL, res->channel, 0);
 	if (!res->cq)
 	{
-		fprintf(stderr, "failed to create CQ with %u entries\n", cq_size);
-		rc = 1;
+		fprintf(stderr, "failed to create CQ with %d entries\n", cq_size);
+		rc = ERR_CREATE_CQ;
 		goto resources_create_exit;
 	}
+	// 请求分开的完成队列时接收完成事件使用单独的完成队列，发送和接收的完成事件可以各自取回，互不竞争
+	if (res->separate_cqs)
+	{
+		res->recv_cq = ibv_create_cq(res->ib_ctx, recv_cqe, NULL, res->channel, 0);
+		if (!res->recv_cq)
+		{
+			fprintf(stderr, "failed to create receive CQ with %d entries\n", recv_cqe);
+			rc = ERR_CREATE_CQ;
+			goto resources_create_exit;
+		}
+	}
 
-	// 分配内存缓冲区
-	size = MSG_SIZE;
-	res->buf = (char *)malloc(size);
+	// 分配内存缓冲区，未指定大小时使用默认的消息大小
+	if (!res->buf_size)
+		res->buf_size = MSG_SIZE;
+	size = res->buf_size;
+	// 指定了 NUMA 节点时缓冲区从该节点分配，与网卡位于同一节点可以避免跨插槽访问内存
+	res->buf = alloc_data_buffer(size, res->numa_node);
 	if (!res->buf)
 	{
-		fprintf(stderr, "failed to malloc %Zu bytes to memory buffer\n", size);
-		rc = 1;
+		fprintf(stderr, "failed to allocate %Zu bytes to memory buffer\n", size);
+		rc = ERR_ALLOC_BUFFER;
 		goto resources_create_exit;
 	}
 	// // 使用 memset 将缓冲区清零。
 	// memset(res->buf, 0, size);
 	// // 如果是服务器端，将消息内容复制到缓冲区中。
-	// if (!config.server_name)
+	// if (!res->cfg.server_name)
 	// {
 	// 	printf("Enter your message: ");
 	// 	if (fgets(res->buf, MSG_SIZE, stdin) != NULL) // 假设 BUFFER_SIZE 是 res.buf 的大小
@@ -547,51 +2391,121 @@ int resources_create(struct resources *res)
 	// 这行代码设定了用于注册内存区域的访问标志。IBV_ACCESS_LOCAL_WRITE 允许本地写入，IBV_ACCESS_REMOTE_READ 和 IBV_ACCESS_REMOTE_WRITE 分别允许远程端读取和写入这块内存。
 	// 这些标志确保了内存区域既能被本地 RDMA 设备用于写操作，也能被远程 RDMA 设备用于读和写操作。
 	mr_flags = IBV_ACCESS_LOCAL_WRITE | IBV_ACCESS_REMOTE_READ | IBV_ACCESS_REMOTE_WRITE;
+	// 设备支持原子操作时允许远端在数据缓冲区上执行原子操作
+	if (res->device_attr.atomic_cap != IBV_ATOMIC_NONE)
+		mr_flags |= IBV_ACCESS_REMOTE_ATOMIC;
+	// 调用者指定了访问标志时使用指定的标志；接收和 RDMA 读都写入本地缓冲区，所以总是允许本地写入
+	if (res->mr_access)
+		mr_flags = res->mr_access | IBV_ACCESS_LOCAL_WRITE;
 	// 函数注册内存区域。这个调用关联了前面分配的保护域（res->pd）、内存缓冲区（res->buf）、缓冲区大小（size）以及访问标志（mr_flags）。
+	// 记录注册的大小，注册失败时调用者据此报告尝试注册的字节数
+	res->reg_size = size;
 	res->mr = ibv_reg_mr(res->pd, res->buf, size, mr_flags);
 	if (!res->mr)
 	{
-		fprintf(stderr, "ibv_reg_mr failed with mr_flags=0x%x\n", mr_flags);
-		rc = 1;
+		fprintf(stderr, "ibv_reg_mr of %Zu bytes failed with mr_flags=0x%x\n", size, mr_flags);
+		rc = ERR_REG_MR;
 		goto resources_create_exit;
 	}
-	fprintf(stdout, "MR was registered with addr=%p, lkey=0x%x, rkey=0x%x, flags=0x%x\n",
-			res->buf, res->mr->lkey, res->mr->rkey, mr_flags);
+	// 确认整个缓冲区都被注册在同一个内存区域中，否则后续的原子操作和 DMA 会越界
+	if (res->mr->length != size)
+	{
+		fprintf(stderr, "MR covers %Zu of the %Zu requested bytes\n", res->mr->length, size);
+		rc = ERR_PARTIAL_REGISTRATION;
+		goto resources_create_exit;
+	}
+	verbose_print("MR was registered with addr=%p, lkey=0x%x, rkey=0x%x, flags=0x%x\n",
+			res->buf, res->mr->lkey, res->mr->rkey, mr_flags);
+	res->mr_access = mr_flags;
+
+	// 请求使用设备内存时，远端访问的缓冲区放在网卡的片上内存中，本地缓冲区仍用于暂存数据
+	if (res->use_dm && alloc_device_memory(res, size, mr_flags))
+		fprintf(stderr, "device memory is not available, using host memory\n");
+
+	// 分配并注册控制区，用于保存本端的写索引，远端只需读取权限
+	res->ctrl = (uint64_t *)calloc(1, CTRL_SIZE);
+	if (!res->ctrl)
+	{
+		fprintf(stderr, "failed to malloc %Zu bytes to control buffer\n", CTRL_SIZE);
+		rc = ERR_ALLOC_BUFFER;
+		goto resources_create_exit;
+	}
+	res->reg_size = CTRL_SIZE;
+	res->ctrl_mr = ibv_reg_mr(res->pd, res->ctrl, CTRL_SIZE, IBV_ACCESS_LOCAL_WRITE | IBV_ACCESS_REMOTE_READ);
+	if (!res->ctrl_mr)
+	{
+		fprintf(stderr, "ibv_reg_mr failed for control buffer\n");
+		rc = ERR_REG_MR;
+		goto resources_create_exit;
+	}
+	if (res->ctrl_mr->length != CTRL_SIZE)
+	{
+		fprintf(stderr, "control MR covers %Zu of the %Zu requested bytes\n", res->ctrl_mr->length, CTRL_SIZE);
+		rc = ERR_PARTIAL_REGISTRATION;
+		goto resources_create_exit;
+	}
+	// UD 队列对接收的数据前面带有 GRH，使用单独的接收缓冲区，避免与发送数据共用 res->buf
+	if (res->cfg.qp_type == IBV_QPT_UD)
+	{
+		res->ud_buf = (char *)calloc(1, UD_GRH_SIZE + size);
+		if (!res->ud_buf)
+		{
+			fprintf(stderr, "failed to malloc %Zu bytes to UD receive buffer\n", UD_GRH_SIZE + size);
+			rc = ERR_ALLOC_BUFFER;
+			goto resources_create_exit;
+		}
+		res->reg_size = UD_GRH_SIZE + size;
+		res->ud_mr = ibv_reg_mr(res->pd, res->ud_buf, UD_GRH_SIZE + size, IBV_ACCESS_LOCAL_WRITE);
+		if (!res->ud_mr)
+		{
+			fprintf(stderr, "ibv_reg_mr failed for UD receive buffer\n");
+			rc = ERR_REG_MR;
+			goto resources_create_exit;
+		}
+	}
 
 	// 这一部分代码涉及使用 InfiniBand Verbs API 创建队列对（Queue Pair, QP），它是 RDMA 通信的核心组件。队列对包含两个队列：发送队列（Send Queue）和接收队列（Receive Queue）
 
 	// 将 qp_init_attr 结构体的内容初始化为零。
 	memset(&qp_init_attr, 0, sizeof(qp_init_attr));
 
-	// 设置队列对类型为可靠连接（Reliable Connection）。
-	qp_init_attr.qp_type = IBV_QPT_RC;
+	// 设置队列对类型，默认为可靠连接（Reliable Connection），也可以是不可靠连接（Unreliable Connection）。
+	qp_init_attr.qp_type = res->cfg.qp_type;
 
-	// 设置发送队列的所有工作请求在完成时都将产生一个完成事件。
-	qp_init_attr.sq_sig_all = 1;
+	// 只有设置了 IBV_SEND_SIGNALED 的工作请求才产生完成事件，post_write_batch 依赖这一点只对批次的最后一个请求发信号。
+	qp_init_attr.sq_sig_all = 0;
 
 	// 指定发送和接收操作都使用同一个完成队列（Completion Queue）
 	qp_init_attr.send_cq = res->cq;
-	qp_init_attr.recv_cq = res->cq;
+	qp_init_attr.recv_cq = res->recv_cq ? res->recv_cq : res->cq;
 
-	// 这个字段指定了发送队列（Send Queue）可以容纳的最大工作请求（Work Request）数。在你的代码中，这个值被设置为 1，意味着发送队列一次只能容纳一个发送工作请求。
-	qp_init_attr.cap.max_send_wr = 10;
+	// 这个字段指定了发送队列（Send Queue）可以容纳的最大工作请求（Work Request）数。
+	qp_init_attr.cap.max_send_wr = res->max_send_wr;
 
-	// 这个字段指定了接收队列（Receive Queue）可以容纳的最大工作请求数。在你的代码中，这个值也被设置为 1，意味着接收队列一次只能容纳一个接收工作请求。
-	qp_init_attr.cap.max_recv_wr = 10;
+	// 这个字段指定了接收队列（Receive Queue）可以容纳的最大工作请求数。
+	qp_init_attr.cap.max_recv_wr = res->max_recv_wr;
 
 	// : 设置每个工作请求的最大散布/聚集元素（Scatter/Gather Element）数为 1。
-	qp_init_attr.cap.max_send_sge = 10;
+	qp_init_attr.cap.max_send_sge = MAX_SEND_SGE;
 	qp_init_attr.cap.max_recv_sge = 10;
 
+	// 请求的最大内联数据长度，ibv_create_qp 会写回设备实际支持的值
+	qp_init_attr.cap.max_inline_data = res->max_inline_data;
+
+	// 使用共享接收队列时，接收请求提交到共享接收队列，队列对自己的接收队列不再使用
+	if (res->srq)
+		qp_init_attr.srq = res->srq->srq;
+
 	// 使用 ibv_create_qp 函数根据提供的属性创建队列对。
 	res->qp = ibv_create_qp(res->pd, &qp_init_attr);
 	if (!res->qp)
 	{
 		fprintf(stderr, "failed to create QP\n");
-		rc = 1;
+		rc = ERR_CREATE_QP;
 		goto resources_create_exit;
 	}
-	fprintf(stdout, "QP was created, QP number=0x%x\n", res->qp->qp_num);
+	res->max_inline_data = qp_init_attr.cap.max_inline_data;
+	verbose_print("QP was created, QP number=0x%x\n", res->qp->qp_num);
 resources_create_exit:
 	// 这个资源清理过程确保了在发生错误时，所有已经分配或创建的资源被适当地释放，从而防止资源泄露。
 	if (rc)
@@ -607,31 +2521,60 @@ resources_create_exit:
 			ibv_dereg_mr(res->mr);
 			res->mr = NULL;
 		}
+		if (res->ctrl_mr)
+		{
+			ibv_dereg_mr(res->ctrl_mr);
+			res->ctrl_mr = NULL;
+		}
+		free_device_memory(res);
+		if (res->ctrl)
+		{
+			free(res->ctrl);
+			res->ctrl = NULL;
+		}
+		if (res->ud_mr)
+		{
+			ibv_dereg_mr(res->ud_mr);
+			res->ud_mr = NULL;
+		}
+		if (res->ud_buf)
+		{
+			free(res->ud_buf);
+			res->ud_buf = NULL;
+		}
 		if (res->buf)
 		{
-			free(res->buf);
+			free_data_buffer(res->buf, res->buf_size, res->numa_node);
 			res->buf = NULL;
 		}
+		if (res->recv_cq)
+		{
+			ibv_destroy_cq(res->recv_cq);
+			res->recv_cq = NULL;
+		}
 		if (res->cq)
 		{
 			ibv_destroy_cq(res->cq);
 			res->cq = NULL;
 		}
+		if (res->channel)
+		{
+			ibv_destroy_comp_channel(res->channel);
+			res->channel = NULL;
+		}
+		// 共享接收队列的保护域和设备上下文由 srq_destroy 释放
 		if (res->pd)
 		{
-			ibv_dealloc_pd(res->pd);
+			if (!res->srq)
+				ibv_dealloc_pd(res->pd);
 			res->pd = NULL;
 		}
 		if (res->ib_ctx)
 		{
-			ibv_close_device(res->ib_ctx);
+			if (!res->srq)
+				ibv_close_device(res->ib_ctx);
 			res->ib_ctx = NULL;
 		}
-		if (dev_list)
-		{
-			ibv_free_device_list(dev_list);
-			dev_list = NULL;
-		}
 		if (res->sock >= 0)
 		{
 			if (close(res->sock))
@@ -645,7 +2588,7 @@ resources_create_exit:
  * Function: modify_qp_to_init
  *
  * Input
- * qp QP to transition
+ * res pointer to resources structure whose QP is transitioned
  *
  * Output
  * none
@@ -655,8 +2598,9 @@ resources_create_exit:
  *
  * Description
  ******************************************************************************/
-int modify_qp_to_init(struct ibv_qp *qp)
+int modify_qp_to_init(struct resources *res)
 {
+	struct ibv_qp *qp = res->qp;
 	struct ibv_qp_attr attr;
 	int flags;
 	int rc;
@@ -666,16 +2610,25 @@ int modify_qp_to_init(struct ibv_qp *qp)
 	attr.qp_state = IBV_QPS_INIT;
 
 	//  设置队列对将要使用的端口号。
-	attr.port_num = config.ib_port;
+	attr.port_num = res->cfg.ib_port;
 
 	// 置分区键（Partition Key）索引。在大多数情况下，这个值设置为 0。
 	attr.pkey_index = 0;
 
 	//  设置队列对的访问权限，包括本地写入、远程读取和远程写入。
-	attr.qp_access_flags = IBV_ACCESS_LOCAL_WRITE | IBV_ACCESS_REMOTE_READ | IBV_ACCESS_REMOTE_WRITE;
+	attr.qp_access_flags = IBV_ACCESS_LOCAL_WRITE | IBV_ACCESS_REMOTE_READ | IBV_ACCESS_REMOTE_WRITE | IBV_ACCESS_REMOTE_ATOMIC;
+	// UC 队列对不支持 RDMA 读和原子操作，只允许远程写入
+	if (qp->qp_type == IBV_QPT_UC)
+		attr.qp_access_flags = IBV_ACCESS_LOCAL_WRITE | IBV_ACCESS_REMOTE_WRITE;
 
 	// 指定将要修改的队列对属性。
 	flags = IBV_QP_STATE | IBV_QP_PKEY_INDEX | IBV_QP_PORT | IBV_QP_ACCESS_FLAGS;
+	// UD 队列对没有远程访问权限，只接受携带相同 Q_Key 的数据报
+	if (qp->qp_type == IBV_QPT_UD)
+	{
+		attr.qkey = UD_QKEY;
+		flags = IBV_QP_STATE | IBV_QP_PKEY_INDEX | IBV_QP_PORT | IBV_QP_QKEY;
+	}
 
 	// 函数修改队列对的状态。这个调用需要 qp、属性结构体 attr 和指定的标志 flags
 	rc = ibv_modify_qp(qp, &attr, flags);
@@ -687,7 +2640,7 @@ int modify_qp_to_init(struct ibv_qp *qp)
  * Function: modify_qp_to_rtr
  *
  * Input
- * qp QP to transition
+ * res pointer to resources structure whose QP is transitioned
  * remote_qpn remote QP number
  * dlid destination LID
  * dgid destination GID (mandatory for RoCEE)
@@ -700,8 +2653,9 @@ int modify_qp_to_init(struct ibv_qp *qp)
  *
  * Description
  ******************************************************************************/
-int modify_qp_to_rtr(struct ibv_qp *qp, uint32_t remote_qpn, uint16_t dlid, uint8_t *dgid)
+int modify_qp_to_rtr(struct resources *res, uint32_t remote_qpn, uint16_t dlid, uint8_t *dgid)
 {
+	struct ibv_qp *qp = res->qp;
 	/*
 	参数部分：
 	qp: 要修改状态的队列对。
@@ -711,6 +2665,7 @@ int modify_qp_to_rtr(struct ibv_qp *qp, uint32_t remote_qpn, uint16_t dlid, uint
 	*/
 
 	struct ibv_qp_attr attr;
+	struct ibv_port_attr port_attr;
 	int flags;
 	int rc;
 	memset(&attr, 0, sizeof(attr));
@@ -718,14 +2673,21 @@ int modify_qp_to_rtr(struct ibv_qp *qp, uint32_t remote_qpn, uint16_t dlid, uint
 	// 设置队列对状态为 RTR (IBV_QPS_RTR)。
 	attr.qp_state = IBV_QPS_RTR;
 
-	// 设置路径最大传输单元（attr.path_mtu）
-	attr.path_mtu = IBV_MTU_256;
+	// 设置路径最大传输单元（attr.path_mtu），未配置时使用 IBV_MTU_256；超过端口当前 MTU 时退回到端口的 active_mtu
+	attr.path_mtu = res->cfg.path_mtu ? res->cfg.path_mtu : IBV_MTU_256;
+	if (!ibv_query_port(qp->context, res->cfg.ib_port, &port_attr) && attr.path_mtu > port_attr.active_mtu)
+	{
+		fprintf(stderr, "path MTU %d exceeds the active MTU %d of port %d, using the active MTU\n",
+				attr.path_mtu, port_attr.active_mtu, res->cfg.ib_port);
+		attr.path_mtu = port_attr.active_mtu;
+	}
 
 	// 设置目的队列对编号（attr.dest_qp_num）为 remote_qpn。
 	attr.dest_qp_num = remote_qpn;
 
-	// 设置请求包序列号（attr.rq_psn）。
-	attr.rq_psn = 0;
+	// 设置接收包序列号（attr.rq_psn）为对端发送队列的起始序列号（保存在 remote_props 中）。
+	// 两端不一致时，收到的包被当作乱序或重复包丢弃，发送端重传直到重试次数耗尽。
+	attr.rq_psn = res->remote_props.psn & 0xffffff;
 
 	// 设置目标端的最大远程读原子操作数（attr.max_dest_rd_atomic）。
 	attr.max_dest_rd_atomic = 1;
@@ -743,12 +2705,12 @@ int modify_qp_to_rtr(struct ibv_qp *qp, uint32_t remote_qpn, uint16_t dlid, uint
 	// 设置源路径位，通常用于子网内的路径选择。
 	attr.ah_attr.src_path_bits = 0;
 	//  设置使用的 IB 端口号。
-	attr.ah_attr.port_num = config.ib_port;
+	attr.ah_attr.port_num = res->cfg.ib_port;
 
 	// 如果使用全局标识符（GID），设置 attr.ah_attr.is_global 为 1 并复制 dgid 到 attr.ah_attr.grh.dgid。
-	if (config.gid_idx >= 0)
+	if (res->cfg.gid_idx >= 0)
 	{
-		// 如果 config.gid_idx 大于等于 0，表示需要使用全局标识符（GID）进行通信，这通常在跨子网通信时使用。
+		// 如果 res->cfg.gid_idx 大于等于 0，表示需要使用全局标识符（GID）进行通信，这通常在跨子网通信时使用。
 
 		// 设置为使用全局路由。
 		attr.ah_attr.is_global = 1;
@@ -761,7 +2723,7 @@ int modify_qp_to_rtr(struct ibv_qp *qp, uint32_t remote_qpn, uint16_t dlid, uint
 		// 设置跳数限制，对于 RDMA 通常设置为 1。
 		attr.ah_attr.grh.hop_limit = 1;
 		// 设置源 GID 索引
-		attr.ah_attr.grh.sgid_index = config.gid_idx;
+		attr.ah_attr.grh.sgid_index = res->cfg.gid_idx;
 		// 设置流量类别，通常设置为 0。
 		attr.ah_attr.grh.traffic_class = 0;
 	}
@@ -769,6 +2731,12 @@ int modify_qp_to_rtr(struct ibv_qp *qp, uint32_t remote_qpn, uint16_t dlid, uint
 	// ，指定将要修改的队列对属性。
 	flags = IBV_QP_STATE | IBV_QP_AV | IBV_QP_PATH_MTU | IBV_QP_DEST_QPN |
 			IBV_QP_RQ_PSN | IBV_QP_MAX_DEST_RD_ATOMIC | IBV_QP_MIN_RNR_TIMER;
+	// UC 队列对没有 RDMA 读/原子操作和 RNR 重试，不能设置相应属性
+	if (qp->qp_type == IBV_QPT_UC)
+		flags = IBV_QP_STATE | IBV_QP_AV | IBV_QP_PATH_MTU | IBV_QP_DEST_QPN | IBV_QP_RQ_PSN;
+	// UD 队列对不与固定的对端相连，目的地由每个发送请求的地址句柄指定
+	if (qp->qp_type == IBV_QPT_UD)
+		flags = IBV_QP_STATE;
 
 	// 使用 ibv_modify_qp 函数根据指定的属性和标志修改队列对状态。
 	rc = ibv_modify_qp(qp, &attr, flags);
@@ -776,11 +2744,38 @@ int modify_qp_to_rtr(struct ibv_qp *qp, uint32_t remote_qpn, uint16_t dlid, uint
 		fprintf(stderr, "failed to modify QP state to RTR\n");
 	return rc;
 }
+/******************************************************************************
+ * Function: query_path_mtu
+ *
+ * Input
+ * qp QP to query
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * the path MTU of qp as an enum ibv_mtu value on success, -1 on failure
+ *
+ * Description
+ * Query the path MTU chosen by modify_qp_to_rtr, which may be lower than
+ * res->cfg.path_mtu if the port does not support the requested value.
+ ******************************************************************************/
+int query_path_mtu(struct ibv_qp *qp)
+{
+	struct ibv_qp_attr attr;
+	struct ibv_qp_init_attr init_attr;
+	if (ibv_query_qp(qp, &attr, IBV_QP_PATH_MTU, &init_attr))
+	{
+		fprintf(stderr, "failed to query QP path MTU\n");
+		return -1;
+	}
+	return attr.path_mtu;
+}
 /******************************************************************************
  * Function: modify_qp_to_rts
  *
  * Input
- * qp QP to transition
+ * res pointer to resources structure whose QP is transitioned
  *
  * Output
  * none
@@ -791,8 +2786,9 @@ int modify_qp_to_rtr(struct ibv_qp *qp, uint32_t remote_qpn, uint16_t dlid, uint
  * Description
 函数的目的是将队列对（Queue Pair, QP）从准备接收（Ready to Receive, RTR）状态转换到准备发送（Ready to Send, RTS）状态。
  ******************************************************************************/
-int modify_qp_to_rts(struct ibv_qp *qp)
+int modify_qp_to_rts(struct resources *res)
 {
+	struct ibv_qp *qp = res->qp;
 	struct ibv_qp_attr attr;
 	int flags;
 	int rc;
@@ -801,17 +2797,17 @@ int modify_qp_to_rts(struct ibv_qp *qp)
 	// 设置队列对的目标状态为 RTS。
 	attr.qp_state = IBV_QPS_RTS;
 
-	// 设置超时参数，用于确定重传超时时间。
-	attr.timeout = 0x12;
+	// 设置超时参数，用于确定重传超时时间：4.096 微秒 * 2^timeout。
+	attr.timeout = res->cfg.qp_timeout;
 
 	// 设置最大重试发送次数。
-	attr.retry_cnt = 6;
+	attr.retry_cnt = res->cfg.retry_cnt;
 
-	// 设置 RNR（Receiver Not Ready）重试次数。这里设置为 0 表示不进行 RNR 重试。
-	attr.rnr_retry = 0;
+	// 设置 RNR（Receiver Not Ready）重试次数。默认为 0 表示不进行 RNR 重试，7 表示无限重试。
+	attr.rnr_retry = res->cfg.rnr_retry;
 
-	// 设置发送队列的包序列号。
-	attr.sq_psn = 0;
+	// 设置发送队列的起始包序列号，对端通过连接信息得知这个值。包序列号只有 24 位。
+	attr.sq_psn = res->psn & 0xffffff;
 
 	//  设置最大远程读原子操作数。
 	attr.max_rd_atomic = 1;
@@ -819,6 +2815,9 @@ int modify_qp_to_rts(struct ibv_qp *qp)
 	// 这些标志指定了要修改的队列对属性。
 	flags = IBV_QP_STATE | IBV_QP_TIMEOUT | IBV_QP_RETRY_CNT |
 			IBV_QP_RNR_RETRY | IBV_QP_SQ_PSN | IBV_QP_MAX_QP_RD_ATOMIC;
+	// UC 和 UD 队列对没有确认和重传，只需设置发送包序列号
+	if (qp->qp_type == IBV_QPT_UC || qp->qp_type == IBV_QPT_UD)
+		flags = IBV_QP_STATE | IBV_QP_SQ_PSN;
 
 	// 使用 ibv_modify_qp 函数根据指定的属性和标志修改队列对状态。
 	rc = ibv_modify_qp(qp, &attr, flags);
@@ -826,17 +2825,218 @@ int modify_qp_to_rts(struct ibv_qp *qp)
 		fprintf(stderr, "failed to modify QP state to RTS\n");
 	return rc;
 }
+/******************************************************************************
+ * Function: modify_qp_to_reset
+ *
+ * Input
+ * res pointer to resources structure whose QP is transitioned
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, ibv_modify_qp failure code on failure
+ *
+ * Description
+ * Move the QP from any state, in particular IBV_QPS_ERR, back to RESET. The
+ * work requests still queued are discarded without completions and the QP
+ * can then be brought up again with modify_qp_to_init, _rtr and _rts.
+ ******************************************************************************/
+int modify_qp_to_reset(struct resources *res)
+{
+	struct ibv_qp_attr attr;
+	int rc;
+	memset(&attr, 0, sizeof(attr));
+	attr.qp_state = IBV_QPS_RESET;
+	rc = ibv_modify_qp(res->qp, &attr, IBV_QP_STATE);
+	if (rc)
+		fprintf(stderr, "failed to modify QP state to RESET\n");
+	else
+		res->qp_err = 0;
+	return rc;
+}
+/******************************************************************************
+ * Function: query_qp_state
+ *
+ * Input
+ * res pointer to resources structure
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * the current state of the QP (enum ibv_qp_state), -1 on failure
+ *
+ * Description
+ ******************************************************************************/
+int query_qp_state(struct resources *res)
+{
+	struct ibv_qp_attr attr;
+	struct ibv_qp_init_attr init_attr;
+	if (ibv_query_qp(res->qp, &attr, IBV_QP_STATE, &init_attr))
+	{
+		fprintf(stderr, "failed to query QP state\n");
+		return -1;
+	}
+	return attr.qp_state;
+}
+/******************************************************************************
+ * Function: drain_cq
+ *
+ * Input
+ * res pointer to resources structure
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * the number of completions removed, -1 if polling failed
+ *
+ * Description
+ * Poll the CQ, and the receive CQ if there is one, until it is empty and
+ * discard what is found, regardless of status, counting it in res->dropped.
+ * Once a QP is in the error state, every outstanding work request completes
+ * with IBV_WC_WR_FLUSH_ERR; those completions must be removed before the QP
+ * is reused, so that they are not taken for completions of new requests.
+ ******************************************************************************/
+int drain_cq(struct resources *res)
+{
+	struct ibv_wc wc[MAX_POLL_BATCH];
+	int drained = 0;
+	int n;
+	while ((n = ibv_poll_cq(res->cq, MAX_POLL_BATCH, wc)) > 0)
+		drained += n;
+	// 分开的完成队列时接收队列的完成事件在 recv_cq 中
+	while (n == 0 && res->recv_cq && (n = ibv_poll_cq(res->recv_cq, MAX_POLL_BATCH, wc)) > 0)
+		drained += n;
+	if (n < 0)
+	{
+		fprintf(stderr, "poll CQ failed\n");
+		return -1;
+	}
+	__atomic_add_fetch(&res->dropped, drained, __ATOMIC_RELAXED);
+	return drained;
+}
+/******************************************************************************
+ * Function: clear_buffers
+ *
+ * Input
+ * res pointer to resources structure
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 0 on success, error code of ibv_memcpy_to_dm on failure
+ *
+ * Description
+ * Zero the data buffer, the control region, the UD receive buffer and the
+ * device memory, so that nothing of an earlier connection can be read
+ * through the memory regions once they are handed to a new peer.
+ ******************************************************************************/
+int clear_buffers(struct resources *res)
+{
+	memset(res->buf, 0, res->buf_size);
+	memset(res->ctrl, 0, CTRL_SIZE);
+	if (res->ud_buf)
+		memset(res->ud_buf, 0, UD_GRH_SIZE + res->buf_size);
+	// 远端访问的是设备内存，用清零后的本地缓冲区覆盖它
+	return dm_copy(res, 0, res->buf_size, 1);
+}
+/******************************************************************************
+ * Function: cm_checksum
+ *
+ * Input
+ * data pointer to the bytes to checksum
+ * len number of bytes
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * 32-bit FNV-1a hash of the bytes
+ *
+ * Description
+ * Checksum used to validate the connection data exchanged in connect_qp.
+ * It is computed over the data exactly as sent on the wire.
+ ******************************************************************************/
+uint32_t cm_checksum(const void *data, size_t len)
+{
+	const uint8_t *p = data;
+	uint32_t hash = 2166136261u;
+	size_t i;
+	for (i = 0; i < len; i++)
+	{
+		hash ^= p[i];
+		hash *= 16777619u;
+	}
+	return hash;
+}
+/******************************************************************************
+ * Function: query_local_con_data
+ *
+ * Input
+ * res pointer to resources structure
+ *
+ * Output
+ * data local connection data in host byte order
+ *
+ * Returns
+ * 0 on success, ibv_query_gid failure code on failure
+ *
+ * Description
+ * Collect the values the remote side needs to connect to this QP: buffer
+ * address and rkey, QP number, LID, GID (zero unless res->cfg.gid_idx is set)
+ * and the control region. connect_qp sends them to the peer; they can also
+ * be shipped over any other channel and passed to modify_qp_to_rtr there.
+ ******************************************************************************/
+int query_local_con_data(struct resources *res, struct cm_con_data_t *data)
+{
+	union ibv_gid my_gid;
+	int rc;
+	// 不使用 GID 时（仅在 InfiniBand 子网内通信）GID 保持为零
+	memset(&my_gid, 0, sizeof my_gid);
+	if (res->cfg.gid_idx >= 0)
+	{
+		rc = ibv_query_gid(res->ib_ctx, res->cfg.ib_port, res->cfg.gid_idx, &my_gid);
+		if (rc)
+		{
+			fprintf(stderr, "could not get gid for port %d, index %d\n", res->cfg.ib_port, res->cfg.gid_idx);
+			return rc;
+		}
+	}
+	memset(data, 0, sizeof(*data));
+	data->addr = (uintptr_t)res->buf;
+	data->rkey = res->mr->rkey;
+	// 使用设备内存时远端访问零起始地址的设备内存区域
+	if (res->dm_mr)
+	{
+		data->addr = 0;
+		data->rkey = res->dm_mr->rkey;
+	}
+	data->qp_num = res->qp->qp_num;
+	data->lid = res->port_attr.lid;
+	memcpy(data->gid, &my_gid, 16);
+	data->ctrl_addr = (uintptr_t)res->ctrl;
+	data->ctrl_rkey = res->ctrl_mr->rkey;
+	data->psn = res->psn;
+	data->buf_size = res->buf_size;
+	return 0;
+}
 /******************************************************************************
  * Function: connect_qp
  *
  * Input
  * res pointer to resources structure
+ * timeout_ms bound on each exchange with the peer in milliseconds, 0 or
+ * negative to wait indefinitely
  *
  * Output
  * none
  *
  * Returns
- * 0 on success, error code on failure
+ * 0 on success, ERR_BAD_HANDSHAKE if the connection data received from the
+ * remote side is malformed, other error codes on failure
  *
  * Description
  * Connect the QP. Transition the server side to RTR, sender side to RTS
@@ -844,7 +3044,7 @@ int modify_qp_to_rts(struct ibv_qp *qp)
  * 连接队列对，将服务端变成待接受状态，客户端变成待发送状态
  * 函数的作用是配置和连接队列对（Queue Pair, QP），以便进行 RDMA 通信。这个过程包括设置队列对的状态，以及交换所需的连接信息。以下是函数的详细解释：
  ******************************************************************************/
-int connect_qp(struct resources *res)
+int connect_qp(struct resources *res, int timeout_ms)
 {
 
 	// 这个结构体用于存储本地连接所需的信息，如本地队列对（QP）的编号、内存区域（MR）的键（key）、本地标识符（LID）和全局标识符（GID）。这些信息将被发送到远程端以建立连接。
@@ -854,49 +3054,70 @@ int connect_qp(struct resources *res)
 	struct cm_con_data_t remote_con_data;
 
 	struct cm_con_data_t tmp_con_data;
+	struct cm_con_msg_t local_msg;
+	struct cm_con_msg_t remote_msg;
 	int rc = 0;
 
 	// 这个字符变量通常用于同步过程中的简单数据交换，确保双方都准备好进行下一步操作
 	char temp_char;
 
-	// 这是一个全局标识符（Global Identifier, GID）的联合体，用于存储本地端的 GID。在使用 RoCE（RDMA over Converged Ethernet）或跨子网的 RDMA 通信时，GID 是必需的。它用于唯一标识 InfiniBand 网络中的设备。
-	union ibv_gid my_gid;
-
-	// 表示使用全局标识符（Global Identifier, GID）。函数查询并设置 GID
-	if (config.gid_idx >= 0)
-	{
-		// 这行代码查询指定 IB 端口的 GID。res->ib_ctx 是设备上下文，config.ib_port 是端口号，config.gid_idx 是 GID 索引。
-		rc = ibv_query_gid(res->ib_ctx, config.ib_port, config.gid_idx, &my_gid);
-		if (rc)
-		{
-			fprintf(stderr, "could not get gid for port %d, index %d\n", config.ib_port, config.gid_idx);
-			return rc;
-		}
-	}
-	else
-		fprintf(stdout, "using InfiniBand subnet connection\n");
-	// 意味着不需要使用 GID。这种情况下，将 my_gid 清零。这通常用于仅在 InfiniBand 子网内通信的情况。
-	memset(&my_gid, 0, sizeof my_gid);
+	// 查询本地连接信息（主机字节顺序），然后转换为网络字节顺序发送给远端
+	rc = query_local_con_data(res, &tmp_con_data);
+	if (rc)
+		return rc;
+	// 交换连接信息期间限制每次套接字读写的等待时间，避免对端不响应时一直阻塞
+	rc = sock_set_timeout(res->sock, timeout_ms);
+	if (rc)
+		return rc;
+	if (res->cfg.gid_idx < 0)
+		verbose_print("using InfiniBand subnet connection\n");
 
 	// 设置本地缓冲区地址。htonll 将地址从主机字节顺序转换为网络字节顺序。
-	local_con_data.addr = htonll((uintptr_t)res->buf);
+	local_con_data.addr = htonll(tmp_con_data.addr);
 	// 设置本地内存区域（MR）的远程键（rkey）。htonl 转换为网络字节顺序。
-	local_con_data.rkey = htonl(res->mr->rkey);
+	local_con_data.rkey = htonl(tmp_con_data.rkey);
 	//  设置本地队列对编号。同样使用 htonl 进行字节顺序转换。
-	local_con_data.qp_num = htonl(res->qp->qp_num);
+	local_con_data.qp_num = htonl(tmp_con_data.qp_num);
 	// 设置本地标识符（LID）。htons 转换为网络字节顺序。
-	local_con_data.lid = htons(res->port_attr.lid);
+	local_con_data.lid = htons(tmp_con_data.lid);
 	// 复制 GID 到本地连接数据结构。
-	memcpy(local_con_data.gid, &my_gid, 16);
-	fprintf(stdout, "\nLocal LID = 0x%x\n", res->port_attr.lid);
+	memcpy(local_con_data.gid, tmp_con_data.gid, 16);
+	// 设置本地控制区的地址和远程密钥，远端通过它读取本端的写索引
+	local_con_data.ctrl_addr = htonll(tmp_con_data.ctrl_addr);
+	local_con_data.ctrl_rkey = htonl(tmp_con_data.ctrl_rkey);
+	// 本端的起始包序列号，对端在 RTR 时以它作为期望的接收序列号
+	local_con_data.psn = htonl(tmp_con_data.psn);
+	local_con_data.buf_size = htonl(tmp_con_data.buf_size);
+	verbose_print("\nLocal LID = 0x%x\n", res->port_attr.lid);
 	// 函数通过已建立的 TCP 套接字交换本地和远程连接数据。
 	// 这里将远端的数据从socket里面读取然后放到临时数据中
-	if (sock_sync_data(res->sock, sizeof(struct cm_con_data_t), (char *)&local_con_data, (char *)&tmp_con_data) < 0)
+	// 连接信息前加上魔数和长度，后附校验和，防止截断或错乱的数据被当作远端信息使用
+	memset(&local_msg, 0, sizeof(local_msg));
+	local_msg.magic = htonl(CM_MAGIC);
+	local_msg.length = htonl(sizeof(struct cm_con_data_t));
+	local_msg.data = local_con_data;
+	local_msg.checksum = htonl(cm_checksum(&local_msg.data, sizeof(local_msg.data)));
+	memset(&remote_msg, 0, sizeof(remote_msg));
+	if (sock_sync_data(res->sock, sizeof(struct cm_con_msg_t), (char *)&local_msg, (char *)&remote_msg) < 0)
 	{
 		fprintf(stderr, "failed to exchange connection data between sides\n");
 		rc = 1;
 		goto connect_qp_exit;
 	}
+	if (ntohl(remote_msg.magic) != CM_MAGIC || ntohl(remote_msg.length) != sizeof(struct cm_con_data_t))
+	{
+		fprintf(stderr, "unexpected connection data header: magic 0x%x, length %u\n",
+				ntohl(remote_msg.magic), ntohl(remote_msg.length));
+		rc = ERR_BAD_HANDSHAKE;
+		goto connect_qp_exit;
+	}
+	if (ntohl(remote_msg.checksum) != cm_checksum(&remote_msg.data, sizeof(remote_msg.data)))
+	{
+		fprintf(stderr, "connection data checksum mismatch\n");
+		rc = ERR_BAD_HANDSHAKE;
+		goto connect_qp_exit;
+	}
+	tmp_con_data = remote_msg.data;
 
 	// 从 tmp_con_data（临时存储远程数据）提取远程端的连接信息，转换回主机字节顺序，并存储在 remote_con_data。
 	remote_con_data.addr = ntohll(tmp_con_data.addr);
@@ -906,32 +3127,37 @@ int connect_qp(struct resources *res)
 	remote_con_data.lid = ntohs(tmp_con_data.lid);
 	// 如果使用 GID，则从 tmp_con_data 复制 GID 到 remote_con_data。
 	memcpy(remote_con_data.gid, tmp_con_data.gid, 16);
+	remote_con_data.ctrl_addr = ntohll(tmp_con_data.ctrl_addr);
+	remote_con_data.ctrl_rkey = ntohl(tmp_con_data.ctrl_rkey);
+	remote_con_data.psn = ntohl(tmp_con_data.psn);
+	remote_con_data.buf_size = ntohl(tmp_con_data.buf_size);
 	/* save the remote side attributes, we will need it for the post SR */
 	res->remote_props = remote_con_data;
-	fprintf(stdout, "Remote address = 0x%" PRIx64 "\n", remote_con_data.addr);
-	fprintf(stdout, "Remote rkey = 0x%x\n", remote_con_data.rkey);
-	fprintf(stdout, "Remote QP number = 0x%x\n", remote_con_data.qp_num);
-	fprintf(stdout, "Remote LID = 0x%x\n", remote_con_data.lid);
+	verbose_print("Remote address = 0x%" PRIx64 "\n", remote_con_data.addr);
+	verbose_print("Remote rkey = 0x%x\n", remote_con_data.rkey);
+	verbose_print("Remote QP number = 0x%x\n", remote_con_data.qp_num);
+	verbose_print("Remote LID = 0x%x\n", remote_con_data.lid);
 	// 如果使用 GID，也打印远程 GID
-	if (config.gid_idx >= 0)
+	if (res->cfg.gid_idx >= 0)
 	{
 		uint8_t *p = remote_con_data.gid;
 		// 打印远程 GID 的每个字节：这个 GID 是一个 128 位的标识符，在这里以 16 个字节的形式打印出来，每个字节表示为两位十六进制数。
-		fprintf(stdout, "Remote GID =%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x\n ", p[0],
+		verbose_print("Remote GID =%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x:%02x\n ", p[0],
 				p[1], p[2], p[3], p[4], p[5], p[6], p[7], p[8], p[9], p[10], p[11], p[12], p[13], p[14], p[15]);
 	}
 
 	// 将队列对的状态修改为 INIT。
 	// 在这个阶段，队列对从其初始状态（RESET）转换到 INIT 状态。在 INIT 状态下，队列对被配置为具有必要的访问权限和网络参数，但还不能用于发送或接收数据。
 	// 这是队列对生命周期中的第一个激活状态，为后续的数据传输做准备。
-	rc = modify_qp_to_init(res->qp);
+	rc = modify_qp_to_init(res);
 	if (rc)
 	{
 		fprintf(stderr, "change QP state to INIT failed\n");
 		goto connect_qp_exit;
 	}
 
-	if (config.server_name)
+	// UD 队列对的接收请求由 RecvFrom 按需投递
+	if (res->cfg.server_name && res->qp->qp_type != IBV_QPT_UD)
 	{
 		rc = post_receive(res);
 		if (rc)
@@ -942,20 +3168,26 @@ int connect_qp(struct resources *res)
 	}
 
 	// 在此状态下队列对开始准备接收远程端的数据。
-	rc = modify_qp_to_rtr(res->qp, remote_con_data.qp_num, remote_con_data.lid, remote_con_data.gid);
+	rc = modify_qp_to_rtr(res, remote_con_data.qp_num, remote_con_data.lid, remote_con_data.gid);
 	if (rc)
 	{
 		fprintf(stderr, "failed to modify QP state to RTR\n");
 		goto connect_qp_exit;
 	}
 
-	rc = modify_qp_to_rts(res->qp);
+	rc = modify_qp_to_rts(res);
 	if (rc)
 	{
 		fprintf(stderr, "failed to modify QP state to RTR\n");
 		goto connect_qp_exit;
 	}
-	fprintf(stdout, "QP state was change to RTS\n");
+	if (res->qp->qp_type == IBV_QPT_UD)
+	{
+		rc = create_ud_ah(res);
+		if (rc)
+			goto connect_qp_exit;
+	}
+	verbose_print("QP state was change to RTS\n");
 
 	if (sock_sync_data(res->sock, 1, "Q", &temp_char)) /* just send a dummy char back and forth */
 	{
@@ -963,6 +3195,138 @@ int connect_qp(struct resources *res)
 		rc = 1;
 	}
 connect_qp_exit:
+	// 连接建立后的同步等待的是对端的操作，不再限制时间
+	if (sock_set_timeout(res->sock, -1) && !rc)
+		rc = 1;
+	return rc;
+}
+/******************************************************************************
+ * Function: select_roce_gid
+ *
+ * Input
+ * ib_ctx device context
+ * ib_port physical port number of the device
+ * gid_tbl_len length of the port's GID table
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * the index of the selected GID, -1 if the port has no usable GID
+ *
+ * Description
+ * Choose the GID a RoCE port is addressed by. Only RoCEv2 GIDs are
+ * considered, as reported in sysfs; if the kernel does not report GID types,
+ * any GID is. GIDs derived from an IPv4 address are preferred, then global
+ * IPv6 GIDs, and link-local GIDs are used only if there is nothing else.
+ ******************************************************************************/
+int select_roce_gid(struct ibv_context *ib_ctx, int ib_port, int gid_tbl_len)
+{
+	union ibv_gid gid;
+	char path[256];
+	char type[32];
+	FILE *f;
+	int best = -1;
+	int best_score = 0;
+	int score;
+	int i;
+	for (i = 0; i < gid_tbl_len; i++)
+	{
+		if (ibv_query_gid(ib_ctx, ib_port, i, &gid))
+			continue;
+		// 空的 GID 表项全为零
+		if (!gid.global.subnet_prefix && !gid.global.interface_id)
+			continue;
+		// 内核在 sysfs 中报告每个 GID 的类型，只使用 RoCEv2 的 GID
+		snprintf(path, sizeof(path), "/sys/class/infiniband/%s/ports/%d/gid_attrs/types/%d",
+				 ibv_get_device_name(ib_ctx->device), ib_port, i);
+		f = fopen(path, "r");
+		if (f)
+		{
+			if (!fgets(type, sizeof(type), f) || strncmp(type, "RoCE v2", 7))
+			{
+				fclose(f);
+				continue;
+			}
+			fclose(f);
+		}
+		// ::ffff:a.b.c.d 形式的 GID 来自 IPv4 地址，fe80::/10 为链路本地地址
+		if (!memcmp(gid.raw, "\0\0\0\0\0\0\0\0\0\0\xff\xff", 12))
+			score = 3;
+		else if (gid.raw[0] == 0xfe && (gid.raw[1] & 0xc0) == 0x80)
+			score = 1;
+		else
+			score = 2;
+		if (score > best_score)
+		{
+			best = i;
+			best_score = score;
+		}
+	}
+	return best;
+}
+/******************************************************************************
+ * Function: query_gid_table_len
+ *
+ * Input
+ * dev_name name of the IB device, or NULL for the first device found
+ * ib_port physical port number of the device
+ *
+ * Output
+ * none
+ *
+ * Returns
+ * length of the port's GID table on success, -1 on failure
+ *
+ * Description
+ * Open the device, query the port and close the device again. Used to
+ * validate a GID index before any resources are created.
+ ******************************************************************************/
+int query_gid_table_len(const char *dev_name, int ib_port)
+{
+	struct ibv_device **dev_list = NULL;
+	struct ibv_device *ib_dev = NULL;
+	struct ibv_context *ib_ctx = NULL;
+	struct ibv_port_attr port_attr;
+	int num_devices;
+	int i;
+	int rc = -1;
+	dev_list = ibv_get_device_list(&num_devices);
+	if (!dev_list)
+	{
+		fprintf(stderr, "failed to get IB devices list\n");
+		return -1;
+	}
+	// 未指定设备名时与 resources_create 一样使用第一个设备
+	for (i = 0; i < num_devices; i++)
+	{
+		if (!dev_name || !strcmp(ibv_get_device_name(dev_list[i]), dev_name))
+		{
+			ib_dev = dev_list[i];
+			break;
+		}
+	}
+	if (!ib_dev)
+	{
+		fprintf(stderr, "IB device %s wasn't found\n", dev_name ? dev_name : "(any)");
+		goto query_gid_table_len_exit;
+	}
+	ib_ctx = ibv_open_device(ib_dev);
+	if (!ib_ctx)
+	{
+		fprintf(stderr, "failed to open device %s\n", ibv_get_device_name(ib_dev));
+		goto query_gid_table_len_exit;
+	}
+	if (ibv_query_port(ib_ctx, ib_port, &port_attr))
+	{
+		fprintf(stderr, "ibv_query_port on port %d failed\n", ib_port);
+		goto query_gid_table_len_exit;
+	}
+	rc = port_attr.gid_tbl_len;
+query_gid_table_len_exit:
+	if (ib_ctx)
+		ibv_close_device(ib_ctx);
+	ibv_free_device_list(dev_list);
 	return rc;
 }
 /******************************************************************************
@@ -996,21 +3360,57 @@ int resources_destroy(struct resources *res)
 			fprintf(stderr, "failed to deregister MR\n");
 			rc = 1;
 		}
+	free_device_memory(res);
 	if (res->buf)
-		free(res->buf);
+		free_data_buffer(res->buf, res->buf_size, res->numa_node);
+	if (res->ctrl_mr)
+		if (ibv_dereg_mr(res->ctrl_mr))
+		{
+			fprintf(stderr, "failed to deregister control MR\n");
+			rc = 1;
+		}
+	if (res->ctrl)
+		free(res->ctrl);
+	if (res->ud_mr)
+		if (ibv_dereg_mr(res->ud_mr))
+		{
+			fprintf(stderr, "failed to deregister UD receive MR\n");
+			rc = 1;
+		}
+	if (res->ud_buf)
+		free(res->ud_buf);
+	if (res->ah)
+		if (ibv_destroy_ah(res->ah))
+		{
+			fprintf(stderr, "failed to destroy address handle\n");
+			rc = 1;
+		}
+	if (res->recv_cq)
+		if (ibv_destroy_cq(res->recv_cq))
+		{
+			fprintf(stderr, "failed to destroy receive CQ\n");
+			rc = 1;
+		}
 	if (res->cq)
 		if (ibv_destroy_cq(res->cq))
 		{
 			fprintf(stderr, "failed to destroy CQ\n");
 			rc = 1;
 		}
-	if (res->pd)
+	if (res->channel)
+		if (ibv_destroy_comp_channel(res->channel))
+		{
+			fprintf(stderr, "failed to destroy completion channel\n");
+			rc = 1;
+		}
+	// 共享接收队列的保护域和设备上下文由 srq_destroy 释放
+	if (res->pd && !res->srq)
 		if (ibv_dealloc_pd(res->pd))
 		{
 			fprintf(stderr, "failed to deallocate PD\n");
 			rc = 1;
 		}
-	if (res->ib_ctx)
+	if (res->ib_ctx && !res->srq)
 		if (ibv_close_device(res->ib_ctx))
 		{
 			fprintf(stderr, "failed to close device context\n");
@@ -1101,7 +3501,7 @@ void usage(const char *argv0)
 int receive_message(struct resources *res, const char *entity)
 {
 	printf("%s: Enter your message to send (type 'exit' to end): ", entity);
-	if (fgets(res->buf, MSG_SIZE, stdin) == NULL || strcmp(res->buf, "exit\n") == 0)
+	if (fgets(res->buf, res->buf_size, stdin) == NULL || strcmp(res->buf, "exit\n") == 0)
 	{
 		return 1; // return 1 indicates exit
 	}
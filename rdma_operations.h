@@ -13,11 +13,91 @@
 #include <infiniband/verbs.h>
 #include <sys/types.h>
 #include <sys/socket.h>
+#include <sys/un.h>
 #include <netdb.h>
+#include <fcntl.h>
+#include <poll.h>
+#include <errno.h>
+#include <sys/mman.h>
+#include <sys/syscall.h>
+
+/* 连接建立过程中的提示信息（设备、内存区域、队列对编号等）默认不打印，
+ * 编译时定义 RDMA_VERBOSE（例如 CGO_CFLAGS=-DRDMA_VERBOSE）才输出到标准错误；
+ * 未定义时参数仍参与类型检查，但调用被编译器消除 */
+#ifdef RDMA_VERBOSE
+#define verbose_print(...) fprintf(stderr, __VA_ARGS__)
+#else
+#define verbose_print(...)                 \
+	do                                     \
+	{                                      \
+		if (0)                             \
+			fprintf(stderr, __VA_ARGS__); \
+	} while (0)
+#endif
 
 #define MAX_POLL_CQ_TIMEOUT 2000
+#define MAX_POLL_BATCH 64
+/* UD 接收缓冲区开头由设备写入的全局路由头（GRH）的大小 */
+#define UD_GRH_SIZE 40
+/* UD 队列对使用的 Q_Key，两端必须相同 */
+#define UD_QKEY 0x11111111
+/* 每个发送工作请求最多包含的散布/聚集元素数 */
+#define MAX_SEND_SGE 10
+/* 发送队列默认可容纳的工作请求数 */
+#define DEFAULT_MAX_SEND_WR 10
+/* 接收队列默认可容纳的工作请求数 */
+#define DEFAULT_MAX_RECV_WR 10
+/* 共享接收队列默认的接收槽数 */
+#define DEFAULT_SRQ_WR 256
+/* resources.numa_node 可以指定的 NUMA 节点数上限 */
+#define MAX_NUMA_NODES 1024
 #define MSG "******************************************************************************/"
 #define MSG_SIZE (strlen(MSG) + 6)
+#define CTRL_SIZE (3 * sizeof(uint64_t))
+/* resources_create 返回值：内存区域未能完整注册 */
+#define ERR_PARTIAL_REGISTRATION 2
+/* sock_accept 返回值：超时内没有客户端连接 */
+#define SOCK_TIMEOUT -2
+/* sock_sync_data 返回值：对端在交换完成前关闭了连接 */
+#define SOCK_CLOSED -3
+/* connect_qp 返回值：交换的连接信息校验失败 */
+#define ERR_BAD_HANDSHAKE 3
+/* resources_create 返回值：请求的发送或接收队列深度超过设备的 max_qp_wr，或所需的完成队列超过 max_cqe */
+#define ERR_QUEUE_DEPTH 4
+/* resources_create 返回值：端口的链路层与 config.link_layer 要求的不符 */
+#define ERR_LINK_LAYER 5
+/* resources_create 返回值：RoCE 端口上没有可用的 GID */
+#define ERR_NO_GID 6
+/* resources_create 返回值：打开 RDMA 设备失败 */
+#define ERR_OPEN_DEVICE 7
+/* resources_create 返回值：ibv_query_port 查询端口属性失败 */
+#define ERR_QUERY_PORT 8
+/* resources_create 返回值：ibv_query_device 查询设备属性失败 */
+#define ERR_QUERY_DEVICE 9
+/* resources_create 返回值：分配保护域失败 */
+#define ERR_ALLOC_PD 10
+/* resources_create 返回值：创建完成队列或完成通道失败 */
+#define ERR_CREATE_CQ 11
+/* resources_create 返回值：分配数据、控制或 UD 接收缓冲区失败 */
+#define ERR_ALLOC_BUFFER 12
+/* resources_create 返回值：注册内存区域失败，尝试注册的大小保存在 resources.reg_size */
+#define ERR_REG_MR 13
+/* resources_create 返回值：创建队列对失败 */
+#define ERR_CREATE_QP 14
+/* wait_cq_event 和等待完成事件的返回值：超时内没有取到完成事件 */
+#define POLL_TIMEOUT -4
+/* sock_listen 返回值：端口已被占用 */
+#define SOCK_IN_USE -5
+/* 等待完成事件的返回值：完成事件的状态不是 IBV_WC_SUCCESS，状态保存在 resources.wc_status */
+#define WC_ERROR -6
+/* 接收请求的 wr_id 置最高位，与从 1 开始编号的发送请求区分开 */
+#define RECV_WR_ID 0x8000000000000000ULL
+/* 连接信息消息的魔数 "RDMA" */
+#define CM_MAGIC 0x52444d41
+/* 探测请求的魔数 "PRBE"，服务器应答后关闭连接并继续等待真正的客户端 */
+#define PROBE_MAGIC 0x50524245
+/* 探测应答标志：服务器使用 GID（config.gid_idx >= 0） */
+#define PROBE_FLAG_GID 0x1
 #if __BYTE_ORDER == __LITTLE_ENDIAN
 
 static inline uint64_t htonll(uint64_t x) { return bswap_64(x); }
@@ -36,44 +116,162 @@ struct config_t
     u_int32_t tcp_port;   /* server TCP port */
     int ib_port;          // 本地使用的 InfiniBand 端口号
     int gid_idx;          // 用于选择要使用的全局唯一标识符（Global Identifier，GID）的索引
+    int qp_type;          // 队列对类型：IBV_QPT_RC（默认）、IBV_QPT_UC 或 IBV_QPT_UD，由 Options.QPType 按连接设置
+    int path_mtu;         // RTR 时请求的路径 MTU（enum ibv_mtu），0 表示使用 IBV_MTU_256
+    uint8_t qp_timeout;   // RTS 时的本地确认超时（4.096 微秒 * 2^qp_timeout）
+    uint8_t retry_cnt;    // RTS 时的传输重试次数
+    uint8_t rnr_retry;    // RTS 时的 RNR 重试次数，7 表示无限重试
+    int link_layer;       // 要求的端口链路层（IBV_LINK_LAYER_*），IBV_LINK_LAYER_UNSPECIFIED 表示不限
 };
 
 struct cm_con_data_t
 {
     uint64_t addr;         // 缓冲区的内存地址。
+    uint64_t ctrl_addr;    // 控制区（写索引）的内存地址
     uint32_t rkey;         // 远程密钥，用于远程访问 RDMA 缓冲区。
     uint32_t qp_num;       // 队列对的编号。
+    uint32_t ctrl_rkey;    // 控制区的远程密钥
+    uint32_t psn;          // 发送队列的起始包序列号（Packet Sequence Number），对端接收时以它为期望的第一个序列号
+    uint32_t buf_size;     // 数据缓冲区的大小，两端的写入都不能超过较小一方的缓冲区
     uint16_t lid;          // 本地 InfiniBand 端口的本地标识符（Local Identifier）
     uint8_t gid[16];       /* gid */
-} __attribute__((packed)); 
+} __attribute__((packed)); /* 字段按自然对齐排列，Go 侧可以直接访问 */
+
+/* 通过 TCP 交换的连接信息消息，所有数值字段均为网络字节顺序 */
+struct cm_con_msg_t
+{
+    uint32_t magic;              // 固定为 CM_MAGIC，用于识别对端协议
+    uint32_t length;             // data 的长度，必须等于 sizeof(struct cm_con_data_t)
+    struct cm_con_data_t data;   // 连接信息
+    uint32_t checksum;           // data 的 FNV-1a 校验和
+} __attribute__((packed));
+
+/* 共享接收队列：监听器的所有连接共用设备上下文、保护域和预先提交的接收槽 */
+struct srq_t
+{
+    struct ibv_context *ib_ctx; /* 设备上下文，由使用它的连接共享 */
+    struct ibv_pd *pd;          /* 保护域，由使用它的连接共享 */
+    struct ibv_srq *srq;        /* 共享接收队列的句柄 */
+    char *buf;                  /* depth 个 buf_size 字节的接收槽，接收请求的 wr_id 为槽号 */
+    struct ibv_mr *mr;          /* buf 对应的内存区域句柄 */
+    size_t buf_size;            /* 每个接收槽的大小，创建前为 0 时使用 MSG_SIZE */
+    uint32_t depth;             /* 接收槽数，创建前为 0 时使用 DEFAULT_SRQ_WR */
+};
 
 struct resources
 {
     struct ibv_device_attr
         device_attr;
     struct ibv_port_attr port_attr;    /* InfiniBand 端口的属性*/
+    struct config_t cfg;               /* 本连接使用的配置，创建资源前由调用者填写，通常从全局 config 复制 */
     struct cm_con_data_t remote_props; /*存储用于连接远程端的值。 */
     struct ibv_context *ib_ctx;        /*指向 InfiniBand 设备上下文的指针 */
     struct ibv_pd *pd;                 /* 保护域（Protection Domain）的句柄。*/
     struct ibv_cq *cq;                 /* 完成队列（Completion Queue）的句柄 */
+    struct ibv_cq *recv_cq;            /* separate_cqs 时接收队列单独使用的完成队列，否则为 NULL，发送和接收共用 cq */
+    int separate_cqs;                  /* 非 0 时为发送队列和接收队列分别创建完成队列 */
+    int poll_recv;                     /* 非 0 时轮询函数等待 recv_cq 上的接收完成事件，调用者在等待接收前设置 */
+    struct ibv_comp_channel *channel;  /* 完成通道，仅在 event_mode 下创建 */
+    int event_mode;                    /* 非 0 时在完成通道上阻塞等待完成事件而不是忙轮询 */
+    int poll_timeout_ms;               /* 等待一个完成事件的最长时间（毫秒），为 0 时使用 MAX_POLL_CQ_TIMEOUT */
+    int poll_batch;                    /* 每次 ibv_poll_cq 最多取回的完成事件数，为 0 时使用 SetPollBatch 设置的默认值 */
     struct ibv_qp *qp;                 /* 队列对的句柄。*/
     struct ibv_mr *mr;                 /* 指向用于 RDMA 操作的内存区域（Memory Region）的句柄。 */
     char *buf;                         /* 用于 RDMA 和发送操作的内存缓冲区指针 */
+    size_t buf_size;                   /* 缓冲区大小，创建资源前为 0 时使用 MSG_SIZE */
+    int use_dm;                        /* 非 0 时远端访问的缓冲区尽量放在设备内存中 */
+    struct ibv_dm *dm;                 /* 设备（片上）内存，分配失败或未请求时为 NULL */
+    struct ibv_mr *dm_mr;              /* dm 对应的零起始内存区域，远端通过它访问数据缓冲区 */
+    int numa_node;                     /* 数据缓冲区绑定的 NUMA 节点，小于 0 时使用 malloc 默认分配 */
+    int mr_access;                     /* buf 的访问标志（IBV_ACCESS_*），创建资源前为 0 时允许远端读写及设备支持的原子操作，创建后为实际使用的标志 */
+    uint32_t max_send_wr;              /* 发送队列深度，创建资源前为 0 时使用 DEFAULT_MAX_SEND_WR，完成队列按它和 max_recv_wr 分配 */
+    uint32_t max_recv_wr;              /* 接收队列深度，创建资源前为 0 时使用 DEFAULT_MAX_RECV_WR */
+    uint32_t psn;                      /* 本端发送队列的起始包序列号（24 位），创建资源前由调用者设置 */
+    uint32_t max_inline_data;          /* 创建资源前为请求的最大内联数据长度，创建后为设备实际支持的值 */
+    uint64_t *ctrl;                    /* 控制区：ctrl[0] 为本端写索引，ctrl[1] 接收远端写索引，ctrl[2] 接收原子操作的原值 */
+    struct ibv_mr *ctrl_mr;            /* 控制区对应的内存区域句柄 */
+    char *ud_buf;                      /* UD 队列对的接收缓冲区：UD_GRH_SIZE 字节的 GRH 加 buf_size 字节的数据 */
+    struct ibv_mr *ud_mr;              /* ud_buf 对应的内存区域句柄 */
+    struct ibv_ah *ah;                 /* UD 队列对发往对端的地址句柄，由 create_ud_ah 创建 */
+    struct srq_t *srq;                 /* 非 NULL 时使用它的设备上下文和保护域，接收请求提交到共享接收队列 */
+    uint64_t cq_overruns;              /* 收到的 CQ 溢出（IBV_EVENT_CQ_ERR）异步事件数 */
+    uint64_t dropped;                  /* 没有操作认领、被 drain_cq 或 Go 层丢弃的完成事件数 */
+    uint64_t poll_spins;               /* 没有取到完成事件的 ibv_poll_cq 调用次数 */
+    uint32_t last_byte_len;            /* 最近一个被认领的成功完成事件的 byte_len，由 Go 层记录 */
+    uint64_t last_wr_id;               /* 最近一个被认领的成功完成事件的 wr_id，由 Go 层记录 */
+    int last_opcode;                   /* 最近一个被认领的成功完成事件的 opcode（enum ibv_wc_opcode），由 Go 层记录 */
+    int wc_status;                     /* 最近一个失败完成事件的状态（enum ibv_wc_status） */
+    uint32_t wc_vendor_err;            /* 最近一个失败完成事件的厂商错误码 */
+    uint64_t wc_wr_id;                 /* 最近一个失败完成事件的 wr_id */
+    uint64_t wr_seq;                   /* 最近提交的发送工作请求的 wr_id，由 next_wr_id 递增 */
+    int qp_err;                        /* 取到失败的完成事件后发现队列对处于 IBV_QPS_ERR 状态时置 1，modify_qp_to_reset 清零 */
+    size_t reg_size;                   /* resources_create 最近一次尝试注册的内存区域大小，ERR_REG_MR 时为失败的那次 */
     int sock;                          /* TCP 套接字的文件描述符。 */
 };
+/* 新连接的默认配置，每个连接在创建时复制到 resources.cfg，之后只使用自己的副本 */
 extern struct config_t config;
 
-int sock_connect(const char *servername, int port);
+int sock_connect(const char *servername, int port, int timeout_ms);
+int connect_timeout(int sockfd, const struct sockaddr *addr, socklen_t addrlen, int timeout_ms);
+int sock_set_timeout(int sock, int timeout_ms);
+int sock_listen(const char *bind_addr, int port, int reuse_addr);
+int sock_listen_unix(const char *path);
+int sock_connect_unix(const char *path, int timeout_ms);
+int sock_accept(int listenfd, int timeout_ms, int gid_idx);
+int answer_probe(int sock, int gid_idx, int timeout_ms);
 int sock_sync_data(int sock, int xfer_size, char *local_data, char *remote_data);
-int poll_completion(struct resources *res);
+struct ibv_cq *wait_cq(struct resources *res);
+int poll_cq_batch(struct resources *res, struct ibv_wc *wc, int num_entries);
+int poll_cq_spin(struct resources *res, struct ibv_wc *wc, int num_entries, int spins);
+int arm_cq(struct resources *res);
+int wait_cq_event(struct resources *res, int timeout_ms);
+void drain_async_events(struct resources *res);
+uint64_t next_wr_id(struct resources *res);
+int send_flags(struct resources *res, int opcode, uint32_t length);
 int post_send(struct resources *res, int opcode);
 int post_receive(struct resources *res);
+int post_receive_region(struct resources *res, struct ibv_mr *mr, uint64_t wr_id);
+int post_ud_send(struct resources *res, uint32_t length);
+int post_ud_receive(struct resources *res);
+int create_ud_ah(struct resources *res);
+int srq_create(struct srq_t *srq, const char *dev_name);
+int post_srq_receive(struct srq_t *srq, uint32_t slot);
+int srq_destroy(struct srq_t *srq);
+struct ibv_context *open_ib_device(const char *dev_name);
+uint64_t query_max_dm_size(struct ibv_context *ib_ctx);
+int probe_device(const char *dev_name, int ib_port, char *name, size_t name_len, struct ibv_device_attr *device_attr, struct ibv_port_attr *port_attr, uint64_t *max_dm_size);
+int post_read_index(struct resources *res);
+int post_atomic(struct resources *res, int opcode, uint64_t offset, uint64_t compare_add, uint64_t swap);
+int post_send_offset(struct resources *res, int opcode, uint64_t offset, uint32_t length);
+int post_write_batch(struct resources *res, const uint32_t *offsets, const uint32_t *lengths, int count);
+int post_write_sg(struct resources *res, const uint64_t *addrs, const uint32_t *lengths, const uint32_t *lkeys, int count);
+int post_send_region(struct resources *res, int opcode, struct ibv_mr *mr, uint32_t length, uint64_t remote_addr, uint32_t rkey);
+struct ibv_mr *register_buffer(struct resources *res, size_t size, int mr_flags);
+int deregister_buffer(struct ibv_mr *mr);
+struct ibv_mr *register_memory(struct resources *res, void *addr, size_t size);
+int deregister_memory(struct ibv_mr *mr);
 void resources_init(struct resources *res);
+char *alloc_data_buffer(size_t size, int node);
+void free_data_buffer(char *buf, size_t size, int node);
+int alloc_device_memory(struct resources *res, size_t size, int mr_flags);
+void free_device_memory(struct resources *res);
+int dm_copy(struct resources *res, uint64_t offset, size_t length, int to_dm);
+int rotate_mr(struct resources *res, uint32_t *rkey);
 int resources_create(struct resources *res);
-int modify_qp_to_init(struct ibv_qp *qp);
-int modify_qp_to_rtr(struct ibv_qp *qp, uint32_t remote_qpn, uint16_t dlid, uint8_t *dgid);
-int modify_qp_to_rts(struct ibv_qp *qp);
-int connect_qp(struct resources *res);
+int resources_create_with_sock(struct resources *res, int sock);
+int modify_qp_to_init(struct resources *res);
+int modify_qp_to_rtr(struct resources *res, uint32_t remote_qpn, uint16_t dlid, uint8_t *dgid);
+int modify_qp_to_rts(struct resources *res);
+int modify_qp_to_reset(struct resources *res);
+int query_qp_state(struct resources *res);
+int drain_cq(struct resources *res);
+int clear_buffers(struct resources *res);
+int query_path_mtu(struct ibv_qp *qp);
+uint32_t cm_checksum(const void *data, size_t len);
+int query_local_con_data(struct resources *res, struct cm_con_data_t *data);
+int connect_qp(struct resources *res, int timeout_ms);
+int query_gid_table_len(const char *dev_name, int ib_port);
+int select_roce_gid(struct ibv_context *ib_ctx, int ib_port, int gid_tbl_len);
 int resources_destroy(struct resources *res);
 void print_config(void);
 void usage(const char *argv0);
@@ -0,0 +1,113 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Recover brings a connection whose queue pair has entered the error state back
+// into service, so that a single failed work completion, for example a remote
+// access error or an exhausted retry count, does not require tearing the
+// connection down and connecting again. Such a failure is reported as an
+// RDMAError matching ErrQPError, and the connection is marked Errored.
+//
+// `res` is a pointer to RDMAResources in the Errored state, connected over an RC
+// or UC queue pair with a synchronization socket.
+//
+// Recover discards the completions of the work requests flushed from the send
+// and receive queues, moves the queue pair back through RESET, INIT, RTR and RTS
+// and posts again the receives that were outstanding: the one into the data
+// buffer and those posted with PostRecv. The peer's queue pair has usually failed
+// as well, so both sides must call Recover, as the next operation after the
+// failure: they agree on new starting packet sequence numbers over the
+// synchronization socket, and Recover blocks until the peer has called it too.
+// The data in the buffers and the registered regions are left alone.
+//
+// On success, it returns nil and the connection is Connected again. On failure,
+// it returns an error and the connection stays Errored; it must then be released
+// with Destroy. ErrUnsupported is returned for UD queue pairs, connections
+// without a synchronization socket and connections using a shared receive queue.
+//
+// Example:
+//
+//	if err := h.Write(res, "ping", "client"); errors.Is(err, rdmahandler.ErrQPError) {
+//	    if err := h.Recover(res); err != nil {
+//	        h.Destroy(res)
+//	        log.Fatalf("Failed to recover connection: %v", err)
+//	    }
+//	}
+func (h *RDMAHandler) Recover(res *RDMAResources) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if state := res.State(); state != Errored {
+		return fmt.Errorf("recover: connection is %v, not errored", state)
+	}
+	if res.res.sock < 0 {
+		return fmt.Errorf("recover: %w: connection has no synchronization socket", ErrUnsupported)
+	}
+	if res.srq != nil || QPType(res.res.qp.qp_type) == QPTypeUD {
+		return fmt.Errorf("recover: %w with a shared receive queue or UD queue pair", ErrUnsupported)
+	}
+	if rc, err := C.modify_qp_to_reset(&res.res); rc != 0 {
+		return newRDMAError("modify_qp_to_reset", rc, err)
+	}
+	// the flushed work requests left their completions behind; none of them has a
+	// waiter any more
+	if rc, err := C.drain_cq(&res.res); rc < 0 {
+		return newRDMAError("drain_cq", rc, err)
+	}
+	res.dropUnclaimed()
+	if err := h.ModifyQPToInit(res); err != nil {
+		return err
+	}
+	if err := repostReceives(res); err != nil {
+		return err
+	}
+	// packets of the failed connection may still be on the wire, so both sides
+	// start from fresh packet sequence numbers
+	psn := rand.Uint32() & maxPSN
+	remotePSN, err := exchangeValue(res, recoverToken, psn)
+	if err != nil {
+		return err
+	}
+	if remotePSN > maxPSN {
+		return fmt.Errorf("%w: packet sequence number %d out of range", ErrBadHandshake, remotePSN)
+	}
+	res.res.psn = C.uint32_t(psn)
+	remote := qpParamsFromC(&res.res.remote_props)
+	remote.PSN = remotePSN
+	if err := h.ModifyQPToRTR(res, remote); err != nil {
+		return err
+	}
+	if err := h.ModifyQPToRTS(res); err != nil {
+		return err
+	}
+	// the peer must not send before this side is ready to receive
+	if err := syncPeer(res, syncDone); err != nil {
+		return err
+	}
+	res.state.CompareAndSwap(int32(Errored), int32(Connected))
+	return nil
+}
+
+// repostReceives posts again, in their original order, the receives that were
+// outstanding when the queue pair of `res` was reset. The caller must hold res.mu.
+func repostReceives(res *RDMAResources) error {
+	if res.recvPosted {
+		if rc, err := C.post_receive(&res.res); rc != 0 {
+			return newRDMAError("post_receive", rc, err)
+		}
+	}
+	for _, slot := range res.recvPending {
+		if rc, err := C.post_receive_region(&res.res, res.recvSlots[slot], C.uint64_t(slot+1)); rc != 0 {
+			return newRDMAError("post_receive_region", rc, err)
+		}
+	}
+	return nil
+}
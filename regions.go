@@ -0,0 +1,245 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// AccessFlags are the permissions of a memory region added with AddRegion or of
+// the data buffer (see Options.AccessFlags), a combination of the IBV_ACCESS_*
+// flags of the verbs.
+//
+// The flags of a region restrict what the peer may do with it: a Write into a
+// peer region without AccessRemoteWrite, or a Read from one without
+// AccessRemoteRead, fails with WCRemAccessErr and leaves the connection in the
+// Errored state.
+type AccessFlags int
+
+const (
+	AccessLocalWrite   AccessFlags = C.IBV_ACCESS_LOCAL_WRITE   // the local device may write the region
+	AccessRemoteWrite  AccessFlags = C.IBV_ACCESS_REMOTE_WRITE  // the peer may write the region with RDMA writes
+	AccessRemoteRead   AccessFlags = C.IBV_ACCESS_REMOTE_READ   // the peer may read the region with RDMA reads
+	AccessRemoteAtomic AccessFlags = C.IBV_ACCESS_REMOTE_ATOMIC // the peer may target the region with atomics
+)
+
+// defaultAccess is the access of the buffers registered with RegisterNamedBuffer
+// and, unless Options.AccessFlags is set, of the connection's data buffer.
+const defaultAccess = AccessLocalWrite | AccessRemoteWrite | AccessRemoteRead
+
+// allAccess is the combination of all supported access flags.
+const allAccess = AccessLocalWrite | AccessRemoteWrite | AccessRemoteRead | AccessRemoteAtomic
+
+// RegionID identifies a memory region of a connection for WriteRegion and
+// ReadRegion. DefaultRegion is the connection's data buffer; the regions added
+// with AddRegion or RegisterNamedBuffer are numbered from 1 in the order they
+// were added.
+type RegionID int
+
+// DefaultRegion is the connection's data buffer, used by Write and Read.
+const DefaultRegion RegionID = 0
+
+// extraRegion is a memory region added to a connection with AddRegion or
+// RegisterNamedBuffer, together with the location of its counterpart on the peer.
+type extraRegion struct {
+	label      string // names the region in errors, e.g. "region 2" or `buffer "control"`
+	mr         *C.struct_ibv_mr
+	size       int
+	remoteAddr uint64
+	remoteKey  uint32
+	remoteSize int
+}
+
+// bytes returns the local memory of the region as a byte slice.
+func (r *extraRegion) bytes() []byte {
+	return unsafe.Slice((*byte)(r.mr.addr), r.size)
+}
+
+// AddRegion allocates and registers an additional memory region of `size` bytes
+// on the connection with the access flags `flags`, so that a protocol can keep,
+// for example, small control messages apart from bulk payload and give the peer
+// write access to one but not the other.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// `flags` combines the Access constants. AccessLocalWrite is always added, since
+// the data of ReadRegion lands in the local region; AccessRemoteWrite and
+// AccessRemoteAtomic require it anyway.
+//
+// The region's address, remote key and size are exchanged with the peer over the
+// synchronization socket and kept per region, so both sides must add their
+// regions in the same order; the region with a given ID on one side is paired
+// with the region with the same ID on the other. Buffers registered with
+// RegisterNamedBuffer are regions too and take IDs in the same sequence. The
+// regions are released by Destroy.
+//
+// If the device registers less than `size` bytes, ErrPartialRegistration is returned.
+//
+// On success, it returns the ID of the region and nil error. On failure, it returns
+// DefaultRegion and an error, and nothing is registered.
+//
+// Example:
+//
+//	meta, err := h.AddRegion(res, 4096, rdmahandler.AccessRemoteWrite)
+//	if err != nil {
+//	    log.Fatalf("Failed to add region: %v", err)
+//	}
+//	err = h.WriteRegion(res, meta, []byte("v1"), "client")
+func (h *RDMAHandler) AddRegion(res *RDMAResources, size int, flags AccessFlags) (RegionID, error) {
+	if err := res.begin(); err != nil {
+		return DefaultRegion, err
+	}
+	defer res.end()
+	if flags&^allAccess != 0 {
+		return DefaultRegion, fmt.Errorf("invalid access flags %#x", int(flags))
+	}
+	return addRegion(res, fmt.Sprintf("region %d", len(res.extraRegions)+1), size, flags)
+}
+
+// addRegion registers a region of `size` bytes with the access flags `flags` and
+// exchanges its descriptor with the peer under `name`. The caller must hold
+// res.mu.
+func addRegion(res *RDMAResources, name string, size int, flags AccessFlags) (RegionID, error) {
+	if size <= payloadHeaderSize || uint64(size) > uint64(^uint32(0)) {
+		return DefaultRegion, fmt.Errorf("invalid size %d for %s", size, name)
+	}
+	r, err := registerBuffer(res, name, size, flags|AccessLocalWrite)
+	if err != nil {
+		return DefaultRegion, err
+	}
+	r.label = name
+	res.extraRegions = append(res.extraRegions, r)
+	return RegionID(len(res.extraRegions)), nil
+}
+
+// region returns the region with the given ID added with AddRegion or
+// RegisterNamedBuffer. The caller must hold res.mu.
+func (res *RDMAResources) region(id RegionID, character string) (*extraRegion, error) {
+	if id <= DefaultRegion || int(id) > len(res.extraRegions) {
+		return nil, fmt.Errorf("%s: region %d not added", character, id)
+	}
+	return res.extraRegions[id-1], nil
+}
+
+// WriteRegion is like WriteBytes but transfers `data` from the local region `id`
+// into the peer's region with the same ID. DefaultRegion selects the data buffer,
+// making it equivalent to WriteBytes.
+//
+// `data` plus its 4-byte length header must fit in both the local and the remote
+// region, otherwise an error is returned and nothing is sent. Writes to added
+// regions do not advance the write index reported by Available.
+//
+// Example:
+//
+//	if err := h.WriteRegion(clientRes, meta, header, "client"); err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) WriteRegion(res *RDMAResources, id RegionID, data []byte, character string) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if id == DefaultRegion {
+		_, err := writeBytes(res, data, character)
+		return err
+	}
+	r, err := res.region(id, character)
+	if err != nil {
+		return err
+	}
+	return writeRegion(res, r, data, character)
+}
+
+// writeRegion implements WriteRegion and WriteNamed for the added region `r`.
+// The caller must hold res.mu.
+func writeRegion(res *RDMAResources, r *extraRegion, data []byte, character string) error {
+	length := payloadHeaderSize + len(data)
+	if length > r.size || length > r.remoteSize {
+		return fmt.Errorf("%s: %d bytes do not fit in %s", character, len(data), r.label)
+	}
+	if err := syncData(res, syncWrite); err != nil {
+		return err
+	}
+	local := r.bytes()
+	binary.BigEndian.PutUint32(local, uint32(len(data)))
+	copy(local[payloadHeaderSize:], data)
+
+	acquireInflight()
+	if rc, err := C.post_send_region(&res.res, C.IBV_WR_RDMA_WRITE, r.mr, C.uint32_t(length), C.uint64_t(r.remoteAddr), C.uint32_t(r.remoteKey)); rc != 0 {
+		releaseInflight()
+		return fmt.Errorf("%s: %w", character, res.opError("post_send_region", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return fmt.Errorf("%s: %w", character, res.opError("poll_completion", rc, err))
+	}
+	res.countWrite(len(data))
+	return syncData(res, syncDone)
+}
+
+// ReadRegion is like ReadBytes but reads the peer's region `id` into the local
+// region with the same ID and returns the data last written there with
+// WriteRegion. DefaultRegion selects the data buffer, making it equivalent to
+// ReadBytes.
+//
+// Example:
+//
+//	header, err := h.ReadRegion(serverRes, meta, "server")
+//	if err != nil {
+//	    log.Fatalf("RDMA read failed: %v", err)
+//	}
+func (h *RDMAHandler) ReadRegion(res *RDMAResources, id RegionID, character string) ([]byte, error) {
+	if err := res.begin(); err != nil {
+		return nil, err
+	}
+	defer res.end()
+	if id == DefaultRegion {
+		data, _, err := readBytes(res, character)
+		return data, err
+	}
+	r, err := res.region(id, character)
+	if err != nil {
+		return nil, err
+	}
+	return readRegion(res, r, character)
+}
+
+// readRegion implements ReadRegion and ReadNamed for the added region `r`. The
+// caller must hold res.mu.
+func readRegion(res *RDMAResources, r *extraRegion, character string) ([]byte, error) {
+	if err := requireRC(res, character); err != nil {
+		return nil, err
+	}
+	if r.remoteSize == 0 {
+		return nil, fmt.Errorf("%s: %s has no counterpart on the peer since Reset", character, r.label)
+	}
+	length := min(r.size, r.remoteSize)
+	if err := syncData(res, syncRead); err != nil {
+		return nil, err
+	}
+	acquireInflight()
+	if rc, err := C.post_send_region(&res.res, C.IBV_WR_RDMA_READ, r.mr, C.uint32_t(length), C.uint64_t(r.remoteAddr), C.uint32_t(r.remoteKey)); rc != 0 {
+		releaseInflight()
+		return nil, fmt.Errorf("%s: %w", character, res.opError("post_send_region", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return nil, fmt.Errorf("%s: %w", character, res.opError("poll_completion", rc, err))
+	}
+	if err := syncData(res, syncDone); err != nil {
+		return nil, err
+	}
+	data, err := decodePayload(r.mr.addr, C.size_t(length), character)
+	if err != nil {
+		return nil, err
+	}
+	res.countRead(len(data))
+	return data, nil
+}
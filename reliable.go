@@ -0,0 +1,194 @@
+package rdmahandler
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the reconnect policy of a ReliableClient.
+const (
+	defaultMaxReconnects  = 5
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+)
+
+// ReliableClient is a client connection that is transparently re-established after
+// a transport error. It is created with NewReliableClient.
+//
+// When Write or Read fails and leaves the connection Errored, the resources are
+// destroyed, the client reconnects to the same server with InitClientWithOptions,
+// waiting with exponential backoff between attempts, and the operation is retried
+// on the new connection. An RDMAError that is not temporary (see
+// RDMAError.Temporary), such as a protection or remote access error, would only
+// repeat, so it is returned at once; the broken connection is replaced on the next
+// call. Errors that leave the connection usable, such as a payload that does not
+// fit in the buffer, and a clean shutdown by the peer are returned as they are.
+//
+// Reconnecting only helps if the server accepts a new client, for example by calling
+// RDMAListener.WaitForClient in a loop. A retried Write may reach the server twice if
+// the failure happened after the server received the data.
+//
+// All methods are safe for concurrent use; operations are serialized.
+type ReliableClient struct {
+	// MaxReconnects is the number of reconnect attempts made for a failed operation
+	// before its error is returned. Zero selects 5.
+	MaxReconnects int
+
+	// InitialBackoff is the wait before the first reconnect attempt; it doubles
+	// after every failed attempt up to MaxBackoff. Zero selects 100ms and 5s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	h    RDMAHandler
+	ip   string
+	port int
+	opts Options
+
+	mu         sync.Mutex
+	res        *RDMAResources // nil after a failed reconnect
+	closed     bool
+	reconnects atomic.Uint64
+}
+
+// NewReliableClient connects to the RDMA server at `ip` and `port` with the settings
+// in `opts`, like InitClientWithOptions, and returns a client that reconnects with
+// the same parameters whenever the connection fails.
+//
+// The initial connection is not retried. On success, it returns the client and nil
+// error. On failure, it returns nil and the error encountered.
+//
+// Example:
+//
+//	c, err := h.NewReliableClient("192.168.1.10", 8080, rdmahandler.Options{})
+//	if err != nil {
+//	    log.Fatalf("Failed to connect: %v", err)
+//	}
+//	defer c.Close()
+//	if err := c.Write("Hello RDMA", "client"); err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) NewReliableClient(ip string, port int, opts Options) (*ReliableClient, error) {
+	res, err := h.InitClientWithOptions(ip, port, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &ReliableClient{ip: ip, port: port, opts: opts, res: res}, nil
+}
+
+// Write sends `contents` to the server like RDMAHandler.Write, reconnecting and
+// retrying if the connection fails.
+func (c *ReliableClient) Write(contents string, character string) error {
+	return c.do(func(res *RDMAResources) error {
+		return c.h.Write(res, contents, character)
+	})
+}
+
+// Read reads data from the server like RDMAHandler.Read, reconnecting and retrying
+// if the connection fails.
+func (c *ReliableClient) Read(character string) (string, error) {
+	var data string
+	err := c.do(func(res *RDMAResources) error {
+		var err error
+		data, err = c.h.Read(res, character)
+		return err
+	})
+	return data, err
+}
+
+// Stats returns the counters of the current connection, with Reconnects set to
+// the number of times the client has reconnected. The other counters start from
+// zero on every new connection.
+func (c *ReliableClient) Stats() Stats {
+	c.mu.Lock()
+	res := c.res
+	c.mu.Unlock()
+	var s Stats
+	if res != nil {
+		s = res.Stats()
+	}
+	s.Reconnects = c.reconnects.Load()
+	return s
+}
+
+// Close shuts the current connection down with RDMAHandler.Close. The client cannot
+// be used afterwards.
+func (c *ReliableClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	if c.res == nil {
+		return nil
+	}
+	err := c.h.Close(c.res)
+	c.res = nil
+	return err
+}
+
+// do runs `op` on the current connection. If `op` leaves the connection Errored
+// with an error that is not fatal, or an earlier reconnect failed, the client
+// reconnects and runs `op` again.
+func (c *ReliableClient) do(op func(*RDMAResources) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	var err error
+	if c.res != nil {
+		if err = op(c.res); err == nil || c.res.State() != Errored {
+			return err
+		}
+		c.h.Destroy(c.res)
+		c.res = nil
+		if isFatal(err) {
+			return err
+		}
+	}
+	for attempt := 0; attempt < c.maxReconnects(); attempt++ {
+		time.Sleep(c.backoff(attempt))
+		res, dialErr := c.h.InitClientWithOptions(c.ip, c.port, c.opts)
+		if dialErr != nil {
+			err = dialErr
+			continue
+		}
+		c.res = res
+		c.reconnects.Add(1)
+		if err = op(res); err == nil || res.State() != Errored {
+			return err
+		}
+		c.h.Destroy(res)
+		c.res = nil
+		if isFatal(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("giving up after %d reconnect attempts: %w", c.maxReconnects(), err)
+}
+
+// maxReconnects returns MaxReconnects or its default.
+func (c *ReliableClient) maxReconnects() int {
+	if c.MaxReconnects > 0 {
+		return c.MaxReconnects
+	}
+	return defaultMaxReconnects
+}
+
+// backoff returns the wait before reconnect attempt number `attempt`, counting from 0.
+func (c *ReliableClient) backoff(attempt int) time.Duration {
+	d, limit := c.InitialBackoff, c.MaxBackoff
+	if d <= 0 {
+		d = defaultInitialBackoff
+	}
+	if limit <= 0 {
+		limit = defaultMaxBackoff
+	}
+	for i := 0; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
@@ -0,0 +1,112 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Reset detaches `res` from its peer so that its resources can be reused for a
+// connection to another peer, which avoids opening the device, allocating the
+// protection domain, registering the buffers and creating the completion queues
+// and the queue pair again when connections come and go quickly.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection, Connected or Errored.
+//
+// Reset announces the shutdown to the peer like Close and closes the
+// synchronization socket. It then moves the queue pair back through RESET to
+// INIT, discarding the outstanding work requests and their completions, and
+// zeroes the data buffer and the control region so that the next peer cannot
+// read what the previous one left there. The memory regions keep their keys.
+// Regions added with AddRegion or RegisterNamedBuffer stay registered, but their
+// remote counterparts are forgotten, so they cannot be written or read until a
+// new peer is paired with them.
+//
+// Afterwards `res` is in the state CreateResources leaves its resources in, with
+// a fresh starting packet sequence number: LocalQPParams returns the parameters
+// to hand to the new peer, and ConnectResources connects it. Like other
+// connections set up that way it has no synchronization socket, so the
+// synchronized operations need Options.ManualSync. The resources must still be
+// released with Destroy.
+//
+// On success, it returns nil. If the peer did not acknowledge the shutdown, it
+// returns an error, but the resources are reset in any case. If the queue pair
+// cannot be reset, it returns an error and `res` must be released with Destroy.
+// ErrUnsupported is returned for connections using a shared receive queue.
+//
+// Example:
+//
+//	if err := h.Reset(res); err != nil {
+//	    log.Printf("Reset: %v", err)
+//	}
+//	local, err := h.LocalQPParams(res)
+//	if err != nil {
+//	    log.Fatalf("Failed to query local parameters: %v", err)
+//	}
+//	if err := h.ConnectResources(res, exchange(local)); err != nil {
+//	    log.Fatalf("Failed to connect: %v", err)
+//	}
+func (h *RDMAHandler) Reset(res *RDMAResources) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if res.srq != nil {
+		return fmt.Errorf("reset: %w with a shared receive queue", ErrUnsupported)
+	}
+	var ackErr error
+	if res.res.sock >= 0 {
+		ackErr = sendClose(res)
+		C.close(res.res.sock)
+		res.res.sock = -1
+	}
+	if err := resetQP(res); err != nil {
+		res.markErrored()
+		return errors.Join(ackErr, err)
+	}
+	res.forgetPeer()
+	res.state.Store(int32(Uninitialized))
+	return ackErr
+}
+
+// resetQP moves the queue pair of `res` through RESET back to INIT, discards the
+// completions left in the completion queues and zeroes the buffers. The caller
+// must hold res.mu.
+func resetQP(res *RDMAResources) error {
+	if rc, err := C.modify_qp_to_reset(&res.res); rc != 0 {
+		return newRDMAError("modify_qp_to_reset", rc, err)
+	}
+	if rc, err := C.drain_cq(&res.res); rc < 0 {
+		return newRDMAError("drain_cq", rc, err)
+	}
+	res.dropUnclaimed()
+	if rc, err := C.modify_qp_to_init(&res.res); rc != 0 {
+		return newRDMAError("modify_qp_to_init", rc, err)
+	}
+	if rc, err := C.clear_buffers(&res.res); rc != 0 {
+		return newRDMAError("clear_buffers", rc, err)
+	}
+	return nil
+}
+
+// forgetPeer clears what `res` knows about its peer and the state of the
+// transfers with it, after its queue pair was reset. The caller must hold res.mu.
+func (res *RDMAResources) forgetPeer() {
+	res.res.remote_props = C.struct_cm_con_data_t{}
+	res.res.psn = C.uint32_t(rand.Uint32() & maxPSN)
+	res.writeIndex = 0
+	res.readIndex = 0
+	// the receives were discarded with the queue pair's work requests
+	res.recvPosted = false
+	res.recvFree = append(res.recvFree, res.recvPending...)
+	res.recvPending = nil
+	for _, buf := range res.extraRegions {
+		buf.remoteAddr, buf.remoteKey, buf.remoteSize = 0, 0, 0
+	}
+	res.role = NoRole
+}
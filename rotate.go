@@ -0,0 +1,77 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import "fmt"
+
+// RotateKey registers the connection's data buffer again to obtain a fresh remote
+// key and exchanges it with the peer, so that a key captured earlier on a
+// long-lived connection can no longer be used to reach the buffer.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection over an RC or UC queue pair with a synchronization
+// socket.
+//
+// Both sides must call RotateKey at the same point of their protocol, like a
+// synchronized operation: it blocks until the peer has called it too, and since
+// each side holds its connection for the duration, no operation is in flight on
+// either side while the keys change. The old memory region is deregistered once
+// the new one is in place, which invalidates its remote key, and each side then
+// targets the peer's new key. The control region and the regions added with
+// AddRegion or RegisterNamedBuffer keep their keys. The local key changes too, so
+// values returned earlier by LocalKey and RemoteKeyForLocalBuffer are stale.
+//
+// A receive posted into the data buffer refers to the old memory region, so the
+// key cannot be rotated while one is outstanding, as it is on the client from the
+// handshake until its first Recv. Such a side, or one whose registration fails,
+// keeps its key and returns an error, while the exchange still completes so that
+// both sides stay in step.
+//
+// On success, it returns nil. On failure, it returns an error; ErrUnsupported is
+// returned for UD queue pairs and connections without a synchronization socket.
+//
+// Example:
+//
+//	ticker := time.NewTicker(time.Hour)
+//	for range ticker.C {
+//	    if err := h.RotateKey(res); err != nil {
+//	        log.Printf("Failed to rotate key: %v", err)
+//	    }
+//	}
+func (h *RDMAHandler) RotateKey(res *RDMAResources) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if res.res.sock < 0 {
+		return fmt.Errorf("rotate key: %w: connection has no synchronization socket", ErrUnsupported)
+	}
+	if QPType(res.res.qp.qp_type) == QPTypeUD {
+		return fmt.Errorf("rotate key: %w on a UD queue pair", ErrUnsupported)
+	}
+	var rkey C.uint32_t
+	var rotateErr error
+	if res.recvPosted {
+		rotateErr = fmt.Errorf("rotate key: a receive into the data buffer is outstanding")
+		rkey = res.advertisedKey()
+	} else if rc, err := C.rotate_mr(&res.res, &rkey); rc != 0 {
+		rotateErr = fmt.Errorf("rotate key: %w", newRDMAError("rotate_mr", rc, err))
+	}
+	remoteKey, err := exchangeValue(res, rotateToken, uint32(rkey))
+	if err != nil {
+		return fmt.Errorf("rotate key: %w", err)
+	}
+	res.res.remote_props.rkey = C.uint32_t(remoteKey)
+	return rotateErr
+}
+
+// advertisedKey returns the remote key through which the peer reaches the data
+// buffer: that of the device memory if it is used, of the buffer itself otherwise.
+func (res *RDMAResources) advertisedKey() C.uint32_t {
+	if res.res.dm_mr != nil {
+		return res.res.dm_mr.rkey
+	}
+	return res.res.mr.rkey
+}
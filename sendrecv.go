@@ -0,0 +1,261 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import "fmt"
+
+// Send transmits `data` to the peer with a two-sided send operation (IBV_WR_SEND),
+// which is consumed by a Recv on the peer.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// Unlike Write, which places data into the peer's buffer without its involvement, a
+// send completes only into a receive work request the peer has posted beforehand. A
+// receive must therefore be posted before the peer sends: Send first synchronizes with
+// the peer's Recv, which posts its receive before that synchronization, and only then
+// posts the send. Every Send must be matched by exactly one Recv on the peer.
+//
+// `data` plus a 4-byte length header must fit in the connection's data buffer, which
+// is also used to stage the message.
+//
+// On success, it returns nil. On failure, it returns an error detailing the issue encountered.
+//
+// Example:
+//
+//	if err := h.Send(clientRes, []byte("request")); err != nil {
+//	    log.Fatalf("RDMA send failed: %v", err)
+//	}
+//	reply, err := h.Recv(clientRes)
+func (h *RDMAHandler) Send(res *RDMAResources, data []byte) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if err := res.checkFits(len(data), "send"); err != nil {
+		return err
+	}
+	if err := syncData(res, syncWrite); err != nil {
+		return err
+	}
+	return sendMessage(res, data, "send")
+}
+
+// PostSend is like Send but does not synchronize with the peer: the message is
+// posted at once and consumes the oldest receive the peer has outstanding, which
+// it must have posted with PostRecv beforehand. It pairs with WaitRecv, so a
+// stream of messages can flow without a round trip over the synchronization
+// socket for each one.
+//
+// If the message arrives while the peer has no receive posted, an RC queue pair
+// retries for Options.RNRRetry receiver-not-ready rounds and then fails with
+// WCRNRRetryExcErr; a UC queue pair drops the message silently. The receiver
+// should therefore keep enough receives posted, and a sender that may outrun it
+// should set RNRRetry to 7 to wait indefinitely.
+//
+// On success, it returns nil. On failure, it returns an error detailing the issue encountered.
+//
+// Example:
+//
+//	for _, msg := range batch {
+//	    if err := h.PostSend(clientRes, msg); err != nil {
+//	        log.Fatalf("RDMA send failed: %v", err)
+//	    }
+//	}
+func (h *RDMAHandler) PostSend(res *RDMAResources, data []byte) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if err := res.checkFits(len(data), "post send"); err != nil {
+		return err
+	}
+	return sendMessage(res, data, "post send")
+}
+
+// sendMessage stages `data` in the data buffer and sends it with a two-sided send,
+// waiting for its completion. The caller must hold res.mu and have checked that
+// the data fits.
+func sendMessage(res *RDMAResources, data []byte, character string) error {
+	res.putPayload(data)
+
+	acquireInflight()
+	if rc, err := C.post_send(&res.res, C.IBV_WR_SEND); rc != 0 {
+		releaseInflight()
+		return fmt.Errorf("%s: %w", character, res.opError("post_send", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return fmt.Errorf("%s: %w", character, res.opError("poll_completion", rc, err))
+	}
+	return nil
+}
+
+// Recv receives one message sent by the peer with Send and returns its data.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// Recv posts a receive work request into the connection's data buffer, unless one
+// is already outstanding, synchronizes with the peer's Send so that the receive is in
+// place before the peer sends, and then waits for the receive completion. The data
+// buffer is overwritten by the message. If receives posted with PostRecv are
+// outstanding, none is posted and the message lands in the oldest of them.
+//
+// On a connection accepted by a listener with Options.UseSRQ, no receive is posted
+// and the data buffer is left alone: the message arrives in a slot of the shared
+// receive queue, which is posted again once the message has been copied out.
+//
+// On success, it returns the received data and nil error.
+// On failure, it returns nil and the error encountered.
+//
+// Example:
+//
+//	req, err := h.Recv(serverRes)
+//	if err != nil {
+//	    log.Fatalf("RDMA receive failed: %v", err)
+//	}
+//	err = h.Send(serverRes, handle(req))
+func (h *RDMAHandler) Recv(res *RDMAResources) ([]byte, error) {
+	if err := res.begin(); err != nil {
+		return nil, err
+	}
+	defer res.end()
+	if res.srq == nil && !res.recvPosted && len(res.recvPending) == 0 {
+		if rc, err := C.post_receive(&res.res); rc != 0 {
+			return nil, fmt.Errorf("recv: %w", res.opError("post_receive", rc, err))
+		}
+		res.recvPosted = true
+	}
+	if err := syncData(res, syncRead); err != nil {
+		return nil, err
+	}
+	return waitRecv(res, "recv")
+}
+
+// PostRecv posts one receive work request for a message the peer sends with
+// PostSend, without waiting for it. Together with WaitRecv it splits Recv in two,
+// so that a receiver can post many receives ahead of time and the sender can
+// stream messages into them.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection over an RC or UC queue pair.
+//
+// A message can only be received into a receive that was posted before it
+// arrived: the receiver must post first, and only then let the sender know, for
+// example through an earlier message or out of band, that it may send. Each
+// receive has a buffer of its own of the data buffer's size, allocated on first
+// use and reused afterwards, and receives complete in the order they were posted.
+// At most Options.RecvQueueDepth receives can be outstanding.
+//
+// On success, it returns nil. On failure, it returns an error and nothing is posted;
+// ErrUnsupported is returned for UD queue pairs and for connections using a shared
+// receive queue, whose receives are managed by RecvFrom and the listener.
+//
+// Example:
+//
+//	for i := 0; i < 8; i++ {
+//	    if err := h.PostRecv(serverRes); err != nil {
+//	        log.Fatalf("Failed to post receive: %v", err)
+//	    }
+//	}
+//	// tell the client it may send, then
+//	for i := 0; i < 8; i++ {
+//	    msg, err := h.WaitRecv(serverRes)
+//	    if err != nil {
+//	        log.Fatalf("RDMA receive failed: %v", err)
+//	    }
+//	    process(msg)
+//	}
+func (h *RDMAHandler) PostRecv(res *RDMAResources) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	if res.srq != nil || QPType(res.res.qp.qp_type) == QPTypeUD {
+		return fmt.Errorf("post recv: %w with a shared receive queue or UD queue pair", ErrUnsupported)
+	}
+	posted := len(res.recvPending)
+	if res.recvPosted {
+		posted++
+	}
+	if posted >= int(res.res.max_recv_wr) {
+		return fmt.Errorf("post recv: receive queue full with %d receives posted", posted)
+	}
+	var slot int
+	if n := len(res.recvFree); n > 0 {
+		slot = res.recvFree[n-1]
+		res.recvFree = res.recvFree[:n-1]
+	} else {
+		mr := C.register_buffer(&res.res, res.res.buf_size, C.IBV_ACCESS_LOCAL_WRITE)
+		if mr == nil {
+			return fmt.Errorf("post recv: failed to register receive buffer")
+		}
+		slot = len(res.recvSlots)
+		res.recvSlots = append(res.recvSlots, mr)
+	}
+	if rc, err := C.post_receive_region(&res.res, res.recvSlots[slot], C.uint64_t(slot+1)); rc != 0 {
+		res.recvFree = append(res.recvFree, slot)
+		return fmt.Errorf("post recv: %w", res.opError("post_receive_region", rc, err))
+	}
+	res.recvPending = append(res.recvPending, slot)
+	return nil
+}
+
+// WaitRecv waits for the oldest receive posted with PostRecv to complete and
+// returns the message it received. Unlike Recv it does not synchronize with the
+// peer, so it pairs with PostSend rather than Send. Options.PollTimeout bounds
+// the wait.
+//
+// On success, it returns the received data and nil error. If no receive is
+// outstanding, or on failure, it returns nil and an error.
+//
+// Example:
+//
+//	msg, err := h.WaitRecv(serverRes)
+//	if err != nil {
+//	    log.Fatalf("RDMA receive failed: %v", err)
+//	}
+func (h *RDMAHandler) WaitRecv(res *RDMAResources) ([]byte, error) {
+	if err := res.begin(); err != nil {
+		return nil, err
+	}
+	defer res.end()
+	if len(res.recvPending) == 0 && !res.recvPosted {
+		return nil, fmt.Errorf("wait recv: no receive posted")
+	}
+	return waitRecv(res, "wait recv")
+}
+
+// waitRecv waits for the next receive completion and returns the message from the
+// buffer it landed in: a shared receive queue slot, the data buffer or a slot of
+// PostRecv, which is then idle again. The caller must hold res.mu.
+func waitRecv(res *RDMAResources, character string) ([]byte, error) {
+	acquireInflight()
+	rc, err := res.pollRecvCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return nil, fmt.Errorf("%s: %w", character, res.opError("poll_completion", rc, err))
+	}
+	if res.res.last_opcode&C.IBV_WC_RECV == 0 {
+		return nil, fmt.Errorf("%s: completion with opcode %d is not a receive", character, int(res.res.last_opcode))
+	}
+	if res.srq != nil {
+		return res.srq.take(res, character)
+	}
+	id := int(uint64(res.res.last_wr_id) &^ RecvWRID)
+	if id == 0 {
+		res.recvPosted = false
+		return res.payload(character)
+	}
+	if len(res.recvPending) == 0 || res.recvPending[0] != id-1 {
+		return nil, fmt.Errorf("%s: completion for unknown receive %d", character, id)
+	}
+	res.recvPending = res.recvPending[1:]
+	res.recvFree = append(res.recvFree, id-1)
+	mr := res.recvSlots[id-1]
+	return decodePayload(mr.addr, mr.length, character)
+}
@@ -0,0 +1,85 @@
+package rdmahandler
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newLoopback returns a connection whose queue pair is connected to itself, see
+// InitLoopback, and destroys it when the test ends. The test is skipped on a
+// machine without an RDMA device.
+func newLoopback(t *testing.T, opts Options) *RDMAResources {
+	t.Helper()
+	var h RDMAHandler
+	res, err := h.InitLoopback(opts)
+	if err != nil {
+		t.Skipf("no RDMA device: %v", err)
+	}
+	t.Cleanup(func() { h.Destroy(res) })
+	return res
+}
+
+// TestPostRecvQueued posts several receives before the first WaitRecv, so that
+// their completions pile up in the completion queue, which must have room for
+// all of them.
+func TestPostRecvQueued(t *testing.T) {
+	for _, separate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SeparateCQs=%v", separate), func(t *testing.T) {
+			const n = 8
+			res := newLoopback(t, Options{RecvQueueDepth: n, SeparateCQs: separate})
+			var h RDMAHandler
+			for i := 0; i < n; i++ {
+				if err := h.PostRecv(res); err != nil {
+					t.Fatalf("PostRecv %d: %v", i, err)
+				}
+			}
+			for i := 0; i < n; i++ {
+				if err := h.PostSend(res, []byte(fmt.Sprintf("msg %d", i))); err != nil {
+					t.Fatalf("PostSend %d: %v", i, err)
+				}
+			}
+			for i := 0; i < n; i++ {
+				msg, err := h.WaitRecv(res)
+				if err != nil {
+					t.Fatalf("WaitRecv %d: %v", i, err)
+				}
+				if want := fmt.Sprintf("msg %d", i); string(msg) != want {
+					t.Errorf("WaitRecv %d returned %q, expected %q", i, msg, want)
+				}
+			}
+			if s := res.State(); s != Connected {
+				t.Errorf("state after the transfers is %v, expected %v", s, Connected)
+			}
+		})
+	}
+}
+
+// TestRecvQueueDepth fills a receive queue deeper than the default, so that all of
+// its completions must fit in the completion queue sized from RecvQueueDepth.
+func TestRecvQueueDepth(t *testing.T) {
+	const depth = 32
+	res := newLoopback(t, Options{SendQueueDepth: depth, RecvQueueDepth: depth})
+	var h RDMAHandler
+	for i := 0; i < depth; i++ {
+		if err := h.PostRecv(res); err != nil {
+			t.Fatalf("PostRecv %d: %v", i, err)
+		}
+	}
+	if err := h.PostRecv(res); err == nil {
+		t.Fatalf("PostRecv beyond RecvQueueDepth %d succeeded", depth)
+	}
+	for i := 0; i < depth; i++ {
+		if err := h.PostSend(res, []byte{byte(i)}); err != nil {
+			t.Fatalf("PostSend %d: %v", i, err)
+		}
+	}
+	for i := 0; i < depth; i++ {
+		msg, err := h.WaitRecv(res)
+		if err != nil {
+			t.Fatalf("WaitRecv %d: %v", i, err)
+		}
+		if len(msg) != 1 || msg[0] != byte(i) {
+			t.Errorf("WaitRecv %d returned %v, expected [%d]", i, msg, i)
+		}
+	}
+}
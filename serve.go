@@ -0,0 +1,164 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Serve answers the peer's requests until the peer closes the connection or `ctx`
+// is done.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// Each request is received with Recv and passed to `handler`, and the returned
+// response is sent back with Send, so the peer issues requests with Send followed by
+// Recv. If `handler` returns an error, Serve stops and returns it without answering the
+// request.
+//
+// When the peer shuts the connection down with Close, Serve returns nil. When `ctx` is
+// cancelled while Serve waits for the next request, the wait is interrupted by
+// shutting down the synchronization socket and ctx.Err() is returned; the connection
+// cannot be used afterwards and must be released with Destroy. A request that is
+// being handled when `ctx` is cancelled is still answered before ctx.Err() is
+// returned, and the connection remains usable.
+//
+// Example:
+//
+//	err := h.Serve(ctx, serverRes, func(req []byte) ([]byte, error) {
+//	    return bytes.ToUpper(req), nil
+//	})
+//	if err != nil {
+//	    log.Printf("serve: %v", err)
+//	}
+//	h.Destroy(serverRes)
+func (h *RDMAHandler) Serve(ctx context.Context, res *RDMAResources, handler Handler) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// the socket is only shut down while waiting for a request, so that a request
+	// already being handled is answered
+	var mu sync.Mutex
+	waiting, shut := false, false
+	stop := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if waiting {
+			C.shutdown(res.res.sock, C.SHUT_RDWR)
+			shut = true
+		}
+	})
+	defer func() {
+		stop()
+		if shut {
+			res.markErrored()
+		}
+	}()
+	for {
+		mu.Lock()
+		if err := ctx.Err(); err != nil {
+			mu.Unlock()
+			return err
+		}
+		waiting = true
+		mu.Unlock()
+		req, err := h.Recv(res)
+		mu.Lock()
+		waiting = false
+		mu.Unlock()
+		if errors.Is(err, ErrPeerClosed) {
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil && shut {
+			return ctxErr
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := handler(req)
+		if err != nil {
+			return fmt.Errorf("serve: handler failed: %w", err)
+		}
+		if err := h.Send(res, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Handler answers a request received by Serve or ServeContext with a response.
+type Handler func(req []byte) ([]byte, error)
+
+// ServeContext accepts clients on `l` and serves each connection with Serve and
+// `handler` in its own goroutine, until `ctx` is cancelled.
+//
+// Cancelling `ctx` shuts the server down gracefully: the listener is closed so that
+// no more clients are accepted, connections waiting for their next request are
+// interrupted, and requests being handled are answered first. ServeContext returns
+// once every connection's Serve has returned and its resources have been released
+// with Destroy, so no queue pair is left allocated. It then returns ctx.Err().
+//
+// A client whose connection setup fails is skipped. If the listener fails, or is
+// closed by someone else, the active connections are drained the same way and the
+// error, or ErrClosed, is returned. Errors of individual connections are logged to
+// the listener's Options.Logger.
+//
+// Example:
+//
+//	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+//	defer stop()
+//	l, err := h.NewListener(8080)
+//	if err != nil {
+//	    log.Fatalf("Failed to listen: %v", err)
+//	}
+//	err = h.ServeContext(ctx, l, func(req []byte) ([]byte, error) {
+//	    return bytes.ToUpper(req), nil
+//	})
+//	log.Printf("server stopped: %v", err)
+func (h *RDMAHandler) ServeContext(ctx context.Context, l *RDMAListener, handler Handler) error {
+	// connections are served with serveCtx, so that they are also drained when
+	// the listener fails
+	serveCtx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(serveCtx, func() {
+		l.Close()
+	})
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+		stop()
+	}()
+	logger := l.opts.logger()
+	for {
+		res, err := h.Accept(l)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err == nil {
+				h.Destroy(res)
+			}
+			return ctxErr
+		}
+		var rerr *RDMAError
+		switch {
+		case errors.Is(err, ErrAcceptTimeout):
+			continue
+		case errors.Is(err, ErrClosed), errors.As(err, &rerr) && rerr.Op == "sock_accept":
+			return err
+		case err != nil:
+			logger.Info("client connection failed", "port", l.port, "err", err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h.Serve(serveCtx, res, handler); err != nil && serveCtx.Err() == nil {
+				logger.Info("connection failed", "port", l.port, "err", err)
+			}
+			h.Destroy(res)
+		}()
+	}
+}
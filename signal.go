@@ -0,0 +1,61 @@
+package rdmahandler
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// DestroyOnSignal arranges for `res` to be released with Destroy when the process
+// receives one of `sigs`, or os.Interrupt and SIGTERM if none are given, so that
+// Ctrl-C does not leave the queue pair and the memory regions allocated.
+//
+// `res` is a pointer to RDMAResources returned by a successful initialization. If
+// the initialization fails, the partially created resources have already been
+// released and there is nothing to install a handler for.
+//
+// The returned context is cancelled when the signal arrives, before `res` is
+// destroyed. Passing it to ReadContext, WriteContext and the like interrupts the
+// operation in progress, which Destroy would otherwise wait for, and lets the
+// application leave its loop. While the handler is installed the signals no longer
+// terminate the process.
+//
+// The returned stop function removes the handler and waits until a Destroy it
+// started has finished. It returns the error of that Destroy, or nil if no signal
+// arrived; `res` must then still be released by the caller.
+//
+// Example:
+//
+//	ctx, stop := h.DestroyOnSignal(res)
+//	for ctx.Err() == nil {
+//	    data, err := h.ReadContext(ctx, res, "server")
+//	    if err != nil {
+//	        break
+//	    }
+//	    fmt.Println("Received data:", data)
+//	}
+//	if err := stop(); err != nil {
+//	    log.Printf("destroy: %v", err)
+//	}
+//	h.Destroy(res)
+func (h *RDMAHandler) DestroyOnSignal(res *RDMAResources, sigs ...os.Signal) (context.Context, func() error) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), sigs...)
+	var err error
+	done := make(chan struct{})
+	stopDestroy := context.AfterFunc(ctx, func() {
+		defer close(done)
+		err = h.Destroy(res)
+	})
+	return ctx, func() error {
+		stopped := stopDestroy()
+		cancel()
+		if !stopped {
+			<-done
+		}
+		return err
+	}
+}
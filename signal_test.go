@@ -0,0 +1,50 @@
+package rdmahandler
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestDestroyOnSignal sends SIGUSR1 to the test process, which the handler
+// catches. The resources hold no verbs objects, see TestDestroyConcurrent.
+func TestDestroyOnSignal(t *testing.T) {
+	res := &RDMAResources{}
+	res.res.sock = -1
+	res.state.Store(int32(Connected))
+	var h RDMAHandler
+	ctx, stop := h.DestroyOnSignal(res, syscall.SIGUSR1)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("kill: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("context not cancelled by the signal")
+	}
+	if err := stop(); err != nil {
+		t.Errorf("stop returned %v", err)
+	}
+	if s := res.State(); s != Closed {
+		t.Errorf("state after the signal is %v, expected %v", s, Closed)
+	}
+}
+
+func TestDestroyOnSignalStop(t *testing.T) {
+	res := &RDMAResources{}
+	res.res.sock = -1
+	res.state.Store(int32(Connected))
+	var h RDMAHandler
+	ctx, stop := h.DestroyOnSignal(res, syscall.SIGUSR1)
+	if err := stop(); err != nil {
+		t.Errorf("stop returned %v", err)
+	}
+	if ctx.Err() == nil {
+		t.Errorf("context not cancelled by stop")
+	}
+	if s := res.State(); s != Connected {
+		t.Errorf("state after stop is %v, expected %v", s, Connected)
+	}
+	h.Destroy(res)
+}
@@ -0,0 +1,86 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// sharedRecvQueue is the shared receive queue of a listener created with
+// Options.UseSRQ. The connections handed out by the listener use its device
+// context and protection domain, and their messages arrive in its receive slots.
+//
+// It is reference counted: the listener and every connection hold a reference,
+// and the C resources are released when the last one is dropped.
+type sharedRecvQueue struct {
+	// srq lives in C memory, since the resources of every connection point to it.
+	srq *C.struct_srq_t
+
+	// mu guards refs and keeps the queue from being destroyed while a receive
+	// slot is posted again.
+	mu   sync.Mutex
+	refs int
+}
+
+// newSharedRecvQueue creates the shared receive queue for a listener whose
+// connections use `opts`. The caller holds the only reference.
+func newSharedRecvQueue(opts Options) (*sharedRecvQueue, error) {
+	cfg := defaultConfig()
+	devName := cfg.dev_name
+	if opts.DeviceName != "" {
+		devName = C.CString(opts.DeviceName)
+		defer C.free(unsafe.Pointer(devName))
+	}
+	srq := (*C.struct_srq_t)(C.calloc(1, C.sizeof_struct_srq_t))
+	srq.buf_size = C.size_t(opts.BufferSize)
+	if rc, err := C.srq_create(srq, devName); rc != 0 {
+		C.free(unsafe.Pointer(srq))
+		return nil, newConnError("srq_create", rc, err, opts)
+	}
+	return &sharedRecvQueue{srq: srq, refs: 1}, nil
+}
+
+// acquire adds a reference for a connection created on the queue.
+func (q *sharedRecvQueue) acquire() {
+	q.mu.Lock()
+	q.refs++
+	q.mu.Unlock()
+}
+
+// release drops a reference and destroys the queue with the last one.
+func (q *sharedRecvQueue) release() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.refs--; q.refs > 0 {
+		return nil
+	}
+	rc, err := C.srq_destroy(q.srq)
+	C.free(unsafe.Pointer(q.srq))
+	q.srq = nil
+	if rc != 0 {
+		return newRDMAError("srq_destroy", rc, err)
+	}
+	return nil
+}
+
+// take returns a copy of the message in the receive slot reported by the last
+// completion on `res` and posts the slot again. The caller must hold res.mu.
+func (q *sharedRecvQueue) take(res *RDMAResources, character string) ([]byte, error) {
+	slot := res.res.last_wr_id &^ C.RECV_WR_ID
+	if slot >= C.uint64_t(q.srq.depth) {
+		return nil, fmt.Errorf("%s: completion for unknown receive slot %d", character, slot)
+	}
+	buf := unsafe.Add(unsafe.Pointer(q.srq.buf), uintptr(slot)*uintptr(q.srq.buf_size))
+	data, err := decodePayload(buf, q.srq.buf_size, character)
+	q.mu.Lock()
+	rc, perr := C.post_srq_receive(q.srq, C.uint32_t(slot))
+	q.mu.Unlock()
+	if rc != 0 {
+		return nil, fmt.Errorf("%s: %w", character, res.opError("post_srq_receive", rc, perr))
+	}
+	return data, err
+}
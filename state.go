@@ -0,0 +1,150 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import "fmt"
+
+// ConnectionState is the state of an RDMAResources as tracked by this package.
+type ConnectionState int
+
+const (
+	// Uninitialized is the state of an RDMAResources that was not returned by
+	// one of the Init functions or RDMAListener.WaitForClient.
+	Uninitialized ConnectionState = iota
+	// Connected means the queue pairs are connected and the resources usable.
+	Connected
+	// Closed means the resources were released with Destroy or Close.
+	Closed
+	// Errored means an operation failed in a way that leaves the connection
+	// unusable, for example a failed completion, a lost synchronization socket
+	// or a cancelled operation. The resources must still be released with Destroy,
+	// unless the failure left only the queue pair in the error state, which
+	// Recover repairs.
+	Errored
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Uninitialized:
+		return "uninitialized"
+	case Connected:
+		return "connected"
+	case Closed:
+		return "closed"
+	case Errored:
+		return "errored"
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+// State returns the current state of the connection.
+//
+// Example:
+//
+//	if err := h.Write(res, "ping", "client"); err != nil && res.State() == rdmahandler.Errored {
+//	    h.Destroy(res)
+//	}
+func (res *RDMAResources) State() ConnectionState {
+	return ConnectionState(res.state.Load())
+}
+
+// Connected reports whether the connection is established and no operation has
+// failed on it yet.
+func (res *RDMAResources) Connected() bool {
+	return res.State() == Connected
+}
+
+// Role is the side a connection plays in its setup.
+type Role int
+
+const (
+	// NoRole is the role of a connection set up without a client and a server,
+	// with CreateResources and ConnectResources or with InitLoopback.
+	NoRole Role = iota
+	// Server is the role of a connection created by InitServer or accepted by
+	// an RDMAListener.
+	Server
+	// Client is the role of a connection created by InitClient.
+	Client
+)
+
+// String returns "server" or "client", the character names the operations take,
+// or "none" for NoRole.
+func (r Role) String() string {
+	switch r {
+	case NoRole:
+		return "none"
+	case Server:
+		return "server"
+	case Client:
+		return "client"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Role returns the role `res` was created with. It is fixed when the connection
+// is initialized and can be called at any time, also after it has been closed.
+//
+// Example:
+//
+//	msg, err := h.Read(res, res.Role().String())
+//	if err != nil {
+//	    log.Fatalf("RDMA read failed: %v", err)
+//	}
+func (res *RDMAResources) Role() Role {
+	return res.role
+}
+
+// checkOpen returns ErrClosed if res was released, or an error if it was never
+// connected. It must run before anything touches the C resources.
+func (res *RDMAResources) checkOpen() error {
+	switch res.State() {
+	case Closed:
+		return ErrClosed
+	case Uninitialized:
+		return fmt.Errorf("connection not initialized")
+	}
+	return nil
+}
+
+// markErrored records that an operation failed in a way that leaves the
+// connection unusable.
+func (res *RDMAResources) markErrored() {
+	res.state.CompareAndSwap(int32(Connected), int32(Errored))
+}
+
+// begin locks res for an operation and checks that it is still open. On success
+// the caller must release the lock with end.
+func (res *RDMAResources) begin() error {
+	res.mu.Lock()
+	if err := res.checkOpen(); err != nil {
+		res.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// end releases the lock taken by begin.
+func (res *RDMAResources) end() {
+	res.mu.Unlock()
+}
+
+// opError is like newRDMAError for a failure on the established connection res,
+// which is marked as errored. A completion timeout wraps ErrPollTimeout, and a
+// completion with an error status wraps its WCStatus.
+func (res *RDMAResources) opError(op string, rc C.int, err error) *RDMAError {
+	res.markErrored()
+	e := newRDMAError(op, rc, err)
+	switch rc {
+	case C.POLL_TIMEOUT:
+		e.Err = ErrPollTimeout
+	case C.WC_ERROR:
+		e.Err = WCStatus(res.res.wc_status)
+		e.VendorErr = uint32(res.res.wc_vendor_err)
+		e.WRID = uint64(res.res.wc_wr_id)
+		e.QPError = res.res.qp_err != 0
+	}
+	return e
+}
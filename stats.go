@@ -0,0 +1,130 @@
+package rdmahandler
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Stats is a snapshot of the counters of a connection.
+type Stats struct {
+	// CQOverruns is the number of completion queue overrun events reported by
+	// the device. Any overrun means completions were lost and the CQ is too small
+	// for the number of outstanding work requests.
+	CQOverruns uint64
+	// Dropped is the number of completions discarded when Recover or Reset
+	// brought the queue pair back, because no operation was left to claim them.
+	Dropped uint64
+
+	// BytesWritten and BytesRead count the payload bytes moved by successful
+	// write and read operations.
+	BytesWritten uint64
+	BytesRead    uint64
+	// WriteOps and ReadOps count successful write and read operations.
+	WriteOps uint64
+	ReadOps  uint64
+	// SyncOps counts the synchronizations with the peer over the TCP socket.
+	SyncOps uint64
+	// PollSpins counts the polls of the completion queue that found no
+	// completion, a measure of the time spent busy-waiting.
+	PollSpins uint64
+
+	// Reconnects is the number of times a ReliableClient re-established its
+	// connection. It is always zero for a plain RDMAResources.
+	Reconnects uint64
+}
+
+// connCounters holds the counters of a connection kept on the Go side.
+type connCounters struct {
+	bytesWritten atomic.Uint64
+	bytesRead    atomic.Uint64
+	writeOps     atomic.Uint64
+	readOps      atomic.Uint64
+	syncOps      atomic.Uint64
+}
+
+// countWrite records a successful write of n payload bytes.
+func (res *RDMAResources) countWrite(n int) {
+	res.counters.writeOps.Add(1)
+	res.counters.bytesWritten.Add(uint64(n))
+}
+
+// countRead records a successful read of n payload bytes.
+func (res *RDMAResources) countRead(n int) {
+	res.counters.readOps.Add(1)
+	res.counters.bytesRead.Add(uint64(n))
+}
+
+// Stats returns a snapshot of the counters of the connection. It is safe to call
+// from a monitoring goroutine while operations are in flight.
+//
+// Example:
+//
+//	if s := res.Stats(); s.CQOverruns > 0 || s.Dropped > 0 {
+//	    log.Printf("completions lost: %+v", s)
+//	}
+func (res *RDMAResources) Stats() Stats {
+	return Stats{
+		CQOverruns: atomic.LoadUint64((*uint64)(unsafe.Pointer(&res.res.cq_overruns))),
+		Dropped:    atomic.LoadUint64((*uint64)(unsafe.Pointer(&res.res.dropped))),
+
+		BytesWritten: res.counters.bytesWritten.Load(),
+		BytesRead:    res.counters.bytesRead.Load(),
+		WriteOps:     res.counters.writeOps.Load(),
+		ReadOps:      res.counters.readOps.Load(),
+		SyncOps:      res.counters.syncOps.Load(),
+		PollSpins:    atomic.LoadUint64((*uint64)(unsafe.Pointer(&res.res.poll_spins))),
+	}
+}
+
+// WriteMetrics writes the counters of the connection to `w` in the Prometheus
+// text exposition format, so that an HTTP handler can serve them for scraping
+// without translating Stats by hand. Every sample carries the labels device
+// and ib_port, the RDMA device and port the connection uses (see Config).
+//
+// All metrics are counters named rdmahandler_*_total, for example
+// rdmahandler_bytes_written_total. The output is a complete exposition of one
+// connection; it cannot be concatenated with that of another connection, since
+// the format allows each metric family to be described only once.
+//
+// On success, it returns nil. On failure, it returns the error of `w`.
+//
+// Example:
+//
+//	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+//	    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+//	    if err := res.WriteMetrics(w); err != nil {
+//	        log.Printf("writing metrics: %v", err)
+//	    }
+//	})
+func (res *RDMAResources) WriteMetrics(w io.Writer) error {
+	s := res.Stats()
+	cfg := res.Config()
+	labels := fmt.Sprintf(`{device="%s",ib_port="%d"}`, metricLabelEscaper.Replace(cfg.DeviceName), cfg.IBPort)
+	metrics := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"bytes_written", "Payload bytes moved by successful write operations.", s.BytesWritten},
+		{"bytes_read", "Payload bytes moved by successful read operations.", s.BytesRead},
+		{"write_ops", "Successful write operations.", s.WriteOps},
+		{"read_ops", "Successful read operations.", s.ReadOps},
+		{"sync_ops", "Synchronizations with the peer over the bootstrap socket.", s.SyncOps},
+		{"poll_spins", "Polls of the completion queue that found no completion.", s.PollSpins},
+		{"cq_overruns", "Completion queue overrun events reported by the device.", s.CQOverruns},
+		{"dropped_completions", "Completions discarded by Recover and Reset because no operation claimed them.", s.Dropped},
+	}
+	var b strings.Builder
+	for _, m := range metrics {
+		name := "rdmahandler_" + m.name + "_total"
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s%s %d\n", name, m.help, name, name, labels, m.value)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// metricLabelEscaper escapes a label value for the Prometheus text format.
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,38 @@
+package rdmahandler
+
+// Sync synchronizes with the peer over the bootstrap socket: it blocks until the
+// peer calls Sync too, so that everything either side did before the call is
+// finished on both sides when it returns. It is how connections created with
+// Options.ManualSync order their transfers, in place of the synchronization Read
+// and Write otherwise perform around every operation; see Options.ManualSync.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection with a synchronization socket. Sync may also be
+// called on connections without Options.ManualSync, between operations.
+//
+// If the peer has closed the connection, ErrPeerClosed is returned. If the peer
+// is in the middle of a Read or Write with built-in synchronization instead, an
+// error wrapping ErrProtocolDesync is returned and the connection is Errored.
+//
+// Example:
+//
+//	// client
+//	if err := h.Write(clientRes, "Hello RDMA", "client"); err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+//	if err := h.Sync(clientRes); err != nil {
+//	    log.Fatalf("Sync failed: %v", err)
+//	}
+//
+//	// server: the write has landed once Sync returns
+//	if err := h.Sync(serverRes); err != nil {
+//	    log.Fatalf("Sync failed: %v", err)
+//	}
+//	msg, err := h.Read(serverRes, "server")
+func (h *RDMAHandler) Sync(res *RDMAResources) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	return syncPeer(res, syncDone)
+}
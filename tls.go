@@ -0,0 +1,113 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// exchangeQPParamsTLS is like exchangeQPParams but exchanges the parameters inside
+// a TLS session set up with `config` on the bootstrap socket of `res`, so that the
+// peer is authenticated and the remote keys and addresses cannot be read or
+// altered on the way. `client` selects the side of the TLS handshake; `timeout`
+// bounds the whole exchange, zero waits indefinitely.
+//
+// The session is only used for this exchange. It is abandoned afterwards without
+// a close_notify, and the socket goes on carrying the cleartext synchronization
+// traffic as with exchangeQPParams.
+func exchangeQPParamsTLS(res *RDMAResources, local QPParams, config *tls.Config, client bool, timeout time.Duration) (QPParams, error) {
+	conn, err := bootstrapConn(res.res.sock)
+	if err != nil {
+		return QPParams{}, fmt.Errorf("failed to set up TLS on the bootstrap socket: %w", err)
+	}
+	defer func() {
+		conn.Close()
+		// the duplicate shares the file status flags with the socket, which the C
+		// layer expects to block
+		syscall.SetNonblock(int(res.res.sock), false)
+	}()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	var session *tls.Conn
+	if client {
+		session = tls.Client(conn, config)
+	} else {
+		// a session ticket sent after the handshake would be left unread
+		config = config.Clone()
+		config.SessionTicketsDisabled = true
+		session = tls.Server(conn, config)
+	}
+	if err := session.Handshake(); err != nil {
+		return QPParams{}, fmt.Errorf("TLS handshake on the bootstrap socket failed: %w", err)
+	}
+	if _, err := session.Write(encodeQPMessage(local)); err != nil {
+		return QPParams{}, fmt.Errorf("failed to send connection data over TLS: %w", err)
+	}
+	remote := make([]byte, qpMessageSize)
+	if _, err := io.ReadFull(session, remote); err != nil {
+		return QPParams{}, fmt.Errorf("failed to receive connection data over TLS: %w", err)
+	}
+	return decodeQPMessage(remote)
+}
+
+// bootstrapConn returns a net.Conn on a duplicate of the socket `sock`, which
+// stays open when the net.Conn is closed. Reads stop at TLS record boundaries;
+// see recordConn.
+func bootstrapConn(sock C.int) (net.Conn, error) {
+	fd, err := syscall.Dup(int(sock))
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "bootstrap")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return &recordConn{Conn: conn}, nil
+}
+
+// tlsRecordHeaderSize is the size of the header of a TLS record, whose last two
+// bytes hold the length of the record's body.
+const tlsRecordHeaderSize = 5
+
+// recordConn is a net.Conn whose reads never extend past the end of the current
+// TLS record. crypto/tls reads ahead as far as the socket has data, and would
+// swallow the cleartext the peer sends right after its last record once the
+// session is abandoned; reading record by record leaves it on the socket.
+type recordConn struct {
+	net.Conn
+	// header holds the unread part of the header of the current record and left
+	// the number of unread bytes of its body.
+	header []byte
+	left   int
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	if len(c.header) == 0 && c.left == 0 {
+		header := make([]byte, tlsRecordHeaderSize)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		c.header = header
+		c.left = int(binary.BigEndian.Uint16(header[3:]))
+	}
+	if len(c.header) > 0 {
+		n := copy(p, c.header)
+		c.header = c.header[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(p[:min(len(p), c.left)])
+	c.left -= n
+	return n, err
+}
@@ -0,0 +1,168 @@
+package rdmahandler
+
+/*
+#include "rdma_operations.h"
+*/
+import "C"
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// WriteVectored is like WriteBytes but sends the concatenation of `buffers`, in the
+// manner of writev, with a single work request whose scatter/gather list references
+// each buffer.
+//
+// `res` is a pointer to RDMAResources that must be previously initialized and represent
+// an established RDMA connection.
+//
+// The device can only gather from registered memory. Buffers that lie entirely in a
+// region registered on `res` with RegisterMemory are sent in place, without being
+// copied. Other buffers are copied into the connection's data buffer, after the length
+// header; consecutive ones share a single scatter/gather entry. The work request can
+// hold at most 10 entries, one of which is the length header.
+//
+// The data is written into the peer's data buffer in the format of WriteBytes. Its
+// total length, together with the 4-byte length header, must fit in the data buffer.
+// Since buffers sent in place are not in the local data buffer, the peer cannot fetch
+// the data with ReadBytes; WriteVectored must be matched by ReadWritten on the peer.
+//
+// On success, it returns nil. On failure, it returns an error detailing the issue
+// encountered.
+//
+// Example:
+//
+//	header := []byte("HDR1")
+//	body := unsafe.Slice((*byte)(ptr), 4096) // in a region registered with RegisterMemory
+//	if err := h.WriteVectored(clientRes, [][]byte{header, body}, "client"); err != nil {
+//	    log.Fatalf("RDMA write failed: %v", err)
+//	}
+func (h *RDMAHandler) WriteVectored(res *RDMAResources, buffers [][]byte, character string) error {
+	if err := res.begin(); err != nil {
+		return err
+	}
+	defer res.end()
+	total := 0
+	for _, b := range buffers {
+		total += len(b)
+	}
+	if err := res.checkFits(total, character); err != nil {
+		return err
+	}
+	// find the registered region of each buffer up front, so that a list that
+	// needs too many entries is rejected before synchronizing with the peer
+	regions := make([]*MemoryRegion, len(buffers))
+	entries := 1
+	staged := true // the header is in the data buffer, so staged data can extend it
+	for i, b := range buffers {
+		if len(b) == 0 {
+			continue
+		}
+		regions[i] = res.regionOf(b)
+		if regions[i] != nil || !staged {
+			entries++
+		}
+		staged = regions[i] == nil
+	}
+	if entries > C.MAX_SEND_SGE {
+		return fmt.Errorf("%s: %d buffers need %d scatter/gather entries, at most %d are supported", character, len(buffers), entries, C.MAX_SEND_SGE)
+	}
+	if err := syncData(res, syncWrite); err != nil {
+		return err
+	}
+
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(res.res.buf)), int(res.res.buf_size))
+	binary.BigEndian.PutUint32(buf, uint32(total))
+	base := uint64(uintptr(unsafe.Pointer(res.res.buf)))
+	addrs := []C.uint64_t{C.uint64_t(base)}
+	lengths := []C.uint32_t{payloadHeaderSize}
+	lkeys := []C.uint32_t{res.res.mr.lkey}
+	off := payloadHeaderSize
+	staged = true
+	for i, b := range buffers {
+		if len(b) == 0 {
+			continue
+		}
+		if m := regions[i]; m != nil {
+			addrs = append(addrs, C.uint64_t(uintptr(unsafe.Pointer(&b[0]))))
+			lengths = append(lengths, C.uint32_t(len(b)))
+			lkeys = append(lkeys, m.mr.lkey)
+			staged = false
+			continue
+		}
+		copy(buf[off:], b)
+		if staged {
+			lengths[len(lengths)-1] += C.uint32_t(len(b))
+		} else {
+			addrs = append(addrs, C.uint64_t(base+uint64(off)))
+			lengths = append(lengths, C.uint32_t(len(b)))
+			lkeys = append(lkeys, res.res.mr.lkey)
+		}
+		off += len(b)
+		staged = true
+	}
+
+	acquireInflight()
+	if rc, err := C.post_write_sg(&res.res, &addrs[0], &lengths[0], &lkeys[0], C.int(len(addrs))); rc != 0 {
+		releaseInflight()
+		return fmt.Errorf("%s: %w", character, res.opError("post_write_sg", rc, err))
+	}
+	rc, err := res.pollCompletion()
+	releaseInflight()
+	if rc != 0 {
+		return fmt.Errorf("%s: %w", character, res.opError("poll_completion", rc, err))
+	}
+	res.writeIndex += uint64(total)
+	res.publishWriteIndex()
+	res.countWrite(total)
+	return syncData(res, syncDone)
+}
+
+// ReadWritten returns the data the peer wrote into the local data buffer with
+// WriteVectored. No RDMA operation is posted: ReadWritten takes part in the peer's
+// two synchronizations and then decodes the local data buffer.
+//
+// On success, it returns the data and nil error. On failure, it returns nil and the
+// error encountered.
+//
+// Example:
+//
+//	data, err := h.ReadWritten(serverRes, "server")
+//	if err != nil {
+//	    log.Fatalf("RDMA receive failed: %v", err)
+//	}
+func (h *RDMAHandler) ReadWritten(res *RDMAResources, character string) ([]byte, error) {
+	if err := res.begin(); err != nil {
+		return nil, err
+	}
+	defer res.end()
+	if err := syncData(res, syncRead); err != nil {
+		return nil, err
+	}
+	// the peer's write has completed once it reaches its second synchronization
+	if err := syncData(res, syncDone); err != nil {
+		return nil, err
+	}
+	res.syncDeviceMemory(0, int(res.res.buf_size), false)
+	data, err := res.payload(character)
+	if err != nil {
+		return nil, err
+	}
+	res.readIndex += uint64(len(data))
+	res.countRead(len(data))
+	return data, nil
+}
+
+// regionOf returns the region registered on res with RegisterMemory that contains
+// all of `b`, or nil if there is none. The caller must hold res.mu.
+func (res *RDMAResources) regionOf(b []byte) *MemoryRegion {
+	start := uintptr(unsafe.Pointer(&b[0]))
+	for m := range res.regions {
+		addr := uintptr(m.mr.addr)
+		if start >= addr && start+uintptr(len(b)) <= addr+uintptr(m.size) {
+			return m
+		}
+	}
+	return nil
+}